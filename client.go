@@ -1,10 +1,14 @@
 package g9p
 
 import (
+	"context"
 	"errors"
+	"fmt"
 	"io"
 	"sync"
+	"sync/atomic"
 
+	"github.com/kennylevinsen/g9p/p9err"
 	"github.com/kennylevinsen/g9p/protocol"
 )
 
@@ -13,95 +17,342 @@ var (
 	ErrTagInUse        = errors.New("tag already in use")
 	ErrNoSuchTag       = errors.New("tag does not exist")
 	ErrInvalidResponse = errors.New("invalid response")
+	ErrClientClosed    = errors.New("client closed")
 )
 
-// Client implements a 9P2000 client on a ReadWriter.
+// Client implements a 9P2000 client on a ReadWriter. The 9P2000.u and 9P2000.L
+// dialects are supported if negotiated with Version.
+//
+// Requests with a zero tag are assigned a free tag when sent, which is stored
+// in the request. If all tags are in flight, sending blocks until one is
+// freed. Requests may also be sent with an explicit tag, such as one from
+// NextTag, which is useful if the tag must be known in advance in order to
+// flush the request. Tag 0 itself is therefore never sent, and Version
+// requests keep their NOTAG.
 type Client struct {
 	rw        io.ReadWriter
 	queueLock sync.RWMutex
-	queue     map[protocol.Tag]chan protocol.Message
+	queue     map[protocol.Tag]*pending
 	writeLock sync.Mutex
 	nextTag   protocol.Tag
+	dialect   protocol.Dialect
+
+	// tagSem holds a token for every tag in flight, which limits the
+	// number of tags in flight to the number of available tags.
+	tagSem chan struct{}
+
+	// done is closed when the client shuts down, after err has been set to
+	// the reason.
+	done      chan struct{}
+	err       error
+	closeOnce sync.Once
+
+	// msize is the negotiated maximum message size. It is accessed
+	// atomically.
+	msize uint32
+}
+
+func (c *Client) maxSize() uint32 {
+	if msize := atomic.LoadUint32(&c.msize); msize != 0 {
+		return msize
+	}
+	return defaultMaxSize
+}
+
+// maxIO returns the largest read or write payload that fits within the
+// negotiated maximum message size.
+func (c *Client) maxIO() uint32 {
+	if msize := c.maxSize(); msize > protocol.IOHDRSZ {
+		return msize - protocol.IOHDRSZ
+	}
+	return 0
+}
+
+// pending is a request in flight.
+type pending struct {
+	ch chan protocol.Message
+
+	// flushing is set while the request is being flushed. The response to a
+	// flushing request is delivered, but the tag remains in flight until the
+	// flush has completed.
+	flushing bool
 }
 
-// NextTag retrieves the next valid tag.
+// NextTag returns a tag that is not currently in flight. The tag is not
+// reserved, so if the client is shared, requests may still fail with
+// ErrTagInUse. Requests with a zero tag are assigned a tag automatically.
 func (c *Client) NextTag() protocol.Tag {
-	t := c.nextTag
-	c.nextTag++
-	if c.nextTag == protocol.NOTAG {
+	c.queueLock.Lock()
+	defer c.queueLock.Unlock()
+	return c.freeTag()
+}
+
+// freeTag returns a tag that is not in flight, or NOTAG if all are. Tag 0 is
+// never returned, as it requests automatic assignment. The queueLock must be
+// held.
+func (c *Client) freeTag() protocol.Tag {
+	for i := 0; i < int(protocol.NOTAG)-1; i++ {
 		c.nextTag++
+		if c.nextTag == protocol.NOTAG {
+			c.nextTag = 1
+		}
+		t := c.nextTag
+		if _, inFlight := c.queue[t]; !inFlight {
+			return t
+		}
 	}
-	return t
+	return protocol.NOTAG
 }
 
-func (c *Client) getTag(t protocol.Tag) (chan protocol.Message, error) {
+// getTag registers a request as in flight. If the request has a zero tag, a
+// free tag is assigned to it, blocking until one is available or ctx is
+// cancelled.
+func (c *Client) getTag(ctx context.Context, d protocol.Message) (chan protocol.Message, error) {
+	select {
+	case <-c.done:
+		return nil, c.err
+	default:
+	}
+
+	t := d.GetTag()
+	if t != protocol.NOTAG {
+		select {
+		case c.tagSem <- struct{}{}:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-c.done:
+			return nil, c.err
+		}
+	}
+
 	c.queueLock.Lock()
 	defer c.queueLock.Unlock()
+	if t == 0 {
+		// A free tag always exists, as a token has been acquired.
+		t = c.freeTag()
+		d.SetTag(t)
+	}
 	if _, ok := c.queue[t]; ok {
+		c.releaseTag(t)
 		return nil, ErrTagInUse
 	}
 
 	ch := make(chan protocol.Message, 1)
-	c.queue[t] = ch
+	c.queue[t] = &pending{ch: ch}
 	return ch, nil
 }
 
+// releaseTag returns the token of a tag that is no longer in flight. The
+// queueLock must be held.
+func (c *Client) releaseTag(t protocol.Tag) {
+	if t != protocol.NOTAG {
+		<-c.tagSem
+	}
+}
+
 func (c *Client) handleResponse(d protocol.Message) error {
 	c.queueLock.Lock()
 	defer c.queueLock.Unlock()
 	t := d.GetTag()
-	if ch, ok := c.queue[t]; ok {
-		ch <- d
-		delete(c.queue, t)
+	if p, ok := c.queue[t]; ok {
+		select {
+		case p.ch <- d:
+		default:
+			// A response has already been delivered.
+			return ErrNoSuchTag
+		}
+		if !p.flushing {
+			delete(c.queue, t)
+			c.releaseTag(t)
+		}
 		return nil
 	}
 	return ErrNoSuchTag
 }
 
-func (c *Client) write(t protocol.Tag, d protocol.Message) error {
+func (c *Client) dropTag(t protocol.Tag) {
+	c.queueLock.Lock()
+	defer c.queueLock.Unlock()
+	if _, ok := c.queue[t]; ok {
+		delete(c.queue, t)
+		c.releaseTag(t)
+	}
+}
+
+// write writes a request. A failed write may have left a partial message on
+// the connection, so the client is shut down.
+func (c *Client) write(d protocol.Message) error {
 	c.writeLock.Lock()
 	defer c.writeLock.Unlock()
 
-	if err := protocol.Encode(c.rw, d); err != nil {
-		if _, ok := c.queue[t]; ok {
-			delete(c.queue, t)
+	if uint32(protocol.MessageSize(d, c.dialect)) > c.maxSize() {
+		return protocol.ErrMessageTooLarge
+	}
 
-		}
+	if err := protocol.EncodeDialect(c.rw, d, c.dialect); err != nil {
+		c.shutdown(err)
 		return err
 	}
 	return nil
 }
 
-func (c *Client) send(d protocol.Message) (protocol.Message, error) {
-	t := d.GetTag()
-	ch, err := c.getTag(t)
+// shutdown shuts the client down with the given reason, closing the
+// connection and failing all pending and future requests. Only the first
+// reason is kept.
+func (c *Client) shutdown(err error) {
+	c.closeOnce.Do(func() {
+		c.err = err
+		close(c.done)
+		if closer, ok := c.rw.(io.Closer); ok {
+			closer.Close()
+		}
+	})
+}
+
+// Done returns a channel that is closed when the client has shut down.
+func (c *Client) Done() <-chan struct{} {
+	return c.done
+}
+
+// Err returns the reason the client shut down, or nil if it has not.
+func (c *Client) Err() error {
+	select {
+	case <-c.done:
+		return c.err
+	default:
+		return nil
+	}
+}
+
+// startFlush marks a request as being flushed, returning false if it is no
+// longer in flight.
+func (c *Client) startFlush(t protocol.Tag) bool {
+	c.queueLock.Lock()
+	defer c.queueLock.Unlock()
+	p, ok := c.queue[t]
+	if ok {
+		p.flushing = true
+	}
+	return ok
+}
+
+// send sends a request and waits for the response. If ctx is cancelled before
+// the response arrives, the request is flushed, and ctx.Err() is returned once
+// the flush completes. The tag is not released until then. As required by
+// http://man.cat-v.org/plan_9/5/flush, a response received before the flush
+// completes is honored and returned as if the request had not been flushed.
+func (c *Client) send(ctx context.Context, d protocol.Message) (protocol.Message, error) {
+	ch, err := c.getTag(ctx, d)
 	if err != nil {
 		return nil, err
 	}
-	c.write(t, d)
-	resp := <-ch
+	t := d.GetTag()
+	if err := c.write(d); err != nil {
+		c.dropTag(t)
+		return nil, err
+	}
+
+	var resp protocol.Message
+	select {
+	case resp = <-ch:
+	case <-c.done:
+		return nil, c.err
+	case <-ctx.Done():
+		resp, err = c.cancel(ctx, t, ch)
+		if err != nil {
+			return nil, err
+		}
+	}
+
 	if resp == nil {
 		return nil, ErrFlushed
 	}
 
 	if e, ok := resp.(*protocol.ErrorResponse); ok {
-		return nil, errors.New(e.Error)
+		return nil, responseError(e.Error, e.Errno)
+	}
+	if e, ok := resp.(*protocol.LinuxErrorResponse); ok {
+		if c := p9err.FromErrno(e.Ecode); c != nil {
+			return nil, c
+		}
+		return nil, &Error{Err: fmt.Sprintf("errno %d", e.Ecode), Errno: e.Ecode}
 	}
 	return resp, nil
 }
 
+// responseError returns the error for an error response, which is the
+// canonical error with the same string if there is one, and the error number
+// does not say otherwise.
+func responseError(s string, errno uint32) error {
+	if c := p9err.Lookup(s); c != nil && (errno == 0 || errno == c.Errno) {
+		return c
+	}
+	return &Error{Err: s, Errno: errno}
+}
+
+// cancel flushes a request whose context has been cancelled, returning the
+// response if one arrived before the flush completed.
+func (c *Client) cancel(ctx context.Context, t protocol.Tag, ch chan protocol.Message) (protocol.Message, error) {
+	if t == protocol.NOTAG || !c.startFlush(t) {
+		// Requests without a tag cannot be flushed, and requests no longer in
+		// flight have already been responded to.
+		select {
+		case resp := <-ch:
+			return resp, nil
+		default:
+			c.dropTag(t)
+			return nil, ctx.Err()
+		}
+	}
+
+	// The flush itself is not cancelled, as the tag must not be reused until
+	// the flush has completed.
+	_, err := c.send(context.Background(), &protocol.FlushRequest{OldTag: t})
+	c.dropTag(t)
+
+	select {
+	case resp := <-ch:
+		return resp, nil
+	default:
+	}
+	if err != nil {
+		return nil, err
+	}
+	return nil, ctx.Err()
+}
+
 func (c *Client) flush(t protocol.Tag) {
 	c.queueLock.Lock()
 	defer c.queueLock.Unlock()
-	if ch, ok := c.queue[t]; ok {
-		ch <- nil
+	if p, ok := c.queue[t]; ok {
+		select {
+		case p.ch <- nil:
+		default:
+		}
 		delete(c.queue, t)
+		c.releaseTag(t)
 	}
 }
 
-// Version performs the protocol handshake.
+func (c *Client) negotiated(vr *protocol.VersionResponse) {
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+	c.dialect, _ = protocol.ParseDialect(vr.Version)
+	atomic.StoreUint32(&c.msize, vr.MaxSize)
+}
+
+// Version performs the protocol handshake. The negotiated version selects the
+// dialect used for all subsequent messages, and the negotiated maximum message
+// size limits the size of all subsequent messages.
 func (c *Client) Version(r *protocol.VersionRequest) (*protocol.VersionResponse, error) {
-	resp, err := c.send(r)
+	return c.VersionContext(context.Background(), r)
+}
+
+// VersionContext is like Version, but returns when ctx is cancelled. Version
+// requests cannot be flushed, so the connection should be considered unusable
+// if it is cancelled.
+func (c *Client) VersionContext(ctx context.Context, r *protocol.VersionRequest) (*protocol.VersionResponse, error) {
+	resp, err := c.send(ctx, r)
 	if err != nil {
 		return nil, err
 	}
@@ -114,7 +365,12 @@ func (c *Client) Version(r *protocol.VersionRequest) (*protocol.VersionResponse,
 
 // Auth retrieves the fid for authentication.
 func (c *Client) Auth(r *protocol.AuthRequest) (*protocol.AuthResponse, error) {
-	resp, err := c.send(r)
+	return c.AuthContext(context.Background(), r)
+}
+
+// AuthContext is like Auth, but flushes the request if ctx is cancelled.
+func (c *Client) AuthContext(ctx context.Context, r *protocol.AuthRequest) (*protocol.AuthResponse, error) {
+	resp, err := c.send(ctx, r)
 	if err != nil {
 		return nil, err
 	}
@@ -127,7 +383,12 @@ func (c *Client) Auth(r *protocol.AuthRequest) (*protocol.AuthResponse, error) {
 
 // Attach connects to the root node of a service.
 func (c *Client) Attach(r *protocol.AttachRequest) (*protocol.AttachResponse, error) {
-	resp, err := c.send(r)
+	return c.AttachContext(context.Background(), r)
+}
+
+// AttachContext is like Attach, but flushes the request if ctx is cancelled.
+func (c *Client) AttachContext(ctx context.Context, r *protocol.AttachRequest) (*protocol.AttachResponse, error) {
+	resp, err := c.send(ctx, r)
 	if err != nil {
 		return nil, err
 	}
@@ -140,9 +401,14 @@ func (c *Client) Attach(r *protocol.AttachRequest) (*protocol.AttachResponse, er
 
 // Flush flushes a previous request.
 func (c *Client) Flush(r *protocol.FlushRequest) (*protocol.FlushResponse, error) {
+	return c.FlushContext(context.Background(), r)
+}
+
+// FlushContext is like Flush, but flushes the request if ctx is cancelled.
+func (c *Client) FlushContext(ctx context.Context, r *protocol.FlushRequest) (*protocol.FlushResponse, error) {
 	// TODO(kl): Handle of multiple flushes on a single request.
 	t := r.OldTag
-	resp, err := c.send(r)
+	resp, err := c.send(ctx, r)
 	if err != nil {
 		return nil, err
 	}
@@ -156,7 +422,12 @@ func (c *Client) Flush(r *protocol.FlushRequest) (*protocol.FlushResponse, error
 
 // Walk navigates to a new file from the current fid.
 func (c *Client) Walk(r *protocol.WalkRequest) (*protocol.WalkResponse, error) {
-	resp, err := c.send(r)
+	return c.WalkContext(context.Background(), r)
+}
+
+// WalkContext is like Walk, but flushes the request if ctx is cancelled.
+func (c *Client) WalkContext(ctx context.Context, r *protocol.WalkRequest) (*protocol.WalkResponse, error) {
+	resp, err := c.send(ctx, r)
 	if err != nil {
 		return nil, err
 	}
@@ -169,7 +440,12 @@ func (c *Client) Walk(r *protocol.WalkRequest) (*protocol.WalkResponse, error) {
 
 // Open opens the current file according to provided parameters.
 func (c *Client) Open(r *protocol.OpenRequest) (*protocol.OpenResponse, error) {
-	resp, err := c.send(r)
+	return c.OpenContext(context.Background(), r)
+}
+
+// OpenContext is like Open, but flushes the request if ctx is cancelled.
+func (c *Client) OpenContext(ctx context.Context, r *protocol.OpenRequest) (*protocol.OpenResponse, error) {
+	resp, err := c.send(ctx, r)
 	if err != nil {
 		return nil, err
 	}
@@ -182,7 +458,12 @@ func (c *Client) Open(r *protocol.OpenRequest) (*protocol.OpenResponse, error) {
 
 // Create creates and opens a file according to provided parameters.
 func (c *Client) Create(r *protocol.CreateRequest) (*protocol.CreateResponse, error) {
-	resp, err := c.send(r)
+	return c.CreateContext(context.Background(), r)
+}
+
+// CreateContext is like Create, but flushes the request if ctx is cancelled.
+func (c *Client) CreateContext(ctx context.Context, r *protocol.CreateRequest) (*protocol.CreateResponse, error) {
+	resp, err := c.send(ctx, r)
 	if err != nil {
 		return nil, err
 	}
@@ -193,9 +474,21 @@ func (c *Client) Create(r *protocol.CreateRequest) (*protocol.CreateResponse, er
 	return nil, ErrInvalidResponse
 }
 
-// Read reads from a file, which must be open in a readable mode.
+// Read reads from a file, which must be open in a readable mode. The count is
+// clamped to fit within the negotiated maximum message size.
 func (c *Client) Read(r *protocol.ReadRequest) (*protocol.ReadResponse, error) {
-	resp, err := c.send(r)
+	return c.ReadContext(context.Background(), r)
+}
+
+// ReadContext is like Read, but flushes the request if ctx is cancelled.
+func (c *Client) ReadContext(ctx context.Context, r *protocol.ReadRequest) (*protocol.ReadResponse, error) {
+	if max := c.maxIO(); r.Count > max {
+		clamped := *r
+		clamped.Count = max
+		r = &clamped
+	}
+
+	resp, err := c.send(ctx, r)
 	if err != nil {
 		return nil, err
 	}
@@ -206,9 +499,22 @@ func (c *Client) Read(r *protocol.ReadRequest) (*protocol.ReadResponse, error) {
 	return nil, ErrInvalidResponse
 }
 
-// Write writes to a file, which must be open in a writable mode.
+// Write writes to a file, which must be open in a writable mode. The data is
+// clamped to fit within the negotiated maximum message size, in which case the
+// response reflects the partial write.
 func (c *Client) Write(r *protocol.WriteRequest) (*protocol.WriteResponse, error) {
-	resp, err := c.send(r)
+	return c.WriteContext(context.Background(), r)
+}
+
+// WriteContext is like Write, but flushes the request if ctx is cancelled.
+func (c *Client) WriteContext(ctx context.Context, r *protocol.WriteRequest) (*protocol.WriteResponse, error) {
+	if max := c.maxIO(); uint32(len(r.Data)) > max {
+		clamped := *r
+		clamped.Data = r.Data[:max]
+		r = &clamped
+	}
+
+	resp, err := c.send(ctx, r)
 	if err != nil {
 		return nil, err
 	}
@@ -221,7 +527,12 @@ func (c *Client) Write(r *protocol.WriteRequest) (*protocol.WriteResponse, error
 
 // Clunk terminates a fid.
 func (c *Client) Clunk(r *protocol.ClunkRequest) (*protocol.ClunkResponse, error) {
-	resp, err := c.send(r)
+	return c.ClunkContext(context.Background(), r)
+}
+
+// ClunkContext is like Clunk, but flushes the request if ctx is cancelled.
+func (c *Client) ClunkContext(ctx context.Context, r *protocol.ClunkRequest) (*protocol.ClunkResponse, error) {
+	resp, err := c.send(ctx, r)
 	if err != nil {
 		return nil, err
 	}
@@ -234,7 +545,12 @@ func (c *Client) Clunk(r *protocol.ClunkRequest) (*protocol.ClunkResponse, error
 
 // Remove terminates a fid and removes the file if possible.
 func (c *Client) Remove(r *protocol.RemoveRequest) (*protocol.RemoveResponse, error) {
-	resp, err := c.send(r)
+	return c.RemoveContext(context.Background(), r)
+}
+
+// RemoveContext is like Remove, but flushes the request if ctx is cancelled.
+func (c *Client) RemoveContext(ctx context.Context, r *protocol.RemoveRequest) (*protocol.RemoveResponse, error) {
+	resp, err := c.send(ctx, r)
 	if err != nil {
 		return nil, err
 	}
@@ -247,7 +563,12 @@ func (c *Client) Remove(r *protocol.RemoveRequest) (*protocol.RemoveResponse, er
 
 // Stat returns the stat structure of the file.
 func (c *Client) Stat(r *protocol.StatRequest) (*protocol.StatResponse, error) {
-	resp, err := c.send(r)
+	return c.StatContext(context.Background(), r)
+}
+
+// StatContext is like Stat, but flushes the request if ctx is cancelled.
+func (c *Client) StatContext(ctx context.Context, r *protocol.StatRequest) (*protocol.StatResponse, error) {
+	resp, err := c.send(ctx, r)
 	if err != nil {
 		return nil, err
 	}
@@ -260,7 +581,12 @@ func (c *Client) Stat(r *protocol.StatRequest) (*protocol.StatResponse, error) {
 
 // WriteStat updates the stat structure of the file.
 func (c *Client) WriteStat(r *protocol.WriteStatRequest) (*protocol.WriteStatResponse, error) {
-	resp, err := c.send(r)
+	return c.WriteStatContext(context.Background(), r)
+}
+
+// WriteStatContext is like WriteStat, but flushes the request if ctx is cancelled.
+func (c *Client) WriteStatContext(ctx context.Context, r *protocol.WriteStatRequest) (*protocol.WriteStatResponse, error) {
+	resp, err := c.send(ctx, r)
 	if err != nil {
 		return nil, err
 	}
@@ -271,54 +597,398 @@ func (c *Client) WriteStat(r *protocol.WriteStatRequest) (*protocol.WriteStatRes
 	return nil, ErrInvalidResponse
 }
 
-// Start starts serving the responses for the client.
-func (c *Client) Start() error {
-	defer func() {
-		if closer, ok := c.rw.(io.Closer); ok {
-			closer.Close()
-		}
-	}()
+// StatFS retrieves information about the file system.
+func (c *Client) StatFS(r *protocol.StatFSRequest) (*protocol.StatFSResponse, error) {
+	return c.StatFSContext(context.Background(), r)
+}
+
+// StatFSContext is like StatFS, but flushes the request if ctx is cancelled.
+func (c *Client) StatFSContext(ctx context.Context, r *protocol.StatFSRequest) (*protocol.StatFSResponse, error) {
+	resp, err := c.send(ctx, r)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp, ok := resp.(*protocol.StatFSResponse); ok {
+		return resp, nil
+	}
+	return nil, ErrInvalidResponse
+}
+
+// LinuxOpen opens the current file with Linux open flags.
+func (c *Client) LinuxOpen(r *protocol.LinuxOpenRequest) (*protocol.LinuxOpenResponse, error) {
+	return c.LinuxOpenContext(context.Background(), r)
+}
+
+// LinuxOpenContext is like LinuxOpen, but flushes the request if ctx is cancelled.
+func (c *Client) LinuxOpenContext(ctx context.Context, r *protocol.LinuxOpenRequest) (*protocol.LinuxOpenResponse, error) {
+	resp, err := c.send(ctx, r)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp, ok := resp.(*protocol.LinuxOpenResponse); ok {
+		return resp, nil
+	}
+	return nil, ErrInvalidResponse
+}
+
+// LinuxCreate creates and opens a regular file with Linux open flags.
+func (c *Client) LinuxCreate(r *protocol.LinuxCreateRequest) (*protocol.LinuxCreateResponse, error) {
+	return c.LinuxCreateContext(context.Background(), r)
+}
+
+// LinuxCreateContext is like LinuxCreate, but flushes the request if ctx is cancelled.
+func (c *Client) LinuxCreateContext(ctx context.Context, r *protocol.LinuxCreateRequest) (*protocol.LinuxCreateResponse, error) {
+	resp, err := c.send(ctx, r)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp, ok := resp.(*protocol.LinuxCreateResponse); ok {
+		return resp, nil
+	}
+	return nil, ErrInvalidResponse
+}
+
+// Symlink creates a symbolic link.
+func (c *Client) Symlink(r *protocol.SymlinkRequest) (*protocol.SymlinkResponse, error) {
+	return c.SymlinkContext(context.Background(), r)
+}
+
+// SymlinkContext is like Symlink, but flushes the request if ctx is cancelled.
+func (c *Client) SymlinkContext(ctx context.Context, r *protocol.SymlinkRequest) (*protocol.SymlinkResponse, error) {
+	resp, err := c.send(ctx, r)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp, ok := resp.(*protocol.SymlinkResponse); ok {
+		return resp, nil
+	}
+	return nil, ErrInvalidResponse
+}
+
+// Mknod creates a device node or named pipe.
+func (c *Client) Mknod(r *protocol.MknodRequest) (*protocol.MknodResponse, error) {
+	return c.MknodContext(context.Background(), r)
+}
+
+// MknodContext is like Mknod, but flushes the request if ctx is cancelled.
+func (c *Client) MknodContext(ctx context.Context, r *protocol.MknodRequest) (*protocol.MknodResponse, error) {
+	resp, err := c.send(ctx, r)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp, ok := resp.(*protocol.MknodResponse); ok {
+		return resp, nil
+	}
+	return nil, ErrInvalidResponse
+}
+
+// Rename moves a file to a new directory and name.
+func (c *Client) Rename(r *protocol.RenameRequest) (*protocol.RenameResponse, error) {
+	return c.RenameContext(context.Background(), r)
+}
+
+// RenameContext is like Rename, but flushes the request if ctx is cancelled.
+func (c *Client) RenameContext(ctx context.Context, r *protocol.RenameRequest) (*protocol.RenameResponse, error) {
+	resp, err := c.send(ctx, r)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp, ok := resp.(*protocol.RenameResponse); ok {
+		return resp, nil
+	}
+	return nil, ErrInvalidResponse
+}
+
+// ReadLink reads the target of a symbolic link.
+func (c *Client) ReadLink(r *protocol.ReadLinkRequest) (*protocol.ReadLinkResponse, error) {
+	return c.ReadLinkContext(context.Background(), r)
+}
+
+// ReadLinkContext is like ReadLink, but flushes the request if ctx is cancelled.
+func (c *Client) ReadLinkContext(ctx context.Context, r *protocol.ReadLinkRequest) (*protocol.ReadLinkResponse, error) {
+	resp, err := c.send(ctx, r)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp, ok := resp.(*protocol.ReadLinkResponse); ok {
+		return resp, nil
+	}
+	return nil, ErrInvalidResponse
+}
+
+// GetAttr returns the attributes of the file.
+func (c *Client) GetAttr(r *protocol.GetAttrRequest) (*protocol.GetAttrResponse, error) {
+	return c.GetAttrContext(context.Background(), r)
+}
+
+// GetAttrContext is like GetAttr, but flushes the request if ctx is cancelled.
+func (c *Client) GetAttrContext(ctx context.Context, r *protocol.GetAttrRequest) (*protocol.GetAttrResponse, error) {
+	resp, err := c.send(ctx, r)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp, ok := resp.(*protocol.GetAttrResponse); ok {
+		return resp, nil
+	}
+	return nil, ErrInvalidResponse
+}
+
+// SetAttr updates the attributes of the file.
+func (c *Client) SetAttr(r *protocol.SetAttrRequest) (*protocol.SetAttrResponse, error) {
+	return c.SetAttrContext(context.Background(), r)
+}
+
+// SetAttrContext is like SetAttr, but flushes the request if ctx is cancelled.
+func (c *Client) SetAttrContext(ctx context.Context, r *protocol.SetAttrRequest) (*protocol.SetAttrResponse, error) {
+	resp, err := c.send(ctx, r)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp, ok := resp.(*protocol.SetAttrResponse); ok {
+		return resp, nil
+	}
+	return nil, ErrInvalidResponse
+}
+
+// XattrWalk prepares a fid for reading an extended attribute.
+func (c *Client) XattrWalk(r *protocol.XattrWalkRequest) (*protocol.XattrWalkResponse, error) {
+	return c.XattrWalkContext(context.Background(), r)
+}
+
+// XattrWalkContext is like XattrWalk, but flushes the request if ctx is cancelled.
+func (c *Client) XattrWalkContext(ctx context.Context, r *protocol.XattrWalkRequest) (*protocol.XattrWalkResponse, error) {
+	resp, err := c.send(ctx, r)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp, ok := resp.(*protocol.XattrWalkResponse); ok {
+		return resp, nil
+	}
+	return nil, ErrInvalidResponse
+}
+
+// XattrCreate prepares a fid for writing an extended attribute.
+func (c *Client) XattrCreate(r *protocol.XattrCreateRequest) (*protocol.XattrCreateResponse, error) {
+	return c.XattrCreateContext(context.Background(), r)
+}
+
+// XattrCreateContext is like XattrCreate, but flushes the request if ctx is cancelled.
+func (c *Client) XattrCreateContext(ctx context.Context, r *protocol.XattrCreateRequest) (*protocol.XattrCreateResponse, error) {
+	resp, err := c.send(ctx, r)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp, ok := resp.(*protocol.XattrCreateResponse); ok {
+		return resp, nil
+	}
+	return nil, ErrInvalidResponse
+}
+
+// ReadDir reads directory entries from an open directory. The count is
+// clamped to fit within the negotiated maximum message size.
+func (c *Client) ReadDir(r *protocol.ReadDirRequest) (*protocol.ReadDirResponse, error) {
+	return c.ReadDirContext(context.Background(), r)
+}
+
+// ReadDirContext is like ReadDir, but flushes the request if ctx is cancelled.
+func (c *Client) ReadDirContext(ctx context.Context, r *protocol.ReadDirRequest) (*protocol.ReadDirResponse, error) {
+	if max := c.maxIO(); r.Count > max {
+		clamped := *r
+		clamped.Count = max
+		r = &clamped
+	}
+
+	resp, err := c.send(ctx, r)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp, ok := resp.(*protocol.ReadDirResponse); ok {
+		return resp, nil
+	}
+	return nil, ErrInvalidResponse
+}
 
+// Fsync commits a file to storage.
+func (c *Client) Fsync(r *protocol.FsyncRequest) (*protocol.FsyncResponse, error) {
+	return c.FsyncContext(context.Background(), r)
+}
+
+// FsyncContext is like Fsync, but flushes the request if ctx is cancelled.
+func (c *Client) FsyncContext(ctx context.Context, r *protocol.FsyncRequest) (*protocol.FsyncResponse, error) {
+	resp, err := c.send(ctx, r)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp, ok := resp.(*protocol.FsyncResponse); ok {
+		return resp, nil
+	}
+	return nil, ErrInvalidResponse
+}
+
+// Lock acquires or releases a POSIX record lock.
+func (c *Client) Lock(r *protocol.LockRequest) (*protocol.LockResponse, error) {
+	return c.LockContext(context.Background(), r)
+}
+
+// LockContext is like Lock, but flushes the request if ctx is cancelled.
+func (c *Client) LockContext(ctx context.Context, r *protocol.LockRequest) (*protocol.LockResponse, error) {
+	resp, err := c.send(ctx, r)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp, ok := resp.(*protocol.LockResponse); ok {
+		return resp, nil
+	}
+	return nil, ErrInvalidResponse
+}
+
+// GetLock tests for a conflicting POSIX record lock.
+func (c *Client) GetLock(r *protocol.GetLockRequest) (*protocol.GetLockResponse, error) {
+	return c.GetLockContext(context.Background(), r)
+}
+
+// GetLockContext is like GetLock, but flushes the request if ctx is cancelled.
+func (c *Client) GetLockContext(ctx context.Context, r *protocol.GetLockRequest) (*protocol.GetLockResponse, error) {
+	resp, err := c.send(ctx, r)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp, ok := resp.(*protocol.GetLockResponse); ok {
+		return resp, nil
+	}
+	return nil, ErrInvalidResponse
+}
+
+// Link creates a hard link.
+func (c *Client) Link(r *protocol.LinkRequest) (*protocol.LinkResponse, error) {
+	return c.LinkContext(context.Background(), r)
+}
+
+// LinkContext is like Link, but flushes the request if ctx is cancelled.
+func (c *Client) LinkContext(ctx context.Context, r *protocol.LinkRequest) (*protocol.LinkResponse, error) {
+	resp, err := c.send(ctx, r)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp, ok := resp.(*protocol.LinkResponse); ok {
+		return resp, nil
+	}
+	return nil, ErrInvalidResponse
+}
+
+// Mkdir creates a directory.
+func (c *Client) Mkdir(r *protocol.MkdirRequest) (*protocol.MkdirResponse, error) {
+	return c.MkdirContext(context.Background(), r)
+}
+
+// MkdirContext is like Mkdir, but flushes the request if ctx is cancelled.
+func (c *Client) MkdirContext(ctx context.Context, r *protocol.MkdirRequest) (*protocol.MkdirResponse, error) {
+	resp, err := c.send(ctx, r)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp, ok := resp.(*protocol.MkdirResponse); ok {
+		return resp, nil
+	}
+	return nil, ErrInvalidResponse
+}
+
+// RenameAt moves a file from one directory to another.
+func (c *Client) RenameAt(r *protocol.RenameAtRequest) (*protocol.RenameAtResponse, error) {
+	return c.RenameAtContext(context.Background(), r)
+}
+
+// RenameAtContext is like RenameAt, but flushes the request if ctx is cancelled.
+func (c *Client) RenameAtContext(ctx context.Context, r *protocol.RenameAtRequest) (*protocol.RenameAtResponse, error) {
+	resp, err := c.send(ctx, r)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp, ok := resp.(*protocol.RenameAtResponse); ok {
+		return resp, nil
+	}
+	return nil, ErrInvalidResponse
+}
+
+// UnlinkAt removes a file from a directory.
+func (c *Client) UnlinkAt(r *protocol.UnlinkAtRequest) (*protocol.UnlinkAtResponse, error) {
+	return c.UnlinkAtContext(context.Background(), r)
+}
+
+// UnlinkAtContext is like UnlinkAt, but flushes the request if ctx is cancelled.
+func (c *Client) UnlinkAtContext(ctx context.Context, r *protocol.UnlinkAtRequest) (*protocol.UnlinkAtResponse, error) {
+	resp, err := c.send(ctx, r)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp, ok := resp.(*protocol.UnlinkAtResponse); ok {
+		return resp, nil
+	}
+	return nil, ErrInvalidResponse
+}
+
+// Start starts serving the responses for the client. Responses larger than
+// the negotiated maximum message size are rejected by returning
+// protocol.ErrMessageTooLarge.
+//
+// Start returns when the client shuts down, returning the reason, which is
+// also reported by Err. This is ErrClientClosed if Stop was called, but the
+// ReadWriter must implement io.Closer for Stop to interrupt Start.
+func (c *Client) Start() error {
 	for {
-		var (
-			size uint32
-			mt   protocol.MessageType
-			err  error
-		)
-
-		if size, mt, err = protocol.DecodeHdr(c.rw); err != nil {
-			return err
+		b, err := protocol.ReadFrame(c.rw, c.maxSize())
+		if err != nil {
+			c.shutdown(err)
+			return c.err
 		}
 
-		limiter := &io.LimitedReader{R: c.rw, N: int64(size) - protocol.HeaderSize}
-
-		var r protocol.Message
-		if r, err = protocol.MessageTypeToMessage(mt); err != nil {
-			return err
+		// The dialect is only changed by this goroutine, so it is safe to read
+		// without holding the writeLock.
+		r, err := protocol.UnmarshalMessage(b, c.dialect)
+		if err != nil {
+			c.shutdown(err)
+			return c.err
 		}
-		if err = r.Decode(limiter); err != nil {
-			return err
+
+		if vr, ok := r.(*protocol.VersionResponse); ok {
+			c.negotiated(vr)
 		}
 
 		c.handleResponse(r)
-
 	}
 }
 
-// Stop stops a client.
+// Stop shuts the client down, closing the connection and failing all pending
+// and future requests with ErrClientClosed.
 func (c *Client) Stop() {
-	// TODO(kl): Add more robust stop.
-	defer func() {
-		if closer, ok := c.rw.(io.Closer); ok {
-			closer.Close()
-		}
-	}()
+	c.shutdown(ErrClientClosed)
 }
 
 // NewClient returns a new client serving the provided ReadWriter.
 func NewClient(rw io.ReadWriter) *Client {
 	return &Client{
-		rw:    rw,
-		queue: make(map[protocol.Tag]chan protocol.Message),
+		rw:     rw,
+		queue:  make(map[protocol.Tag]*pending),
+		tagSem: make(chan struct{}, protocol.NOTAG-1),
+		done:   make(chan struct{}),
 	}
 }
@@ -0,0 +1,549 @@
+// Package client implements a file oriented 9P client on top of g9p.Client,
+// taking care of fid allocation, walks and I/O chunking.
+package client
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"io/fs"
+	"path"
+	"sync"
+
+	"github.com/kennylevinsen/g9p"
+	"github.com/kennylevinsen/g9p/protocol"
+)
+
+// Errors
+var (
+	ErrNotOpen     = errors.New("fid not open")
+	ErrAlreadyOpen = errors.New("fid already open")
+	ErrBadVersion  = errors.New("server does not support 9P2000")
+	ErrBadWhence   = errors.New("invalid whence")
+	ErrNegative    = errors.New("negative offset")
+	ErrClosed      = errors.New("fid already closed")
+	ErrNoIOUnit    = errors.New("message size too small for reads and writes")
+)
+
+// Conn is a 9P2000 connection.
+type Conn struct {
+	c *g9p.Client
+
+	// msize is the negotiated maximum message size, and dialect the
+	// negotiated dialect, which determines the layout of stats in directory
+	// reads.
+	msize   uint32
+	dialect protocol.Dialect
+
+	fidLock  sync.Mutex
+	nextFid  protocol.Fid
+	freeFids []protocol.Fid
+}
+
+// New negotiates the 9P2000 protocol with the given maximum message size on a
+// client, which must have been started.
+func New(c *g9p.Client, msize uint32) (*Conn, error) {
+	conn := &Conn{c: c}
+	res, err := c.Version(&protocol.VersionRequest{
+		Tag:     protocol.NOTAG,
+		MaxSize: msize,
+		Version: protocol.Version9P2000,
+	})
+	if err != nil {
+		return nil, err
+	}
+	if res.Version != protocol.Version9P2000 {
+		return nil, ErrBadVersion
+	}
+
+	conn.msize = res.MaxSize
+	conn.dialect, _ = protocol.ParseDialect(res.Version)
+	return conn, nil
+}
+
+// Client returns the underlying client.
+func (c *Conn) Client() *g9p.Client {
+	return c.c
+}
+
+// allocFid returns an unused fid number.
+func (c *Conn) allocFid() protocol.Fid {
+	c.fidLock.Lock()
+	defer c.fidLock.Unlock()
+
+	if n := len(c.freeFids); n > 0 {
+		fid := c.freeFids[n-1]
+		c.freeFids = c.freeFids[:n-1]
+		return fid
+	}
+
+	fid := c.nextFid
+	c.nextFid++
+	if c.nextFid == protocol.NOFID {
+		c.nextFid++
+	}
+	return fid
+}
+
+// freeFid returns a fid number for reuse.
+func (c *Conn) freeFid(fid protocol.Fid) {
+	c.fidLock.Lock()
+	defer c.fidLock.Unlock()
+	c.freeFids = append(c.freeFids, fid)
+}
+
+// maxIO returns the largest payload of a read or write.
+func (c *Conn) maxIO() uint32 {
+	if c.msize > protocol.IOHDRSZ {
+		return c.msize - protocol.IOHDRSZ
+	}
+	return 0
+}
+
+// Attach attaches to the file tree aname as user, returning a fid for the
+// root of the tree. Authentication is not supported.
+func (c *Conn) Attach(user, aname string) (*Fid, error) {
+	num := c.allocFid()
+	res, err := c.c.Attach(&protocol.AttachRequest{
+		Fid:      num,
+		AuthFid:  protocol.NOFID,
+		Username: user,
+		Service:  aname,
+	})
+	if err != nil {
+		c.freeFid(num)
+		return nil, err
+	}
+
+	return &Fid{conn: c, num: num, qid: res.Qid}, nil
+}
+
+// Fid is a fid on a connection. Once opened, it implements io.Reader,
+// io.Writer, io.ReaderAt, io.WriterAt and io.Seeker. Fids must be closed to be
+// released.
+type Fid struct {
+	conn *Conn
+	num  protocol.Fid
+
+	lock   sync.Mutex
+	qid    protocol.Qid
+	closed bool
+	opened bool
+	iounit uint32
+	offset int64
+}
+
+// Num returns the fid number.
+func (f *Fid) Num() protocol.Fid {
+	return f.num
+}
+
+// Qid returns the qid of the file the fid refers to.
+func (f *Fid) Qid() protocol.Qid {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return f.qid
+}
+
+// check returns ErrClosed if the fid has been closed.
+func (f *Fid) check() error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	if f.closed {
+		return ErrClosed
+	}
+	return nil
+}
+
+// Walk walks the given names from the fid, returning a new fid for the
+// resulting file. The fid itself is not changed. Walks of more than
+// protocol.MAXWELEM names are split into multiple requests. A walk of no names
+// returns a new fid for the same file.
+//
+// If a name does not exist, an *fs.PathError wrapping fs.ErrNotExist is
+// returned.
+func (f *Fid) Walk(names ...string) (*Fid, error) {
+	if err := f.check(); err != nil {
+		return nil, err
+	}
+
+	newfid := &Fid{conn: f.conn, num: f.conn.allocFid(), qid: f.Qid()}
+
+	from := f.num
+	walked := 0
+	for {
+		n := len(names) - walked
+		if n > protocol.MAXWELEM {
+			n = protocol.MAXWELEM
+		}
+		chunk := names[walked : walked+n]
+
+		res, err := f.conn.c.Walk(&protocol.WalkRequest{
+			Fid:    from,
+			NewFid: newfid.num,
+			Names:  chunk,
+		})
+		if err == nil && len(res.Qids) != len(chunk) {
+			err = &fs.PathError{Op: "walk", Path: path.Join(names[:walked+len(res.Qids)+1]...), Err: fs.ErrNotExist}
+		}
+		if err != nil {
+			if from == newfid.num {
+				newfid.Close()
+			} else {
+				f.conn.freeFid(newfid.num)
+			}
+			return nil, err
+		}
+
+		if len(res.Qids) > 0 {
+			newfid.qid = res.Qids[len(res.Qids)-1]
+		}
+
+		walked += n
+		from = newfid.num
+		if walked == len(names) {
+			return newfid, nil
+		}
+	}
+}
+
+// Open opens the fid with the given mode.
+func (f *Fid) Open(mode protocol.OpenMode) error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	if f.closed {
+		return ErrClosed
+	}
+	if f.opened {
+		return ErrAlreadyOpen
+	}
+
+	res, err := f.conn.c.Open(&protocol.OpenRequest{
+		Fid:  f.num,
+		Mode: mode,
+	})
+	if err != nil {
+		return err
+	}
+
+	f.setOpened(res.Qid, res.IOUnit)
+	return nil
+}
+
+// Create creates a file with the given name and permissions in the directory
+// referenced by the fid, after which the fid refers to the new file, opened
+// with the given mode.
+func (f *Fid) Create(name string, perm protocol.FileMode, mode protocol.OpenMode) error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	if f.closed {
+		return ErrClosed
+	}
+	if f.opened {
+		return ErrAlreadyOpen
+	}
+
+	res, err := f.conn.c.Create(&protocol.CreateRequest{
+		Fid:         f.num,
+		Name:        name,
+		Permissions: perm,
+		Mode:        mode,
+	})
+	if err != nil {
+		return err
+	}
+
+	f.setOpened(res.Qid, res.IOUnit)
+	return nil
+}
+
+// setOpened marks the fid as opened. The lock must be held.
+func (f *Fid) setOpened(qid protocol.Qid, iounit uint32) {
+	f.qid = qid
+	f.opened = true
+	f.iounit = iounit
+	if max := f.conn.maxIO(); f.iounit == 0 || f.iounit > max {
+		f.iounit = max
+	}
+}
+
+// Stat returns the stat of the file the fid refers to.
+func (f *Fid) Stat() (protocol.Stat, error) {
+	if err := f.check(); err != nil {
+		return protocol.Stat{}, err
+	}
+
+	res, err := f.conn.c.Stat(&protocol.StatRequest{
+		Fid: f.num,
+	})
+	if err != nil {
+		return protocol.Stat{}, err
+	}
+	return res.Stat, nil
+}
+
+// WriteStat changes the stat of the file the fid refers to. Fields that are
+// not to be changed must be set to their "don't touch" values, as described in
+// http://man.cat-v.org/plan_9/5/stat. DontTouch returns a stat with all fields
+// set this way.
+func (f *Fid) WriteStat(s protocol.Stat) error {
+	if err := f.check(); err != nil {
+		return err
+	}
+
+	_, err := f.conn.c.WriteStat(&protocol.WriteStatRequest{
+		Fid:  f.num,
+		Stat: s,
+	})
+	return err
+}
+
+// DontTouch returns a stat which changes nothing when used with WriteStat. It
+// is the same as protocol.DontTouch.
+func DontTouch() protocol.Stat {
+	return protocol.DontTouch()
+}
+
+// release marks the fid as closed, returning ErrClosed if it already was.
+func (f *Fid) release() error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	if f.closed {
+		return ErrClosed
+	}
+	f.closed = true
+	return nil
+}
+
+// Remove removes the file the fid refers to. The fid is released, even if
+// the remove fails.
+func (f *Fid) Remove() error {
+	if err := f.release(); err != nil {
+		return err
+	}
+
+	_, err := f.conn.c.Remove(&protocol.RemoveRequest{
+		Fid: f.num,
+	})
+	f.conn.freeFid(f.num)
+	return err
+}
+
+// Close clunks and releases the fid.
+func (f *Fid) Close() error {
+	if err := f.release(); err != nil {
+		return err
+	}
+
+	_, err := f.conn.c.Clunk(&protocol.ClunkRequest{
+		Fid: f.num,
+	})
+	f.conn.freeFid(f.num)
+	return err
+}
+
+// ioUnit returns the largest payload of a single read or write, or an error
+// if the fid is not open or the negotiated message size leaves no room for
+// data.
+func (f *Fid) ioUnit() (uint32, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	if f.closed {
+		return 0, ErrClosed
+	}
+	if !f.opened {
+		return 0, ErrNotOpen
+	}
+	if f.iounit == 0 {
+		return 0, ErrNoIOUnit
+	}
+	return f.iounit, nil
+}
+
+// readAt performs a single read at the given offset.
+func (f *Fid) readAt(p []byte, off int64) (int, error) {
+	iounit, err := f.ioUnit()
+	if err != nil {
+		return 0, err
+	}
+	if uint32(len(p)) > iounit {
+		p = p[:iounit]
+	}
+
+	res, err := f.conn.c.Read(&protocol.ReadRequest{
+		Fid:    f.num,
+		Offset: uint64(off),
+		Count:  uint32(len(p)),
+	})
+	if err != nil {
+		return 0, err
+	}
+	if len(res.Data) == 0 && len(p) > 0 {
+		return 0, io.EOF
+	}
+	return copy(p, res.Data), nil
+}
+
+// Read reads from the current offset with a single read request, which means
+// that less than len(p) bytes may be read. For directories, Read returns whole
+// packed stats. ReadDir reads all stats of a directory.
+func (f *Fid) Read(p []byte) (int, error) {
+	f.lock.Lock()
+	off := f.offset
+	f.lock.Unlock()
+
+	n, err := f.readAt(p, off)
+
+	f.lock.Lock()
+	f.offset = off + int64(n)
+	f.lock.Unlock()
+	return n, err
+}
+
+// ReadAt reads len(p) bytes from the given offset, issuing as many reads as
+// necessary.
+func (f *Fid) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, ErrNegative
+	}
+
+	var read int
+	for read < len(p) {
+		n, err := f.readAt(p[read:], off+int64(read))
+		read += n
+		if err != nil {
+			return read, err
+		}
+		if n == 0 {
+			return read, io.ErrNoProgress
+		}
+	}
+	return read, nil
+}
+
+// writeAt writes all of p at the given offset, issuing as many writes as
+// necessary.
+func (f *Fid) writeAt(p []byte, off int64) (int, error) {
+	iounit, err := f.ioUnit()
+	if err != nil {
+		return 0, err
+	}
+
+	var written int
+	for {
+		chunk := p[written:]
+		if uint32(len(chunk)) > iounit {
+			chunk = chunk[:iounit]
+		}
+
+		res, err := f.conn.c.Write(&protocol.WriteRequest{
+			Fid:    f.num,
+			Offset: uint64(off + int64(written)),
+			Data:   chunk,
+		})
+		if err != nil {
+			return written, err
+		}
+
+		written += int(res.Count)
+		if written == len(p) {
+			return written, nil
+		}
+		if res.Count == 0 {
+			return written, io.ErrShortWrite
+		}
+	}
+}
+
+// Write writes p at the current offset.
+func (f *Fid) Write(p []byte) (int, error) {
+	f.lock.Lock()
+	off := f.offset
+	f.lock.Unlock()
+
+	n, err := f.writeAt(p, off)
+
+	f.lock.Lock()
+	f.offset = off + int64(n)
+	f.lock.Unlock()
+	return n, err
+}
+
+// WriteAt writes p at the given offset.
+func (f *Fid) WriteAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, ErrNegative
+	}
+	return f.writeAt(p, off)
+}
+
+// Seek sets the offset for the next Read or Write. Seeking relative to the end
+// of the file requires a Stat of the file.
+func (f *Fid) Seek(offset int64, whence int) (int64, error) {
+	var base int64
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		f.lock.Lock()
+		base = f.offset
+		f.lock.Unlock()
+	case io.SeekEnd:
+		s, err := f.Stat()
+		if err != nil {
+			return 0, err
+		}
+		base = int64(s.Length)
+	default:
+		return 0, ErrBadWhence
+	}
+
+	if base+offset < 0 {
+		return 0, ErrNegative
+	}
+
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.offset = base + offset
+	return f.offset, nil
+}
+
+// ReadDir reads the remaining stats of an opened directory.
+func (f *Fid) ReadDir() ([]protocol.Stat, error) {
+	iounit, err := f.ioUnit()
+	if err != nil {
+		return nil, err
+	}
+
+	var stats []protocol.Stat
+	b := make([]byte, iounit)
+	for {
+		n, err := f.Read(b)
+		if err == io.EOF {
+			return stats, nil
+		}
+		if err != nil {
+			return stats, err
+		}
+
+		for data := b[:n]; len(data) > 0; {
+			var s protocol.Stat
+			if len(data) < 2 {
+				return stats, io.ErrUnexpectedEOF
+			}
+			size := 2 + int(binary.LittleEndian.Uint16(data))
+			if size > len(data) {
+				return stats, io.ErrUnexpectedEOF
+			}
+			if err := s.UnmarshalDialect(data[:size], f.conn.dialect); err != nil {
+				return stats, err
+			}
+			stats = append(stats, s)
+			data = data[size:]
+		}
+	}
+}
@@ -0,0 +1,164 @@
+package client
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"testing/fstest"
+
+	"github.com/kennylevinsen/g9p"
+	"github.com/kennylevinsen/g9p/localfs"
+	"github.com/kennylevinsen/g9p/protocol"
+)
+
+// Test if Fid lives up to the io interfaces.
+var (
+	_ io.Reader   = (*Fid)(nil)
+	_ io.Writer   = (*Fid)(nil)
+	_ io.ReaderAt = (*Fid)(nil)
+	_ io.WriterAt = (*Fid)(nil)
+	_ io.Seeker   = (*Fid)(nil)
+	_ io.Closer   = (*Fid)(nil)
+)
+
+// serve serves a local directory, and returns a connection to it with the
+// given maximum message size.
+func serve(t *testing.T, dir string, msize uint32) *Conn {
+	fsys, err := localfs.New(dir)
+	if err != nil {
+		t.Fatalf("could not export directory: %v", err)
+	}
+	t.Cleanup(func() { fsys.Close() })
+
+	a, b := net.Pipe()
+	go g9p.ServeContext(a, fsys.Handler())
+	c := g9p.NewClient(b)
+	go c.Start()
+	t.Cleanup(func() { b.Close() })
+
+	conn, err := New(c, msize)
+	if err != nil {
+		t.Fatalf("could not negotiate version: %v", err)
+	}
+	return conn
+}
+
+func TestFid(t *testing.T) {
+	dir := t.TempDir()
+	names := strings.Split("a/b/c/d/e/f/g/h/i/j/k/l/m/n/o/p/q/r/s/t", "/")
+	if err := os.MkdirAll(filepath.Join(dir, filepath.Join(names...)), 0755); err != nil {
+		t.Fatalf("could not create directories: %v", err)
+	}
+
+	conn := serve(t, dir, 8192)
+	root, err := conn.Attach("glenda", "")
+	if err != nil {
+		t.Fatalf("attach failed: %v", err)
+	}
+	defer root.Close()
+
+	// Walks longer than protocol.MAXWELEM are split.
+	deep, err := root.Walk(names...)
+	if err != nil {
+		t.Fatalf("walk failed: %v", err)
+	}
+	if deep.Qid().Type != protocol.QTDIR {
+		t.Fatalf("walk did not end at a directory: %+v", deep.Qid())
+	}
+	deep.Close()
+
+	if _, err := root.Walk(append(names, "missing")...); !errors.Is(err, fs.ErrNotExist) {
+		t.Fatalf("walk to missing file returned %v", err)
+	}
+
+	f, err := root.Walk()
+	if err != nil {
+		t.Fatalf("clone failed: %v", err)
+	}
+	if err := f.Create("file", 0644, protocol.ORDWR); err != nil {
+		t.Fatalf("create failed: %v", err)
+	}
+
+	// Write more than a single message can hold.
+	content := strings.Repeat("0123456789", 2000)
+	if n, err := io.WriteString(f, content); err != nil || n != len(content) {
+		t.Fatalf("write failed: %d, %v", n, err)
+	}
+
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		t.Fatalf("seek failed: %v", err)
+	}
+	b, err := io.ReadAll(f)
+	if err != nil || string(b) != content {
+		t.Fatalf("read back %d bytes, %v", len(b), err)
+	}
+
+	if pos, err := f.Seek(-10, io.SeekEnd); err != nil || pos != int64(len(content)-10) {
+		t.Fatalf("seek from end returned %d, %v", pos, err)
+	}
+
+	if err := f.Remove(); err != nil {
+		t.Fatalf("remove failed: %v", err)
+	}
+
+	// Fids are recycled.
+	again, err := root.Walk()
+	if err != nil {
+		t.Fatalf("clone failed: %v", err)
+	}
+	if again.Num() != f.Num() {
+		t.Fatalf("fid %d was not reused, got %d", f.Num(), again.Num())
+	}
+	again.Close()
+}
+
+func TestFS(t *testing.T) {
+	dir := t.TempDir()
+	for name, content := range map[string]string{
+		"hello":         "hello, world",
+		"sub/file":      "in a subdirectory",
+		"sub/deep/file": "deeper",
+	} {
+		p := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatalf("could not create directory: %v", err)
+		}
+		if err := os.WriteFile(p, []byte(content), 0644); err != nil {
+			t.Fatalf("could not create file: %v", err)
+		}
+	}
+
+	conn := serve(t, dir, 8192)
+	root, err := conn.Attach("glenda", "")
+	if err != nil {
+		t.Fatalf("attach failed: %v", err)
+	}
+	defer root.Close()
+
+	if err := fstest.TestFS(NewFS(root), "hello", "sub/file", "sub/deep/file"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestNoIOUnit(t *testing.T) {
+	conn := serve(t, t.TempDir(), protocol.IOHDRSZ)
+	root, err := conn.Attach("", "")
+	if err != nil {
+		t.Fatalf("attach failed: %v", err)
+	}
+	defer root.Close()
+	if err := root.Open(protocol.OREAD); err != nil {
+		t.Fatalf("open failed: %v", err)
+	}
+
+	// A message size leaving no room for data fails reads rather than
+	// looping forever.
+	if _, err := root.ReadAt(make([]byte, 10), 0); err != ErrNoIOUnit {
+		t.Fatalf("read returned %v, expected %v", err, ErrNoIOUnit)
+	}
+}
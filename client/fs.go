@@ -0,0 +1,222 @@
+package client
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/kennylevinsen/g9p/protocol"
+)
+
+// FS is an io/fs.FS for the file tree below a fid. It also implements
+// fs.ReadDirFS and fs.StatFS. Files opened through the FS implement
+// fs.ReadDirFile, io.Seeker and io.ReaderAt.
+type FS struct {
+	root *Fid
+}
+
+// NewFS returns a FS for the file tree below root. The root fid remains owned
+// by the caller, and must not be closed while the FS is in use.
+func NewFS(root *Fid) *FS {
+	return &FS{root: root}
+}
+
+// walk returns a new fid for the named file.
+func (fsys *FS) walk(op, name string) (*Fid, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: op, Path: name, Err: fs.ErrInvalid}
+	}
+
+	var names []string
+	if name != "." {
+		names = strings.Split(name, "/")
+	}
+
+	fid, err := fsys.root.Walk(names...)
+	if err != nil {
+		var pe *fs.PathError
+		if errors.As(err, &pe) {
+			err = pe.Err
+		}
+		return nil, &fs.PathError{Op: op, Path: name, Err: err}
+	}
+	return fid, nil
+}
+
+// Open opens the named file for reading.
+func (fsys *FS) Open(name string) (fs.File, error) {
+	fid, err := fsys.walk("open", name)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := fid.Open(protocol.OREAD); err != nil {
+		fid.Close()
+		return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+	}
+	return &file{fid: fid, name: name}, nil
+}
+
+// Stat returns the FileInfo of the named file.
+func (fsys *FS) Stat(name string) (fs.FileInfo, error) {
+	fid, err := fsys.walk("stat", name)
+	if err != nil {
+		return nil, err
+	}
+	defer fid.Close()
+
+	s, err := fid.Stat()
+	if err != nil {
+		return nil, &fs.PathError{Op: "stat", Path: name, Err: err}
+	}
+	return fileInfoNamed(s, name), nil
+}
+
+// ReadDir reads the named directory, returning its entries sorted by name.
+func (fsys *FS) ReadDir(name string) ([]fs.DirEntry, error) {
+	f, err := fsys.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	entries, err := f.(*file).ReadDir(-1)
+	if err != nil {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: err}
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name() < entries[j].Name() })
+	return entries, nil
+}
+
+// fileInfoNamed returns the FileInfo of a stat, using the base of the opened
+// name. The root of a file tree is named "." by io/fs, while servers usually
+// name it "/".
+func fileInfoNamed(s protocol.Stat, name string) fs.FileInfo {
+	if name == "." {
+		s.Name = "."
+	}
+	return FileInfo(s)
+}
+
+// file is a file opened through FS.
+type file struct {
+	fid  *Fid
+	name string
+
+	// entries holds directory entries that have been read, but not yet
+	// returned by ReadDir.
+	entries []fs.DirEntry
+	eof     bool
+}
+
+func (f *file) Stat() (fs.FileInfo, error) {
+	s, err := f.fid.Stat()
+	if err != nil {
+		return nil, &fs.PathError{Op: "stat", Path: f.name, Err: err}
+	}
+	return fileInfoNamed(s, f.name), nil
+}
+
+func (f *file) isDir() bool {
+	return f.fid.Qid().Type&protocol.QTDIR != 0
+}
+
+func (f *file) Read(p []byte) (int, error) {
+	if f.isDir() {
+		return 0, &fs.PathError{Op: "read", Path: f.name, Err: errors.New("is a directory")}
+	}
+	return f.fid.Read(p)
+}
+
+func (f *file) ReadAt(p []byte, off int64) (int, error) {
+	if f.isDir() {
+		return 0, &fs.PathError{Op: "read", Path: f.name, Err: errors.New("is a directory")}
+	}
+	return f.fid.ReadAt(p, off)
+}
+
+func (f *file) Seek(offset int64, whence int) (int64, error) {
+	return f.fid.Seek(offset, whence)
+}
+
+// ReadDir reads the directory as described by fs.ReadDirFile.
+func (f *file) ReadDir(n int) ([]fs.DirEntry, error) {
+	if !f.isDir() {
+		return nil, &fs.PathError{Op: "readdir", Path: f.name, Err: errors.New("not a directory")}
+	}
+
+	if !f.eof && (n <= 0 || len(f.entries) < n) {
+		stats, err := f.fid.ReadDir()
+		for _, s := range stats {
+			f.entries = append(f.entries, fs.FileInfoToDirEntry(FileInfo(s)))
+		}
+		if err != nil {
+			return nil, err
+		}
+		f.eof = true
+	}
+
+	if n <= 0 {
+		entries := f.entries
+		f.entries = nil
+		return entries, nil
+	}
+	if len(f.entries) == 0 {
+		return nil, io.EOF
+	}
+	if n > len(f.entries) {
+		n = len(f.entries)
+	}
+	entries := f.entries[:n:n]
+	f.entries = f.entries[n:]
+	return entries, nil
+}
+
+func (f *file) Close() error {
+	return f.fid.Close()
+}
+
+// FileMode converts a 9P file mode to a fs.FileMode.
+func FileMode(m protocol.FileMode) fs.FileMode {
+	mode := fs.FileMode(m & 0777)
+	for _, b := range []struct {
+		p protocol.FileMode
+		f fs.FileMode
+	}{
+		{protocol.DMDIR, fs.ModeDir},
+		{protocol.DMAPPEND, fs.ModeAppend},
+		{protocol.DMEXCL, fs.ModeExclusive},
+		{protocol.DMTMP, fs.ModeTemporary},
+		{protocol.DMSYMLINK, fs.ModeSymlink},
+		{protocol.DMDEVICE, fs.ModeDevice},
+		{protocol.DMNAMEDPIPE, fs.ModeNamedPipe},
+		{protocol.DMSOCKET, fs.ModeSocket},
+		{protocol.DMSETUID, fs.ModeSetuid},
+		{protocol.DMSETGID, fs.ModeSetgid},
+	} {
+		if m&b.p != 0 {
+			mode |= b.f
+		}
+	}
+	return mode
+}
+
+// FileInfo returns a fs.FileInfo for a stat. Its Sys method returns the
+// protocol.Stat.
+func FileInfo(s protocol.Stat) fs.FileInfo {
+	return fileInfo{s}
+}
+
+type fileInfo struct {
+	s protocol.Stat
+}
+
+func (fi fileInfo) Name() string       { return fi.s.Name }
+func (fi fileInfo) Size() int64        { return int64(fi.s.Length) }
+func (fi fileInfo) Mode() fs.FileMode  { return FileMode(fi.s.Mode) }
+func (fi fileInfo) ModTime() time.Time { return time.Unix(int64(fi.s.Mtime), 0) }
+func (fi fileInfo) IsDir() bool        { return fi.s.Mode&protocol.DMDIR != 0 }
+func (fi fileInfo) Sys() interface{}   { return fi.s }
@@ -1,6 +1,130 @@
 package g9p
 
-// Test if the client lives up to the Handler interface.
-var _ Handler = (*Client)(nil)
+import (
+	"context"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
 
-// TODO(kl): Write some tests!!!
+	"github.com/kennylevinsen/g9p/protocol"
+)
+
+// Test if the client lives up to the Handler interfaces.
+var (
+	_ Handler      = (*Client)(nil)
+	_ LinuxHandler = (*Client)(nil)
+)
+
+// statHandler is a ContextHandler that only implements Version and Stat.
+type statHandler struct {
+	ContextHandler
+}
+
+func (statHandler) Version(_ context.Context, r *protocol.VersionRequest) (*protocol.VersionResponse, error) {
+	return &protocol.VersionResponse{MaxSize: r.MaxSize, Version: r.Version}, nil
+}
+
+func (statHandler) Stat(_ context.Context, r *protocol.StatRequest) (*protocol.StatResponse, error) {
+	return &protocol.StatResponse{Stat: protocol.Stat{Name: "file"}}, nil
+}
+
+func (statHandler) Read(ctx context.Context, r *protocol.ReadRequest) (*protocol.ReadResponse, error) {
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+func TestClientTags(t *testing.T) {
+	a, b := net.Pipe()
+	go ServeContext(a, statHandler{})
+	c := NewClient(b)
+	go c.Start()
+	defer b.Close()
+
+	if _, err := c.Version(&protocol.VersionRequest{Tag: protocol.NOTAG, MaxSize: 8192, Version: protocol.Version9P2000}); err != nil {
+		t.Fatalf("version failed: %v", err)
+	}
+
+	// Concurrent requests with zero tags are assigned distinct tags.
+	var wg sync.WaitGroup
+	errs := make(chan error, 100)
+	for i := 0; i < 100; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := c.Stat(&protocol.StatRequest{}); err != nil {
+				errs <- err
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Errorf("stat failed: %v", err)
+	}
+
+	// NextTag never returns 0, which would be assigned another tag.
+	for i := 0; i < int(protocol.NOTAG); i++ {
+		if tag := c.NextTag(); tag == 0 || tag == protocol.NOTAG {
+			t.Fatalf("NextTag returned %d", tag)
+		}
+	}
+}
+
+func TestClientContext(t *testing.T) {
+	a, b := net.Pipe()
+	go ServeContext(a, statHandler{})
+	c := NewClient(b)
+	go c.Start()
+	defer b.Close()
+
+	if _, err := c.Version(&protocol.VersionRequest{Tag: protocol.NOTAG, MaxSize: 8192, Version: protocol.Version9P2000}); err != nil {
+		t.Fatalf("version failed: %v", err)
+	}
+
+	// The read never completes, and is flushed when the context expires.
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err := c.ReadContext(ctx, &protocol.ReadRequest{Tag: 1}); err != context.DeadlineExceeded {
+		t.Fatalf("read returned %v, expected %v", err, context.DeadlineExceeded)
+	}
+
+	// The tag is free for reuse once the call returns.
+	if _, err := c.Stat(&protocol.StatRequest{Tag: 1}); err != nil {
+		t.Fatalf("stat failed: %v", err)
+	}
+}
+
+func TestClientShutdown(t *testing.T) {
+	a, b := net.Pipe()
+	c := NewClient(b)
+	started := make(chan error, 1)
+	go func() { started <- c.Start() }()
+
+	// The server never responds, so the request is pending until the
+	// connection is closed.
+	pending := make(chan error, 1)
+	go func() {
+		_, err := c.Stat(&protocol.StatRequest{})
+		pending <- err
+	}()
+	if _, err := protocol.Decode(a); err != nil {
+		t.Fatalf("could not read request: %v", err)
+	}
+	a.Close()
+
+	if err := <-started; err != io.EOF {
+		t.Fatalf("start returned %v, expected %v", err, io.EOF)
+	}
+	if err := <-pending; err != io.EOF {
+		t.Fatalf("pending request returned %v, expected %v", err, io.EOF)
+	}
+	<-c.Done()
+	if err := c.Err(); err != io.EOF {
+		t.Fatalf("err returned %v, expected %v", err, io.EOF)
+	}
+	if _, err := c.Stat(&protocol.StatRequest{}); err != io.EOF {
+		t.Fatalf("request after shutdown returned %v, expected %v", err, io.EOF)
+	}
+}
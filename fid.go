@@ -0,0 +1,504 @@
+package g9p
+
+import (
+	"context"
+	"strings"
+	"sync"
+
+	"github.com/kennylevinsen/g9p/p9err"
+	"github.com/kennylevinsen/g9p/protocol"
+)
+
+// Errors returned by FidServer for requests that break the fid rules.
+var (
+	ErrUnknownFid  = p9err.ErrUnknownFid
+	ErrFidInUse    = p9err.ErrFidInUse
+	ErrFidOpen     = p9err.ErrIsOpen
+	ErrFidNotOpen  = p9err.ErrNotOpen
+	ErrFidMode     = p9err.ErrFidMode
+	ErrAuthFid     = p9err.ErrAuthFid
+	ErrWalkTooLong = p9err.ErrWalkTooLong
+)
+
+// Fid is the server side state of a fid, as tracked by FidServer.
+type Fid[T any] struct {
+	// Num is the fid number chosen by the client.
+	Num protocol.Fid
+
+	// Qid is the qid of the file the fid refers to.
+	Qid protocol.Qid
+
+	// User is the user the fid was attached or authenticated as.
+	User string
+
+	// Auth is set if the fid is an authentication fid created by Auth.
+	Auth bool
+
+	// Opened is set once the fid has been opened by Open or Create, in which
+	// case Mode holds the mode it was opened with.
+	Opened bool
+	Mode   protocol.OpenMode
+
+	// Value is the state the FidHandler associates with the fid.
+	Value T
+
+	// lock is held for writing by Open and Create, and for reading by other
+	// requests using the fid.
+	lock sync.RWMutex
+
+	refs    int
+	clunked bool
+}
+
+// FidHandler is the interface implemented by handlers served by FidServer.
+// Every method is handed the fid state for the fids referenced by the
+// request, which FidServer has already validated. The methods otherwise
+// behave like those of ContextHandler.
+//
+// Open and Create have exclusive use of their fid, and may change its Value
+// freely. Other requests using a fid run concurrently with each other, but
+// never with an Open or Create of the same fid, which waits for them to
+// complete. Handlers thus only need to synchronize changes they make to the
+// Value outside of Open and Create.
+type FidHandler[T any] interface {
+	// Auth sets up the authentication fid afid. The fid is only registered if
+	// Auth succeeds, in which case its Qid is set to the AuthQid of the
+	// response.
+	Auth(ctx context.Context, afid *Fid[T], r *protocol.AuthRequest) (*protocol.AuthResponse, error)
+
+	// Attach sets up fid as the root of the file tree. afid is the
+	// authentication fid, or nil if none was provided. The fid is only
+	// registered if Attach succeeds, in which case its Qid is set to the Qid of
+	// the response.
+	Attach(ctx context.Context, fid, afid *Fid[T], r *protocol.AttachRequest) (*protocol.AttachResponse, error)
+
+	// Walk walks from fid, and sets up newfid for the walked file. newfid
+	// starts out as a copy of fid with a zero Value, and is a distinct Fid even
+	// if the request uses the same fid number for both. newfid is only
+	// registered if all names were walked, in which case its Qid is set to the
+	// last of the walked qids. Otherwise, it is discarded without a call to
+	// Clunk. If newfid replaces fid, fid is clunked.
+	Walk(ctx context.Context, fid, newfid *Fid[T], r *protocol.WalkRequest) (*protocol.WalkResponse, error)
+
+	// Open opens fid, which is never an authentication fid or already open. On
+	// success, the fid is marked as opened with the requested mode.
+	Open(ctx context.Context, fid *Fid[T], r *protocol.OpenRequest) (*protocol.OpenResponse, error)
+
+	// Create creates a file in the directory referenced by fid, which is never
+	// an authentication fid or already open. On success, the fid is marked as
+	// opened with the requested mode, and refers to the new file.
+	Create(ctx context.Context, fid *Fid[T], r *protocol.CreateRequest) (*protocol.CreateResponse, error)
+
+	// Read reads from fid, which is either an authentication fid or opened for
+	// reading.
+	Read(ctx context.Context, fid *Fid[T], r *protocol.ReadRequest) (*protocol.ReadResponse, error)
+
+	// Write writes to fid, which is either an authentication fid or opened
+	// for writing.
+	Write(ctx context.Context, fid *Fid[T], r *protocol.WriteRequest) (*protocol.WriteResponse, error)
+
+	// Remove removes the file referenced by fid. The fid is released whether
+	// or not Remove succeeds, which leads to a call to Clunk.
+	Remove(ctx context.Context, fid *Fid[T], r *protocol.RemoveRequest) error
+
+	// Stat returns the stat of the file referenced by fid.
+	Stat(ctx context.Context, fid *Fid[T], r *protocol.StatRequest) (*protocol.StatResponse, error)
+
+	// WriteStat changes the stat of the file referenced by fid.
+	WriteStat(ctx context.Context, fid *Fid[T], r *protocol.WriteStatRequest) (*protocol.WriteStatResponse, error)
+
+	// Clunk releases the state of fid. It is called exactly once for every
+	// registered fid, once it has been released by Clunk, Remove, a Walk
+	// replacing it, Version, or the connection closing, and all requests
+	// using it have completed. Handlers that support ORCLOSE must remove the
+	// file here.
+	Clunk(fid *Fid[T])
+}
+
+// FidServer is a ContextHandler that keeps track of the fids of a connection,
+// and dispatches requests to a FidHandler along with the validated fid state.
+// It ensures that new fids are not already in use, that the referenced fids
+// exist, that opened fids are not walked or opened again, that walks have at
+// most MAXWELEM names, and that fids are only read or written when opened
+// with a matching mode. Fids are released when clunked or removed, on Version
+// and when the connection is closed.
+//
+// FidServer handles Version itself, accepting 9P2000 and 9P2000.u. As the
+// layout of stats differs between the two, handlers must encode the stats
+// returned by directory reads in the dialect given by Dialect.
+//
+// A FidServer holds the fids of a single connection, and must not be shared
+// between connections.
+type FidServer[T any] struct {
+	// MaxSize is the largest message size accepted by Version, or 0 to
+	// accept the size requested by the client.
+	MaxSize uint32
+
+	handler FidHandler[T]
+
+	fidLock sync.Mutex
+	fids    map[protocol.Fid]*Fid[T]
+}
+
+// NewFidServer returns a FidServer serving the given handler.
+func NewFidServer[T any](handler FidHandler[T]) *FidServer[T] {
+	return &FidServer[T]{
+		handler: handler,
+		fids:    make(map[protocol.Fid]*Fid[T]),
+	}
+}
+
+// get returns the fid with the given number, and holds a reference to it
+// until put is called.
+func (fs *FidServer[T]) get(num protocol.Fid) (*Fid[T], error) {
+	fs.fidLock.Lock()
+	defer fs.fidLock.Unlock()
+
+	fid, exists := fs.fids[num]
+	if !exists {
+		return nil, ErrUnknownFid
+	}
+	fid.refs++
+	return fid, nil
+}
+
+// put releases a reference obtained by get, clunking the fid if it has been
+// released and this was the last reference.
+func (fs *FidServer[T]) put(fid *Fid[T]) {
+	fs.fidLock.Lock()
+	fid.refs--
+	clunk := fid.clunked && fid.refs == 0
+	fs.fidLock.Unlock()
+
+	if clunk {
+		fs.handler.Clunk(fid)
+	}
+}
+
+// inUse returns ErrFidInUse if a fid with the given number is registered.
+func (fs *FidServer[T]) inUse(num protocol.Fid) error {
+	fs.fidLock.Lock()
+	defer fs.fidLock.Unlock()
+
+	if _, exists := fs.fids[num]; exists || num == protocol.NOFID {
+		return ErrFidInUse
+	}
+	return nil
+}
+
+// add registers a new fid. If the fid number has been taken since it was
+// checked, the fid is clunked and ErrFidInUse is returned.
+func (fs *FidServer[T]) add(fid *Fid[T]) error {
+	fs.fidLock.Lock()
+	if _, exists := fs.fids[fid.Num]; exists {
+		fs.fidLock.Unlock()
+		fs.handler.Clunk(fid)
+		return ErrFidInUse
+	}
+	fs.fids[fid.Num] = fid
+	fs.fidLock.Unlock()
+	return nil
+}
+
+// release unregisters a fid that the caller holds a reference to. The fid is
+// clunked once the reference is put.
+func (fs *FidServer[T]) release(fid *Fid[T]) {
+	fs.fidLock.Lock()
+	defer fs.fidLock.Unlock()
+
+	if fs.fids[fid.Num] == fid {
+		delete(fs.fids, fid.Num)
+	}
+	fid.clunked = true
+}
+
+// reset releases all fids.
+func (fs *FidServer[T]) reset() {
+	var clunk []*Fid[T]
+
+	fs.fidLock.Lock()
+	for num, fid := range fs.fids {
+		delete(fs.fids, num)
+		fid.clunked = true
+		if fid.refs == 0 {
+			clunk = append(clunk, fid)
+		}
+	}
+	fs.fidLock.Unlock()
+
+	for _, fid := range clunk {
+		fs.handler.Clunk(fid)
+	}
+}
+
+// Close releases all fids. It is called by Server when the connection is
+// closed.
+func (fs *FidServer[T]) Close() error {
+	fs.reset()
+	return nil
+}
+
+func (fs *FidServer[T]) Version(_ context.Context, r *protocol.VersionRequest) (*protocol.VersionResponse, error) {
+	fs.reset()
+
+	msize := r.MaxSize
+	if fs.MaxSize != 0 && fs.MaxSize < msize {
+		msize = fs.MaxSize
+	}
+
+	version := "unknown"
+	if r.Version == protocol.Version9P2000u {
+		version = protocol.Version9P2000u
+	} else if strings.HasPrefix(r.Version, protocol.Version9P2000) {
+		version = protocol.Version9P2000
+	}
+
+	return &protocol.VersionResponse{
+		MaxSize: msize,
+		Version: version,
+	}, nil
+}
+
+func (fs *FidServer[T]) Auth(ctx context.Context, r *protocol.AuthRequest) (*protocol.AuthResponse, error) {
+	if err := fs.inUse(r.AuthFid); err != nil {
+		return nil, err
+	}
+
+	afid := &Fid[T]{Num: r.AuthFid, User: r.Username, Auth: true}
+	res, err := fs.handler.Auth(ctx, afid, r)
+	if err != nil {
+		return nil, err
+	}
+
+	afid.Qid = res.AuthQid
+	if err := fs.add(afid); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+func (fs *FidServer[T]) Attach(ctx context.Context, r *protocol.AttachRequest) (*protocol.AttachResponse, error) {
+	if err := fs.inUse(r.Fid); err != nil {
+		return nil, err
+	}
+
+	var afid *Fid[T]
+	if r.AuthFid != protocol.NOFID {
+		var err error
+		if afid, err = fs.get(r.AuthFid); err != nil {
+			return nil, err
+		}
+		defer fs.put(afid)
+		afid.lock.RLock()
+		defer afid.lock.RUnlock()
+
+		if !afid.Auth {
+			return nil, ErrAuthFid
+		}
+	}
+
+	fid := &Fid[T]{Num: r.Fid, User: r.Username}
+	res, err := fs.handler.Attach(ctx, fid, afid, r)
+	if err != nil {
+		return nil, err
+	}
+
+	fid.Qid = res.Qid
+	if err := fs.add(fid); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+func (fs *FidServer[T]) Walk(ctx context.Context, r *protocol.WalkRequest) (*protocol.WalkResponse, error) {
+	fid, err := fs.get(r.Fid)
+	if err != nil {
+		return nil, err
+	}
+	defer fs.put(fid)
+	fid.lock.RLock()
+	defer fid.lock.RUnlock()
+
+	if fid.Auth {
+		return nil, ErrAuthFid
+	}
+	if fid.Opened {
+		return nil, ErrFidOpen
+	}
+	if len(r.Names) > protocol.MAXWELEM {
+		return nil, ErrWalkTooLong
+	}
+	if r.NewFid != r.Fid {
+		if err := fs.inUse(r.NewFid); err != nil {
+			return nil, err
+		}
+	}
+
+	newfid := &Fid[T]{Num: r.NewFid, Qid: fid.Qid, User: fid.User}
+	res, err := fs.handler.Walk(ctx, fid, newfid, r)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(res.Qids) != len(r.Names) {
+		return res, nil
+	}
+	if len(res.Qids) > 0 {
+		newfid.Qid = res.Qids[len(res.Qids)-1]
+	}
+
+	if r.NewFid == r.Fid {
+		fs.release(fid)
+	}
+	if err := fs.add(newfid); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+func (fs *FidServer[T]) Open(ctx context.Context, r *protocol.OpenRequest) (*protocol.OpenResponse, error) {
+	fid, err := fs.get(r.Fid)
+	if err != nil {
+		return nil, err
+	}
+	defer fs.put(fid)
+	fid.lock.Lock()
+	defer fid.lock.Unlock()
+
+	if fid.Auth {
+		return nil, ErrAuthFid
+	}
+	if fid.Opened {
+		return nil, ErrFidOpen
+	}
+
+	res, err := fs.handler.Open(ctx, fid, r)
+	if err != nil {
+		return nil, err
+	}
+
+	fid.Qid = res.Qid
+	fid.Opened = true
+	fid.Mode = r.Mode
+	return res, nil
+}
+
+func (fs *FidServer[T]) Create(ctx context.Context, r *protocol.CreateRequest) (*protocol.CreateResponse, error) {
+	fid, err := fs.get(r.Fid)
+	if err != nil {
+		return nil, err
+	}
+	defer fs.put(fid)
+	fid.lock.Lock()
+	defer fid.lock.Unlock()
+
+	if fid.Auth {
+		return nil, ErrAuthFid
+	}
+	if fid.Opened {
+		return nil, ErrFidOpen
+	}
+
+	res, err := fs.handler.Create(ctx, fid, r)
+	if err != nil {
+		return nil, err
+	}
+
+	fid.Qid = res.Qid
+	fid.Opened = true
+	fid.Mode = r.Mode
+	return res, nil
+}
+
+func (fs *FidServer[T]) Read(ctx context.Context, r *protocol.ReadRequest) (*protocol.ReadResponse, error) {
+	fid, err := fs.get(r.Fid)
+	if err != nil {
+		return nil, err
+	}
+	defer fs.put(fid)
+	fid.lock.RLock()
+	defer fid.lock.RUnlock()
+
+	if !fid.Auth {
+		if !fid.Opened {
+			return nil, ErrFidNotOpen
+		}
+		if mode := fid.Mode & 3; mode != protocol.OREAD && mode != protocol.ORDWR && mode != protocol.OEXEC {
+			return nil, ErrFidMode
+		}
+	}
+
+	return fs.handler.Read(ctx, fid, r)
+}
+
+func (fs *FidServer[T]) Write(ctx context.Context, r *protocol.WriteRequest) (*protocol.WriteResponse, error) {
+	fid, err := fs.get(r.Fid)
+	if err != nil {
+		return nil, err
+	}
+	defer fs.put(fid)
+	fid.lock.RLock()
+	defer fid.lock.RUnlock()
+
+	if !fid.Auth {
+		if !fid.Opened {
+			return nil, ErrFidNotOpen
+		}
+		if mode := fid.Mode & 3; mode != protocol.OWRITE && mode != protocol.ORDWR {
+			return nil, ErrFidMode
+		}
+	}
+
+	return fs.handler.Write(ctx, fid, r)
+}
+
+func (fs *FidServer[T]) Clunk(_ context.Context, r *protocol.ClunkRequest) (*protocol.ClunkResponse, error) {
+	fid, err := fs.get(r.Fid)
+	if err != nil {
+		return nil, err
+	}
+	fs.release(fid)
+	fs.put(fid)
+
+	return &protocol.ClunkResponse{}, nil
+}
+
+func (fs *FidServer[T]) Remove(ctx context.Context, r *protocol.RemoveRequest) (*protocol.RemoveResponse, error) {
+	fid, err := fs.get(r.Fid)
+	if err != nil {
+		return nil, err
+	}
+	defer fs.put(fid)
+	fid.lock.RLock()
+	defer fid.lock.RUnlock()
+
+	fs.release(fid)
+	if err := fs.handler.Remove(ctx, fid, r); err != nil {
+		return nil, err
+	}
+	return &protocol.RemoveResponse{}, nil
+}
+
+func (fs *FidServer[T]) Stat(ctx context.Context, r *protocol.StatRequest) (*protocol.StatResponse, error) {
+	fid, err := fs.get(r.Fid)
+	if err != nil {
+		return nil, err
+	}
+	defer fs.put(fid)
+	fid.lock.RLock()
+	defer fid.lock.RUnlock()
+
+	return fs.handler.Stat(ctx, fid, r)
+}
+
+func (fs *FidServer[T]) WriteStat(ctx context.Context, r *protocol.WriteStatRequest) (*protocol.WriteStatResponse, error) {
+	fid, err := fs.get(r.Fid)
+	if err != nil {
+		return nil, err
+	}
+	defer fs.put(fid)
+	fid.lock.RLock()
+	defer fid.lock.RUnlock()
+
+	return fs.handler.WriteStat(ctx, fid, r)
+}
@@ -0,0 +1,213 @@
+package g9p
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/kennylevinsen/g9p/protocol"
+)
+
+// Test if the FidServer lives up to the ContextHandler interface.
+var _ ContextHandler = (*FidServer[int])(nil)
+
+// countingHandler is a FidHandler that accepts everything, and counts clunks.
+// Create sets the Value of the fid to 1, which Stat returns as the length.
+type countingHandler struct {
+	clunks int
+}
+
+func (*countingHandler) Auth(context.Context, *Fid[int], *protocol.AuthRequest) (*protocol.AuthResponse, error) {
+	return &protocol.AuthResponse{AuthQid: protocol.Qid{Type: protocol.QTAUTH}}, nil
+}
+
+func (*countingHandler) Attach(context.Context, *Fid[int], *Fid[int], *protocol.AttachRequest) (*protocol.AttachResponse, error) {
+	return &protocol.AttachResponse{Qid: protocol.Qid{Type: protocol.QTDIR}}, nil
+}
+
+func (*countingHandler) Walk(_ context.Context, _, _ *Fid[int], r *protocol.WalkRequest) (*protocol.WalkResponse, error) {
+	return &protocol.WalkResponse{Qids: make([]protocol.Qid, len(r.Names))}, nil
+}
+
+func (*countingHandler) Open(context.Context, *Fid[int], *protocol.OpenRequest) (*protocol.OpenResponse, error) {
+	return &protocol.OpenResponse{}, nil
+}
+
+func (*countingHandler) Create(_ context.Context, fid *Fid[int], _ *protocol.CreateRequest) (*protocol.CreateResponse, error) {
+	fid.Value = 1
+	return &protocol.CreateResponse{}, nil
+}
+
+func (*countingHandler) Read(context.Context, *Fid[int], *protocol.ReadRequest) (*protocol.ReadResponse, error) {
+	return &protocol.ReadResponse{}, nil
+}
+
+func (*countingHandler) Write(_ context.Context, _ *Fid[int], r *protocol.WriteRequest) (*protocol.WriteResponse, error) {
+	return &protocol.WriteResponse{Count: uint32(len(r.Data))}, nil
+}
+
+func (*countingHandler) Remove(context.Context, *Fid[int], *protocol.RemoveRequest) error {
+	return nil
+}
+
+func (*countingHandler) Stat(_ context.Context, fid *Fid[int], _ *protocol.StatRequest) (*protocol.StatResponse, error) {
+	return &protocol.StatResponse{Stat: protocol.Stat{Length: uint64(fid.Value)}}, nil
+}
+
+func (*countingHandler) WriteStat(context.Context, *Fid[int], *protocol.WriteStatRequest) (*protocol.WriteStatResponse, error) {
+	return &protocol.WriteStatResponse{}, nil
+}
+
+func (h *countingHandler) Clunk(*Fid[int]) {
+	h.clunks++
+}
+
+func TestFidServer(t *testing.T) {
+	h := &countingHandler{}
+	fs := NewFidServer[int](h)
+	ctx := context.Background()
+
+	tests := []struct {
+		name string
+		do   func() error
+		err  error
+	}{
+		{"attach", func() error {
+			_, err := fs.Attach(ctx, &protocol.AttachRequest{Fid: 1, AuthFid: protocol.NOFID})
+			return err
+		}, nil},
+		{"attach in use", func() error {
+			_, err := fs.Attach(ctx, &protocol.AttachRequest{Fid: 1, AuthFid: protocol.NOFID})
+			return err
+		}, ErrFidInUse},
+		{"attach with non-auth afid", func() error {
+			_, err := fs.Attach(ctx, &protocol.AttachRequest{Fid: 2, AuthFid: 1})
+			return err
+		}, ErrAuthFid},
+		{"read unopened", func() error {
+			_, err := fs.Read(ctx, &protocol.ReadRequest{Fid: 1})
+			return err
+		}, ErrFidNotOpen},
+		{"walk unknown", func() error {
+			_, err := fs.Walk(ctx, &protocol.WalkRequest{Fid: 3, NewFid: 4})
+			return err
+		}, ErrUnknownFid},
+		{"walk clone", func() error {
+			_, err := fs.Walk(ctx, &protocol.WalkRequest{Fid: 1, NewFid: 2})
+			return err
+		}, nil},
+		{"walk to used fid", func() error {
+			_, err := fs.Walk(ctx, &protocol.WalkRequest{Fid: 1, NewFid: 2, Names: []string{"a"}})
+			return err
+		}, ErrFidInUse},
+		{"walk too long", func() error {
+			_, err := fs.Walk(ctx, &protocol.WalkRequest{Fid: 1, NewFid: 3, Names: make([]string, protocol.MAXWELEM+1)})
+			return err
+		}, ErrWalkTooLong},
+		{"open", func() error {
+			_, err := fs.Open(ctx, &protocol.OpenRequest{Fid: 2, Mode: protocol.OWRITE})
+			return err
+		}, nil},
+		{"open twice", func() error {
+			_, err := fs.Open(ctx, &protocol.OpenRequest{Fid: 2, Mode: protocol.OREAD})
+			return err
+		}, ErrFidOpen},
+		{"walk opened", func() error {
+			_, err := fs.Walk(ctx, &protocol.WalkRequest{Fid: 2, NewFid: 3})
+			return err
+		}, ErrFidOpen},
+		{"read write-only", func() error {
+			_, err := fs.Read(ctx, &protocol.ReadRequest{Fid: 2})
+			return err
+		}, ErrFidMode},
+		{"write", func() error {
+			_, err := fs.Write(ctx, &protocol.WriteRequest{Fid: 2, Data: []byte("x")})
+			return err
+		}, nil},
+		{"remove", func() error {
+			_, err := fs.Remove(ctx, &protocol.RemoveRequest{Fid: 2})
+			return err
+		}, nil},
+		{"stat removed", func() error {
+			_, err := fs.Stat(ctx, &protocol.StatRequest{Fid: 2})
+			return err
+		}, ErrUnknownFid},
+		{"walk in place", func() error {
+			_, err := fs.Walk(ctx, &protocol.WalkRequest{Fid: 1, NewFid: 1, Names: []string{"a"}})
+			return err
+		}, nil},
+	}
+
+	for _, tt := range tests {
+		if err := tt.do(); err != tt.err {
+			t.Fatalf("%s: got error %v, expected %v", tt.name, err, tt.err)
+		}
+	}
+
+	// Fid 2 was removed, and fid 1 was replaced by a walk.
+	if h.clunks != 2 {
+		t.Fatalf("got %d clunks, expected 2", h.clunks)
+	}
+
+	fs.Close()
+	if h.clunks != 3 {
+		t.Fatalf("got %d clunks after close, expected 3", h.clunks)
+	}
+}
+
+func TestFidServerConcurrentOpen(t *testing.T) {
+	fs := NewFidServer[int](&countingHandler{})
+	ctx := context.Background()
+	if _, err := fs.Attach(ctx, &protocol.AttachRequest{Fid: 1, AuthFid: protocol.NOFID}); err != nil {
+		t.Fatalf("attach failed: %v", err)
+	}
+
+	// Reads racing with the open either see the fid unopened or opened.
+	errs := make(chan error, 1)
+	go func() {
+		defer close(errs)
+		for i := 0; i < 1000; i++ {
+			if _, err := fs.Read(ctx, &protocol.ReadRequest{Fid: 1}); err != nil && err != ErrFidNotOpen {
+				errs <- err
+				return
+			}
+		}
+	}()
+	if _, err := fs.Open(ctx, &protocol.OpenRequest{Fid: 1, Mode: protocol.OREAD}); err != nil {
+		t.Fatalf("open failed: %v", err)
+	}
+	if err := <-errs; err != nil {
+		t.Fatalf("read returned %v", err)
+	}
+}
+
+func TestFidServerConcurrentCreate(t *testing.T) {
+	fs := NewFidServer[int](&countingHandler{})
+	ctx := context.Background()
+	if _, err := fs.Attach(ctx, &protocol.AttachRequest{Fid: 1, AuthFid: protocol.NOFID}); err != nil {
+		t.Fatalf("attach failed: %v", err)
+	}
+
+	// Stats racing with the create see the value from before or after it.
+	errs := make(chan error, 1)
+	go func() {
+		defer close(errs)
+		for i := 0; i < 1000; i++ {
+			res, err := fs.Stat(ctx, &protocol.StatRequest{Fid: 1})
+			if err != nil {
+				errs <- err
+				return
+			}
+			if res.Stat.Length > 1 {
+				errs <- fmt.Errorf("stat saw value %d", res.Stat.Length)
+				return
+			}
+		}
+	}()
+	if _, err := fs.Create(ctx, &protocol.CreateRequest{Fid: 1, Name: "file", Mode: protocol.OREAD}); err != nil {
+		t.Fatalf("create failed: %v", err)
+	}
+	if err := <-errs; err != nil {
+		t.Fatalf("stat returned %v", err)
+	}
+}
@@ -0,0 +1,450 @@
+// Package g9ptest implements a conformance test suite for 9P2000 handlers.
+package g9ptest
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/kennylevinsen/g9p"
+	"github.com/kennylevinsen/g9p/protocol"
+)
+
+// User is the user name the test suite attaches as.
+const User = "g9ptest"
+
+// TestHandler checks a handler against the 9P2000 semantics described in
+// http://man.cat-v.org/plan_9/5/, serving it with a g9p.Server. Every test
+// runs as a subtest on a new connection, served by a new handler returned by
+// newHandler. Plain Handlers may be tested using g9p.AdaptHandler.
+//
+// Attaching to the handler, with any aname, must give a writable directory in
+// which User may create files and directories. The directory need not be
+// empty, as the tests only touch the files they create, whose names start with
+// "g9ptest". Every spec violation is reported as a test error, along with the
+// manual page describing the violated rule.
+func TestHandler(t *testing.T, newHandler func() g9p.ContextHandler) {
+	tests := []struct {
+		name string
+		test func(*conn)
+	}{
+		{"Version", testVersion},
+		{"Walk", testWalk},
+		{"DirRead", testDirRead},
+		{"ORCLOSE", testORCLOSE},
+		{"WriteStat", testWriteStat},
+		{"ClunkAfterError", testClunkAfterError},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.test(connect(t, newHandler()))
+		})
+	}
+}
+
+// conn is a connection to a handler under test.
+type conn struct {
+	*testing.T
+	c *g9p.Client
+
+	// nextFid is the next fid returned by fid.
+	nextFid protocol.Fid
+}
+
+// connect serves a handler over a pipe, and negotiates the version.
+func connect(t *testing.T, h g9p.ContextHandler) *conn {
+	a, b := net.Pipe()
+	go g9p.ServeContext(a, h)
+	c := g9p.NewClient(b)
+	go c.Start()
+	t.Cleanup(c.Stop)
+
+	if _, err := c.Version(&protocol.VersionRequest{Tag: protocol.NOTAG, MaxSize: 8192, Version: protocol.Version9P2000}); err != nil {
+		t.Fatalf("version: %v", err)
+	}
+	return &conn{T: t, c: c, nextFid: 1}
+}
+
+// violation reports a spec violation, referring to the manual page of the
+// violated rule.
+func (c *conn) violation(page, format string, args ...interface{}) {
+	c.Helper()
+	c.Errorf("%s (see http://man.cat-v.org/plan_9/5/%s)", fmt.Sprintf(format, args...), page)
+}
+
+// fid returns an unused fid.
+func (c *conn) fid() protocol.Fid {
+	f := c.nextFid
+	c.nextFid++
+	return f
+}
+
+// attach attaches a new fid.
+func (c *conn) attach() protocol.Fid {
+	c.Helper()
+	fid := c.fid()
+	res, err := c.c.Attach(&protocol.AttachRequest{Fid: fid, AuthFid: protocol.NOFID, Username: User})
+	if err != nil {
+		c.Fatalf("attach: %v", err)
+	}
+	if res.Qid.Type&protocol.QTDIR == 0 {
+		c.violation("attach", "attach returned qid %v, which is not a directory", res.Qid)
+	}
+	return fid
+}
+
+// walk walks from fid to a new fid, failing the test if the walk fails.
+func (c *conn) walk(fid protocol.Fid, names ...string) protocol.Fid {
+	c.Helper()
+	newfid := c.fid()
+	res, err := c.c.Walk(&protocol.WalkRequest{Fid: fid, NewFid: newfid, Names: names})
+	if err != nil {
+		c.Fatalf("walk to %q: %v", names, err)
+	}
+	if len(res.Qids) != len(names) {
+		c.Fatalf("walk to %q: only %d of %d names walked", names, len(res.Qids), len(names))
+	}
+	return newfid
+}
+
+// create creates a file in the directory dir, returning the opened fid of
+// the file.
+func (c *conn) create(dir protocol.Fid, name string, perm protocol.FileMode, mode protocol.OpenMode) protocol.Fid {
+	c.Helper()
+	fid := c.walk(dir)
+	res, err := c.c.Create(&protocol.CreateRequest{Fid: fid, Name: name, Permissions: perm, Mode: mode})
+	if err != nil {
+		c.Fatalf("create %s: %v", name, err)
+	}
+	if isDir := res.Qid.Type&protocol.QTDIR != 0; isDir != (perm&protocol.DMDIR != 0) {
+		c.violation("open", "create of %s with permissions %v returned qid %v", name, perm, res.Qid)
+	}
+	return fid
+}
+
+// mkdir creates a directory in dir, returning an unopened fid for it.
+func (c *conn) mkdir(dir protocol.Fid, name string) protocol.Fid {
+	c.Helper()
+	c.clunk(c.create(dir, name, protocol.DMDIR|0777, protocol.OREAD))
+	return c.walk(dir, name)
+}
+
+// stat returns the stat of a fid.
+func (c *conn) stat(fid protocol.Fid) protocol.Stat {
+	c.Helper()
+	res, err := c.c.Stat(&protocol.StatRequest{Fid: fid})
+	if err != nil {
+		c.Fatalf("stat: %v", err)
+	}
+	return res.Stat
+}
+
+// clunk clunks a fid.
+func (c *conn) clunk(fid protocol.Fid) {
+	c.Helper()
+	if _, err := c.c.Clunk(&protocol.ClunkRequest{Fid: fid}); err != nil {
+		c.violation("clunk", "clunk of fid %d failed: %v", fid, err)
+	}
+}
+
+// exists returns whether a fid is known to the handler.
+func (c *conn) exists(fid protocol.Fid) bool {
+	_, err := c.c.Stat(&protocol.StatRequest{Fid: fid})
+	return err == nil
+}
+
+func testVersion(c *conn) {
+	for _, tt := range []struct {
+		version, want string
+	}{
+		{"9P2000", "9P2000"},
+		{"9P2000.g9ptest", "9P2000"},
+		{"g9ptest", "unknown"},
+	} {
+		res, err := c.c.Version(&protocol.VersionRequest{Tag: protocol.NOTAG, MaxSize: 8192, Version: tt.version})
+		if err != nil {
+			c.violation("version", "version %q failed: %v", tt.version, err)
+			continue
+		}
+		if res.Version != tt.want {
+			c.violation("version", "version %q negotiated %q, expected %q", tt.version, res.Version, tt.want)
+		}
+		if res.MaxSize > 8192 {
+			c.violation("version", "negotiated msize %d exceeds the requested 8192", res.MaxSize)
+		}
+	}
+
+	// A new version aborts all outstanding I/O and clunks all fids.
+	if _, err := c.c.Version(&protocol.VersionRequest{Tag: protocol.NOTAG, MaxSize: 8192, Version: protocol.Version9P2000}); err != nil {
+		c.Fatalf("version: %v", err)
+	}
+	fid := c.attach()
+	if _, err := c.c.Version(&protocol.VersionRequest{Tag: protocol.NOTAG, MaxSize: 8192, Version: protocol.Version9P2000}); err != nil {
+		c.Fatalf("version: %v", err)
+	}
+	if c.exists(fid) {
+		c.violation("version", "fid %d still exists after version", fid)
+	}
+}
+
+func testWalk(c *conn) {
+	root := c.attach()
+	rootQid := c.stat(root).Qid
+	dir := c.mkdir(root, "g9ptest.walk")
+	c.clunk(c.create(dir, "file", 0666, protocol.OREAD))
+
+	// An empty walk clones the fid.
+	clone := c.fid()
+	res, err := c.c.Walk(&protocol.WalkRequest{Fid: root, NewFid: clone})
+	switch {
+	case err != nil:
+		c.violation("walk", "empty walk failed: %v", err)
+	case len(res.Qids) != 0:
+		c.violation("walk", "empty walk returned %d qids", len(res.Qids))
+	case !c.exists(clone):
+		c.violation("walk", "empty walk did not create newfid")
+	case c.stat(clone).Qid.Path != rootQid.Path:
+		c.violation("walk", "empty walk created newfid for another file")
+	}
+
+	// A walk failing at the first name fails, and a walk failing later
+	// returns the qids walked so far. Neither creates newfid.
+	newfid := c.fid()
+	if _, err := c.c.Walk(&protocol.WalkRequest{Fid: root, NewFid: newfid, Names: []string{"g9ptest.missing"}}); err == nil {
+		c.violation("walk", "walk to missing file succeeded")
+	}
+	if c.exists(newfid) {
+		c.violation("walk", "failed walk created newfid")
+	}
+	res, err = c.c.Walk(&protocol.WalkRequest{Fid: root, NewFid: newfid, Names: []string{"g9ptest.walk", "missing"}})
+	switch {
+	case err != nil:
+		c.violation("walk", "partial walk failed instead of returning the qids walked: %v", err)
+	case len(res.Qids) != 1:
+		c.violation("walk", "partial walk returned %d qids, expected 1", len(res.Qids))
+	case c.exists(newfid):
+		c.violation("walk", "partial walk created newfid")
+	}
+	res, err = c.c.Walk(&protocol.WalkRequest{Fid: root, NewFid: newfid, Names: []string{"g9ptest.walk", "file", "beyond"}})
+	if err != nil || len(res.Qids) != 2 {
+		c.violation("walk", "walk beyond a file returned %v, %v, expected 2 qids", res, err)
+	}
+
+	// Walks have at most MAXWELEM names, and .. of the root is the root.
+	names := make([]string, protocol.MAXWELEM)
+	for i := range names {
+		names[i] = ".."
+	}
+	res, err = c.c.Walk(&protocol.WalkRequest{Fid: root, NewFid: newfid, Names: names})
+	if err != nil || len(res.Qids) != len(names) {
+		c.violation("walk", "walk of %d names returned %v, %v", len(names), res, err)
+	} else {
+		if res.Qids[len(names)-1].Path != rootQid.Path {
+			c.violation("walk", "walk to .. of the root did not stay at the root")
+		}
+		c.clunk(newfid)
+	}
+	if _, err := c.c.Walk(&protocol.WalkRequest{Fid: root, NewFid: newfid, Names: append(names, "..")}); err == nil {
+		c.violation("walk", "walk of %d names succeeded, but at most %d are allowed", len(names)+1, protocol.MAXWELEM)
+	}
+
+	// A walk may replace its fid.
+	same := c.walk(root)
+	res, err = c.c.Walk(&protocol.WalkRequest{Fid: same, NewFid: same, Names: []string{"g9ptest.walk"}})
+	if err != nil || len(res.Qids) != 1 {
+		c.violation("walk", "walk with newfid equal to fid returned %v, %v", res, err)
+	} else if s := c.stat(same); s.Name != "g9ptest.walk" {
+		c.violation("walk", "walk with newfid equal to fid did not move fid, which refers to %q", s.Name)
+	}
+
+	// Opened fids may not be walked, and newfid must not be in use.
+	opened := c.walk(root)
+	if _, err := c.c.Open(&protocol.OpenRequest{Fid: opened, Mode: protocol.OREAD}); err != nil {
+		c.Fatalf("open: %v", err)
+	}
+	if _, err := c.c.Walk(&protocol.WalkRequest{Fid: opened, NewFid: c.fid()}); err == nil {
+		c.violation("walk", "walk from an opened fid succeeded")
+	}
+	if _, err := c.c.Walk(&protocol.WalkRequest{Fid: root, NewFid: opened}); err == nil {
+		c.violation("walk", "walk to a newfid in use succeeded")
+	}
+}
+
+// readDir reads the entries of a directory with reads of the given count,
+// starting at offset 0 and continuing where each read ended.
+func (c *conn) readDir(fid protocol.Fid, count uint32) []string {
+	c.Helper()
+	var names []string
+	var offset uint64
+	for {
+		res, err := c.c.Read(&protocol.ReadRequest{Fid: fid, Offset: offset, Count: count})
+		if err != nil {
+			c.violation("read", "directory read at offset %d failed: %v", offset, err)
+			return names
+		}
+		if len(res.Data) == 0 {
+			return names
+		}
+		if uint32(len(res.Data)) > count {
+			c.violation("read", "directory read returned %d bytes, more than the %d requested", len(res.Data), count)
+		}
+
+		for b := res.Data; len(b) > 0; {
+			var s protocol.Stat
+			if len(b) < 2 || 2+int(binary.LittleEndian.Uint16(b)) > len(b) || s.Unmarshal(b) != nil {
+				c.violation("read", "directory read returned a partial or malformed entry")
+				return names
+			}
+			names = append(names, s.Name)
+			b = b[2+binary.LittleEndian.Uint16(b):]
+		}
+		offset += uint64(len(res.Data))
+	}
+}
+
+func testDirRead(c *conn) {
+	root := c.attach()
+	dir := c.mkdir(root, "g9ptest.dirread")
+	want := []string{"a", "b", "c", strings.Repeat("d", 100)}
+	for _, name := range want {
+		c.clunk(c.create(dir, name, 0666, protocol.OREAD))
+	}
+
+	if _, err := c.c.Open(&protocol.OpenRequest{Fid: dir, Mode: protocol.OREAD}); err != nil {
+		c.Fatalf("open: %v", err)
+	}
+
+	// Reads return whole entries, whether the count fits all entries or
+	// just one.
+	for _, count := range []uint32{4096, 200} {
+		got := c.readDir(dir, count)
+		sort.Strings(got)
+		if strings.Join(got, "/") != strings.Join(want, "/") {
+			c.violation("read", "directory reads of %d bytes returned %q, expected %q", count, got, want)
+		}
+	}
+
+	// Reads must continue where the previous read ended, or start over at 0.
+	res, err := c.c.Read(&protocol.ReadRequest{Fid: dir, Count: 100})
+	if err != nil || len(res.Data) == 0 {
+		c.Fatalf("directory read: %v, %v", res, err)
+	}
+	if _, err := c.c.Read(&protocol.ReadRequest{Fid: dir, Offset: uint64(len(res.Data)) + 1, Count: 100}); err == nil {
+		c.violation("read", "directory read at an offset other than 0 or the end of the previous read succeeded")
+	}
+
+	// A count too small for an entry must not return a partial entry.
+	if res, err := c.c.Read(&protocol.ReadRequest{Fid: dir, Count: 10}); err == nil && len(res.Data) > 0 {
+		c.violation("read", "directory read of 10 bytes returned a partial entry")
+	}
+}
+
+func testORCLOSE(c *conn) {
+	root := c.attach()
+
+	// Files created or opened with ORCLOSE are removed when clunked.
+	c.clunk(c.create(root, "g9ptest.orclose", 0666, protocol.OWRITE|protocol.ORCLOSE))
+	if _, err := c.c.Walk(&protocol.WalkRequest{Fid: root, NewFid: c.fid(), Names: []string{"g9ptest.orclose"}}); err == nil {
+		c.violation("open", "file created with ORCLOSE still exists after clunk")
+	}
+
+	c.clunk(c.create(root, "g9ptest.orclose", 0666, protocol.OWRITE))
+	fid := c.walk(root, "g9ptest.orclose")
+	if _, err := c.c.Open(&protocol.OpenRequest{Fid: fid, Mode: protocol.OREAD | protocol.ORCLOSE}); err != nil {
+		c.Fatalf("open: %v", err)
+	}
+	c.clunk(fid)
+	if _, err := c.c.Walk(&protocol.WalkRequest{Fid: root, NewFid: c.fid(), Names: []string{"g9ptest.orclose"}}); err == nil {
+		c.violation("open", "file opened with ORCLOSE still exists after clunk")
+	}
+}
+
+func testWriteStat(c *conn) {
+	root := c.attach()
+	fid := c.create(root, "g9ptest.wstat", 0644, protocol.OWRITE)
+	if _, err := c.c.Write(&protocol.WriteRequest{Fid: fid, Data: []byte("hello, world")}); err != nil {
+		c.Fatalf("write: %v", err)
+	}
+	before := c.stat(fid)
+
+	// A stat of only don't-touch values changes nothing.
+	if _, err := c.c.WriteStat(&protocol.WriteStatRequest{Fid: fid, Stat: protocol.DontTouch()}); err != nil {
+		c.violation("stat", "wstat of only don't-touch values failed: %v", err)
+	}
+	after := c.stat(fid)
+	if after.Name != before.Name || after.Length != before.Length || after.Mode != before.Mode || after.Qid.Path != before.Qid.Path {
+		c.violation("stat", "wstat of only don't-touch values changed the stat from %v to %v", before, after)
+	}
+
+	// Either all changes are made, or none.
+	s := protocol.DontTouch()
+	s.Name = "g9ptest.wstat2"
+	s.Length = 5
+	s.Mode = protocol.DMDIR | 0644
+	if _, err := c.c.WriteStat(&protocol.WriteStatRequest{Fid: fid, Stat: s}); err == nil {
+		c.violation("stat", "wstat changing the DMDIR bit succeeded")
+	}
+	after = c.stat(fid)
+	if after.Name != before.Name || after.Length != before.Length || after.Mode != before.Mode {
+		c.violation("stat", "failed wstat changed the stat from %v to %v", before, after)
+	}
+
+	// This also holds for a rename onto an existing file, which a handler
+	// may only notice once it tries to apply the rename.
+	c.clunk(c.create(root, "g9ptest.wstat.taken", 0644, protocol.OREAD))
+	taken := protocol.DontTouch()
+	taken.Name = "g9ptest.wstat.taken"
+	taken.Length = 5
+	if _, err := c.c.WriteStat(&protocol.WriteStatRequest{Fid: fid, Stat: taken}); err == nil {
+		c.violation("stat", "wstat renaming onto an existing file succeeded")
+	}
+	after = c.stat(fid)
+	if after.Name != before.Name || after.Length != before.Length {
+		c.violation("stat", "wstat renaming onto an existing file changed the stat from %v to %v", before, after)
+	}
+
+	s.Mode = 0600
+	if _, err := c.c.WriteStat(&protocol.WriteStatRequest{Fid: fid, Stat: s}); err != nil {
+		c.violation("stat", "wstat changing name, length and mode failed: %v", err)
+		return
+	}
+	after = c.stat(fid)
+	if after.Name != s.Name || after.Length != s.Length || after.Mode&0777 != s.Mode {
+		c.violation("stat", "wstat changing name, length and mode changed the stat to %v", after)
+	}
+}
+
+func testClunkAfterError(c *conn) {
+	root := c.attach()
+	dir := c.mkdir(root, "g9ptest.clunk")
+	c.clunk(c.create(dir, "file", 0666, protocol.OREAD))
+
+	// A fid remains valid after a failed open, and may be clunked.
+	fid := c.walk(root, "g9ptest.clunk")
+	if _, err := c.c.Open(&protocol.OpenRequest{Fid: fid, Mode: protocol.OWRITE}); err == nil {
+		c.violation("open", "open of directory for writing succeeded")
+	}
+	if !c.exists(fid) {
+		c.violation("open", "fid does not exist after failed open")
+	}
+	c.clunk(fid)
+
+	// A fid is clunked even if remove fails.
+	fid = c.walk(root, "g9ptest.clunk")
+	if _, err := c.c.Remove(&protocol.RemoveRequest{Fid: fid}); err == nil {
+		c.violation("remove", "remove of non-empty directory succeeded")
+	}
+	if c.exists(fid) {
+		c.violation("remove", "fid still exists after failed remove")
+	}
+
+	// Clunked fids are gone.
+	fid = c.walk(root)
+	c.clunk(fid)
+	if _, err := c.c.Clunk(&protocol.ClunkRequest{Fid: fid}); err == nil {
+		c.violation("clunk", "second clunk of fid succeeded")
+	}
+}
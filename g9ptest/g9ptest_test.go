@@ -0,0 +1,25 @@
+package g9ptest
+
+import (
+	"testing"
+
+	"github.com/kennylevinsen/g9p"
+	"github.com/kennylevinsen/g9p/localfs"
+	"github.com/kennylevinsen/g9p/ramfs"
+)
+
+func TestRamFS(t *testing.T) {
+	TestHandler(t, func() g9p.ContextHandler {
+		return ramfs.New(User).Handler()
+	})
+}
+
+func TestLocalFS(t *testing.T) {
+	TestHandler(t, func() g9p.ContextHandler {
+		fsys, err := localfs.New(t.TempDir())
+		if err != nil {
+			t.Fatal(err)
+		}
+		return fsys.Handler()
+	})
+}
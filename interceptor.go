@@ -0,0 +1,186 @@
+package g9p
+
+import (
+	"context"
+	"io"
+	"log"
+	"runtime/debug"
+	"time"
+
+	"github.com/kennylevinsen/g9p/protocol"
+)
+
+// Next handles a request, returning the response.
+type Next func(ctx context.Context, r protocol.Message) (protocol.Message, error)
+
+// Interceptor intercepts a request before it reaches a handler. It may inspect
+// or modify the request, pass it on by calling next, inspect or modify the
+// response, or respond without calling next at all. The response must be of
+// the type matching the request, or nil if an error is returned.
+type Interceptor func(ctx context.Context, r protocol.Message, next Next) (protocol.Message, error)
+
+// Chain returns a ContextHandler passing every request through the
+// interceptors before calling h. The first interceptor is the outermost, and
+// is the first to see a request. Only 9P2000 requests are intercepted, and the
+// returned handler implements neither LinuxHandler nor LinuxContextHandler. If
+// h implements io.Closer, closing the returned handler closes h. To intercept
+// a Handler, use AdaptHandler.
+func Chain(h ContextHandler, interceptors ...Interceptor) ContextHandler {
+	next := func(ctx context.Context, r protocol.Message) (protocol.Message, error) {
+		return call(ctx, h, r)
+	}
+	for i := len(interceptors) - 1; i >= 0; i-- {
+		ic, inner := interceptors[i], next
+		next = func(ctx context.Context, r protocol.Message) (protocol.Message, error) {
+			return ic(ctx, r, inner)
+		}
+	}
+	return chain{h: h, next: next}
+}
+
+// call calls the ContextHandler method matching a request.
+func call(ctx context.Context, h ContextHandler, m protocol.Message) (protocol.Message, error) {
+	switch r := m.(type) {
+	case *protocol.VersionRequest:
+		return h.Version(ctx, r)
+	case *protocol.AuthRequest:
+		return h.Auth(ctx, r)
+	case *protocol.AttachRequest:
+		return h.Attach(ctx, r)
+	case *protocol.WalkRequest:
+		return h.Walk(ctx, r)
+	case *protocol.OpenRequest:
+		return h.Open(ctx, r)
+	case *protocol.CreateRequest:
+		return h.Create(ctx, r)
+	case *protocol.ReadRequest:
+		return h.Read(ctx, r)
+	case *protocol.WriteRequest:
+		return h.Write(ctx, r)
+	case *protocol.ClunkRequest:
+		return h.Clunk(ctx, r)
+	case *protocol.RemoveRequest:
+		return h.Remove(ctx, r)
+	case *protocol.StatRequest:
+		return h.Stat(ctx, r)
+	case *protocol.WriteStatRequest:
+		return h.WriteStat(ctx, r)
+	default:
+		return nil, errNotSupported
+	}
+}
+
+// intercept passes a request through the chain, and checks the type of the
+// response.
+func intercept[T protocol.Message](ctx context.Context, next Next, r protocol.Message) (T, error) {
+	var zero T
+	res, err := next(ctx, r)
+	if err != nil {
+		return zero, err
+	}
+	t, ok := res.(T)
+	if !ok {
+		return zero, ErrInvalidResponse
+	}
+	return t, nil
+}
+
+// chain is a ContextHandler passing requests through a chain of interceptors
+// to h.
+type chain struct {
+	h    ContextHandler
+	next Next
+}
+
+// Close closes the wrapped handler if it implements io.Closer.
+func (c chain) Close() error {
+	if cl, ok := c.h.(io.Closer); ok {
+		return cl.Close()
+	}
+	return nil
+}
+
+func (c chain) Version(ctx context.Context, r *protocol.VersionRequest) (*protocol.VersionResponse, error) {
+	return intercept[*protocol.VersionResponse](ctx, c.next, r)
+}
+
+func (c chain) Auth(ctx context.Context, r *protocol.AuthRequest) (*protocol.AuthResponse, error) {
+	return intercept[*protocol.AuthResponse](ctx, c.next, r)
+}
+
+func (c chain) Attach(ctx context.Context, r *protocol.AttachRequest) (*protocol.AttachResponse, error) {
+	return intercept[*protocol.AttachResponse](ctx, c.next, r)
+}
+
+func (c chain) Walk(ctx context.Context, r *protocol.WalkRequest) (*protocol.WalkResponse, error) {
+	return intercept[*protocol.WalkResponse](ctx, c.next, r)
+}
+
+func (c chain) Open(ctx context.Context, r *protocol.OpenRequest) (*protocol.OpenResponse, error) {
+	return intercept[*protocol.OpenResponse](ctx, c.next, r)
+}
+
+func (c chain) Create(ctx context.Context, r *protocol.CreateRequest) (*protocol.CreateResponse, error) {
+	return intercept[*protocol.CreateResponse](ctx, c.next, r)
+}
+
+func (c chain) Read(ctx context.Context, r *protocol.ReadRequest) (*protocol.ReadResponse, error) {
+	return intercept[*protocol.ReadResponse](ctx, c.next, r)
+}
+
+func (c chain) Write(ctx context.Context, r *protocol.WriteRequest) (*protocol.WriteResponse, error) {
+	return intercept[*protocol.WriteResponse](ctx, c.next, r)
+}
+
+func (c chain) Clunk(ctx context.Context, r *protocol.ClunkRequest) (*protocol.ClunkResponse, error) {
+	return intercept[*protocol.ClunkResponse](ctx, c.next, r)
+}
+
+func (c chain) Remove(ctx context.Context, r *protocol.RemoveRequest) (*protocol.RemoveResponse, error) {
+	return intercept[*protocol.RemoveResponse](ctx, c.next, r)
+}
+
+func (c chain) Stat(ctx context.Context, r *protocol.StatRequest) (*protocol.StatResponse, error) {
+	return intercept[*protocol.StatResponse](ctx, c.next, r)
+}
+
+func (c chain) WriteStat(ctx context.Context, r *protocol.WriteStatRequest) (*protocol.WriteStatResponse, error) {
+	return intercept[*protocol.WriteStatResponse](ctx, c.next, r)
+}
+
+// Logging returns an Interceptor logging every request along with its response
+// or error and the time it took. If l is nil, the log package's standard
+// logger is used.
+func Logging(l *log.Logger) Interceptor {
+	return func(ctx context.Context, r protocol.Message, next Next) (protocol.Message, error) {
+		start := time.Now()
+		res, err := next(ctx, r)
+		if err != nil {
+			logf(l, "g9p: %v -> error: %v (%v)", r, err, time.Since(start))
+		} else {
+			logf(l, "g9p: %v -> %v (%v)", r, res, time.Since(start))
+		}
+		return res, err
+	}
+}
+
+var errInternal = &Error{Err: "internal server error", Errno: errnoEIO}
+
+// Recovery returns an Interceptor recovering from panics in the rest of the
+// chain. The panic and its stack trace are logged, and the request fails with
+// an error. If l is nil, the log package's standard logger is used.
+//
+// Server recovers from panics in its handler in the same way, so Recovery is
+// only needed to recover within a chain, for instance to have a Logging
+// interceptor earlier in the chain log the failed request.
+func Recovery(l *log.Logger) Interceptor {
+	return func(ctx context.Context, r protocol.Message, next Next) (res protocol.Message, err error) {
+		defer func() {
+			if p := recover(); p != nil {
+				logf(l, "g9p: panic handling %v: %v\n%s", r, p, debug.Stack())
+				res, err = nil, errInternal
+			}
+		}()
+		return next(ctx, r)
+	}
+}
@@ -0,0 +1,92 @@
+package g9p
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"log"
+	"strings"
+	"testing"
+
+	"github.com/kennylevinsen/g9p/protocol"
+)
+
+// panicHandler is a statHandler that panics on Read.
+type panicHandler struct {
+	statHandler
+}
+
+func (panicHandler) Read(context.Context, *protocol.ReadRequest) (*protocol.ReadResponse, error) {
+	panic("read")
+}
+
+// closeHandler is a statHandler that records being closed.
+type closeHandler struct {
+	statHandler
+	closed *bool
+}
+
+func (h closeHandler) Close() error {
+	*h.closed = true
+	return nil
+}
+
+func TestChain(t *testing.T) {
+	var order []string
+	trace := func(name string) Interceptor {
+		return func(ctx context.Context, r protocol.Message, next Next) (protocol.Message, error) {
+			order = append(order, name)
+			return next(ctx, r)
+		}
+	}
+	rename := func(ctx context.Context, r protocol.Message, next Next) (protocol.Message, error) {
+		res, err := next(ctx, r)
+		if sr, ok := res.(*protocol.StatResponse); ok {
+			sr.Stat.Name = "renamed"
+		}
+		return res, err
+	}
+
+	var buf bytes.Buffer
+	l := log.New(&buf, "", 0)
+	h := Chain(panicHandler{}, Logging(l), Recovery(l), trace("a"), trace("b"), rename)
+
+	sr, err := h.Stat(context.Background(), &protocol.StatRequest{})
+	if err != nil {
+		t.Fatalf("stat failed: %v", err)
+	}
+	if sr.Stat.Name != "renamed" {
+		t.Fatalf("response not modified by interceptor: %+v", sr.Stat)
+	}
+	if strings.Join(order, "") != "ab" {
+		t.Fatalf("interceptors called in order %v", order)
+	}
+
+	// Panics are turned into errors, and logged along with the request.
+	if _, err := h.Read(context.Background(), &protocol.ReadRequest{}); err != errInternal {
+		t.Fatalf("read returned %v, expected %v", err, errInternal)
+	}
+	if !strings.Contains(buf.String(), "panic handling") {
+		t.Fatalf("panic not logged: %q", buf.String())
+	}
+
+	// Responses of the wrong type are rejected.
+	wrong := func(ctx context.Context, r protocol.Message, next Next) (protocol.Message, error) {
+		return &protocol.ClunkResponse{}, nil
+	}
+	if _, err := Chain(statHandler{}, wrong).Stat(context.Background(), &protocol.StatRequest{}); err != ErrInvalidResponse {
+		t.Fatalf("stat returned %v, expected %v", err, ErrInvalidResponse)
+	}
+}
+
+func TestChainClose(t *testing.T) {
+	var closed bool
+	h := Chain(closeHandler{closed: &closed}, Logging(log.New(io.Discard, "", 0)))
+	c, ok := h.(io.Closer)
+	if !ok {
+		t.Fatalf("chain does not implement io.Closer")
+	}
+	if err := c.Close(); err != nil || !closed {
+		t.Fatalf("close returned %v, handler closed: %v", err, closed)
+	}
+}
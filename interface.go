@@ -1,8 +1,10 @@
 package g9p
 
 import (
+	"context"
 	"errors"
 
+	"github.com/kennylevinsen/g9p/p9err"
 	"github.com/kennylevinsen/g9p/protocol"
 )
 
@@ -11,6 +13,21 @@ var (
 	ErrFlushed = errors.New("request flushed")
 )
 
+// Error is an error with an associated Unix error number. When returned by a
+// Handler served with the 9P2000.u dialect, the error number is sent along
+// with the error string. The client returns errors of this type for error
+// responses, using the canonical errors of package p9err where possible.
+type Error = p9err.Error
+
+// errno returns the Unix error number associated with the error, or 0.
+func errno(err error) uint32 {
+	var e *Error
+	if errors.As(err, &e) {
+		return e.Errno
+	}
+	return 0
+}
+
 // Handler is the interface exposed by g9p's 9P2000 protocol handling
 // mechanisms, both for server and client applications. A client implements
 // this interface, allowing a user to call the methods on the Handler, whereas
@@ -20,14 +37,15 @@ var (
 // communicated back to give the effect of a completely transparent
 // communication layer. Due to the dual purpose of this interface, one could
 // also use g9p's server and client to implement a proxy, as a client can be
-// plugged directly into a server as Handler.
+// plugged directly into a server as Handler. As tags and fids are passed on
+// unchanged, such a proxy can only serve a single connection; Proxy remaps
+// them to share a client between connections.
 //
 // The server should take care of setting the tag of the response to that of
-// the request, but the user of a client is responsible for setting the initial
-// request tag. This could easily be taken care of by the client
-// implementation, but doing so would make it impossible for a user to know the
-// currently used tag, and thereby allow for the request to be cancelled with a
-// Flush.
+// the request. The client assigns a free tag to requests with a zero tag, and
+// stores it in the request, so that the request can still be cancelled with a
+// Flush of that tag. A request may instead carry an explicit tag, such as one
+// from Client.NextTag, if the tag must be known before the request is sent.
 //
 // The docs for this interface can either be read as description of behaviour
 // from the side of a client, or the contract that a server must honour when
@@ -170,3 +188,303 @@ type Handler interface {
 	// claims to be". The response is empty.
 	WriteStat(*protocol.WriteStatRequest) (*protocol.WriteStatResponse, error)
 }
+
+// ContextHandler is a variant of Handler where every request carries a
+// context. The methods have the same semantics as those of Handler, which
+// documents them in detail.
+//
+// There is no Flush method. Instead, when a request is flushed, the server
+// cancels the context of the request and waits for the method to return before
+// responding to the flush, guaranteeing the ordering demanded by
+// http://man.cat-v.org/plan_9/5/flush without the handler having to keep track
+// of requests itself. A method should therefore return promptly once its
+// context is cancelled. If it returns an error after its context was cancelled,
+// no response is sent for the request, just as if ErrFlushed was returned. A
+// method that completes despite the cancellation may return its result as
+// usual, in which case the response is sent before the response to the flush.
+//
+// The contexts are also cancelled when the connection is reset by Version, or
+// when the connection is closed.
+type ContextHandler interface {
+	Version(context.Context, *protocol.VersionRequest) (*protocol.VersionResponse, error)
+	Auth(context.Context, *protocol.AuthRequest) (*protocol.AuthResponse, error)
+	Attach(context.Context, *protocol.AttachRequest) (*protocol.AttachResponse, error)
+	Walk(context.Context, *protocol.WalkRequest) (*protocol.WalkResponse, error)
+	Open(context.Context, *protocol.OpenRequest) (*protocol.OpenResponse, error)
+	Create(context.Context, *protocol.CreateRequest) (*protocol.CreateResponse, error)
+	Read(context.Context, *protocol.ReadRequest) (*protocol.ReadResponse, error)
+	Write(context.Context, *protocol.WriteRequest) (*protocol.WriteResponse, error)
+	Clunk(context.Context, *protocol.ClunkRequest) (*protocol.ClunkResponse, error)
+	Remove(context.Context, *protocol.RemoveRequest) (*protocol.RemoveResponse, error)
+	Stat(context.Context, *protocol.StatRequest) (*protocol.StatResponse, error)
+	WriteStat(context.Context, *protocol.WriteStatRequest) (*protocol.WriteStatResponse, error)
+}
+
+// contextAdapter adapts a Handler to a ContextHandler by ignoring the
+// contexts.
+type contextAdapter struct {
+	h Handler
+}
+
+// AdaptHandler returns a ContextHandler calling h, ignoring the contexts. The
+// handler is not notified of flushes.
+func AdaptHandler(h Handler) ContextHandler {
+	return contextAdapter{h}
+}
+
+func (a contextAdapter) Version(_ context.Context, r *protocol.VersionRequest) (*protocol.VersionResponse, error) {
+	return a.h.Version(r)
+}
+
+func (a contextAdapter) Auth(_ context.Context, r *protocol.AuthRequest) (*protocol.AuthResponse, error) {
+	return a.h.Auth(r)
+}
+
+func (a contextAdapter) Attach(_ context.Context, r *protocol.AttachRequest) (*protocol.AttachResponse, error) {
+	return a.h.Attach(r)
+}
+
+func (a contextAdapter) Walk(_ context.Context, r *protocol.WalkRequest) (*protocol.WalkResponse, error) {
+	return a.h.Walk(r)
+}
+
+func (a contextAdapter) Open(_ context.Context, r *protocol.OpenRequest) (*protocol.OpenResponse, error) {
+	return a.h.Open(r)
+}
+
+func (a contextAdapter) Create(_ context.Context, r *protocol.CreateRequest) (*protocol.CreateResponse, error) {
+	return a.h.Create(r)
+}
+
+func (a contextAdapter) Read(_ context.Context, r *protocol.ReadRequest) (*protocol.ReadResponse, error) {
+	return a.h.Read(r)
+}
+
+func (a contextAdapter) Write(_ context.Context, r *protocol.WriteRequest) (*protocol.WriteResponse, error) {
+	return a.h.Write(r)
+}
+
+func (a contextAdapter) Clunk(_ context.Context, r *protocol.ClunkRequest) (*protocol.ClunkResponse, error) {
+	return a.h.Clunk(r)
+}
+
+func (a contextAdapter) Remove(_ context.Context, r *protocol.RemoveRequest) (*protocol.RemoveResponse, error) {
+	return a.h.Remove(r)
+}
+
+func (a contextAdapter) Stat(_ context.Context, r *protocol.StatRequest) (*protocol.StatResponse, error) {
+	return a.h.Stat(r)
+}
+
+func (a contextAdapter) WriteStat(_ context.Context, r *protocol.WriteStatRequest) (*protocol.WriteStatResponse, error) {
+	return a.h.WriteStat(r)
+}
+
+// LinuxHandler is the companion interface to Handler for the 9P2000.L
+// dialect. A server dispatches the 9P2000.L specific messages to its Handler
+// if it also implements LinuxHandler, or to its ContextHandler if it also
+// implements LinuxContextHandler, and responds with an error otherwise.
+// The messages shared with 9P2000, such as Version, Attach, Walk, Read, Write
+// and Clunk, are still dispatched to the Handler methods. A client speaking
+// 9P2000.L uses LinuxOpen, LinuxCreate, GetAttr and SetAttr in place of Open,
+// Create, Stat and WriteStat, and receives errors as Linux error numbers.
+//
+// The docs below only describe the high-level behaviour. For more info, see
+// https://github.com/chaos/diod/blob/master/protocol.md as well as the Linux
+// man pages of the system calls the messages mirror.
+type LinuxHandler interface {
+
+	// StatFS returns information about the file system the provided fid
+	// belongs to, similar to statfs(2).
+	StatFS(*protocol.StatFSRequest) (*protocol.StatFSResponse, error)
+
+	// LinuxOpen is used to open a fid for manipulation, like Open, but takes
+	// Linux open(2) flags rather than an OpenMode. The response contains the
+	// qid and an optional iounit.
+	LinuxOpen(*protocol.LinuxOpenRequest) (*protocol.LinuxOpenResponse, error)
+
+	// LinuxCreate is used to create and open a regular file in the directory
+	// represented by the fid, like Create. On success, the fid is changed to
+	// point to the created file. Directories, links and device nodes are
+	// created with Mkdir, Symlink, Link and Mknod instead.
+	LinuxCreate(*protocol.LinuxCreateRequest) (*protocol.LinuxCreateResponse, error)
+
+	// Symlink creates a symbolic link in the directory represented by the fid.
+	// The response contains the qid of the link.
+	Symlink(*protocol.SymlinkRequest) (*protocol.SymlinkResponse, error)
+
+	// Mknod creates a device node or named pipe in the directory represented
+	// by the fid. The response contains the qid of the node.
+	Mknod(*protocol.MknodRequest) (*protocol.MknodResponse, error)
+
+	// Rename moves the file represented by the fid to a new name in the
+	// directory represented by the request's DirFid.
+	Rename(*protocol.RenameRequest) (*protocol.RenameResponse, error)
+
+	// ReadLink returns the target of the symbolic link represented by the fid.
+	ReadLink(*protocol.ReadLinkRequest) (*protocol.ReadLinkResponse, error)
+
+	// GetAttr returns the attributes of the file represented by the fid. The
+	// request contains a mask of the wanted attributes, and the response
+	// contains a mask of the attributes that are valid, which may contain more
+	// or fewer attributes than requested.
+	GetAttr(*protocol.GetAttrRequest) (*protocol.GetAttrResponse, error)
+
+	// SetAttr modifies the attributes of the file represented by the fid. Only
+	// the attributes marked as valid in the request are applied.
+	SetAttr(*protocol.SetAttrRequest) (*protocol.SetAttrResponse, error)
+
+	// XattrWalk prepares newfid for reading the named extended attribute of
+	// the file represented by the fid, or the list of attribute names if the
+	// name is empty. The response contains the size of the attribute, which is
+	// then read from newfid.
+	XattrWalk(*protocol.XattrWalkRequest) (*protocol.XattrWalkResponse, error)
+
+	// XattrCreate prepares the fid for setting the named extended attribute.
+	// The value is written to the fid, and applied when the fid is clunked.
+	XattrCreate(*protocol.XattrCreateRequest) (*protocol.XattrCreateResponse, error)
+
+	// ReadDir reads directory entries from the opened directory represented
+	// by the fid. Unlike Read on directories, the offset is the opaque offset
+	// of the last returned protocol.Dirent, or 0 to start from the beginning.
+	// The response contains protocol.Dirent structures encoded end-to-end,
+	// fewer than or equal to count bytes.
+	ReadDir(*protocol.ReadDirRequest) (*protocol.ReadDirResponse, error)
+
+	// Fsync commits the file represented by the fid to storage.
+	Fsync(*protocol.FsyncRequest) (*protocol.FsyncResponse, error)
+
+	// Lock acquires or releases a POSIX record lock on the file represented
+	// by the fid. The response contains the lock status. A lock that would
+	// block must not block the server, but return protocol.LOCK_BLOCKED.
+	Lock(*protocol.LockRequest) (*protocol.LockResponse, error)
+
+	// GetLock tests for a conflicting POSIX record lock on the file
+	// represented by the fid. The response describes the conflicting lock, or
+	// has the type set to protocol.LOCK_TYPE_UNLCK if none exists.
+	GetLock(*protocol.GetLockRequest) (*protocol.GetLockResponse, error)
+
+	// Link creates a hard link to the file represented by the fid in the
+	// directory represented by the request's DirFid.
+	Link(*protocol.LinkRequest) (*protocol.LinkResponse, error)
+
+	// Mkdir creates a directory in the directory represented by the request's
+	// DirFid. The response contains the qid of the new directory.
+	Mkdir(*protocol.MkdirRequest) (*protocol.MkdirResponse, error)
+
+	// RenameAt moves a file from one directory to another, both represented
+	// by fids, similar to renameat(2).
+	RenameAt(*protocol.RenameAtRequest) (*protocol.RenameAtResponse, error)
+
+	// UnlinkAt removes a file from the directory represented by the request's
+	// DirFid, similar to unlinkat(2). Unlike Remove, no fid is clunked.
+	UnlinkAt(*protocol.UnlinkAtRequest) (*protocol.UnlinkAtResponse, error)
+}
+
+// LinuxContextHandler is the companion interface to ContextHandler for the
+// 9P2000.L dialect, like LinuxHandler is to Handler. The methods are those of
+// LinuxHandler, but take the context of the request, which is cancelled when
+// the request is flushed, as described for ContextHandler.
+type LinuxContextHandler interface {
+	StatFS(context.Context, *protocol.StatFSRequest) (*protocol.StatFSResponse, error)
+	LinuxOpen(context.Context, *protocol.LinuxOpenRequest) (*protocol.LinuxOpenResponse, error)
+	LinuxCreate(context.Context, *protocol.LinuxCreateRequest) (*protocol.LinuxCreateResponse, error)
+	Symlink(context.Context, *protocol.SymlinkRequest) (*protocol.SymlinkResponse, error)
+	Mknod(context.Context, *protocol.MknodRequest) (*protocol.MknodResponse, error)
+	Rename(context.Context, *protocol.RenameRequest) (*protocol.RenameResponse, error)
+	ReadLink(context.Context, *protocol.ReadLinkRequest) (*protocol.ReadLinkResponse, error)
+	GetAttr(context.Context, *protocol.GetAttrRequest) (*protocol.GetAttrResponse, error)
+	SetAttr(context.Context, *protocol.SetAttrRequest) (*protocol.SetAttrResponse, error)
+	XattrWalk(context.Context, *protocol.XattrWalkRequest) (*protocol.XattrWalkResponse, error)
+	XattrCreate(context.Context, *protocol.XattrCreateRequest) (*protocol.XattrCreateResponse, error)
+	ReadDir(context.Context, *protocol.ReadDirRequest) (*protocol.ReadDirResponse, error)
+	Fsync(context.Context, *protocol.FsyncRequest) (*protocol.FsyncResponse, error)
+	Lock(context.Context, *protocol.LockRequest) (*protocol.LockResponse, error)
+	GetLock(context.Context, *protocol.GetLockRequest) (*protocol.GetLockResponse, error)
+	Link(context.Context, *protocol.LinkRequest) (*protocol.LinkResponse, error)
+	Mkdir(context.Context, *protocol.MkdirRequest) (*protocol.MkdirResponse, error)
+	RenameAt(context.Context, *protocol.RenameAtRequest) (*protocol.RenameAtResponse, error)
+	UnlinkAt(context.Context, *protocol.UnlinkAtRequest) (*protocol.UnlinkAtResponse, error)
+}
+
+// linuxAdapter adapts a LinuxHandler to a LinuxContextHandler by ignoring the
+// contexts.
+type linuxAdapter struct {
+	h LinuxHandler
+}
+
+func (a linuxAdapter) StatFS(_ context.Context, r *protocol.StatFSRequest) (*protocol.StatFSResponse, error) {
+	return a.h.StatFS(r)
+}
+
+func (a linuxAdapter) LinuxOpen(_ context.Context, r *protocol.LinuxOpenRequest) (*protocol.LinuxOpenResponse, error) {
+	return a.h.LinuxOpen(r)
+}
+
+func (a linuxAdapter) LinuxCreate(_ context.Context, r *protocol.LinuxCreateRequest) (*protocol.LinuxCreateResponse, error) {
+	return a.h.LinuxCreate(r)
+}
+
+func (a linuxAdapter) Symlink(_ context.Context, r *protocol.SymlinkRequest) (*protocol.SymlinkResponse, error) {
+	return a.h.Symlink(r)
+}
+
+func (a linuxAdapter) Mknod(_ context.Context, r *protocol.MknodRequest) (*protocol.MknodResponse, error) {
+	return a.h.Mknod(r)
+}
+
+func (a linuxAdapter) Rename(_ context.Context, r *protocol.RenameRequest) (*protocol.RenameResponse, error) {
+	return a.h.Rename(r)
+}
+
+func (a linuxAdapter) ReadLink(_ context.Context, r *protocol.ReadLinkRequest) (*protocol.ReadLinkResponse, error) {
+	return a.h.ReadLink(r)
+}
+
+func (a linuxAdapter) GetAttr(_ context.Context, r *protocol.GetAttrRequest) (*protocol.GetAttrResponse, error) {
+	return a.h.GetAttr(r)
+}
+
+func (a linuxAdapter) SetAttr(_ context.Context, r *protocol.SetAttrRequest) (*protocol.SetAttrResponse, error) {
+	return a.h.SetAttr(r)
+}
+
+func (a linuxAdapter) XattrWalk(_ context.Context, r *protocol.XattrWalkRequest) (*protocol.XattrWalkResponse, error) {
+	return a.h.XattrWalk(r)
+}
+
+func (a linuxAdapter) XattrCreate(_ context.Context, r *protocol.XattrCreateRequest) (*protocol.XattrCreateResponse, error) {
+	return a.h.XattrCreate(r)
+}
+
+func (a linuxAdapter) ReadDir(_ context.Context, r *protocol.ReadDirRequest) (*protocol.ReadDirResponse, error) {
+	return a.h.ReadDir(r)
+}
+
+func (a linuxAdapter) Fsync(_ context.Context, r *protocol.FsyncRequest) (*protocol.FsyncResponse, error) {
+	return a.h.Fsync(r)
+}
+
+func (a linuxAdapter) Lock(_ context.Context, r *protocol.LockRequest) (*protocol.LockResponse, error) {
+	return a.h.Lock(r)
+}
+
+func (a linuxAdapter) GetLock(_ context.Context, r *protocol.GetLockRequest) (*protocol.GetLockResponse, error) {
+	return a.h.GetLock(r)
+}
+
+func (a linuxAdapter) Link(_ context.Context, r *protocol.LinkRequest) (*protocol.LinkResponse, error) {
+	return a.h.Link(r)
+}
+
+func (a linuxAdapter) Mkdir(_ context.Context, r *protocol.MkdirRequest) (*protocol.MkdirResponse, error) {
+	return a.h.Mkdir(r)
+}
+
+func (a linuxAdapter) RenameAt(_ context.Context, r *protocol.RenameAtRequest) (*protocol.RenameAtResponse, error) {
+	return a.h.RenameAt(r)
+}
+
+func (a linuxAdapter) UnlinkAt(_ context.Context, r *protocol.UnlinkAtRequest) (*protocol.UnlinkAtResponse, error) {
+	return a.h.UnlinkAt(r)
+}
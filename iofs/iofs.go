@@ -0,0 +1,248 @@
+// Package iofs serves an io/fs.FS, such as an embed.FS, os.DirFS or zip.Reader,
+// read-only over 9P.
+package iofs
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/fs"
+	"path"
+	"sync"
+
+	"github.com/kennylevinsen/g9p"
+	"github.com/kennylevinsen/g9p/p9err"
+	"github.com/kennylevinsen/g9p/protocol"
+	"github.com/kennylevinsen/g9p/tree"
+)
+
+// ErrReadOnly is returned for attempts to modify the file system.
+var ErrReadOnly = p9err.ErrReadOnly
+
+// owner is the user, group and last modifier reported for all files.
+const owner = "none"
+
+// New returns a tree serving fsys read-only. The Handler method of the tree
+// returns a handler for a single connection:
+//
+//	g9p.ServeListenerContext(l, iofs.New(fsys).Handler)
+func New(fsys fs.FS) *tree.Tree {
+	return tree.New(dir{node{fsys: &filesystem{fsys}, name: "."}})
+}
+
+// Handler returns a handler serving fsys read-only on a single connection.
+func Handler(fsys fs.FS) g9p.ContextHandler {
+	return New(fsys).Handler()
+}
+
+// filesystem wraps the served fs.FS, so that nodes can refer to it by
+// pointer. This keeps nodes comparable, as required by tree, even if the
+// fs.FS is not.
+type filesystem struct {
+	fs.FS
+}
+
+// node is a file in the file system, identified by its path.
+type node struct {
+	fsys *filesystem
+	name string
+}
+
+func (n node) Stat(context.Context) (protocol.Stat, error) {
+	fi, err := fs.Stat(n.fsys, n.name)
+	if err != nil {
+		return protocol.Stat{}, mapError(err)
+	}
+	s := Stat(fi)
+	if n.name == "." {
+		s.Name = "/"
+	}
+	return s, nil
+}
+
+// dir is a directory in the file system. Directories and files are values,
+// so that the nodes returned for the same path are equal, and get the same
+// qid path from the tree.
+type dir struct {
+	node
+}
+
+func (d dir) child(name string) (tree.Node, error) {
+	fi, err := fs.Stat(d.fsys, name)
+	if err != nil {
+		return nil, mapError(err)
+	}
+	n := node{fsys: d.fsys, name: name}
+	if fi.IsDir() {
+		return dir{n}, nil
+	}
+	return file{n}, nil
+}
+
+func (d dir) Walk(_ context.Context, name string) (tree.Node, error) {
+	p := path.Join(d.name, name)
+	if name == "" || name == "." || !fs.ValidPath(p) || path.Dir(p) != d.name {
+		return nil, tree.ErrNotExist
+	}
+	return d.child(p)
+}
+
+// Children uses fs.ReadDir, which reads the directory through either
+// fs.ReadDirFS or fs.ReadDirFile.
+func (d dir) Children(context.Context) ([]tree.Node, error) {
+	entries, err := fs.ReadDir(d.fsys, d.name)
+	if err != nil {
+		return nil, mapError(err)
+	}
+
+	nodes := make([]tree.Node, 0, len(entries))
+	for _, e := range entries {
+		n := node{fsys: d.fsys, name: path.Join(d.name, e.Name())}
+		if e.IsDir() {
+			nodes = append(nodes, dir{n})
+		} else {
+			nodes = append(nodes, file{n})
+		}
+	}
+	return nodes, nil
+}
+
+// file is a regular file in the file system.
+type file struct {
+	node
+}
+
+func (f file) Open(_ context.Context, mode protocol.OpenMode) (tree.Handle, error) {
+	if m := mode & 3; m == protocol.OWRITE || m == protocol.ORDWR || mode&(protocol.OTRUNC|protocol.ORCLOSE) != 0 {
+		return nil, ErrReadOnly
+	}
+
+	h, err := f.fsys.Open(f.name)
+	if err != nil {
+		return nil, mapError(err)
+	}
+	return &handle{file: f, f: h}, nil
+}
+
+// handle is an open file. Files that do not implement io.ReaderAt or
+// io.Seeker are read sequentially, and reopened to read at an earlier offset.
+type handle struct {
+	file file
+
+	lock sync.Mutex
+	f    fs.File
+	pos  int64
+}
+
+func (h *handle) Read(_ context.Context, p []byte, offset int64) (int, error) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	var n int
+	var err error
+	if ra, ok := h.f.(io.ReaderAt); ok {
+		n, err = ra.ReadAt(p, offset)
+	} else {
+		if err = h.seek(offset); err != nil {
+			return 0, mapError(err)
+		}
+		n, err = io.ReadFull(h.f, p)
+		h.pos += int64(n)
+	}
+
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		err = nil
+	}
+	return n, mapError(err)
+}
+
+// seek moves the read position of a file without io.ReaderAt to offset.
+func (h *handle) seek(offset int64) error {
+	if offset == h.pos {
+		return nil
+	}
+
+	if s, ok := h.f.(io.Seeker); ok {
+		pos, err := s.Seek(offset, io.SeekStart)
+		h.pos = pos
+		return err
+	}
+
+	if offset < h.pos {
+		f, err := h.file.fsys.Open(h.file.name)
+		if err != nil {
+			return err
+		}
+		h.f.Close()
+		h.f = f
+		h.pos = 0
+	}
+
+	n, err := io.CopyN(io.Discard, h.f, offset-h.pos)
+	h.pos += n
+	if err == io.EOF {
+		err = nil
+	}
+	return err
+}
+
+func (h *handle) Write(context.Context, []byte, int64) (int, error) {
+	return 0, ErrReadOnly
+}
+
+func (h *handle) Close() error {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	return h.f.Close()
+}
+
+// Stat converts a fs.FileInfo to a protocol.Stat. The Qid is left for the tree
+// to fill in, except for its version, which is derived from the modification
+// time.
+func Stat(fi fs.FileInfo) protocol.Stat {
+	mode := protocol.FileMode(fi.Mode().Perm())
+	if fi.IsDir() {
+		mode |= protocol.DMDIR
+	}
+	if fi.Mode()&fs.ModeAppend != 0 {
+		mode |= protocol.DMAPPEND
+	}
+	if fi.Mode()&fs.ModeExclusive != 0 {
+		mode |= protocol.DMEXCL
+	}
+	if fi.Mode()&fs.ModeTemporary != 0 {
+		mode |= protocol.DMTMP
+	}
+
+	var length uint64
+	if !fi.IsDir() && fi.Size() > 0 {
+		length = uint64(fi.Size())
+	}
+
+	mtime := uint32(fi.ModTime().Unix())
+	return protocol.Stat{
+		Qid:    protocol.Qid{Version: mtime},
+		Mode:   mode,
+		Atime:  mtime,
+		Mtime:  mtime,
+		Length: length,
+		Name:   fi.Name(),
+		UID:    owner,
+		GID:    owner,
+		MUID:   owner,
+	}
+}
+
+// mapError maps io/fs errors to the errors of the tree package.
+func mapError(err error) error {
+	switch {
+	case err == nil:
+		return nil
+	case errors.Is(err, fs.ErrNotExist):
+		return tree.ErrNotExist
+	case errors.Is(err, fs.ErrPermission):
+		return tree.ErrPermission
+	default:
+		return err
+	}
+}
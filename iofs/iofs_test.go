@@ -0,0 +1,68 @@
+package iofs
+
+import (
+	"net"
+	"testing"
+	"testing/fstest"
+
+	"github.com/kennylevinsen/g9p"
+	"github.com/kennylevinsen/g9p/protocol"
+)
+
+func TestIOFS(t *testing.T) {
+	fsys := fstest.MapFS{
+		"dir/hello": &fstest.MapFile{Data: []byte("hello, world"), Mode: 0644},
+	}
+
+	a, b := net.Pipe()
+	go g9p.ServeContext(a, Handler(fsys))
+	c := g9p.NewClient(b)
+	go c.Start()
+	defer b.Close()
+
+	if _, err := c.Version(&protocol.VersionRequest{Tag: protocol.NOTAG, MaxSize: 8192, Version: protocol.Version9P2000}); err != nil {
+		t.Fatalf("version failed: %v", err)
+	}
+	if _, err := c.Attach(&protocol.AttachRequest{Tag: 1, Fid: 1, AuthFid: protocol.NOFID}); err != nil {
+		t.Fatalf("attach failed: %v", err)
+	}
+
+	if _, err := c.Walk(&protocol.WalkRequest{Tag: 1, Fid: 1, NewFid: 2, Names: []string{"dir", "missing"}}); err != nil {
+		t.Fatalf("partial walk failed: %v", err)
+	}
+	if _, err := c.Walk(&protocol.WalkRequest{Tag: 1, Fid: 1, NewFid: 2, Names: []string{"dir", "hello"}}); err != nil {
+		t.Fatalf("walk failed: %v", err)
+	}
+
+	if _, err := c.Open(&protocol.OpenRequest{Tag: 1, Fid: 2, Mode: protocol.ORDWR}); err == nil || err.Error() != ErrReadOnly.Err {
+		t.Fatalf("write open returned %v, expected %v", err, ErrReadOnly)
+	}
+
+	sr, err := c.Stat(&protocol.StatRequest{Tag: 1, Fid: 2})
+	if err != nil {
+		t.Fatalf("stat failed: %v", err)
+	}
+	if sr.Stat.Name != "hello" || sr.Stat.Length != 12 || sr.Stat.Mode != 0644 {
+		t.Fatalf("unexpected stat: %+v", sr.Stat)
+	}
+
+	// Walking to the same file again gives the same qid.
+	wr, err := c.Walk(&protocol.WalkRequest{Tag: 1, Fid: 1, NewFid: 3, Names: []string{"dir", "hello"}})
+	if err != nil {
+		t.Fatalf("walk failed: %v", err)
+	}
+	if wr.Qids[1].Path != sr.Stat.Qid.Path {
+		t.Fatalf("walk returned qid path %d, expected %d", wr.Qids[1].Path, sr.Stat.Qid.Path)
+	}
+
+	if _, err := c.Open(&protocol.OpenRequest{Tag: 1, Fid: 2, Mode: protocol.OREAD}); err != nil {
+		t.Fatalf("open failed: %v", err)
+	}
+	res, err := c.Read(&protocol.ReadRequest{Tag: 1, Fid: 2, Offset: 7, Count: 100})
+	if err != nil {
+		t.Fatalf("read failed: %v", err)
+	}
+	if string(res.Data) != "world" {
+		t.Fatalf("unexpected read: %q", res.Data)
+	}
+}
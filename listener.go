@@ -0,0 +1,282 @@
+package g9p
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+var (
+	// ErrServerClosed is returned by ListenServer.Serve after Shutdown or
+	// Close has been called.
+	ErrServerClosed = errors.New("server closed")
+)
+
+// shutdownPollInterval is how often Shutdown checks for idle connections.
+const shutdownPollInterval = 10 * time.Millisecond
+
+// ListenServer accepts connections from listeners, serving each connection
+// with a new handler. It is to Server what net/http.Server is to a single
+// HTTP connection. Either Handler or ContextHandler must be set. If
+// ContextHandler is set, Handler is ignored.
+//
+// A ListenServer must not be copied after first use.
+type ListenServer struct {
+	// Handler returns the handler for a new connection.
+	Handler func() Handler
+
+	// ContextHandler returns the ContextHandler for a new connection.
+	ContextHandler func() ContextHandler
+
+	// MaxConns limits the number of connections served at once. When the
+	// limit is reached, new connections are not accepted until a served
+	// connection is closed. Zero means no limit.
+	MaxConns int
+
+	// MaxRequests limits the number of requests handled at once on each
+	// connection, and MaxTotalRequests the number of requests handled at
+	// once across all connections. Zero means no limit. See Server.
+	MaxRequests      int
+	MaxTotalRequests int
+
+	// Sequential makes each connection handle one request at a time. See
+	// Server.
+	Sequential bool
+
+	// OnAccept, if set, is called with every accepted connection before it
+	// is served.
+	OnAccept func(net.Conn)
+
+	// OnClose, if set, is called once a connection has been closed, with the
+	// error that ended it.
+	OnClose func(net.Conn, error)
+
+	// ErrorLog is used to log errors that end a connection, and panics in
+	// handlers. If nil, the log package's standard logger is used.
+	ErrorLog *log.Logger
+
+	mu         sync.Mutex
+	listeners  map[net.Listener]struct{}
+	conns      map[*Server]struct{}
+	sem        chan struct{}
+	limiter    *Limiter
+	done       chan struct{}
+	inShutdown bool
+}
+
+// init initializes the internal state. The mutex must be held.
+func (ls *ListenServer) init() {
+	if ls.done != nil {
+		return
+	}
+	ls.listeners = make(map[net.Listener]struct{})
+	ls.conns = make(map[*Server]struct{})
+	ls.done = make(chan struct{})
+	if ls.MaxConns > 0 {
+		ls.sem = make(chan struct{}, ls.MaxConns)
+	}
+	if ls.MaxTotalRequests > 0 {
+		ls.limiter = NewLimiter(ls.MaxTotalRequests)
+	}
+}
+
+// logf logs to l, or to the log package's standard logger if l is nil.
+func logf(l *log.Logger, format string, args ...interface{}) {
+	if l != nil {
+		l.Printf(format, args...)
+	} else {
+		log.Printf(format, args...)
+	}
+}
+
+// shuttingDown returns whether Shutdown or Close has been called.
+func (ls *ListenServer) shuttingDown() bool {
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+	return ls.inShutdown
+}
+
+// track adds or removes a listener, returning false if the server is shutting
+// down.
+func (ls *ListenServer) track(l net.Listener, add bool) bool {
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+	ls.init()
+	if !add {
+		delete(ls.listeners, l)
+		return true
+	}
+	if ls.inShutdown {
+		return false
+	}
+	ls.listeners[l] = struct{}{}
+	return true
+}
+
+// trackConn adds or removes a connection, returning false if the server is
+// shutting down.
+func (ls *ListenServer) trackConn(s *Server, add bool) bool {
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+	if !add {
+		delete(ls.conns, s)
+		return true
+	}
+	if ls.inShutdown {
+		return false
+	}
+	ls.conns[s] = struct{}{}
+	return true
+}
+
+// Serve accepts connections from l, serving each with a new handler. Serve
+// always returns a non-nil error, which is ErrServerClosed after Shutdown or
+// Close. The listener is closed when Serve returns.
+func (ls *ListenServer) Serve(l net.Listener) error {
+	defer l.Close()
+	if !ls.track(l, true) {
+		return ErrServerClosed
+	}
+	defer ls.track(l, false)
+
+	for {
+		if ls.sem != nil {
+			select {
+			case ls.sem <- struct{}{}:
+			case <-ls.done:
+				return ErrServerClosed
+			}
+		}
+
+		conn, err := l.Accept()
+		if err != nil {
+			ls.release()
+			if ls.shuttingDown() {
+				return ErrServerClosed
+			}
+			return err
+		}
+
+		if ls.OnAccept != nil {
+			ls.OnAccept(conn)
+		}
+
+		s := &Server{
+			RW:          conn,
+			MaxRequests: ls.MaxRequests,
+			Limiter:     ls.limiter,
+			Sequential:  ls.Sequential,
+			ErrorLog:    ls.ErrorLog,
+		}
+		if ls.ContextHandler != nil {
+			s.ContextHandler = ls.ContextHandler()
+		} else {
+			s.Handler = ls.Handler()
+		}
+
+		if !ls.trackConn(s, true) {
+			conn.Close()
+			ls.release()
+			return ErrServerClosed
+		}
+
+		go ls.serveConn(s, conn)
+	}
+}
+
+// serveConn serves a single connection.
+func (ls *ListenServer) serveConn(s *Server, conn net.Conn) {
+	err := s.serve()
+	ls.trackConn(s, false)
+	ls.release()
+
+	if err != nil && err != io.EOF && err != ErrServerClosed && !errors.Is(err, net.ErrClosed) && !ls.shuttingDown() {
+		logf(ls.ErrorLog, "g9p: error serving %v: %v", conn.RemoteAddr(), err)
+	}
+	if ls.OnClose != nil {
+		ls.OnClose(conn, err)
+	}
+}
+
+// release releases a connection slot if MaxConns is set.
+func (ls *ListenServer) release() {
+	if ls.sem != nil {
+		<-ls.sem
+	}
+}
+
+// beginShutdown stops accepting connections, returning the error from closing
+// the listeners.
+func (ls *ListenServer) beginShutdown() error {
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+	ls.init()
+	if !ls.inShutdown {
+		ls.inShutdown = true
+		close(ls.done)
+	}
+
+	var err error
+	for l := range ls.listeners {
+		if cerr := l.Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+		delete(ls.listeners, l)
+	}
+	return err
+}
+
+// closeIdle closes all idle connections, returning true if no connections
+// remain.
+func (ls *ListenServer) closeIdle() bool {
+	ls.mu.Lock()
+	conns := make([]*Server, 0, len(ls.conns))
+	for s := range ls.conns {
+		conns = append(conns, s)
+	}
+	ls.mu.Unlock()
+
+	for _, s := range conns {
+		s.closeIfIdle()
+	}
+	return len(conns) == 0
+}
+
+// Shutdown gracefully shuts down the server. The listeners are closed, idle
+// connections are closed, and connections with requests being handled are
+// closed once the requests have finished. If ctx is done before all
+// connections have been closed, Shutdown returns the context's error, and the
+// remaining connections are left open. Call Close to close them.
+func (ls *ListenServer) Shutdown(ctx context.Context) error {
+	err := ls.beginShutdown()
+
+	ticker := time.NewTicker(shutdownPollInterval)
+	defer ticker.Stop()
+	for {
+		if ls.closeIdle() {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// Close closes the listeners and all connections immediately, cancelling the
+// contexts of all pending requests.
+func (ls *ListenServer) Close() error {
+	err := ls.beginShutdown()
+
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+	for s := range ls.conns {
+		s.close()
+	}
+	return err
+}
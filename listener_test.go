@@ -0,0 +1,131 @@
+package g9p
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/kennylevinsen/g9p/protocol"
+)
+
+// readHandler is a statHandler that reports when a read has started.
+type readHandler struct {
+	statHandler
+	started chan struct{}
+}
+
+func (h readHandler) Read(ctx context.Context, r *protocol.ReadRequest) (*protocol.ReadResponse, error) {
+	h.started <- struct{}{}
+	return h.statHandler.Read(ctx, r)
+}
+
+func dial(t *testing.T, l net.Listener) *Client {
+	conn, err := net.Dial(l.Addr().Network(), l.Addr().String())
+	if err != nil {
+		t.Fatalf("dial failed: %v", err)
+	}
+	c := NewClient(conn)
+	go c.Start()
+	t.Cleanup(c.Stop)
+
+	if _, err := c.Version(&protocol.VersionRequest{Tag: protocol.NOTAG, MaxSize: 8192, Version: protocol.Version9P2000}); err != nil {
+		t.Fatalf("version failed: %v", err)
+	}
+	return c
+}
+
+func TestListenServerShutdown(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen failed: %v", err)
+	}
+
+	started := make(chan struct{}, 1)
+	closed := make(chan net.Conn, 2)
+	ls := &ListenServer{
+		ContextHandler: func() ContextHandler { return readHandler{started: started} },
+		OnClose:        func(conn net.Conn, err error) { closed <- conn },
+	}
+	served := make(chan error, 1)
+	go func() { served <- ls.Serve(l) }()
+
+	idle := dial(t, l)
+	busy := dial(t, l)
+	read := make(chan error, 1)
+	go func() {
+		_, err := busy.Read(&protocol.ReadRequest{Count: 1})
+		read <- err
+	}()
+	<-started
+
+	// The idle connection is closed, while the busy one is left open until
+	// its request finishes.
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := ls.Shutdown(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("shutdown returned %v, expected %v", err, context.DeadlineExceeded)
+	}
+	if err := <-served; err != ErrServerClosed {
+		t.Fatalf("serve returned %v, expected %v", err, ErrServerClosed)
+	}
+	<-closed
+	<-idle.Done()
+	select {
+	case <-busy.Done():
+		t.Fatalf("busy connection closed by shutdown: %v", busy.Err())
+	default:
+	}
+
+	if err := ls.Close(); err != nil {
+		t.Fatalf("close failed: %v", err)
+	}
+	<-closed
+	if err := <-read; err == nil {
+		t.Fatalf("read succeeded after close")
+	}
+}
+
+func TestListenServerLimits(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen failed: %v", err)
+	}
+
+	started := make(chan struct{}, 3)
+	ls := &ListenServer{
+		ContextHandler:   func() ContextHandler { return readHandler{started: started} },
+		MaxRequests:      2,
+		MaxTotalRequests: 3,
+	}
+	go ls.Serve(l)
+
+	// Each connection may only have two reads in progress, and only three
+	// reads are handled across both.
+	read := make(chan error, 4)
+	for _, c := range []*Client{dial(t, l), dial(t, l)} {
+		for i := 0; i < 2; i++ {
+			go func(c *Client) {
+				_, err := c.Read(&protocol.ReadRequest{Count: 1})
+				read <- err
+			}(c)
+		}
+	}
+	for i := 0; i < 3; i++ {
+		<-started
+	}
+	select {
+	case <-started:
+		t.Fatalf("more than 3 reads handled at once")
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	if err := ls.Close(); err != nil {
+		t.Fatalf("close failed: %v", err)
+	}
+	for i := 0; i < 4; i++ {
+		if err := <-read; err == nil {
+			t.Fatalf("read succeeded after close")
+		}
+	}
+}
@@ -0,0 +1,626 @@
+//go:build go1.25
+
+// Package localfs exports a directory on the local file system over 9P, with
+// support for creating, writing, removing and changing files, in the style of
+// u9fs.
+//
+// All access is confined to the exported directory, and neither ".." nor
+// symbolic links can be used to escape it. Qids are derived from the device
+// and inode numbers of the files, and are therefore stable across connections
+// and restarts.
+//
+// The package requires Go 1.25 or later, for the methods of os.Root that
+// change files.
+package localfs
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"os/user"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/kennylevinsen/g9p"
+	"github.com/kennylevinsen/g9p/p9err"
+	"github.com/kennylevinsen/g9p/protocol"
+)
+
+// Errors returned by the file system.
+var (
+	ErrNoAuth     = p9err.ErrNoAuth
+	ErrNotExist   = p9err.ErrNotExist
+	ErrExist      = p9err.ErrExist
+	ErrPermission = p9err.ErrPermission
+	ErrBadName    = &g9p.Error{Err: "bad file name", Errno: 22}
+	ErrBadOffset  = p9err.ErrBadOffset
+	ErrShortRead  = &g9p.Error{Err: "read count too small for directory entry", Errno: 22}
+	ErrBadStat    = &g9p.Error{Err: "wstat cannot change this field", Errno: 1}
+	ErrIsDir      = p9err.ErrIsDir
+)
+
+// FS is an exported local directory.
+type FS struct {
+	root *os.Root
+
+	// wstatLock serializes WriteStat and Create, so that the changes of a
+	// WriteStat are not interleaved with those of another, and no file is
+	// created at the target of a rename after checking that it is free.
+	wstatLock sync.Mutex
+
+	nameLock sync.Mutex
+	users    map[uint32]string
+	groups   map[uint32]string
+}
+
+// file is the per-fid state of a file.
+type file struct {
+	// name is the path of the file relative to the exported directory, or
+	// "." for the exported directory itself. It is changed by WriteStat, and
+	// nameLock is held for reading while it is in use by other requests.
+	nameLock sync.RWMutex
+	name     string
+
+	// f is the opened file.
+	f *os.File
+
+	// dirLock protects the directory read state.
+	dirLock sync.Mutex
+
+	// dir holds the packed stats of an opened directory, as read from offset
+	// 0. dirOffset is the offset the next directory read must start at.
+	dir       []byte
+	dirOffset uint64
+}
+
+// New returns a FS exporting the given directory.
+func New(dir string) (*FS, error) {
+	root, err := os.OpenRoot(dir)
+	if err != nil {
+		return nil, err
+	}
+	return &FS{
+		root:   root,
+		users:  make(map[uint32]string),
+		groups: make(map[uint32]string),
+	}, nil
+}
+
+// Close closes the exported directory. Connections still being served will
+// fail all further requests.
+func (fsys *FS) Close() error {
+	return fsys.root.Close()
+}
+
+// Handler returns a handler serving the directory on a single connection.
+func (fsys *FS) Handler() g9p.ContextHandler {
+	return g9p.NewFidServer[*file](fsys)
+}
+
+// toError converts an error from the os package to an error carrying a Unix
+// error number, using the canonical error for the number if there is one.
+func toError(err error) error {
+	var errno syscall.Errno
+	switch {
+	case err == nil:
+		return nil
+	case errors.As(err, &errno):
+		if c := p9err.FromErrno(uint32(errno)); c != nil {
+			return c
+		}
+		return &g9p.Error{Err: errno.Error(), Errno: uint32(errno)}
+	case errors.Is(err, fs.ErrNotExist):
+		return ErrNotExist
+	case errors.Is(err, fs.ErrExist):
+		return ErrExist
+	case errors.Is(err, fs.ErrPermission):
+		return ErrPermission
+	default:
+		return &g9p.Error{Err: err.Error(), Errno: 5}
+	}
+}
+
+// user returns the name of a user id, or the id as a string if the user is
+// unknown.
+func (fsys *FS) user(uid uint32) string {
+	fsys.nameLock.Lock()
+	defer fsys.nameLock.Unlock()
+
+	name, exists := fsys.users[uid]
+	if !exists {
+		id := strconv.FormatUint(uint64(uid), 10)
+		name = id
+		if u, err := user.LookupId(id); err == nil {
+			name = u.Username
+		}
+		fsys.users[uid] = name
+	}
+	return name
+}
+
+// group returns the name of a group id, or the id as a string if the group is
+// unknown.
+func (fsys *FS) group(gid uint32) string {
+	fsys.nameLock.Lock()
+	defer fsys.nameLock.Unlock()
+
+	name, exists := fsys.groups[gid]
+	if !exists {
+		id := strconv.FormatUint(uint64(gid), 10)
+		name = id
+		if g, err := user.LookupGroupId(id); err == nil {
+			name = g.Name
+		}
+		fsys.groups[gid] = name
+	}
+	return name
+}
+
+// lookupGroup returns the id of a group name.
+func lookupGroup(name string) (int, error) {
+	if gid, err := strconv.Atoi(name); err == nil {
+		return gid, nil
+	}
+	g, err := user.LookupGroup(name)
+	if err != nil {
+		return 0, &g9p.Error{Err: "unknown group", Errno: 22}
+	}
+	return strconv.Atoi(g.Gid)
+}
+
+// qid returns the qid of a file. The path is derived from the device and
+// inode numbers, and the version from the modification time and size.
+func qid(fi fs.FileInfo) protocol.Qid {
+	var q protocol.Qid
+	if fi.IsDir() {
+		q.Type = protocol.QTDIR
+	}
+	if ino, dev, ok := fileID(fi); ok {
+		q.Path = ino ^ dev<<48
+	}
+	q.Version = uint32(fi.ModTime().Unix()) ^ uint32(fi.Size()<<8)
+	return q
+}
+
+// stat converts a FileInfo to a Stat.
+func (fsys *FS) stat(fi fs.FileInfo) protocol.Stat {
+	mode := protocol.FileMode(fi.Mode().Perm())
+	if fi.IsDir() {
+		mode |= protocol.DMDIR
+	}
+	if fi.Mode()&fs.ModeAppend != 0 {
+		mode |= protocol.DMAPPEND
+	}
+	if fi.Mode()&fs.ModeExclusive != 0 {
+		mode |= protocol.DMEXCL
+	}
+
+	var length uint64
+	if !fi.IsDir() {
+		length = uint64(fi.Size())
+	}
+
+	uid, gid := "none", "none"
+	if u, g, ok := fileOwner(fi); ok {
+		uid, gid = fsys.user(u), fsys.group(g)
+	}
+
+	mtime := uint32(fi.ModTime().Unix())
+	return protocol.Stat{
+		Qid:    qid(fi),
+		Mode:   mode,
+		Atime:  mtime,
+		Mtime:  mtime,
+		Length: length,
+		Name:   fi.Name(),
+		UID:    uid,
+		GID:    gid,
+		MUID:   uid,
+	}
+}
+
+// statFile returns the stat of the named file.
+func (fsys *FS) statFile(name string) (protocol.Stat, error) {
+	fi, err := fsys.root.Stat(name)
+	if err != nil {
+		return protocol.Stat{}, toError(err)
+	}
+	s := fsys.stat(fi)
+	if name == "." {
+		s.Name = "/"
+	}
+	return s, nil
+}
+
+// validName reports whether name is a valid name of a directory entry.
+func validName(name string) bool {
+	return name != "" && name != "." && name != ".." && !strings.Contains(name, "/")
+}
+
+func (fsys *FS) Auth(context.Context, *g9p.Fid[*file], *protocol.AuthRequest) (*protocol.AuthResponse, error) {
+	return nil, ErrNoAuth
+}
+
+func (fsys *FS) Attach(_ context.Context, fid, _ *g9p.Fid[*file], r *protocol.AttachRequest) (*protocol.AttachResponse, error) {
+	fi, err := fsys.root.Stat(".")
+	if err != nil {
+		return nil, toError(err)
+	}
+
+	fid.Value = &file{name: "."}
+	return &protocol.AttachResponse{Qid: qid(fi)}, nil
+}
+
+func (fsys *FS) Walk(_ context.Context, fid, newfid *g9p.Fid[*file], r *protocol.WalkRequest) (*protocol.WalkResponse, error) {
+	fid.Value.nameLock.RLock()
+	defer fid.Value.nameLock.RUnlock()
+	name := fid.Value.name
+	qids := make([]protocol.Qid, 0, len(r.Names))
+	for i, elem := range r.Names {
+		// Only directories can be walked from, but the file itself counts
+		// as walked.
+		if i > 0 && qids[i-1].Type&protocol.QTDIR == 0 {
+			break
+		}
+		if elem != ".." && !validName(elem) {
+			if i == 0 {
+				return nil, ErrNotExist
+			}
+			break
+		}
+
+		// path.Join cleans the path, which keeps ".." from leaving the
+		// exported directory. Symbolic links are confined by os.Root.
+		next := path.Join(name, elem)
+		if next == ".." || strings.HasPrefix(next, "../") {
+			next = "."
+		}
+
+		fi, err := fsys.root.Stat(next)
+		if err != nil {
+			if i == 0 {
+				return nil, toError(err)
+			}
+			break
+		}
+
+		name = next
+		qids = append(qids, qid(fi))
+	}
+
+	newfid.Value = &file{name: name}
+	return &protocol.WalkResponse{Qids: qids}, nil
+}
+
+// openFlags converts a 9P open mode to os.OpenFile flags.
+func openFlags(mode protocol.OpenMode) int {
+	var flags int
+	switch mode & 3 {
+	case protocol.OREAD, protocol.OEXEC:
+		flags = os.O_RDONLY
+	case protocol.OWRITE:
+		flags = os.O_WRONLY
+	case protocol.ORDWR:
+		flags = os.O_RDWR
+	}
+	if mode&protocol.OTRUNC != 0 {
+		flags |= os.O_TRUNC
+	}
+	return flags
+}
+
+func (fsys *FS) Open(_ context.Context, fid *g9p.Fid[*file], r *protocol.OpenRequest) (*protocol.OpenResponse, error) {
+	fid.Value.nameLock.RLock()
+	defer fid.Value.nameLock.RUnlock()
+	name := fid.Value.name
+	fi, err := fsys.root.Stat(name)
+	if err != nil {
+		return nil, toError(err)
+	}
+	if fi.IsDir() && (r.Mode&3 == protocol.OWRITE || r.Mode&3 == protocol.ORDWR || r.Mode&protocol.OTRUNC != 0) {
+		return nil, ErrIsDir
+	}
+
+	f, err := fsys.root.OpenFile(name, openFlags(r.Mode), 0)
+	if err != nil {
+		return nil, toError(err)
+	}
+
+	fid.Value.f = f
+	return &protocol.OpenResponse{Qid: qid(fi)}, nil
+}
+
+func (fsys *FS) Create(_ context.Context, fid *g9p.Fid[*file], r *protocol.CreateRequest) (*protocol.CreateResponse, error) {
+	if !validName(r.Name) {
+		return nil, ErrBadName
+	}
+
+	// Creating a file must not race with WriteStat checking that the target
+	// of a rename does not exist.
+	fsys.wstatLock.Lock()
+	defer fsys.wstatLock.Unlock()
+
+	parent := fid.Value.name
+	dir, err := fsys.root.Stat(parent)
+	if err != nil {
+		return nil, toError(err)
+	}
+	if !dir.IsDir() {
+		return nil, toError(syscall.ENOTDIR)
+	}
+
+	// The permissions of the new file are limited by those of the directory,
+	// as described in http://man.cat-v.org/plan_9/5/open.
+	name := path.Join(parent, r.Name)
+	dirPerm := protocol.FileMode(dir.Mode().Perm())
+	var f *os.File
+	if r.Permissions&protocol.DMDIR != 0 {
+		if m := r.Mode & 3; m == protocol.OWRITE || m == protocol.ORDWR || r.Mode&protocol.OTRUNC != 0 {
+			return nil, ErrIsDir
+		}
+		perm := r.Permissions & (^protocol.FileMode(0777) | dirPerm&0777)
+		if err := fsys.root.Mkdir(name, os.FileMode(perm&0777)); err != nil {
+			return nil, toError(err)
+		}
+		if f, err = fsys.root.Open(name); err != nil {
+			return nil, toError(err)
+		}
+	} else {
+		perm := r.Permissions & (^protocol.FileMode(0666) | dirPerm&0666)
+		flags := openFlags(r.Mode) | os.O_CREATE | os.O_EXCL
+		if f, err = fsys.root.OpenFile(name, flags, os.FileMode(perm&0777)); err != nil {
+			return nil, toError(err)
+		}
+	}
+
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, toError(err)
+	}
+
+	fid.Value = &file{name: name, f: f}
+	return &protocol.CreateResponse{Qid: qid(fi)}, nil
+}
+
+func (fsys *FS) Read(ctx context.Context, fid *g9p.Fid[*file], r *protocol.ReadRequest) (*protocol.ReadResponse, error) {
+	fi, err := fid.Value.f.Stat()
+	if err != nil {
+		return nil, toError(err)
+	}
+	if fi.IsDir() {
+		return fsys.readDir(ctx, fid.Value, r)
+	}
+
+	b := make([]byte, r.Count)
+	n, err := fid.Value.f.ReadAt(b, int64(r.Offset))
+	if err != nil && err != io.EOF {
+		return nil, toError(err)
+	}
+	return &protocol.ReadResponse{Data: b[:n]}, nil
+}
+
+// readDir reads packed stats from a directory. Only whole stats are returned,
+// and reads must either start at offset 0, or where the previous read ended.
+func (fsys *FS) readDir(ctx context.Context, f *file, r *protocol.ReadRequest) (*protocol.ReadResponse, error) {
+	f.dirLock.Lock()
+	defer f.dirLock.Unlock()
+	f.nameLock.RLock()
+	defer f.nameLock.RUnlock()
+
+	if r.Offset == 0 {
+		if _, err := f.f.Seek(0, io.SeekStart); err != nil {
+			return nil, toError(err)
+		}
+		entries, err := f.f.ReadDir(-1)
+		if err != nil {
+			return nil, toError(err)
+		}
+
+		f.dir = nil
+		for _, e := range entries {
+			// Entries are stat'ed through the root, which follows symbolic
+			// links that stay within it. Entries that cannot be stat'ed, such
+			// as escaping links, are skipped.
+			fi, err := fsys.root.Stat(path.Join(f.name, e.Name()))
+			if err != nil {
+				continue
+			}
+			s := fsys.stat(fi)
+			s.Name = e.Name()
+			f.dir = s.MarshalAppendDialect(f.dir, g9p.Dialect(ctx))
+		}
+		f.dirOffset = 0
+	} else if r.Offset != f.dirOffset {
+		return nil, ErrBadOffset
+	}
+
+	rest := f.dir[f.dirOffset:]
+	var n uint32
+	for int(n)+2 <= len(rest) {
+		size := 2 + uint32(binary.LittleEndian.Uint16(rest[n:]))
+		if n+size > r.Count {
+			break
+		}
+		n += size
+	}
+	if n == 0 && len(rest) > 0 {
+		return nil, ErrShortRead
+	}
+
+	f.dirOffset += uint64(n)
+	return &protocol.ReadResponse{Data: rest[:n:n]}, nil
+}
+
+func (fsys *FS) Write(_ context.Context, fid *g9p.Fid[*file], r *protocol.WriteRequest) (*protocol.WriteResponse, error) {
+	n, err := fid.Value.f.WriteAt(r.Data, int64(r.Offset))
+	if err != nil {
+		return nil, toError(err)
+	}
+	return &protocol.WriteResponse{Count: uint32(n)}, nil
+}
+
+func (fsys *FS) Remove(_ context.Context, fid *g9p.Fid[*file], r *protocol.RemoveRequest) error {
+	fid.Value.nameLock.RLock()
+	defer fid.Value.nameLock.RUnlock()
+	name := fid.Value.name
+	if name == "." {
+		return ErrPermission
+	}
+	return toError(fsys.root.Remove(name))
+}
+
+func (fsys *FS) Stat(_ context.Context, fid *g9p.Fid[*file], r *protocol.StatRequest) (*protocol.StatResponse, error) {
+	fid.Value.nameLock.RLock()
+	defer fid.Value.nameLock.RUnlock()
+	s, err := fsys.statFile(fid.Value.name)
+	if err != nil {
+		return nil, err
+	}
+	return &protocol.StatResponse{Stat: s}, nil
+}
+
+// WriteStat applies the changes of a stat, as described in
+// http://man.cat-v.org/plan_9/5/stat. All changes are validated before any is
+// applied, and the applied changes are reverted if a later one fails, so that
+// either all or none of the changes take effect.
+func (fsys *FS) WriteStat(_ context.Context, fid *g9p.Fid[*file], r *protocol.WriteStatRequest) (*protocol.WriteStatResponse, error) {
+	fsys.wstatLock.Lock()
+	defer fsys.wstatLock.Unlock()
+
+	fid.Value.nameLock.Lock()
+	defer fid.Value.nameLock.Unlock()
+
+	name := fid.Value.name
+	fi, err := fsys.root.Stat(name)
+	if err != nil {
+		return nil, toError(err)
+	}
+	old := fsys.stat(fi)
+	s := r.Stat
+
+	// Validate.
+	if s.Type != ^uint16(0) || s.Dev != ^uint32(0) ||
+		s.Qid.Type != ^protocol.QidType(0) || s.Qid.Version != ^uint32(0) || s.Qid.Path != ^uint64(0) ||
+		s.Atime != ^uint32(0) || (s.UID != "" && s.UID != old.UID) || s.MUID != "" {
+		return nil, ErrBadStat
+	}
+
+	// Only the permissions can be changed, not whether the file is a
+	// directory, nor DMAPPEND or DMEXCL, which local files do not support.
+	changeMode := s.Mode != ^protocol.FileMode(0)
+	if changeMode && s.Mode&^0777 != old.Mode&^0777 {
+		return nil, ErrBadStat
+	}
+
+	changeLength := s.Length != ^uint64(0)
+	if changeLength && fi.IsDir() {
+		return nil, ErrIsDir
+	}
+
+	gid := -1
+	if s.GID != "" && s.GID != old.GID {
+		if gid, err = lookupGroup(s.GID); err != nil {
+			return nil, err
+		}
+	}
+
+	newName := name
+	if s.Name != "" && s.Name != old.Name {
+		if name == "." || !validName(s.Name) {
+			return nil, ErrBadName
+		}
+		newName = path.Join(path.Dir(name), s.Name)
+		if _, err := fsys.root.Lstat(newName); err == nil {
+			return nil, ErrExist
+		}
+	}
+
+	// Apply, in order of how easily the change can be reverted. The length
+	// is changed last, as truncated data cannot be restored.
+	var undo []func()
+	rollback := func(err error) (*protocol.WriteStatResponse, error) {
+		for i := len(undo) - 1; i >= 0; i-- {
+			undo[i]()
+		}
+		return nil, toError(err)
+	}
+
+	if changeMode {
+		// The setuid, setgid and sticky bits have no 9P equivalent, and are
+		// kept as they are.
+		mode := fi.Mode()&(os.ModeSetuid|os.ModeSetgid|os.ModeSticky) | os.FileMode(s.Mode&0777)
+		if err := fsys.root.Chmod(name, mode); err != nil {
+			return rollback(err)
+		}
+		undo = append(undo, func() { fsys.root.Chmod(name, fi.Mode()) })
+	}
+
+	if gid != -1 {
+		if err := fsys.root.Chown(name, -1, gid); err != nil {
+			return rollback(err)
+		}
+		if _, oldGID, ok := fileOwner(fi); ok {
+			undo = append(undo, func() { fsys.root.Chown(name, -1, int(oldGID)) })
+		}
+	}
+
+	if s.Mtime != ^uint32(0) {
+		if err := fsys.root.Chtimes(name, time.Time{}, time.Unix(int64(s.Mtime), 0)); err != nil {
+			return rollback(err)
+		}
+		undo = append(undo, func() { fsys.root.Chtimes(name, time.Time{}, fi.ModTime()) })
+	}
+
+	if newName != name {
+		if err := fsys.root.Rename(name, newName); err != nil {
+			return rollback(err)
+		}
+		fid.Value.name = newName
+		undo = append(undo, func() {
+			fsys.root.Rename(newName, name)
+			fid.Value.name = name
+		})
+	}
+
+	if changeLength {
+		f, err := fsys.root.OpenFile(newName, os.O_WRONLY, 0)
+		if err != nil {
+			return rollback(err)
+		}
+		err = f.Truncate(int64(s.Length))
+		f.Close()
+		if err != nil {
+			return rollback(err)
+		}
+
+		// Truncating updates the modification time, which must stay as
+		// requested.
+		if s.Mtime != ^uint32(0) {
+			fsys.root.Chtimes(newName, time.Time{}, time.Unix(int64(s.Mtime), 0))
+		}
+	}
+
+	return &protocol.WriteStatResponse{}, nil
+}
+
+func (fsys *FS) Clunk(fid *g9p.Fid[*file]) {
+	f := fid.Value
+	if f == nil {
+		return
+	}
+
+	if f.f != nil {
+		f.f.Close()
+	}
+	if fid.Opened && fid.Mode&protocol.ORCLOSE != 0 && f.name != "." {
+		fsys.root.Remove(f.name)
+	}
+}
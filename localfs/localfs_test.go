@@ -0,0 +1,199 @@
+//go:build go1.25
+
+package localfs
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/kennylevinsen/g9p"
+	"github.com/kennylevinsen/g9p/protocol"
+)
+
+func TestLocalFS(t *testing.T) {
+	dir := t.TempDir()
+	outside := t.TempDir()
+	if err := os.Symlink(outside, filepath.Join(dir, "escape")); err != nil {
+		t.Fatalf("could not create symlink: %v", err)
+	}
+
+	fsys, err := New(dir)
+	if err != nil {
+		t.Fatalf("could not export directory: %v", err)
+	}
+	defer fsys.Close()
+
+	a, b := net.Pipe()
+	go g9p.ServeContext(a, fsys.Handler())
+	c := g9p.NewClient(b)
+	go c.Start()
+	defer b.Close()
+
+	if _, err := c.Version(&protocol.VersionRequest{Tag: protocol.NOTAG, MaxSize: 8192, Version: protocol.Version9P2000}); err != nil {
+		t.Fatalf("version failed: %v", err)
+	}
+	if _, err := c.Attach(&protocol.AttachRequest{Tag: 1, Fid: 1, AuthFid: protocol.NOFID}); err != nil {
+		t.Fatalf("attach failed: %v", err)
+	}
+
+	// Neither .. nor symbolic links may leave the exported directory.
+	wr, err := c.Walk(&protocol.WalkRequest{Tag: 1, Fid: 1, NewFid: 2, Names: []string{".."}})
+	if err != nil {
+		t.Fatalf("walk to .. failed: %v", err)
+	}
+	sr, err := c.Stat(&protocol.StatRequest{Tag: 1, Fid: 2})
+	if err != nil {
+		t.Fatalf("stat failed: %v", err)
+	}
+	if sr.Stat.Name != "/" || wr.Qids[0] != sr.Stat.Qid {
+		t.Fatalf("walk to .. left the exported directory: %+v", sr.Stat)
+	}
+	if _, err := c.Walk(&protocol.WalkRequest{Tag: 1, Fid: 1, NewFid: 3, Names: []string{"escape"}}); err == nil {
+		t.Fatalf("walk through escaping symlink succeeded")
+	}
+
+	// Create and write a file.
+	if _, err := c.Create(&protocol.CreateRequest{Tag: 1, Fid: 2, Name: "file", Permissions: 0644, Mode: protocol.ORDWR}); err != nil {
+		t.Fatalf("create failed: %v", err)
+	}
+	if _, err := c.Write(&protocol.WriteRequest{Tag: 1, Fid: 2, Data: []byte("hello, world")}); err != nil {
+		t.Fatalf("write failed: %v", err)
+	}
+
+	// Walks stop after the file, which counts as walked.
+	wr, err = c.Walk(&protocol.WalkRequest{Tag: 1, Fid: 1, NewFid: 3, Names: []string{"file", "beyond"}})
+	if err != nil || len(wr.Qids) != 1 || wr.Qids[0].Type&protocol.QTDIR != 0 {
+		t.Fatalf("walk beyond file returned %v, %v, expected the qid of the file", wr, err)
+	}
+
+	// Truncate and rename it.
+	s := protocol.DontTouch()
+	s.Name = "renamed"
+	s.Length = 5
+	if _, err := c.WriteStat(&protocol.WriteStatRequest{Tag: 1, Fid: 2, Stat: s}); err != nil {
+		t.Fatalf("wstat failed: %v", err)
+	}
+	content, err := os.ReadFile(filepath.Join(dir, "renamed"))
+	if err != nil || string(content) != "hello" {
+		t.Fatalf("unexpected content after wstat: %q, %v", content, err)
+	}
+
+	// Changing the uid is not permitted, and must not apply other changes.
+	s = protocol.DontTouch()
+	s.Name = "other"
+	s.UID = "nobody-in-particular"
+	if _, err := c.WriteStat(&protocol.WriteStatRequest{Tag: 1, Fid: 2, Stat: s}); err == nil {
+		t.Fatalf("wstat changing uid succeeded")
+	}
+	if _, err := os.Stat(filepath.Join(dir, "renamed")); err != nil {
+		t.Fatalf("failed wstat changed the file: %v", err)
+	}
+
+	// A rename failing when applied, here as the name is too long for the
+	// local file system, does not truncate the file.
+	s = protocol.DontTouch()
+	s.Name = strings.Repeat("x", 300)
+	s.Length = 1
+	if _, err := c.WriteStat(&protocol.WriteStatRequest{Tag: 1, Fid: 2, Stat: s}); err == nil {
+		t.Fatalf("wstat with overlong name succeeded")
+	}
+	content, err = os.ReadFile(filepath.Join(dir, "renamed"))
+	if err != nil || string(content) != "hello" {
+		t.Fatalf("failed wstat changed the content to %q, %v", content, err)
+	}
+
+	// Changing the permissions keeps the sticky bit, while DMAPPEND cannot
+	// be set.
+	if err := os.Mkdir(filepath.Join(dir, "sticky"), 0755); err != nil {
+		t.Fatalf("could not create directory: %v", err)
+	}
+	if err := os.Chmod(filepath.Join(dir, "sticky"), 0755|os.ModeSticky); err != nil {
+		t.Fatalf("could not set sticky bit: %v", err)
+	}
+	if _, err := c.Walk(&protocol.WalkRequest{Tag: 1, Fid: 1, NewFid: 4, Names: []string{"sticky"}}); err != nil {
+		t.Fatalf("walk failed: %v", err)
+	}
+	s = protocol.DontTouch()
+	s.Mode = protocol.DMDIR | 0700
+	if _, err := c.WriteStat(&protocol.WriteStatRequest{Tag: 1, Fid: 4, Stat: s}); err != nil {
+		t.Fatalf("chmod failed: %v", err)
+	}
+	if fi, err := os.Stat(filepath.Join(dir, "sticky")); err != nil || fi.Mode()&(os.ModeSticky|os.ModePerm) != os.ModeSticky|0700 {
+		t.Fatalf("unexpected mode after chmod: %v, %v", fi.Mode(), err)
+	}
+	s.Mode = protocol.DMDIR | protocol.DMAPPEND | 0700
+	if _, err := c.WriteStat(&protocol.WriteStatRequest{Tag: 1, Fid: 4, Stat: s}); !errors.Is(err, ErrBadStat) {
+		t.Fatalf("wstat setting DMAPPEND returned %v, expected %v", err, ErrBadStat)
+	}
+
+	// Qids are stable across walks.
+	wr1, err := c.Walk(&protocol.WalkRequest{Tag: 1, Fid: 1, NewFid: 3, Names: []string{"renamed"}})
+	if err != nil {
+		t.Fatalf("walk failed: %v", err)
+	}
+	if _, err := c.Remove(&protocol.RemoveRequest{Tag: 1, Fid: 3}); err != nil {
+		t.Fatalf("remove failed: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "renamed")); !os.IsNotExist(err) {
+		t.Fatalf("file still exists after remove: %v", err)
+	}
+	if wr1.Qids[0].Path == 0 {
+		t.Fatalf("qid path not derived from inode: %+v", wr1.Qids[0])
+	}
+}
+
+func TestLocalFSConcurrentRename(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "a"), nil, 0644); err != nil {
+		t.Fatalf("could not create file: %v", err)
+	}
+	fsys, err := New(dir)
+	if err != nil {
+		t.Fatalf("could not export directory: %v", err)
+	}
+	defer fsys.Close()
+
+	a, b := net.Pipe()
+	go g9p.ServeContext(a, fsys.Handler())
+	c := g9p.NewClient(b)
+	go c.Start()
+	defer b.Close()
+
+	if _, err := c.Version(&protocol.VersionRequest{Tag: protocol.NOTAG, MaxSize: 8192, Version: protocol.Version9P2000}); err != nil {
+		t.Fatalf("version failed: %v", err)
+	}
+	if _, err := c.Attach(&protocol.AttachRequest{Tag: 1, Fid: 1, AuthFid: protocol.NOFID}); err != nil {
+		t.Fatalf("attach failed: %v", err)
+	}
+	if _, err := c.Walk(&protocol.WalkRequest{Tag: 1, Fid: 1, NewFid: 2, Names: []string{"a"}}); err != nil {
+		t.Fatalf("walk failed: %v", err)
+	}
+
+	// Stats of a fid being renamed see either name.
+	done := make(chan error, 1)
+	go func() {
+		for i := 0; i < 100; i++ {
+			sr, err := c.Stat(&protocol.StatRequest{Tag: 2, Fid: 2})
+			if err != nil || (sr.Stat.Name != "a" && sr.Stat.Name != "b") {
+				done <- fmt.Errorf("stat returned %+v, %v", sr, err)
+				return
+			}
+		}
+		done <- nil
+	}()
+	for i := 0; i < 100; i++ {
+		s := protocol.DontTouch()
+		s.Name = []string{"b", "a"}[i%2]
+		if _, err := c.WriteStat(&protocol.WriteStatRequest{Tag: 1, Fid: 2, Stat: s}); err != nil {
+			t.Fatalf("rename failed: %v", err)
+		}
+	}
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,17 @@
+//go:build !unix && go1.25
+
+package localfs
+
+import "io/fs"
+
+// fileID returns the inode and device numbers of a file, which are not
+// available on this platform.
+func fileID(fs.FileInfo) (ino, dev uint64, ok bool) {
+	return 0, 0, false
+}
+
+// fileOwner returns the user and group ids of a file, which are not available
+// on this platform.
+func fileOwner(fs.FileInfo) (uid, gid uint32, ok bool) {
+	return 0, 0, false
+}
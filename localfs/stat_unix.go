@@ -0,0 +1,26 @@
+//go:build unix && go1.25
+
+package localfs
+
+import (
+	"io/fs"
+	"syscall"
+)
+
+// fileID returns the inode and device numbers of a file.
+func fileID(fi fs.FileInfo) (ino, dev uint64, ok bool) {
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 0, 0, false
+	}
+	return uint64(st.Ino), uint64(st.Dev), true
+}
+
+// fileOwner returns the user and group ids of a file.
+func fileOwner(fi fs.FileInfo) (uid, gid uint32, ok bool) {
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 0, 0, false
+	}
+	return st.Uid, st.Gid, true
+}
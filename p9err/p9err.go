@@ -0,0 +1,149 @@
+// Package p9err provides the error type used throughout g9p, along with a
+// vocabulary of canonical Plan 9 errors.
+//
+// 9P2000 transports errors as strings, so errors are identified by their
+// string. An error received by a client matches a canonical error with the
+// same string under errors.Is, and canonical errors match the io/fs errors
+// they correspond to, such that errors.Is(err, fs.ErrNotExist) works for
+// errors received from a server.
+package p9err
+
+import (
+	"io/fs"
+)
+
+// Error is an error with an associated Unix error number. When returned by a
+// handler served with the 9P2000.u dialect, the error number is sent along
+// with the error string. The client returns errors of this type for error
+// responses.
+type Error struct {
+	// Err is the error string.
+	Err string
+
+	// Errno is the Unix error number, or 0 if none is known.
+	Errno uint32
+}
+
+func (e *Error) Error() string {
+	return e.Err
+}
+
+// Is reports whether the error matches target. Errors match errors with the
+// same string. Errors with the string or error number of a canonical error
+// also match the io/fs error corresponding to it.
+func (e *Error) Is(target error) bool {
+	if t, ok := target.(*Error); ok {
+		return e.Err == t.Err
+	}
+
+	c := Lookup(e.Err)
+	if c == nil {
+		c = FromErrno(e.Errno)
+	}
+	return c != nil && fsErrors[c] != nil && fsErrors[c] == target
+}
+
+// Canonical errors, using the strings of the Plan 9 kernel and lib9p.
+var (
+	ErrNotExist     = &Error{Err: "file does not exist", Errno: 2}
+	ErrExist        = &Error{Err: "file already exists", Errno: 17}
+	ErrPermission   = &Error{Err: "permission denied", Errno: 13}
+	ErrNotDir       = &Error{Err: "not a directory", Errno: 20}
+	ErrIsDir        = &Error{Err: "file is a directory", Errno: 21}
+	ErrNotEmpty     = &Error{Err: "directory not empty", Errno: 39}
+	ErrWalkNoDir    = &Error{Err: "walk in non-directory", Errno: 20}
+	ErrUnknownFid   = &Error{Err: "fid unknown or out of range", Errno: 9}
+	ErrFidInUse     = &Error{Err: "fid already in use", Errno: 9}
+	ErrBadUseFid    = &Error{Err: "bad use of fid", Errno: 9}
+	ErrIsOpen       = &Error{Err: "file already open for I/O", Errno: 9}
+	ErrNotOpen      = &Error{Err: "file not open for I/O", Errno: 9}
+	ErrBadOffset    = &Error{Err: "bad offset in directory read", Errno: 22}
+	ErrBadArg       = &Error{Err: "bad arg in system call", Errno: 22}
+	ErrBadStat      = &Error{Err: "malformed stat buffer", Errno: 22}
+	ErrNoAuth       = &Error{Err: "authentication not required", Errno: 22}
+	ErrReadOnly     = &Error{Err: "file system read only", Errno: 30}
+	ErrIO           = &Error{Err: "i/o error", Errno: 5}
+	ErrInterrupted  = &Error{Err: "interrupted", Errno: 4}
+	ErrNotSupported = &Error{Err: "operation not supported", Errno: 95}
+)
+
+// Canonical errors with strings of g9p's own, for the fid rules enforced by
+// g9p.FidServer.
+var (
+	ErrFidMode     = &Error{Err: "fid not opened for this operation", Errno: 9}
+	ErrAuthFid     = &Error{Err: "bad use of authentication fid", Errno: 22}
+	ErrWalkTooLong = &Error{Err: "too many names in walk", Errno: 22}
+)
+
+var canonical = []*Error{
+	ErrNotExist,
+	ErrExist,
+	ErrPermission,
+	ErrNotDir,
+	ErrIsDir,
+	ErrNotEmpty,
+	ErrWalkNoDir,
+	ErrUnknownFid,
+	ErrFidInUse,
+	ErrBadUseFid,
+	ErrIsOpen,
+	ErrNotOpen,
+	ErrBadOffset,
+	ErrBadArg,
+	ErrBadStat,
+	ErrNoAuth,
+	ErrReadOnly,
+	ErrIO,
+	ErrInterrupted,
+	ErrNotSupported,
+	ErrFidMode,
+	ErrAuthFid,
+	ErrWalkTooLong,
+}
+
+// fsErrors maps canonical errors to the io/fs errors they correspond to.
+var fsErrors = map[*Error]error{
+	ErrNotExist:   fs.ErrNotExist,
+	ErrExist:      fs.ErrExist,
+	ErrPermission: fs.ErrPermission,
+	ErrBadArg:     fs.ErrInvalid,
+}
+
+var byString = make(map[string]*Error)
+
+func init() {
+	for _, e := range canonical {
+		byString[e.Err] = e
+	}
+}
+
+// byErrno maps Unix error numbers to the most general canonical error with
+// that number.
+var byErrno = map[uint32]*Error{
+	1:  ErrPermission,
+	2:  ErrNotExist,
+	4:  ErrInterrupted,
+	5:  ErrIO,
+	9:  ErrBadUseFid,
+	13: ErrPermission,
+	17: ErrExist,
+	20: ErrNotDir,
+	21: ErrIsDir,
+	22: ErrBadArg,
+	30: ErrReadOnly,
+	39: ErrNotEmpty,
+	95: ErrNotSupported,
+}
+
+// Lookup returns the canonical error with the given string, or nil if there
+// is none.
+func Lookup(s string) *Error {
+	return byString[s]
+}
+
+// FromErrno returns the canonical error for a Unix error number, or nil if
+// there is none. Where several canonical errors share an error number, the
+// most general one is returned.
+func FromErrno(errno uint32) *Error {
+	return byErrno[errno]
+}
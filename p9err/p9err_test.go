@@ -0,0 +1,41 @@
+package p9err
+
+import (
+	"errors"
+	"io/fs"
+	"testing"
+)
+
+func TestIs(t *testing.T) {
+	tests := []struct {
+		err    error
+		target error
+		is     bool
+	}{
+		{&Error{Err: "file does not exist"}, ErrNotExist, true},
+		{&Error{Err: "file does not exist"}, fs.ErrNotExist, true},
+		{&Error{Err: "no such file or directory", Errno: 2}, fs.ErrNotExist, true},
+		{&Error{Err: "no such file or directory", Errno: 2}, ErrNotExist, false},
+		{ErrPermission, fs.ErrPermission, true},
+		{ErrExist, fs.ErrExist, true},
+		{ErrIsDir, fs.ErrNotExist, false},
+		{&Error{Err: "something else"}, fs.ErrNotExist, false},
+	}
+
+	for _, tt := range tests {
+		if is := errors.Is(tt.err, tt.target); is != tt.is {
+			t.Errorf("errors.Is(%q, %q) = %v, expected %v", tt.err, tt.target, is, tt.is)
+		}
+	}
+}
+
+func TestLookup(t *testing.T) {
+	for _, e := range canonical {
+		if Lookup(e.Err) != e {
+			t.Errorf("lookup of %q did not return the canonical error", e.Err)
+		}
+		if c := FromErrno(e.Errno); c == nil || c.Errno != e.Errno {
+			t.Errorf("no canonical error for errno %d", e.Errno)
+		}
+	}
+}
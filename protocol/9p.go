@@ -1,5 +1,6 @@
 /*
-Package protocol implements the 9P2000 protocol.
+Package protocol implements the 9P2000 protocol, as well as the 9P2000.u and
+9P2000.L extensions.
 
 This module contains definitions of the protocol messages. In some cases, the
 struct skips fields that are redundant in a Go context, such as a fields that
@@ -24,7 +25,8 @@ func (m MessageType) IsRequest() bool {
 
 // Tag is a unique identifier for a request. It is echoed by the response. It
 // is the responsibility of the client to ensure that it is unique among all
-// current requests.
+// current requests. The g9p client treats a zero tag in a request as a request
+// for a free tag, which it assigns to the request when sent.
 type Tag uint16
 
 // Fid, or "file identifier", is quite similar in concept to a file descriptor,
@@ -90,6 +92,21 @@ func (q *Qid) Encode(w io.Writer) error {
 	return nil
 }
 
+func (q *Qid) MarshalAppend(b []byte) []byte {
+	b = appendUint8(b, uint8(q.Type))
+	b = appendUint32(b, q.Version)
+	b = appendUint64(b, q.Path)
+	return b
+}
+
+func (q *Qid) Unmarshal(b []byte) error {
+	dec := decoder{b: b}
+	q.Type = QidType(dec.uint8())
+	q.Version = dec.uint32()
+	q.Path = dec.uint64()
+	return dec.err
+}
+
 // Stat is a directory entry, providing detailed information of a file. It is
 // called "Dir" in many other implementations.
 type Stat struct {
@@ -125,13 +142,54 @@ type Stat struct {
 
 	// MUID is the user who last modified the file.
 	MUID string
+
+	// Extension carries special file information in 9P2000.u, such as the
+	// target of a symlink or the numbers of a device file.
+	Extension string
+
+	// NUID is the numeric id of the owning user in 9P2000.u.
+	NUID uint32
+
+	// NGID is the numeric id of the owning group in 9P2000.u.
+	NGID uint32
+
+	// NMUID is the numeric id of the user who last modified the file in
+	// 9P2000.u.
+	NMUID uint32
+}
+
+// DontTouch returns a stat with every field set to its "don't touch" value,
+// which changes nothing when used with WriteStat. Fields to be changed may
+// then be set individually.
+func DontTouch() Stat {
+	return Stat{
+		Type:   ^uint16(0),
+		Dev:    ^uint32(0),
+		Qid:    Qid{Type: ^QidType(0), Version: ^uint32(0), Path: ^uint64(0)},
+		Mode:   ^FileMode(0),
+		Atime:  ^uint32(0),
+		Mtime:  ^uint32(0),
+		Length: ^uint64(0),
+	}
 }
 
 func (s *Stat) EncodedLength() int {
-	return 2 + 2 + 4 + 13 + 4 + 4 + 4 + 8 + 8 + len(s.Name) + len(s.UID) + len(s.GID) + len(s.MUID)
+	return s.EncodedLengthDialect(Dialect9P2000)
+}
+
+func (s *Stat) EncodedLengthDialect(d Dialect) int {
+	l := 2 + 2 + 4 + 13 + 4 + 4 + 4 + 8 + 8 + len(s.Name) + len(s.UID) + len(s.GID) + len(s.MUID)
+	if d == Dialect9P2000u {
+		l += 2 + len(s.Extension) + 4 + 4 + 4
+	}
+	return l
 }
 
 func (s *Stat) Decode(r io.Reader) error {
+	return s.DecodeDialect(r, Dialect9P2000)
+}
+
+func (s *Stat) DecodeDialect(r io.Reader, d Dialect) error {
 	var err error
 
 	// We have no use of this length
@@ -172,13 +230,32 @@ func (s *Stat) Decode(r io.Reader) error {
 	if s.MUID, err = ReadString(r); err != nil {
 		return err
 	}
+	if d != Dialect9P2000u {
+		return nil
+	}
+	if s.Extension, err = ReadString(r); err != nil {
+		return err
+	}
+	if s.NUID, err = ReadUint32(r); err != nil {
+		return err
+	}
+	if s.NGID, err = ReadUint32(r); err != nil {
+		return err
+	}
+	if s.NMUID, err = ReadUint32(r); err != nil {
+		return err
+	}
 	return nil
 }
 
 func (s *Stat) Encode(w io.Writer) error {
+	return s.EncodeDialect(w, Dialect9P2000)
+}
+
+func (s *Stat) EncodeDialect(w io.Writer, d Dialect) error {
 	var err error
 
-	l := uint16(s.EncodedLength() - 2)
+	l := uint16(s.EncodedLengthDialect(d) - 2)
 
 	if err = WriteUint16(w, l); err != nil {
 		return err
@@ -216,10 +293,81 @@ func (s *Stat) Encode(w io.Writer) error {
 	if err = WriteString(w, s.MUID); err != nil {
 		return err
 	}
+	if d != Dialect9P2000u {
+		return nil
+	}
+	if err = WriteString(w, s.Extension); err != nil {
+		return err
+	}
+	if err = WriteUint32(w, s.NUID); err != nil {
+		return err
+	}
+	if err = WriteUint32(w, s.NGID); err != nil {
+		return err
+	}
+	if err = WriteUint32(w, s.NMUID); err != nil {
+		return err
+	}
 
 	return nil
 }
 
+func (s *Stat) MarshalAppend(b []byte) []byte {
+	return s.MarshalAppendDialect(b, Dialect9P2000)
+}
+
+func (s *Stat) MarshalAppendDialect(b []byte, d Dialect) []byte {
+	b = appendUint16(b, uint16(s.EncodedLengthDialect(d)-2))
+	b = appendUint16(b, s.Type)
+	b = appendUint32(b, s.Dev)
+	b = s.Qid.MarshalAppend(b)
+	b = appendUint32(b, uint32(s.Mode))
+	b = appendUint32(b, s.Atime)
+	b = appendUint32(b, s.Mtime)
+	b = appendUint64(b, s.Length)
+	b = appendString(b, s.Name)
+	b = appendString(b, s.UID)
+	b = appendString(b, s.GID)
+	b = appendString(b, s.MUID)
+	if d == Dialect9P2000u {
+		b = appendString(b, s.Extension)
+		b = appendUint32(b, s.NUID)
+		b = appendUint32(b, s.NGID)
+		b = appendUint32(b, s.NMUID)
+	}
+	return b
+}
+
+func (s *Stat) Unmarshal(b []byte) error {
+	return s.UnmarshalDialect(b, Dialect9P2000)
+}
+
+func (s *Stat) UnmarshalDialect(b []byte, d Dialect) error {
+	dec := decoder{b: b}
+
+	// We have no use of this length
+	dec.uint16()
+
+	s.Type = dec.uint16()
+	s.Dev = dec.uint32()
+	dec.codec(&s.Qid, 13)
+	s.Mode = FileMode(dec.uint32())
+	s.Atime = dec.uint32()
+	s.Mtime = dec.uint32()
+	s.Length = dec.uint64()
+	s.Name = dec.string()
+	s.UID = dec.string()
+	s.GID = dec.string()
+	s.MUID = dec.string()
+	if d == Dialect9P2000u {
+		s.Extension = dec.string()
+		s.NUID = dec.uint32()
+		s.NGID = dec.uint32()
+		s.NMUID = dec.uint32()
+	}
+	return dec.err
+}
+
 //
 // Message type structs and the encode/decode methods below.
 //
@@ -278,6 +426,21 @@ func (vr *VersionRequest) Encode(w io.Writer) error {
 	return nil
 }
 
+func (vr *VersionRequest) MarshalAppend(b []byte) []byte {
+	b = appendTag(b, vr.Tag)
+	b = appendUint32(b, vr.MaxSize)
+	b = appendString(b, vr.Version)
+	return b
+}
+
+func (vr *VersionRequest) Unmarshal(b []byte) error {
+	dec := decoder{b: b}
+	vr.Tag = dec.tag()
+	vr.MaxSize = dec.uint32()
+	vr.Version = dec.string()
+	return dec.err
+}
+
 // VersionResponse is used to inform the client of maximum size and version,
 // taking the clients VersionRequest into consideration. MaxSize in the reply
 // must not be larger than MaxSize in the request, and the version must
@@ -332,6 +495,21 @@ func (vr *VersionResponse) Encode(w io.Writer) error {
 	return nil
 }
 
+func (vr *VersionResponse) MarshalAppend(b []byte) []byte {
+	b = appendTag(b, vr.Tag)
+	b = appendUint32(b, vr.MaxSize)
+	b = appendString(b, vr.Version)
+	return b
+}
+
+func (vr *VersionResponse) Unmarshal(b []byte) error {
+	dec := decoder{b: b}
+	vr.Tag = dec.tag()
+	vr.MaxSize = dec.uint32()
+	vr.Version = dec.string()
+	return dec.err
+}
+
 // AuthRequest is used to request and authentication protocol connection from
 // the server. The AuthFid can be used to read/write the authentication
 // protocol. The protocol itself is not part of 9P2000.
@@ -346,6 +524,10 @@ type AuthRequest struct {
 
 	// Service is the service to authenticate access to.
 	Service string
+
+	// NUsername is the numeric id of the user in 9P2000.u and 9P2000.L, or
+	// NONUNAME.
+	NUsername uint32
 }
 
 func (ar *AuthRequest) GetTag() Tag {
@@ -357,10 +539,22 @@ func (ar *AuthRequest) SetTag(t Tag) {
 }
 
 func (ar *AuthRequest) EncodedLength() int {
-	return 2 + 4 + 2 + len(ar.Username) + 2 + len(ar.Service)
+	return ar.EncodedLengthDialect(Dialect9P2000)
+}
+
+func (ar *AuthRequest) EncodedLengthDialect(d Dialect) int {
+	l := 2 + 4 + 2 + len(ar.Username) + 2 + len(ar.Service)
+	if d != Dialect9P2000 {
+		l += 4
+	}
+	return l
 }
 
 func (ar *AuthRequest) Decode(r io.Reader) error {
+	return ar.DecodeDialect(r, Dialect9P2000)
+}
+
+func (ar *AuthRequest) DecodeDialect(r io.Reader, d Dialect) error {
 	var err error
 	if ar.Tag, err = ReadTag(r); err != nil {
 		return err
@@ -374,10 +568,20 @@ func (ar *AuthRequest) Decode(r io.Reader) error {
 	if ar.Service, err = ReadString(r); err != nil {
 		return err
 	}
+	if d == Dialect9P2000 {
+		return nil
+	}
+	if ar.NUsername, err = ReadUint32(r); err != nil {
+		return err
+	}
 	return nil
 }
 
 func (ar *AuthRequest) Encode(w io.Writer) error {
+	return ar.EncodeDialect(w, Dialect9P2000)
+}
+
+func (ar *AuthRequest) EncodeDialect(w io.Writer, d Dialect) error {
 	var err error
 	if err = WriteTag(w, ar.Tag); err != nil {
 		return err
@@ -391,9 +595,46 @@ func (ar *AuthRequest) Encode(w io.Writer) error {
 	if err = WriteString(w, ar.Service); err != nil {
 		return err
 	}
+	if d == Dialect9P2000 {
+		return nil
+	}
+	if err = WriteUint32(w, ar.NUsername); err != nil {
+		return err
+	}
 	return nil
 }
 
+func (ar *AuthRequest) MarshalAppend(b []byte) []byte {
+	return ar.MarshalAppendDialect(b, Dialect9P2000)
+}
+
+func (ar *AuthRequest) MarshalAppendDialect(b []byte, d Dialect) []byte {
+	b = appendTag(b, ar.Tag)
+	b = appendFid(b, ar.AuthFid)
+	b = appendString(b, ar.Username)
+	b = appendString(b, ar.Service)
+	if d != Dialect9P2000 {
+		b = appendUint32(b, ar.NUsername)
+	}
+	return b
+}
+
+func (ar *AuthRequest) Unmarshal(b []byte) error {
+	return ar.UnmarshalDialect(b, Dialect9P2000)
+}
+
+func (ar *AuthRequest) UnmarshalDialect(b []byte, d Dialect) error {
+	dec := decoder{b: b}
+	ar.Tag = dec.tag()
+	ar.AuthFid = dec.fid()
+	ar.Username = dec.string()
+	ar.Service = dec.string()
+	if d != Dialect9P2000 {
+		ar.NUsername = dec.uint32()
+	}
+	return dec.err
+}
+
 // AuthResponse is used to acknowledge the authentication protocol connection,
 // and to return the matching Qid.
 type AuthResponse struct {
@@ -437,6 +678,19 @@ func (ar *AuthResponse) Encode(w io.Writer) error {
 	return nil
 }
 
+func (ar *AuthResponse) MarshalAppend(b []byte) []byte {
+	b = appendTag(b, ar.Tag)
+	b = ar.AuthQid.MarshalAppend(b)
+	return b
+}
+
+func (ar *AuthResponse) Unmarshal(b []byte) error {
+	dec := decoder{b: b}
+	ar.Tag = dec.tag()
+	dec.codec(&ar.AuthQid, 13)
+	return dec.err
+}
+
 // AttachRequest is used to establish a connection to a service as a user, and
 // attach a fid to the root of the service.
 type AttachRequest struct {
@@ -454,6 +708,10 @@ type AttachRequest struct {
 
 	// Service is the service that will be accessed.
 	Service string
+
+	// NUsername is the numeric id of the user in 9P2000.u and 9P2000.L, or
+	// NONUNAME.
+	NUsername uint32
 }
 
 func (ar *AttachRequest) GetTag() Tag {
@@ -465,10 +723,22 @@ func (ar *AttachRequest) SetTag(t Tag) {
 }
 
 func (ar *AttachRequest) EncodedLength() int {
-	return 2 + 4 + 4 + 2 + len(ar.Username) + 2 + len(ar.Service)
+	return ar.EncodedLengthDialect(Dialect9P2000)
+}
+
+func (ar *AttachRequest) EncodedLengthDialect(d Dialect) int {
+	l := 2 + 4 + 4 + 2 + len(ar.Username) + 2 + len(ar.Service)
+	if d != Dialect9P2000 {
+		l += 4
+	}
+	return l
 }
 
 func (ar *AttachRequest) Decode(r io.Reader) error {
+	return ar.DecodeDialect(r, Dialect9P2000)
+}
+
+func (ar *AttachRequest) DecodeDialect(r io.Reader, d Dialect) error {
 	var err error
 	if ar.Tag, err = ReadTag(r); err != nil {
 		return err
@@ -485,10 +755,20 @@ func (ar *AttachRequest) Decode(r io.Reader) error {
 	if ar.Service, err = ReadString(r); err != nil {
 		return err
 	}
+	if d == Dialect9P2000 {
+		return nil
+	}
+	if ar.NUsername, err = ReadUint32(r); err != nil {
+		return err
+	}
 	return nil
 }
 
 func (ar *AttachRequest) Encode(w io.Writer) error {
+	return ar.EncodeDialect(w, Dialect9P2000)
+}
+
+func (ar *AttachRequest) EncodeDialect(w io.Writer, d Dialect) error {
 	var err error
 	if err = WriteTag(w, ar.Tag); err != nil {
 		return err
@@ -505,9 +785,48 @@ func (ar *AttachRequest) Encode(w io.Writer) error {
 	if err = WriteString(w, ar.Service); err != nil {
 		return err
 	}
+	if d == Dialect9P2000 {
+		return nil
+	}
+	if err = WriteUint32(w, ar.NUsername); err != nil {
+		return err
+	}
 	return nil
 }
 
+func (ar *AttachRequest) MarshalAppend(b []byte) []byte {
+	return ar.MarshalAppendDialect(b, Dialect9P2000)
+}
+
+func (ar *AttachRequest) MarshalAppendDialect(b []byte, d Dialect) []byte {
+	b = appendTag(b, ar.Tag)
+	b = appendFid(b, ar.Fid)
+	b = appendFid(b, ar.AuthFid)
+	b = appendString(b, ar.Username)
+	b = appendString(b, ar.Service)
+	if d != Dialect9P2000 {
+		b = appendUint32(b, ar.NUsername)
+	}
+	return b
+}
+
+func (ar *AttachRequest) Unmarshal(b []byte) error {
+	return ar.UnmarshalDialect(b, Dialect9P2000)
+}
+
+func (ar *AttachRequest) UnmarshalDialect(b []byte, d Dialect) error {
+	dec := decoder{b: b}
+	ar.Tag = dec.tag()
+	ar.Fid = dec.fid()
+	ar.AuthFid = dec.fid()
+	ar.Username = dec.string()
+	ar.Service = dec.string()
+	if d != Dialect9P2000 {
+		ar.NUsername = dec.uint32()
+	}
+	return dec.err
+}
+
 // AttachResponse acknowledges an attach.
 type AttachResponse struct {
 	Tag Tag
@@ -550,6 +869,19 @@ func (ar *AttachResponse) Encode(w io.Writer) error {
 	return nil
 }
 
+func (ar *AttachResponse) MarshalAppend(b []byte) []byte {
+	b = appendTag(b, ar.Tag)
+	b = ar.Qid.MarshalAppend(b)
+	return b
+}
+
+func (ar *AttachResponse) Unmarshal(b []byte) error {
+	dec := decoder{b: b}
+	ar.Tag = dec.tag()
+	dec.codec(&ar.Qid, 13)
+	return dec.err
+}
+
 // ErrorResponse is used when the server wants to report and error with the
 // request. There is no ErrorRequest, as such a thing would not make sense.
 type ErrorResponse struct {
@@ -557,6 +889,10 @@ type ErrorResponse struct {
 
 	// Error is the error string.
 	Error string
+
+	// Errno is the Unix error number in 9P2000.u, or 0 if the error string
+	// should be used instead.
+	Errno uint32
 }
 
 func (er *ErrorResponse) GetTag() Tag {
@@ -568,10 +904,22 @@ func (er *ErrorResponse) SetTag(t Tag) {
 }
 
 func (er *ErrorResponse) EncodedLength() int {
-	return 2 + 2 + len(er.Error)
+	return er.EncodedLengthDialect(Dialect9P2000)
+}
+
+func (er *ErrorResponse) EncodedLengthDialect(d Dialect) int {
+	l := 2 + 2 + len(er.Error)
+	if d == Dialect9P2000u {
+		l += 4
+	}
+	return l
 }
 
 func (er *ErrorResponse) Decode(r io.Reader) error {
+	return er.DecodeDialect(r, Dialect9P2000)
+}
+
+func (er *ErrorResponse) DecodeDialect(r io.Reader, d Dialect) error {
 	var err error
 	if er.Tag, err = ReadTag(r); err != nil {
 		return err
@@ -579,10 +927,20 @@ func (er *ErrorResponse) Decode(r io.Reader) error {
 	if er.Error, err = ReadString(r); err != nil {
 		return err
 	}
+	if d != Dialect9P2000u {
+		return nil
+	}
+	if er.Errno, err = ReadUint32(r); err != nil {
+		return err
+	}
 	return nil
 }
 
 func (er *ErrorResponse) Encode(w io.Writer) error {
+	return er.EncodeDialect(w, Dialect9P2000)
+}
+
+func (er *ErrorResponse) EncodeDialect(w io.Writer, d Dialect) error {
 	var err error
 	if err = WriteTag(w, er.Tag); err != nil {
 		return err
@@ -590,15 +948,49 @@ func (er *ErrorResponse) Encode(w io.Writer) error {
 	if err = WriteString(w, er.Error); err != nil {
 		return err
 	}
+	if d != Dialect9P2000u {
+		return nil
+	}
+	if err = WriteUint32(w, er.Errno); err != nil {
+		return err
+	}
 	return nil
 }
 
+func (er *ErrorResponse) MarshalAppend(b []byte) []byte {
+	return er.MarshalAppendDialect(b, Dialect9P2000)
+}
+
+func (er *ErrorResponse) MarshalAppendDialect(b []byte, d Dialect) []byte {
+	b = appendTag(b, er.Tag)
+	b = appendString(b, er.Error)
+	if d == Dialect9P2000u {
+		b = appendUint32(b, er.Errno)
+	}
+	return b
+}
+
+func (er *ErrorResponse) Unmarshal(b []byte) error {
+	return er.UnmarshalDialect(b, Dialect9P2000)
+}
+
+func (er *ErrorResponse) UnmarshalDialect(b []byte, d Dialect) error {
+	dec := decoder{b: b}
+	er.Tag = dec.tag()
+	er.Error = dec.string()
+	if d == Dialect9P2000u {
+		er.Errno = dec.uint32()
+	}
+	return dec.err
+}
+
 // FlushRequest is used to cancel a pending request. The flushed tag can be
 // used after a response have been received.
 type FlushRequest struct {
 	Tag Tag
 
-	// OldTag is the tag of the request to cancel.
+	// OldTag is the tag of the request to cancel. For a request sent with a
+	// zero tag, it is the tag assigned to the request when it was sent.
 	OldTag Tag
 }
 
@@ -636,6 +1028,19 @@ func (fr *FlushRequest) Encode(w io.Writer) error {
 	return nil
 }
 
+func (fr *FlushRequest) MarshalAppend(b []byte) []byte {
+	b = appendTag(b, fr.Tag)
+	b = appendTag(b, fr.OldTag)
+	return b
+}
+
+func (fr *FlushRequest) Unmarshal(b []byte) error {
+	dec := decoder{b: b}
+	fr.Tag = dec.tag()
+	fr.OldTag = dec.tag()
+	return dec.err
+}
+
 // FlushResponse is used to indicate a successful flush. Do note that
 // FlushResponse have a peculiar behaviour when multiple flushes are pending.
 type FlushResponse struct {
@@ -670,6 +1075,17 @@ func (fr *FlushResponse) Encode(w io.Writer) error {
 	return nil
 }
 
+func (fr *FlushResponse) MarshalAppend(b []byte) []byte {
+	b = appendTag(b, fr.Tag)
+	return b
+}
+
+func (fr *FlushResponse) Unmarshal(b []byte) error {
+	dec := decoder{b: b}
+	fr.Tag = dec.tag()
+	return dec.err
+}
+
 // WalkRequest is used to walk into directories, starting from the current fid.
 // All but the last name must be directories. If the walk succeeds, the file is
 // assigned to NewFid.
@@ -717,6 +1133,9 @@ func (wr *WalkRequest) Decode(r io.Reader) error {
 	if arr, err = ReadUint16(r); err != nil {
 		return err
 	}
+	if err = checkRemaining(r, 2*int64(arr)); err != nil {
+		return err
+	}
 	wr.Names = make([]string, arr)
 	for i := 0; i < int(arr); i++ {
 		if wr.Names[i], err = ReadString(r); err != nil {
@@ -748,6 +1167,29 @@ func (wr *WalkRequest) Encode(w io.Writer) error {
 	return nil
 }
 
+func (wr *WalkRequest) MarshalAppend(b []byte) []byte {
+	b = appendTag(b, wr.Tag)
+	b = appendFid(b, wr.Fid)
+	b = appendFid(b, wr.NewFid)
+	b = appendUint16(b, uint16(len(wr.Names)))
+	for i := range wr.Names {
+		b = appendString(b, wr.Names[i])
+	}
+	return b
+}
+
+func (wr *WalkRequest) Unmarshal(b []byte) error {
+	dec := decoder{b: b}
+	wr.Tag = dec.tag()
+	wr.Fid = dec.fid()
+	wr.NewFid = dec.fid()
+	wr.Names = make([]string, dec.count(2))
+	for i := range wr.Names {
+		wr.Names[i] = dec.string()
+	}
+	return dec.err
+}
+
 // WalkResponse returns the qids for each successfully walked element. If the
 // walk is successful, the amount of qids will be identical to the amount of
 // names.
@@ -779,6 +1221,9 @@ func (wr *WalkResponse) Decode(r io.Reader) error {
 	if arr, err = ReadUint16(r); err != nil {
 		return err
 	}
+	if err = checkRemaining(r, 13*int64(arr)); err != nil {
+		return err
+	}
 	wr.Qids = make([]Qid, arr)
 	for i := 0; i < int(arr); i++ {
 		if err = wr.Qids[i].Decode(r); err != nil {
@@ -804,6 +1249,25 @@ func (wr *WalkResponse) Encode(w io.Writer) error {
 	return nil
 }
 
+func (wr *WalkResponse) MarshalAppend(b []byte) []byte {
+	b = appendTag(b, wr.Tag)
+	b = appendUint16(b, uint16(len(wr.Qids)))
+	for i := range wr.Qids {
+		b = wr.Qids[i].MarshalAppend(b)
+	}
+	return b
+}
+
+func (wr *WalkResponse) Unmarshal(b []byte) error {
+	dec := decoder{b: b}
+	wr.Tag = dec.tag()
+	wr.Qids = make([]Qid, dec.count(13))
+	for i := range wr.Qids {
+		dec.codec(&wr.Qids[i], 13)
+	}
+	return dec.err
+}
+
 // OpenRequest is used to open a fid for reading/writing/executing.
 type OpenRequest struct {
 	Tag Tag
@@ -855,6 +1319,21 @@ func (or *OpenRequest) Encode(w io.Writer) error {
 	return nil
 }
 
+func (or *OpenRequest) MarshalAppend(b []byte) []byte {
+	b = appendTag(b, or.Tag)
+	b = appendFid(b, or.Fid)
+	b = appendUint8(b, uint8(or.Mode))
+	return b
+}
+
+func (or *OpenRequest) Unmarshal(b []byte) error {
+	dec := decoder{b: b}
+	or.Tag = dec.tag()
+	or.Fid = dec.fid()
+	or.Mode = OpenMode(dec.uint8())
+	return dec.err
+}
+
 // OpenResponse returns the qid of the file, as well as iounit, which is a
 // read/write size that is guaranteed to be sucessfully written/read, or 0 for
 // no such guarantee.
@@ -909,6 +1388,21 @@ func (or *OpenResponse) Encode(w io.Writer) error {
 	return nil
 }
 
+func (or *OpenResponse) MarshalAppend(b []byte) []byte {
+	b = appendTag(b, or.Tag)
+	b = or.Qid.MarshalAppend(b)
+	b = appendUint32(b, or.IOUnit)
+	return b
+}
+
+func (or *OpenResponse) Unmarshal(b []byte) error {
+	dec := decoder{b: b}
+	or.Tag = dec.tag()
+	dec.codec(&or.Qid, 13)
+	or.IOUnit = dec.uint32()
+	return dec.err
+}
+
 // CreateRequest tries to create a file in the current directory with the
 // provided permissions, and then open it with behaviour identical to
 // OpenRequest. A directory is created by creating a file with the DMDIR
@@ -928,6 +1422,10 @@ type CreateRequest struct {
 
 	// Mode is the mode the file should be opened under.
 	Mode OpenMode
+
+	// Extension carries special file information in 9P2000.u, such as the
+	// target of a symlink or the numbers of a device file.
+	Extension string
 }
 
 func (cr *CreateRequest) GetTag() Tag {
@@ -939,10 +1437,22 @@ func (cr *CreateRequest) SetTag(t Tag) {
 }
 
 func (cr *CreateRequest) EncodedLength() int {
-	return 2 + 4 + 2 + len(cr.Name) + 4 + 1
+	return cr.EncodedLengthDialect(Dialect9P2000)
+}
+
+func (cr *CreateRequest) EncodedLengthDialect(d Dialect) int {
+	l := 2 + 4 + 2 + len(cr.Name) + 4 + 1
+	if d == Dialect9P2000u {
+		l += 2 + len(cr.Extension)
+	}
+	return l
 }
 
 func (cr *CreateRequest) Decode(r io.Reader) error {
+	return cr.DecodeDialect(r, Dialect9P2000)
+}
+
+func (cr *CreateRequest) DecodeDialect(r io.Reader, d Dialect) error {
 	var err error
 	if cr.Tag, err = ReadTag(r); err != nil {
 		return err
@@ -959,10 +1469,20 @@ func (cr *CreateRequest) Decode(r io.Reader) error {
 	if cr.Mode, err = ReadOpenMode(r); err != nil {
 		return err
 	}
+	if d != Dialect9P2000u {
+		return nil
+	}
+	if cr.Extension, err = ReadString(r); err != nil {
+		return err
+	}
 	return nil
 }
 
 func (cr *CreateRequest) Encode(w io.Writer) error {
+	return cr.EncodeDialect(w, Dialect9P2000)
+}
+
+func (cr *CreateRequest) EncodeDialect(w io.Writer, d Dialect) error {
 	var err error
 	if err = WriteTag(w, cr.Tag); err != nil {
 		return err
@@ -979,9 +1499,48 @@ func (cr *CreateRequest) Encode(w io.Writer) error {
 	if err = WriteOpenMode(w, cr.Mode); err != nil {
 		return err
 	}
+	if d != Dialect9P2000u {
+		return nil
+	}
+	if err = WriteString(w, cr.Extension); err != nil {
+		return err
+	}
 	return nil
 }
 
+func (cr *CreateRequest) MarshalAppend(b []byte) []byte {
+	return cr.MarshalAppendDialect(b, Dialect9P2000)
+}
+
+func (cr *CreateRequest) MarshalAppendDialect(b []byte, d Dialect) []byte {
+	b = appendTag(b, cr.Tag)
+	b = appendFid(b, cr.Fid)
+	b = appendString(b, cr.Name)
+	b = appendUint32(b, uint32(cr.Permissions))
+	b = appendUint8(b, uint8(cr.Mode))
+	if d == Dialect9P2000u {
+		b = appendString(b, cr.Extension)
+	}
+	return b
+}
+
+func (cr *CreateRequest) Unmarshal(b []byte) error {
+	return cr.UnmarshalDialect(b, Dialect9P2000)
+}
+
+func (cr *CreateRequest) UnmarshalDialect(b []byte, d Dialect) error {
+	dec := decoder{b: b}
+	cr.Tag = dec.tag()
+	cr.Fid = dec.fid()
+	cr.Name = dec.string()
+	cr.Permissions = FileMode(dec.uint32())
+	cr.Mode = OpenMode(dec.uint8())
+	if d == Dialect9P2000u {
+		cr.Extension = dec.string()
+	}
+	return dec.err
+}
+
 // CreateResponse returns the qid of the file, as well as iounit, which is a
 // read/write size that is guaranteed to be sucessfully written/read, or 0 for
 // no such guarantee.
@@ -1036,6 +1595,21 @@ func (cr *CreateResponse) Encode(w io.Writer) error {
 	return nil
 }
 
+func (cr *CreateResponse) MarshalAppend(b []byte) []byte {
+	b = appendTag(b, cr.Tag)
+	b = cr.Qid.MarshalAppend(b)
+	b = appendUint32(b, cr.IOUnit)
+	return b
+}
+
+func (cr *CreateResponse) Unmarshal(b []byte) error {
+	dec := decoder{b: b}
+	cr.Tag = dec.tag()
+	dec.codec(&cr.Qid, 13)
+	cr.IOUnit = dec.uint32()
+	return dec.err
+}
+
 // ReadRequest is used to read data from an open file.
 type ReadRequest struct {
 	Tag Tag
@@ -1096,6 +1670,23 @@ func (rr *ReadRequest) Encode(w io.Writer) error {
 	return nil
 }
 
+func (rr *ReadRequest) MarshalAppend(b []byte) []byte {
+	b = appendTag(b, rr.Tag)
+	b = appendFid(b, rr.Fid)
+	b = appendUint64(b, rr.Offset)
+	b = appendUint32(b, rr.Count)
+	return b
+}
+
+func (rr *ReadRequest) Unmarshal(b []byte) error {
+	dec := decoder{b: b}
+	rr.Tag = dec.tag()
+	rr.Fid = dec.fid()
+	rr.Offset = dec.uint64()
+	rr.Count = dec.uint32()
+	return dec.err
+}
+
 // ReadResponse returns read data.
 type ReadResponse struct {
 	Tag Tag
@@ -1125,6 +1716,9 @@ func (rr *ReadResponse) Decode(r io.Reader) error {
 	if l, err = ReadUint32(r); err != nil {
 		return err
 	}
+	if err = checkRemaining(r, int64(l)); err != nil {
+		return err
+	}
 	rr.Data = make([]byte, l)
 	if err = read(r, rr.Data); err != nil {
 		return err
@@ -1146,6 +1740,19 @@ func (rr *ReadResponse) Encode(w io.Writer) error {
 	return nil
 }
 
+func (rr *ReadResponse) MarshalAppend(b []byte) []byte {
+	b = appendTag(b, rr.Tag)
+	b = appendData(b, rr.Data)
+	return b
+}
+
+func (rr *ReadResponse) Unmarshal(b []byte) error {
+	dec := decoder{b: b}
+	rr.Tag = dec.tag()
+	rr.Data = dec.data()
+	return dec.err
+}
+
 // WriteRequest is used to write to an open file.
 type WriteRequest struct {
 	Tag Tag
@@ -1187,6 +1794,9 @@ func (wr *WriteRequest) Decode(r io.Reader) error {
 	if count, err = ReadUint32(r); err != nil {
 		return err
 	}
+	if err = checkRemaining(r, int64(count)); err != nil {
+		return err
+	}
 	wr.Data = make([]byte, count)
 	if err = read(r, wr.Data); err != nil {
 		return err
@@ -1214,6 +1824,23 @@ func (wr *WriteRequest) Encode(w io.Writer) error {
 	return nil
 }
 
+func (wr *WriteRequest) MarshalAppend(b []byte) []byte {
+	b = appendTag(b, wr.Tag)
+	b = appendFid(b, wr.Fid)
+	b = appendUint64(b, wr.Offset)
+	b = appendData(b, wr.Data)
+	return b
+}
+
+func (wr *WriteRequest) Unmarshal(b []byte) error {
+	dec := decoder{b: b}
+	wr.Tag = dec.tag()
+	wr.Fid = dec.fid()
+	wr.Offset = dec.uint64()
+	wr.Data = dec.data()
+	return dec.err
+}
+
 // WriteResponse informs of how much data was written.
 type WriteResponse struct {
 	Tag Tag
@@ -1256,6 +1883,19 @@ func (wr *WriteResponse) Encode(w io.Writer) error {
 	return nil
 }
 
+func (wr *WriteResponse) MarshalAppend(b []byte) []byte {
+	b = appendTag(b, wr.Tag)
+	b = appendUint32(b, wr.Count)
+	return b
+}
+
+func (wr *WriteResponse) Unmarshal(b []byte) error {
+	dec := decoder{b: b}
+	wr.Tag = dec.tag()
+	wr.Count = dec.uint32()
+	return dec.err
+}
+
 // ClunkRequest is used to clear a fid, allowing it to be reused.
 type ClunkRequest struct {
 	Tag Tag
@@ -1298,6 +1938,19 @@ func (cr *ClunkRequest) Encode(w io.Writer) error {
 	return nil
 }
 
+func (cr *ClunkRequest) MarshalAppend(b []byte) []byte {
+	b = appendTag(b, cr.Tag)
+	b = appendFid(b, cr.Fid)
+	return b
+}
+
+func (cr *ClunkRequest) Unmarshal(b []byte) error {
+	dec := decoder{b: b}
+	cr.Tag = dec.tag()
+	cr.Fid = dec.fid()
+	return dec.err
+}
+
 // ClunkResponse indicates a successful clunk.
 type ClunkResponse struct {
 	Tag Tag
@@ -1331,6 +1984,17 @@ func (cr *ClunkResponse) Encode(w io.Writer) error {
 	return nil
 }
 
+func (cr *ClunkResponse) MarshalAppend(b []byte) []byte {
+	b = appendTag(b, cr.Tag)
+	return b
+}
+
+func (cr *ClunkResponse) Unmarshal(b []byte) error {
+	dec := decoder{b: b}
+	cr.Tag = dec.tag()
+	return dec.err
+}
+
 // RemoveRequest is used to clunk a fid and remove the file if possible.
 type RemoveRequest struct {
 	Tag Tag
@@ -1373,6 +2037,19 @@ func (rr *RemoveRequest) Encode(w io.Writer) error {
 	return nil
 }
 
+func (rr *RemoveRequest) MarshalAppend(b []byte) []byte {
+	b = appendTag(b, rr.Tag)
+	b = appendFid(b, rr.Fid)
+	return b
+}
+
+func (rr *RemoveRequest) Unmarshal(b []byte) error {
+	dec := decoder{b: b}
+	rr.Tag = dec.tag()
+	rr.Fid = dec.fid()
+	return dec.err
+}
+
 // RemoveResponse indicates a successful clunk, but not necessarily a successful remove.
 type RemoveResponse struct {
 	Tag Tag
@@ -1406,6 +2083,17 @@ func (rr *RemoveResponse) Encode(w io.Writer) error {
 	return nil
 }
 
+func (rr *RemoveResponse) MarshalAppend(b []byte) []byte {
+	b = appendTag(b, rr.Tag)
+	return b
+}
+
+func (rr *RemoveResponse) Unmarshal(b []byte) error {
+	dec := decoder{b: b}
+	rr.Tag = dec.tag()
+	return dec.err
+}
+
 // StatRequest is used to retrieve the Stat struct of a file
 type StatRequest struct {
 	Tag Tag
@@ -1448,6 +2136,19 @@ func (sr *StatRequest) Encode(w io.Writer) error {
 	return nil
 }
 
+func (sr *StatRequest) MarshalAppend(b []byte) []byte {
+	b = appendTag(b, sr.Tag)
+	b = appendFid(b, sr.Fid)
+	return b
+}
+
+func (sr *StatRequest) Unmarshal(b []byte) error {
+	dec := decoder{b: b}
+	sr.Tag = dec.tag()
+	sr.Fid = dec.fid()
+	return dec.err
+}
+
 // StatResponse contains the Stat struct of a file.
 type StatResponse struct {
 	Tag Tag
@@ -1465,10 +2166,18 @@ func (sr *StatResponse) SetTag(t Tag) {
 }
 
 func (sr *StatResponse) EncodedLength() int {
-	return 2 + 2 + sr.Stat.EncodedLength()
+	return sr.EncodedLengthDialect(Dialect9P2000)
+}
+
+func (sr *StatResponse) EncodedLengthDialect(d Dialect) int {
+	return 2 + 2 + sr.Stat.EncodedLengthDialect(d)
 }
 
 func (sr *StatResponse) Decode(r io.Reader) error {
+	return sr.DecodeDialect(r, Dialect9P2000)
+}
+
+func (sr *StatResponse) DecodeDialect(r io.Reader, d Dialect) error {
 	var err error
 	if sr.Tag, err = ReadTag(r); err != nil {
 		return err
@@ -1479,29 +2188,59 @@ func (sr *StatResponse) Decode(r io.Reader) error {
 		return err
 	}
 
-	if err = sr.Stat.Decode(r); err != nil {
+	if err = sr.Stat.DecodeDialect(r, d); err != nil {
 		return err
 	}
 	return nil
 }
 
 func (sr *StatResponse) Encode(w io.Writer) error {
+	return sr.EncodeDialect(w, Dialect9P2000)
+}
+
+func (sr *StatResponse) EncodeDialect(w io.Writer, d Dialect) error {
 	var err error
 	if err = WriteTag(w, sr.Tag); err != nil {
 		return err
 	}
 
-	if err = WriteUint16(w, uint16(sr.Stat.EncodedLength())); err != nil {
+	if err = WriteUint16(w, uint16(sr.Stat.EncodedLengthDialect(d))); err != nil {
 		return err
 	}
 
-	if err = sr.Stat.Encode(w); err != nil {
+	if err = sr.Stat.EncodeDialect(w, d); err != nil {
 		return err
 	}
 
 	return nil
 }
 
+func (sr *StatResponse) MarshalAppend(b []byte) []byte {
+	return sr.MarshalAppendDialect(b, Dialect9P2000)
+}
+
+func (sr *StatResponse) MarshalAppendDialect(b []byte, d Dialect) []byte {
+	b = appendTag(b, sr.Tag)
+	b = appendUint16(b, uint16(sr.Stat.EncodedLengthDialect(d)))
+	b = sr.Stat.MarshalAppendDialect(b, d)
+	return b
+}
+
+func (sr *StatResponse) Unmarshal(b []byte) error {
+	return sr.UnmarshalDialect(b, Dialect9P2000)
+}
+
+func (sr *StatResponse) UnmarshalDialect(b []byte, d Dialect) error {
+	dec := decoder{b: b}
+	sr.Tag = dec.tag()
+
+	// We don't need the stat size
+	dec.uint16()
+
+	dec.stat(&sr.Stat, d)
+	return dec.err
+}
+
 // WriteStatRequest attempts to apply a Stat struct to a file. This requires a
 // combination of write permissions to the file as well as to the parent
 // directory, depending on the properties changed. Properties can be set to "no
@@ -1529,10 +2268,18 @@ func (wsr *WriteStatRequest) SetTag(t Tag) {
 }
 
 func (wsr *WriteStatRequest) EncodedLength() int {
-	return 2 + 4 + 2 + wsr.Stat.EncodedLength()
+	return wsr.EncodedLengthDialect(Dialect9P2000)
+}
+
+func (wsr *WriteStatRequest) EncodedLengthDialect(d Dialect) int {
+	return 2 + 4 + 2 + wsr.Stat.EncodedLengthDialect(d)
 }
 
 func (wsr *WriteStatRequest) Decode(r io.Reader) error {
+	return wsr.DecodeDialect(r, Dialect9P2000)
+}
+
+func (wsr *WriteStatRequest) DecodeDialect(r io.Reader, d Dialect) error {
 	var err error
 	if wsr.Tag, err = ReadTag(r); err != nil {
 		return err
@@ -1546,13 +2293,17 @@ func (wsr *WriteStatRequest) Decode(r io.Reader) error {
 		return err
 	}
 
-	if err = wsr.Stat.Decode(r); err != nil {
+	if err = wsr.Stat.DecodeDialect(r, d); err != nil {
 		return err
 	}
 	return nil
 }
 
 func (wsr *WriteStatRequest) Encode(w io.Writer) error {
+	return wsr.EncodeDialect(w, Dialect9P2000)
+}
+
+func (wsr *WriteStatRequest) EncodeDialect(w io.Writer, d Dialect) error {
 	var err error
 	if err = WriteTag(w, wsr.Tag); err != nil {
 		return err
@@ -1560,15 +2311,43 @@ func (wsr *WriteStatRequest) Encode(w io.Writer) error {
 	if err = WriteFid(w, wsr.Fid); err != nil {
 		return err
 	}
-	if err = WriteUint16(w, uint16(wsr.Stat.EncodedLength())); err != nil {
+	if err = WriteUint16(w, uint16(wsr.Stat.EncodedLengthDialect(d))); err != nil {
 		return err
 	}
-	if err = wsr.Stat.Encode(w); err != nil {
+	if err = wsr.Stat.EncodeDialect(w, d); err != nil {
 		return err
 	}
 	return nil
 }
 
+func (wsr *WriteStatRequest) MarshalAppend(b []byte) []byte {
+	return wsr.MarshalAppendDialect(b, Dialect9P2000)
+}
+
+func (wsr *WriteStatRequest) MarshalAppendDialect(b []byte, d Dialect) []byte {
+	b = appendTag(b, wsr.Tag)
+	b = appendFid(b, wsr.Fid)
+	b = appendUint16(b, uint16(wsr.Stat.EncodedLengthDialect(d)))
+	b = wsr.Stat.MarshalAppendDialect(b, d)
+	return b
+}
+
+func (wsr *WriteStatRequest) Unmarshal(b []byte) error {
+	return wsr.UnmarshalDialect(b, Dialect9P2000)
+}
+
+func (wsr *WriteStatRequest) UnmarshalDialect(b []byte, d Dialect) error {
+	dec := decoder{b: b}
+	wsr.Tag = dec.tag()
+	wsr.Fid = dec.fid()
+
+	// We don't need the stat size
+	dec.uint16()
+
+	dec.stat(&wsr.Stat, d)
+	return dec.err
+}
+
 // WriteStatResponse indicates a successful application of a Stat structure.
 type WriteStatResponse struct {
 	Tag Tag
@@ -1601,3 +2380,14 @@ func (wsr *WriteStatResponse) Encode(w io.Writer) error {
 	}
 	return nil
 }
+
+func (wsr *WriteStatResponse) MarshalAppend(b []byte) []byte {
+	b = appendTag(b, wsr.Tag)
+	return b
+}
+
+func (wsr *WriteStatResponse) Unmarshal(b []byte) error {
+	dec := decoder{b: b}
+	wsr.Tag = dec.tag()
+	return dec.err
+}
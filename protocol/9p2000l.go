@@ -0,0 +1,3185 @@
+package protocol
+
+import "io"
+
+//
+// Types that are part of 9P2000.L messages below.
+//
+
+// Attr contains the attributes of a file in 9P2000.L, as returned by
+// GetAttrResponse. It is similar to the Linux stat structure.
+type Attr struct {
+	// Valid is a mask of GETATTR bits describing the valid attributes.
+	Valid uint64
+
+	// Qid is the qid of the file.
+	Qid Qid
+
+	// Mode is the Linux mode of the file, including the file type.
+	Mode uint32
+
+	// UID is the numeric id of the owning user.
+	UID uint32
+
+	// GID is the numeric id of the owning group.
+	GID uint32
+
+	// NLink is the number of hard links to the file.
+	NLink uint64
+
+	// RDev is the device number of a device file.
+	RDev uint64
+
+	// Size is the size of the file in bytes.
+	Size uint64
+
+	// BlockSize is the optimal block size for I/O.
+	BlockSize uint64
+
+	// Blocks is the number of 512 byte blocks allocated.
+	Blocks uint64
+
+	// ATimeSec is the seconds part of the last access time.
+	ATimeSec uint64
+
+	// ATimeNsec is the nanoseconds part of the last access time.
+	ATimeNsec uint64
+
+	// MTimeSec is the seconds part of the last modification time.
+	MTimeSec uint64
+
+	// MTimeNsec is the nanoseconds part of the last modification time.
+	MTimeNsec uint64
+
+	// CTimeSec is the seconds part of the last status change time.
+	CTimeSec uint64
+
+	// CTimeNsec is the nanoseconds part of the last status change time.
+	CTimeNsec uint64
+
+	// BTimeSec is the seconds part of the creation time.
+	BTimeSec uint64
+
+	// BTimeNsec is the nanoseconds part of the creation time.
+	BTimeNsec uint64
+
+	// Gen is the inode generation number.
+	Gen uint64
+
+	// DataVersion is the data version of the file.
+	DataVersion uint64
+}
+
+func (*Attr) EncodedLength() int {
+	return 8 + 13 + 4 + 4 + 4 + 15*8
+}
+
+func (a *Attr) Decode(r io.Reader) error {
+	var err error
+	if a.Valid, err = ReadUint64(r); err != nil {
+		return err
+	}
+	if err = a.Qid.Decode(r); err != nil {
+		return err
+	}
+	if a.Mode, err = ReadUint32(r); err != nil {
+		return err
+	}
+	if a.UID, err = ReadUint32(r); err != nil {
+		return err
+	}
+	if a.GID, err = ReadUint32(r); err != nil {
+		return err
+	}
+	if a.NLink, err = ReadUint64(r); err != nil {
+		return err
+	}
+	if a.RDev, err = ReadUint64(r); err != nil {
+		return err
+	}
+	if a.Size, err = ReadUint64(r); err != nil {
+		return err
+	}
+	if a.BlockSize, err = ReadUint64(r); err != nil {
+		return err
+	}
+	if a.Blocks, err = ReadUint64(r); err != nil {
+		return err
+	}
+	if a.ATimeSec, err = ReadUint64(r); err != nil {
+		return err
+	}
+	if a.ATimeNsec, err = ReadUint64(r); err != nil {
+		return err
+	}
+	if a.MTimeSec, err = ReadUint64(r); err != nil {
+		return err
+	}
+	if a.MTimeNsec, err = ReadUint64(r); err != nil {
+		return err
+	}
+	if a.CTimeSec, err = ReadUint64(r); err != nil {
+		return err
+	}
+	if a.CTimeNsec, err = ReadUint64(r); err != nil {
+		return err
+	}
+	if a.BTimeSec, err = ReadUint64(r); err != nil {
+		return err
+	}
+	if a.BTimeNsec, err = ReadUint64(r); err != nil {
+		return err
+	}
+	if a.Gen, err = ReadUint64(r); err != nil {
+		return err
+	}
+	if a.DataVersion, err = ReadUint64(r); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (a *Attr) Encode(w io.Writer) error {
+	var err error
+	if err = WriteUint64(w, a.Valid); err != nil {
+		return err
+	}
+	if err = a.Qid.Encode(w); err != nil {
+		return err
+	}
+	if err = WriteUint32(w, a.Mode); err != nil {
+		return err
+	}
+	if err = WriteUint32(w, a.UID); err != nil {
+		return err
+	}
+	if err = WriteUint32(w, a.GID); err != nil {
+		return err
+	}
+	if err = WriteUint64(w, a.NLink); err != nil {
+		return err
+	}
+	if err = WriteUint64(w, a.RDev); err != nil {
+		return err
+	}
+	if err = WriteUint64(w, a.Size); err != nil {
+		return err
+	}
+	if err = WriteUint64(w, a.BlockSize); err != nil {
+		return err
+	}
+	if err = WriteUint64(w, a.Blocks); err != nil {
+		return err
+	}
+	if err = WriteUint64(w, a.ATimeSec); err != nil {
+		return err
+	}
+	if err = WriteUint64(w, a.ATimeNsec); err != nil {
+		return err
+	}
+	if err = WriteUint64(w, a.MTimeSec); err != nil {
+		return err
+	}
+	if err = WriteUint64(w, a.MTimeNsec); err != nil {
+		return err
+	}
+	if err = WriteUint64(w, a.CTimeSec); err != nil {
+		return err
+	}
+	if err = WriteUint64(w, a.CTimeNsec); err != nil {
+		return err
+	}
+	if err = WriteUint64(w, a.BTimeSec); err != nil {
+		return err
+	}
+	if err = WriteUint64(w, a.BTimeNsec); err != nil {
+		return err
+	}
+	if err = WriteUint64(w, a.Gen); err != nil {
+		return err
+	}
+	if err = WriteUint64(w, a.DataVersion); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (a *Attr) MarshalAppend(b []byte) []byte {
+	b = appendUint64(b, a.Valid)
+	b = a.Qid.MarshalAppend(b)
+	b = appendUint32(b, a.Mode)
+	b = appendUint32(b, a.UID)
+	b = appendUint32(b, a.GID)
+	b = appendUint64(b, a.NLink)
+	b = appendUint64(b, a.RDev)
+	b = appendUint64(b, a.Size)
+	b = appendUint64(b, a.BlockSize)
+	b = appendUint64(b, a.Blocks)
+	b = appendUint64(b, a.ATimeSec)
+	b = appendUint64(b, a.ATimeNsec)
+	b = appendUint64(b, a.MTimeSec)
+	b = appendUint64(b, a.MTimeNsec)
+	b = appendUint64(b, a.CTimeSec)
+	b = appendUint64(b, a.CTimeNsec)
+	b = appendUint64(b, a.BTimeSec)
+	b = appendUint64(b, a.BTimeNsec)
+	b = appendUint64(b, a.Gen)
+	b = appendUint64(b, a.DataVersion)
+	return b
+}
+
+func (a *Attr) Unmarshal(b []byte) error {
+	dec := decoder{b: b}
+	a.Valid = dec.uint64()
+	dec.codec(&a.Qid, 13)
+	a.Mode = dec.uint32()
+	a.UID = dec.uint32()
+	a.GID = dec.uint32()
+	a.NLink = dec.uint64()
+	a.RDev = dec.uint64()
+	a.Size = dec.uint64()
+	a.BlockSize = dec.uint64()
+	a.Blocks = dec.uint64()
+	a.ATimeSec = dec.uint64()
+	a.ATimeNsec = dec.uint64()
+	a.MTimeSec = dec.uint64()
+	a.MTimeNsec = dec.uint64()
+	a.CTimeSec = dec.uint64()
+	a.CTimeNsec = dec.uint64()
+	a.BTimeSec = dec.uint64()
+	a.BTimeNsec = dec.uint64()
+	a.Gen = dec.uint64()
+	a.DataVersion = dec.uint64()
+	return dec.err
+}
+
+// Dirent is a directory entry in 9P2000.L, as returned by ReadDirResponse.
+type Dirent struct {
+	// Qid is the qid of the file.
+	Qid Qid
+
+	// Offset is the offset to use in a ReadDirRequest to continue reading after
+	// this entry.
+	Offset uint64
+
+	// Type is the file type, as in the d_type field of a Linux dirent.
+	Type uint8
+
+	// Name is the name of the file.
+	Name string
+}
+
+func (d *Dirent) EncodedLength() int {
+	return 13 + 8 + 1 + 2 + len(d.Name)
+}
+
+func (d *Dirent) Decode(r io.Reader) error {
+	var err error
+	if err = d.Qid.Decode(r); err != nil {
+		return err
+	}
+	if d.Offset, err = ReadUint64(r); err != nil {
+		return err
+	}
+	if d.Type, err = ReadByte(r); err != nil {
+		return err
+	}
+	if d.Name, err = ReadString(r); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (d *Dirent) Encode(w io.Writer) error {
+	var err error
+	if err = d.Qid.Encode(w); err != nil {
+		return err
+	}
+	if err = WriteUint64(w, d.Offset); err != nil {
+		return err
+	}
+	if err = WriteByte(w, d.Type); err != nil {
+		return err
+	}
+	if err = WriteString(w, d.Name); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (d *Dirent) MarshalAppend(b []byte) []byte {
+	b = d.Qid.MarshalAppend(b)
+	b = appendUint64(b, d.Offset)
+	b = appendUint8(b, d.Type)
+	b = appendString(b, d.Name)
+	return b
+}
+
+func (d *Dirent) Unmarshal(b []byte) error {
+	dec := decoder{b: b}
+	dec.codec(&d.Qid, 13)
+	d.Offset = dec.uint64()
+	d.Type = dec.uint8()
+	d.Name = dec.string()
+	return dec.err
+}
+
+//
+// 9P2000.L message type structs and the encode/decode methods below.
+//
+
+// LinuxErrorResponse is the 9P2000.L replacement for ErrorResponse, carrying a
+// Linux error number instead of an error string.
+type LinuxErrorResponse struct {
+	Tag Tag
+
+	// Ecode is the Linux error number.
+	Ecode uint32
+}
+
+func (ler *LinuxErrorResponse) GetTag() Tag {
+	return ler.Tag
+}
+
+func (ler *LinuxErrorResponse) SetTag(t Tag) {
+	ler.Tag = t
+}
+
+func (*LinuxErrorResponse) EncodedLength() int {
+	return 2 + 4
+}
+
+func (ler *LinuxErrorResponse) Decode(r io.Reader) error {
+	var err error
+	if ler.Tag, err = ReadTag(r); err != nil {
+		return err
+	}
+	if ler.Ecode, err = ReadUint32(r); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (ler *LinuxErrorResponse) Encode(w io.Writer) error {
+	var err error
+	if err = WriteTag(w, ler.Tag); err != nil {
+		return err
+	}
+	if err = WriteUint32(w, ler.Ecode); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (ler *LinuxErrorResponse) MarshalAppend(b []byte) []byte {
+	b = appendTag(b, ler.Tag)
+	b = appendUint32(b, ler.Ecode)
+	return b
+}
+
+func (ler *LinuxErrorResponse) Unmarshal(b []byte) error {
+	dec := decoder{b: b}
+	ler.Tag = dec.tag()
+	ler.Ecode = dec.uint32()
+	return dec.err
+}
+
+// StatFSRequest is used to retrieve file system information, similar to
+// statfs(2).
+type StatFSRequest struct {
+	Tag Tag
+
+	// Fid is any fid on the file system to query.
+	Fid Fid
+}
+
+func (sfr *StatFSRequest) GetTag() Tag {
+	return sfr.Tag
+}
+
+func (sfr *StatFSRequest) SetTag(t Tag) {
+	sfr.Tag = t
+}
+
+func (*StatFSRequest) EncodedLength() int {
+	return 2 + 4
+}
+
+func (sfr *StatFSRequest) Decode(r io.Reader) error {
+	var err error
+	if sfr.Tag, err = ReadTag(r); err != nil {
+		return err
+	}
+	if sfr.Fid, err = ReadFid(r); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (sfr *StatFSRequest) Encode(w io.Writer) error {
+	var err error
+	if err = WriteTag(w, sfr.Tag); err != nil {
+		return err
+	}
+	if err = WriteFid(w, sfr.Fid); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (sfr *StatFSRequest) MarshalAppend(b []byte) []byte {
+	b = appendTag(b, sfr.Tag)
+	b = appendFid(b, sfr.Fid)
+	return b
+}
+
+func (sfr *StatFSRequest) Unmarshal(b []byte) error {
+	dec := decoder{b: b}
+	sfr.Tag = dec.tag()
+	sfr.Fid = dec.fid()
+	return dec.err
+}
+
+// StatFSResponse contains the file system information.
+type StatFSResponse struct {
+	Tag Tag
+
+	// Type is the file system type, as in statfs(2).
+	Type uint32
+
+	// BlockSize is the optimal transfer block size.
+	BlockSize uint32
+
+	// Blocks is the total amount of data blocks in the file system.
+	Blocks uint64
+
+	// BlocksFree is the amount of free blocks.
+	BlocksFree uint64
+
+	// BlocksAvailable is the amount of free blocks available to an unprivileged
+	// user.
+	BlocksAvailable uint64
+
+	// Files is the total amount of file nodes in the file system.
+	Files uint64
+
+	// FilesFree is the amount of free file nodes.
+	FilesFree uint64
+
+	// FSID is the file system id.
+	FSID uint64
+
+	// NameLength is the maximum length of file names.
+	NameLength uint32
+}
+
+func (sfr *StatFSResponse) GetTag() Tag {
+	return sfr.Tag
+}
+
+func (sfr *StatFSResponse) SetTag(t Tag) {
+	sfr.Tag = t
+}
+
+func (*StatFSResponse) EncodedLength() int {
+	return 2 + 4 + 4 + 8 + 8 + 8 + 8 + 8 + 8 + 4
+}
+
+func (sfr *StatFSResponse) Decode(r io.Reader) error {
+	var err error
+	if sfr.Tag, err = ReadTag(r); err != nil {
+		return err
+	}
+	if sfr.Type, err = ReadUint32(r); err != nil {
+		return err
+	}
+	if sfr.BlockSize, err = ReadUint32(r); err != nil {
+		return err
+	}
+	if sfr.Blocks, err = ReadUint64(r); err != nil {
+		return err
+	}
+	if sfr.BlocksFree, err = ReadUint64(r); err != nil {
+		return err
+	}
+	if sfr.BlocksAvailable, err = ReadUint64(r); err != nil {
+		return err
+	}
+	if sfr.Files, err = ReadUint64(r); err != nil {
+		return err
+	}
+	if sfr.FilesFree, err = ReadUint64(r); err != nil {
+		return err
+	}
+	if sfr.FSID, err = ReadUint64(r); err != nil {
+		return err
+	}
+	if sfr.NameLength, err = ReadUint32(r); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (sfr *StatFSResponse) Encode(w io.Writer) error {
+	var err error
+	if err = WriteTag(w, sfr.Tag); err != nil {
+		return err
+	}
+	if err = WriteUint32(w, sfr.Type); err != nil {
+		return err
+	}
+	if err = WriteUint32(w, sfr.BlockSize); err != nil {
+		return err
+	}
+	if err = WriteUint64(w, sfr.Blocks); err != nil {
+		return err
+	}
+	if err = WriteUint64(w, sfr.BlocksFree); err != nil {
+		return err
+	}
+	if err = WriteUint64(w, sfr.BlocksAvailable); err != nil {
+		return err
+	}
+	if err = WriteUint64(w, sfr.Files); err != nil {
+		return err
+	}
+	if err = WriteUint64(w, sfr.FilesFree); err != nil {
+		return err
+	}
+	if err = WriteUint64(w, sfr.FSID); err != nil {
+		return err
+	}
+	if err = WriteUint32(w, sfr.NameLength); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (sfr *StatFSResponse) MarshalAppend(b []byte) []byte {
+	b = appendTag(b, sfr.Tag)
+	b = appendUint32(b, sfr.Type)
+	b = appendUint32(b, sfr.BlockSize)
+	b = appendUint64(b, sfr.Blocks)
+	b = appendUint64(b, sfr.BlocksFree)
+	b = appendUint64(b, sfr.BlocksAvailable)
+	b = appendUint64(b, sfr.Files)
+	b = appendUint64(b, sfr.FilesFree)
+	b = appendUint64(b, sfr.FSID)
+	b = appendUint32(b, sfr.NameLength)
+	return b
+}
+
+func (sfr *StatFSResponse) Unmarshal(b []byte) error {
+	dec := decoder{b: b}
+	sfr.Tag = dec.tag()
+	sfr.Type = dec.uint32()
+	sfr.BlockSize = dec.uint32()
+	sfr.Blocks = dec.uint64()
+	sfr.BlocksFree = dec.uint64()
+	sfr.BlocksAvailable = dec.uint64()
+	sfr.Files = dec.uint64()
+	sfr.FilesFree = dec.uint64()
+	sfr.FSID = dec.uint64()
+	sfr.NameLength = dec.uint32()
+	return dec.err
+}
+
+// LinuxOpenRequest is the 9P2000.L replacement for OpenRequest, using Linux
+// open(2) flags instead of an OpenMode.
+type LinuxOpenRequest struct {
+	Tag Tag
+
+	// Fid is the file to open.
+	Fid Fid
+
+	// Flags are the Linux open(2) flags to open the file with.
+	Flags uint32
+}
+
+func (lor *LinuxOpenRequest) GetTag() Tag {
+	return lor.Tag
+}
+
+func (lor *LinuxOpenRequest) SetTag(t Tag) {
+	lor.Tag = t
+}
+
+func (*LinuxOpenRequest) EncodedLength() int {
+	return 2 + 4 + 4
+}
+
+func (lor *LinuxOpenRequest) Decode(r io.Reader) error {
+	var err error
+	if lor.Tag, err = ReadTag(r); err != nil {
+		return err
+	}
+	if lor.Fid, err = ReadFid(r); err != nil {
+		return err
+	}
+	if lor.Flags, err = ReadUint32(r); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (lor *LinuxOpenRequest) Encode(w io.Writer) error {
+	var err error
+	if err = WriteTag(w, lor.Tag); err != nil {
+		return err
+	}
+	if err = WriteFid(w, lor.Fid); err != nil {
+		return err
+	}
+	if err = WriteUint32(w, lor.Flags); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (lor *LinuxOpenRequest) MarshalAppend(b []byte) []byte {
+	b = appendTag(b, lor.Tag)
+	b = appendFid(b, lor.Fid)
+	b = appendUint32(b, lor.Flags)
+	return b
+}
+
+func (lor *LinuxOpenRequest) Unmarshal(b []byte) error {
+	dec := decoder{b: b}
+	lor.Tag = dec.tag()
+	lor.Fid = dec.fid()
+	lor.Flags = dec.uint32()
+	return dec.err
+}
+
+// LinuxOpenResponse returns the qid of the file, as well as iounit, which is a
+// read/write size that is guaranteed to be sucessfully written/read, or 0 for
+// no such guarantee.
+type LinuxOpenResponse struct {
+	Tag Tag
+
+	// Qid is the qid of the opened file.
+	Qid Qid
+
+	// IOUnit is the maximum amount of data that can be read/written by a single
+	// call, or 0 for no specification.
+	IOUnit uint32
+}
+
+func (lor *LinuxOpenResponse) GetTag() Tag {
+	return lor.Tag
+}
+
+func (lor *LinuxOpenResponse) SetTag(t Tag) {
+	lor.Tag = t
+}
+
+func (*LinuxOpenResponse) EncodedLength() int {
+	return 2 + 13 + 4
+}
+
+func (lor *LinuxOpenResponse) Decode(r io.Reader) error {
+	var err error
+	if lor.Tag, err = ReadTag(r); err != nil {
+		return err
+	}
+	if err = lor.Qid.Decode(r); err != nil {
+		return err
+	}
+	if lor.IOUnit, err = ReadUint32(r); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (lor *LinuxOpenResponse) Encode(w io.Writer) error {
+	var err error
+	if err = WriteTag(w, lor.Tag); err != nil {
+		return err
+	}
+	if err = lor.Qid.Encode(w); err != nil {
+		return err
+	}
+	if err = WriteUint32(w, lor.IOUnit); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (lor *LinuxOpenResponse) MarshalAppend(b []byte) []byte {
+	b = appendTag(b, lor.Tag)
+	b = lor.Qid.MarshalAppend(b)
+	b = appendUint32(b, lor.IOUnit)
+	return b
+}
+
+func (lor *LinuxOpenResponse) Unmarshal(b []byte) error {
+	dec := decoder{b: b}
+	lor.Tag = dec.tag()
+	dec.codec(&lor.Qid, 13)
+	lor.IOUnit = dec.uint32()
+	return dec.err
+}
+
+// LinuxCreateRequest is the 9P2000.L replacement for CreateRequest. It creates a
+// regular file in the directory represented by Fid and opens it, after which
+// Fid represents the new file.
+type LinuxCreateRequest struct {
+	Tag Tag
+
+	// Fid is the fid of the directory where the file should be created, but
+	// upon successful creation and opening, it changes to the opened file.
+	Fid Fid
+
+	// Name is the name of the file to create.
+	Name string
+
+	// Flags are the Linux open(2) flags to open the file with.
+	Flags uint32
+
+	// Mode is the Linux mode of the file to create.
+	Mode uint32
+
+	// GID is the numeric id of the group owning the file.
+	GID uint32
+}
+
+func (lcr *LinuxCreateRequest) GetTag() Tag {
+	return lcr.Tag
+}
+
+func (lcr *LinuxCreateRequest) SetTag(t Tag) {
+	lcr.Tag = t
+}
+
+func (lcr *LinuxCreateRequest) EncodedLength() int {
+	return 2 + 4 + 2 + len(lcr.Name) + 4 + 4 + 4
+}
+
+func (lcr *LinuxCreateRequest) Decode(r io.Reader) error {
+	var err error
+	if lcr.Tag, err = ReadTag(r); err != nil {
+		return err
+	}
+	if lcr.Fid, err = ReadFid(r); err != nil {
+		return err
+	}
+	if lcr.Name, err = ReadString(r); err != nil {
+		return err
+	}
+	if lcr.Flags, err = ReadUint32(r); err != nil {
+		return err
+	}
+	if lcr.Mode, err = ReadUint32(r); err != nil {
+		return err
+	}
+	if lcr.GID, err = ReadUint32(r); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (lcr *LinuxCreateRequest) Encode(w io.Writer) error {
+	var err error
+	if err = WriteTag(w, lcr.Tag); err != nil {
+		return err
+	}
+	if err = WriteFid(w, lcr.Fid); err != nil {
+		return err
+	}
+	if err = WriteString(w, lcr.Name); err != nil {
+		return err
+	}
+	if err = WriteUint32(w, lcr.Flags); err != nil {
+		return err
+	}
+	if err = WriteUint32(w, lcr.Mode); err != nil {
+		return err
+	}
+	if err = WriteUint32(w, lcr.GID); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (lcr *LinuxCreateRequest) MarshalAppend(b []byte) []byte {
+	b = appendTag(b, lcr.Tag)
+	b = appendFid(b, lcr.Fid)
+	b = appendString(b, lcr.Name)
+	b = appendUint32(b, lcr.Flags)
+	b = appendUint32(b, lcr.Mode)
+	b = appendUint32(b, lcr.GID)
+	return b
+}
+
+func (lcr *LinuxCreateRequest) Unmarshal(b []byte) error {
+	dec := decoder{b: b}
+	lcr.Tag = dec.tag()
+	lcr.Fid = dec.fid()
+	lcr.Name = dec.string()
+	lcr.Flags = dec.uint32()
+	lcr.Mode = dec.uint32()
+	lcr.GID = dec.uint32()
+	return dec.err
+}
+
+// LinuxCreateResponse returns the qid of the file, as well as iounit, which is
+// a read/write size that is guaranteed to be sucessfully written/read, or 0 for
+// no such guarantee.
+type LinuxCreateResponse struct {
+	Tag Tag
+
+	// Qid is the qid of the created file.
+	Qid Qid
+
+	// IOUnit is the maximum amount of data that can be read/written by a single
+	// call, or 0 for no specification.
+	IOUnit uint32
+}
+
+func (lcr *LinuxCreateResponse) GetTag() Tag {
+	return lcr.Tag
+}
+
+func (lcr *LinuxCreateResponse) SetTag(t Tag) {
+	lcr.Tag = t
+}
+
+func (*LinuxCreateResponse) EncodedLength() int {
+	return 2 + 13 + 4
+}
+
+func (lcr *LinuxCreateResponse) Decode(r io.Reader) error {
+	var err error
+	if lcr.Tag, err = ReadTag(r); err != nil {
+		return err
+	}
+	if err = lcr.Qid.Decode(r); err != nil {
+		return err
+	}
+	if lcr.IOUnit, err = ReadUint32(r); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (lcr *LinuxCreateResponse) Encode(w io.Writer) error {
+	var err error
+	if err = WriteTag(w, lcr.Tag); err != nil {
+		return err
+	}
+	if err = lcr.Qid.Encode(w); err != nil {
+		return err
+	}
+	if err = WriteUint32(w, lcr.IOUnit); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (lcr *LinuxCreateResponse) MarshalAppend(b []byte) []byte {
+	b = appendTag(b, lcr.Tag)
+	b = lcr.Qid.MarshalAppend(b)
+	b = appendUint32(b, lcr.IOUnit)
+	return b
+}
+
+func (lcr *LinuxCreateResponse) Unmarshal(b []byte) error {
+	dec := decoder{b: b}
+	lcr.Tag = dec.tag()
+	dec.codec(&lcr.Qid, 13)
+	lcr.IOUnit = dec.uint32()
+	return dec.err
+}
+
+// SymlinkRequest is used to create a symbolic link in a directory.
+type SymlinkRequest struct {
+	Tag Tag
+
+	// Fid is the directory to create the link in.
+	Fid Fid
+
+	// Name is the name of the link.
+	Name string
+
+	// Target is the target of the link.
+	Target string
+
+	// GID is the numeric id of the group owning the link.
+	GID uint32
+}
+
+func (sr *SymlinkRequest) GetTag() Tag {
+	return sr.Tag
+}
+
+func (sr *SymlinkRequest) SetTag(t Tag) {
+	sr.Tag = t
+}
+
+func (sr *SymlinkRequest) EncodedLength() int {
+	return 2 + 4 + 2 + len(sr.Name) + 2 + len(sr.Target) + 4
+}
+
+func (sr *SymlinkRequest) Decode(r io.Reader) error {
+	var err error
+	if sr.Tag, err = ReadTag(r); err != nil {
+		return err
+	}
+	if sr.Fid, err = ReadFid(r); err != nil {
+		return err
+	}
+	if sr.Name, err = ReadString(r); err != nil {
+		return err
+	}
+	if sr.Target, err = ReadString(r); err != nil {
+		return err
+	}
+	if sr.GID, err = ReadUint32(r); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (sr *SymlinkRequest) Encode(w io.Writer) error {
+	var err error
+	if err = WriteTag(w, sr.Tag); err != nil {
+		return err
+	}
+	if err = WriteFid(w, sr.Fid); err != nil {
+		return err
+	}
+	if err = WriteString(w, sr.Name); err != nil {
+		return err
+	}
+	if err = WriteString(w, sr.Target); err != nil {
+		return err
+	}
+	if err = WriteUint32(w, sr.GID); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (sr *SymlinkRequest) MarshalAppend(b []byte) []byte {
+	b = appendTag(b, sr.Tag)
+	b = appendFid(b, sr.Fid)
+	b = appendString(b, sr.Name)
+	b = appendString(b, sr.Target)
+	b = appendUint32(b, sr.GID)
+	return b
+}
+
+func (sr *SymlinkRequest) Unmarshal(b []byte) error {
+	dec := decoder{b: b}
+	sr.Tag = dec.tag()
+	sr.Fid = dec.fid()
+	sr.Name = dec.string()
+	sr.Target = dec.string()
+	sr.GID = dec.uint32()
+	return dec.err
+}
+
+// SymlinkResponse returns the qid of the created link.
+type SymlinkResponse struct {
+	Tag Tag
+
+	// Qid is the qid of the link.
+	Qid Qid
+}
+
+func (sr *SymlinkResponse) GetTag() Tag {
+	return sr.Tag
+}
+
+func (sr *SymlinkResponse) SetTag(t Tag) {
+	sr.Tag = t
+}
+
+func (*SymlinkResponse) EncodedLength() int {
+	return 2 + 13
+}
+
+func (sr *SymlinkResponse) Decode(r io.Reader) error {
+	var err error
+	if sr.Tag, err = ReadTag(r); err != nil {
+		return err
+	}
+	if err = sr.Qid.Decode(r); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (sr *SymlinkResponse) Encode(w io.Writer) error {
+	var err error
+	if err = WriteTag(w, sr.Tag); err != nil {
+		return err
+	}
+	if err = sr.Qid.Encode(w); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (sr *SymlinkResponse) MarshalAppend(b []byte) []byte {
+	b = appendTag(b, sr.Tag)
+	b = sr.Qid.MarshalAppend(b)
+	return b
+}
+
+func (sr *SymlinkResponse) Unmarshal(b []byte) error {
+	dec := decoder{b: b}
+	sr.Tag = dec.tag()
+	dec.codec(&sr.Qid, 13)
+	return dec.err
+}
+
+// MknodRequest is used to create a device node or named pipe in a directory.
+type MknodRequest struct {
+	Tag Tag
+
+	// DirFid is the directory to create the node in.
+	DirFid Fid
+
+	// Name is the name of the node.
+	Name string
+
+	// Mode is the Linux mode of the node, including the file type.
+	Mode uint32
+
+	// Major is the major device number.
+	Major uint32
+
+	// Minor is the minor device number.
+	Minor uint32
+
+	// GID is the numeric id of the group owning the node.
+	GID uint32
+}
+
+func (mr *MknodRequest) GetTag() Tag {
+	return mr.Tag
+}
+
+func (mr *MknodRequest) SetTag(t Tag) {
+	mr.Tag = t
+}
+
+func (mr *MknodRequest) EncodedLength() int {
+	return 2 + 4 + 2 + len(mr.Name) + 4 + 4 + 4 + 4
+}
+
+func (mr *MknodRequest) Decode(r io.Reader) error {
+	var err error
+	if mr.Tag, err = ReadTag(r); err != nil {
+		return err
+	}
+	if mr.DirFid, err = ReadFid(r); err != nil {
+		return err
+	}
+	if mr.Name, err = ReadString(r); err != nil {
+		return err
+	}
+	if mr.Mode, err = ReadUint32(r); err != nil {
+		return err
+	}
+	if mr.Major, err = ReadUint32(r); err != nil {
+		return err
+	}
+	if mr.Minor, err = ReadUint32(r); err != nil {
+		return err
+	}
+	if mr.GID, err = ReadUint32(r); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (mr *MknodRequest) Encode(w io.Writer) error {
+	var err error
+	if err = WriteTag(w, mr.Tag); err != nil {
+		return err
+	}
+	if err = WriteFid(w, mr.DirFid); err != nil {
+		return err
+	}
+	if err = WriteString(w, mr.Name); err != nil {
+		return err
+	}
+	if err = WriteUint32(w, mr.Mode); err != nil {
+		return err
+	}
+	if err = WriteUint32(w, mr.Major); err != nil {
+		return err
+	}
+	if err = WriteUint32(w, mr.Minor); err != nil {
+		return err
+	}
+	if err = WriteUint32(w, mr.GID); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (mr *MknodRequest) MarshalAppend(b []byte) []byte {
+	b = appendTag(b, mr.Tag)
+	b = appendFid(b, mr.DirFid)
+	b = appendString(b, mr.Name)
+	b = appendUint32(b, mr.Mode)
+	b = appendUint32(b, mr.Major)
+	b = appendUint32(b, mr.Minor)
+	b = appendUint32(b, mr.GID)
+	return b
+}
+
+func (mr *MknodRequest) Unmarshal(b []byte) error {
+	dec := decoder{b: b}
+	mr.Tag = dec.tag()
+	mr.DirFid = dec.fid()
+	mr.Name = dec.string()
+	mr.Mode = dec.uint32()
+	mr.Major = dec.uint32()
+	mr.Minor = dec.uint32()
+	mr.GID = dec.uint32()
+	return dec.err
+}
+
+// MknodResponse returns the qid of the created node.
+type MknodResponse struct {
+	Tag Tag
+
+	// Qid is the qid of the node.
+	Qid Qid
+}
+
+func (mr *MknodResponse) GetTag() Tag {
+	return mr.Tag
+}
+
+func (mr *MknodResponse) SetTag(t Tag) {
+	mr.Tag = t
+}
+
+func (*MknodResponse) EncodedLength() int {
+	return 2 + 13
+}
+
+func (mr *MknodResponse) Decode(r io.Reader) error {
+	var err error
+	if mr.Tag, err = ReadTag(r); err != nil {
+		return err
+	}
+	if err = mr.Qid.Decode(r); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (mr *MknodResponse) Encode(w io.Writer) error {
+	var err error
+	if err = WriteTag(w, mr.Tag); err != nil {
+		return err
+	}
+	if err = mr.Qid.Encode(w); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (mr *MknodResponse) MarshalAppend(b []byte) []byte {
+	b = appendTag(b, mr.Tag)
+	b = mr.Qid.MarshalAppend(b)
+	return b
+}
+
+func (mr *MknodResponse) Unmarshal(b []byte) error {
+	dec := decoder{b: b}
+	mr.Tag = dec.tag()
+	dec.codec(&mr.Qid, 13)
+	return dec.err
+}
+
+// RenameRequest is used to move the file represented by Fid into a directory
+// under a new name.
+type RenameRequest struct {
+	Tag Tag
+
+	// Fid is the file to rename.
+	Fid Fid
+
+	// DirFid is the directory to move the file to.
+	DirFid Fid
+
+	// Name is the new name of the file.
+	Name string
+}
+
+func (rr *RenameRequest) GetTag() Tag {
+	return rr.Tag
+}
+
+func (rr *RenameRequest) SetTag(t Tag) {
+	rr.Tag = t
+}
+
+func (rr *RenameRequest) EncodedLength() int {
+	return 2 + 4 + 4 + 2 + len(rr.Name)
+}
+
+func (rr *RenameRequest) Decode(r io.Reader) error {
+	var err error
+	if rr.Tag, err = ReadTag(r); err != nil {
+		return err
+	}
+	if rr.Fid, err = ReadFid(r); err != nil {
+		return err
+	}
+	if rr.DirFid, err = ReadFid(r); err != nil {
+		return err
+	}
+	if rr.Name, err = ReadString(r); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (rr *RenameRequest) Encode(w io.Writer) error {
+	var err error
+	if err = WriteTag(w, rr.Tag); err != nil {
+		return err
+	}
+	if err = WriteFid(w, rr.Fid); err != nil {
+		return err
+	}
+	if err = WriteFid(w, rr.DirFid); err != nil {
+		return err
+	}
+	if err = WriteString(w, rr.Name); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (rr *RenameRequest) MarshalAppend(b []byte) []byte {
+	b = appendTag(b, rr.Tag)
+	b = appendFid(b, rr.Fid)
+	b = appendFid(b, rr.DirFid)
+	b = appendString(b, rr.Name)
+	return b
+}
+
+func (rr *RenameRequest) Unmarshal(b []byte) error {
+	dec := decoder{b: b}
+	rr.Tag = dec.tag()
+	rr.Fid = dec.fid()
+	rr.DirFid = dec.fid()
+	rr.Name = dec.string()
+	return dec.err
+}
+
+// RenameResponse indicates a successful rename.
+type RenameResponse struct {
+	Tag Tag
+}
+
+func (rr *RenameResponse) GetTag() Tag {
+	return rr.Tag
+}
+
+func (rr *RenameResponse) SetTag(t Tag) {
+	rr.Tag = t
+}
+
+func (*RenameResponse) EncodedLength() int {
+	return 2
+}
+
+func (rr *RenameResponse) Decode(r io.Reader) error {
+	var err error
+	if rr.Tag, err = ReadTag(r); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (rr *RenameResponse) Encode(w io.Writer) error {
+	var err error
+	if err = WriteTag(w, rr.Tag); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (rr *RenameResponse) MarshalAppend(b []byte) []byte {
+	b = appendTag(b, rr.Tag)
+	return b
+}
+
+func (rr *RenameResponse) Unmarshal(b []byte) error {
+	dec := decoder{b: b}
+	rr.Tag = dec.tag()
+	return dec.err
+}
+
+// ReadLinkRequest is used to read the target of a symbolic link.
+type ReadLinkRequest struct {
+	Tag Tag
+
+	// Fid is the link to read.
+	Fid Fid
+}
+
+func (rlr *ReadLinkRequest) GetTag() Tag {
+	return rlr.Tag
+}
+
+func (rlr *ReadLinkRequest) SetTag(t Tag) {
+	rlr.Tag = t
+}
+
+func (*ReadLinkRequest) EncodedLength() int {
+	return 2 + 4
+}
+
+func (rlr *ReadLinkRequest) Decode(r io.Reader) error {
+	var err error
+	if rlr.Tag, err = ReadTag(r); err != nil {
+		return err
+	}
+	if rlr.Fid, err = ReadFid(r); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (rlr *ReadLinkRequest) Encode(w io.Writer) error {
+	var err error
+	if err = WriteTag(w, rlr.Tag); err != nil {
+		return err
+	}
+	if err = WriteFid(w, rlr.Fid); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (rlr *ReadLinkRequest) MarshalAppend(b []byte) []byte {
+	b = appendTag(b, rlr.Tag)
+	b = appendFid(b, rlr.Fid)
+	return b
+}
+
+func (rlr *ReadLinkRequest) Unmarshal(b []byte) error {
+	dec := decoder{b: b}
+	rlr.Tag = dec.tag()
+	rlr.Fid = dec.fid()
+	return dec.err
+}
+
+// ReadLinkResponse contains the target of a symbolic link.
+type ReadLinkResponse struct {
+	Tag Tag
+
+	// Target is the target of the link.
+	Target string
+}
+
+func (rlr *ReadLinkResponse) GetTag() Tag {
+	return rlr.Tag
+}
+
+func (rlr *ReadLinkResponse) SetTag(t Tag) {
+	rlr.Tag = t
+}
+
+func (rlr *ReadLinkResponse) EncodedLength() int {
+	return 2 + 2 + len(rlr.Target)
+}
+
+func (rlr *ReadLinkResponse) Decode(r io.Reader) error {
+	var err error
+	if rlr.Tag, err = ReadTag(r); err != nil {
+		return err
+	}
+	if rlr.Target, err = ReadString(r); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (rlr *ReadLinkResponse) Encode(w io.Writer) error {
+	var err error
+	if err = WriteTag(w, rlr.Tag); err != nil {
+		return err
+	}
+	if err = WriteString(w, rlr.Target); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (rlr *ReadLinkResponse) MarshalAppend(b []byte) []byte {
+	b = appendTag(b, rlr.Tag)
+	b = appendString(b, rlr.Target)
+	return b
+}
+
+func (rlr *ReadLinkResponse) Unmarshal(b []byte) error {
+	dec := decoder{b: b}
+	rlr.Tag = dec.tag()
+	rlr.Target = dec.string()
+	return dec.err
+}
+
+// GetAttrRequest is the 9P2000.L replacement for StatRequest, used to retrieve
+// the attributes of a file.
+type GetAttrRequest struct {
+	Tag Tag
+
+	// Fid is the file to retrieve attributes for.
+	Fid Fid
+
+	// RequestMask is a mask of GETATTR bits describing the requested
+	// attributes.
+	RequestMask uint64
+}
+
+func (gar *GetAttrRequest) GetTag() Tag {
+	return gar.Tag
+}
+
+func (gar *GetAttrRequest) SetTag(t Tag) {
+	gar.Tag = t
+}
+
+func (*GetAttrRequest) EncodedLength() int {
+	return 2 + 4 + 8
+}
+
+func (gar *GetAttrRequest) Decode(r io.Reader) error {
+	var err error
+	if gar.Tag, err = ReadTag(r); err != nil {
+		return err
+	}
+	if gar.Fid, err = ReadFid(r); err != nil {
+		return err
+	}
+	if gar.RequestMask, err = ReadUint64(r); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (gar *GetAttrRequest) Encode(w io.Writer) error {
+	var err error
+	if err = WriteTag(w, gar.Tag); err != nil {
+		return err
+	}
+	if err = WriteFid(w, gar.Fid); err != nil {
+		return err
+	}
+	if err = WriteUint64(w, gar.RequestMask); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (gar *GetAttrRequest) MarshalAppend(b []byte) []byte {
+	b = appendTag(b, gar.Tag)
+	b = appendFid(b, gar.Fid)
+	b = appendUint64(b, gar.RequestMask)
+	return b
+}
+
+func (gar *GetAttrRequest) Unmarshal(b []byte) error {
+	dec := decoder{b: b}
+	gar.Tag = dec.tag()
+	gar.Fid = dec.fid()
+	gar.RequestMask = dec.uint64()
+	return dec.err
+}
+
+// GetAttrResponse contains the attributes of a file.
+type GetAttrResponse struct {
+	Tag Tag
+
+	// Attr are the attributes of the file.
+	Attr Attr
+}
+
+func (gar *GetAttrResponse) GetTag() Tag {
+	return gar.Tag
+}
+
+func (gar *GetAttrResponse) SetTag(t Tag) {
+	gar.Tag = t
+}
+
+func (gar *GetAttrResponse) EncodedLength() int {
+	return 2 + gar.Attr.EncodedLength()
+}
+
+func (gar *GetAttrResponse) Decode(r io.Reader) error {
+	var err error
+	if gar.Tag, err = ReadTag(r); err != nil {
+		return err
+	}
+	if err = gar.Attr.Decode(r); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (gar *GetAttrResponse) Encode(w io.Writer) error {
+	var err error
+	if err = WriteTag(w, gar.Tag); err != nil {
+		return err
+	}
+	if err = gar.Attr.Encode(w); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (gar *GetAttrResponse) MarshalAppend(b []byte) []byte {
+	b = appendTag(b, gar.Tag)
+	b = gar.Attr.MarshalAppend(b)
+	return b
+}
+
+func (gar *GetAttrResponse) Unmarshal(b []byte) error {
+	dec := decoder{b: b}
+	gar.Tag = dec.tag()
+	dec.codec(&gar.Attr, gar.Attr.EncodedLength())
+	return dec.err
+}
+
+// SetAttrRequest is the 9P2000.L replacement for WriteStatRequest, used to
+// modify the attributes of a file. Only the attributes marked in Valid are
+// applied.
+type SetAttrRequest struct {
+	Tag Tag
+
+	// Fid is the file to modify attributes for.
+	Fid Fid
+
+	// Valid is a mask of SETATTR bits describing the attributes to apply.
+	Valid uint32
+
+	// Mode is the Linux permission bits of the file.
+	Mode uint32
+
+	// UID is the numeric id of the owning user.
+	UID uint32
+
+	// GID is the numeric id of the owning group.
+	GID uint32
+
+	// Size is the size to truncate the file to.
+	Size uint64
+
+	// ATimeSec is the seconds part of the last access time.
+	ATimeSec uint64
+
+	// ATimeNsec is the nanoseconds part of the last access time.
+	ATimeNsec uint64
+
+	// MTimeSec is the seconds part of the last modification time.
+	MTimeSec uint64
+
+	// MTimeNsec is the nanoseconds part of the last modification time.
+	MTimeNsec uint64
+}
+
+func (sar *SetAttrRequest) GetTag() Tag {
+	return sar.Tag
+}
+
+func (sar *SetAttrRequest) SetTag(t Tag) {
+	sar.Tag = t
+}
+
+func (*SetAttrRequest) EncodedLength() int {
+	return 2 + 4 + 4 + 4 + 4 + 4 + 8 + 8 + 8 + 8 + 8
+}
+
+func (sar *SetAttrRequest) Decode(r io.Reader) error {
+	var err error
+	if sar.Tag, err = ReadTag(r); err != nil {
+		return err
+	}
+	if sar.Fid, err = ReadFid(r); err != nil {
+		return err
+	}
+	if sar.Valid, err = ReadUint32(r); err != nil {
+		return err
+	}
+	if sar.Mode, err = ReadUint32(r); err != nil {
+		return err
+	}
+	if sar.UID, err = ReadUint32(r); err != nil {
+		return err
+	}
+	if sar.GID, err = ReadUint32(r); err != nil {
+		return err
+	}
+	if sar.Size, err = ReadUint64(r); err != nil {
+		return err
+	}
+	if sar.ATimeSec, err = ReadUint64(r); err != nil {
+		return err
+	}
+	if sar.ATimeNsec, err = ReadUint64(r); err != nil {
+		return err
+	}
+	if sar.MTimeSec, err = ReadUint64(r); err != nil {
+		return err
+	}
+	if sar.MTimeNsec, err = ReadUint64(r); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (sar *SetAttrRequest) Encode(w io.Writer) error {
+	var err error
+	if err = WriteTag(w, sar.Tag); err != nil {
+		return err
+	}
+	if err = WriteFid(w, sar.Fid); err != nil {
+		return err
+	}
+	if err = WriteUint32(w, sar.Valid); err != nil {
+		return err
+	}
+	if err = WriteUint32(w, sar.Mode); err != nil {
+		return err
+	}
+	if err = WriteUint32(w, sar.UID); err != nil {
+		return err
+	}
+	if err = WriteUint32(w, sar.GID); err != nil {
+		return err
+	}
+	if err = WriteUint64(w, sar.Size); err != nil {
+		return err
+	}
+	if err = WriteUint64(w, sar.ATimeSec); err != nil {
+		return err
+	}
+	if err = WriteUint64(w, sar.ATimeNsec); err != nil {
+		return err
+	}
+	if err = WriteUint64(w, sar.MTimeSec); err != nil {
+		return err
+	}
+	if err = WriteUint64(w, sar.MTimeNsec); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (sar *SetAttrRequest) MarshalAppend(b []byte) []byte {
+	b = appendTag(b, sar.Tag)
+	b = appendFid(b, sar.Fid)
+	b = appendUint32(b, sar.Valid)
+	b = appendUint32(b, sar.Mode)
+	b = appendUint32(b, sar.UID)
+	b = appendUint32(b, sar.GID)
+	b = appendUint64(b, sar.Size)
+	b = appendUint64(b, sar.ATimeSec)
+	b = appendUint64(b, sar.ATimeNsec)
+	b = appendUint64(b, sar.MTimeSec)
+	b = appendUint64(b, sar.MTimeNsec)
+	return b
+}
+
+func (sar *SetAttrRequest) Unmarshal(b []byte) error {
+	dec := decoder{b: b}
+	sar.Tag = dec.tag()
+	sar.Fid = dec.fid()
+	sar.Valid = dec.uint32()
+	sar.Mode = dec.uint32()
+	sar.UID = dec.uint32()
+	sar.GID = dec.uint32()
+	sar.Size = dec.uint64()
+	sar.ATimeSec = dec.uint64()
+	sar.ATimeNsec = dec.uint64()
+	sar.MTimeSec = dec.uint64()
+	sar.MTimeNsec = dec.uint64()
+	return dec.err
+}
+
+// SetAttrResponse indicates a successful application of the attributes.
+type SetAttrResponse struct {
+	Tag Tag
+}
+
+func (sar *SetAttrResponse) GetTag() Tag {
+	return sar.Tag
+}
+
+func (sar *SetAttrResponse) SetTag(t Tag) {
+	sar.Tag = t
+}
+
+func (*SetAttrResponse) EncodedLength() int {
+	return 2
+}
+
+func (sar *SetAttrResponse) Decode(r io.Reader) error {
+	var err error
+	if sar.Tag, err = ReadTag(r); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (sar *SetAttrResponse) Encode(w io.Writer) error {
+	var err error
+	if err = WriteTag(w, sar.Tag); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (sar *SetAttrResponse) MarshalAppend(b []byte) []byte {
+	b = appendTag(b, sar.Tag)
+	return b
+}
+
+func (sar *SetAttrResponse) Unmarshal(b []byte) error {
+	dec := decoder{b: b}
+	sar.Tag = dec.tag()
+	return dec.err
+}
+
+// XattrWalkRequest is used to prepare reading an extended attribute, or the
+// list of extended attribute names if Name is empty. The contents are read from
+// NewFid.
+type XattrWalkRequest struct {
+	Tag Tag
+
+	// Fid is the file to read extended attributes of.
+	Fid Fid
+
+	// NewFid is the fid to assign the extended attribute to.
+	NewFid Fid
+
+	// Name is the name of the extended attribute.
+	Name string
+}
+
+func (xwr *XattrWalkRequest) GetTag() Tag {
+	return xwr.Tag
+}
+
+func (xwr *XattrWalkRequest) SetTag(t Tag) {
+	xwr.Tag = t
+}
+
+func (xwr *XattrWalkRequest) EncodedLength() int {
+	return 2 + 4 + 4 + 2 + len(xwr.Name)
+}
+
+func (xwr *XattrWalkRequest) Decode(r io.Reader) error {
+	var err error
+	if xwr.Tag, err = ReadTag(r); err != nil {
+		return err
+	}
+	if xwr.Fid, err = ReadFid(r); err != nil {
+		return err
+	}
+	if xwr.NewFid, err = ReadFid(r); err != nil {
+		return err
+	}
+	if xwr.Name, err = ReadString(r); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (xwr *XattrWalkRequest) Encode(w io.Writer) error {
+	var err error
+	if err = WriteTag(w, xwr.Tag); err != nil {
+		return err
+	}
+	if err = WriteFid(w, xwr.Fid); err != nil {
+		return err
+	}
+	if err = WriteFid(w, xwr.NewFid); err != nil {
+		return err
+	}
+	if err = WriteString(w, xwr.Name); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (xwr *XattrWalkRequest) MarshalAppend(b []byte) []byte {
+	b = appendTag(b, xwr.Tag)
+	b = appendFid(b, xwr.Fid)
+	b = appendFid(b, xwr.NewFid)
+	b = appendString(b, xwr.Name)
+	return b
+}
+
+func (xwr *XattrWalkRequest) Unmarshal(b []byte) error {
+	dec := decoder{b: b}
+	xwr.Tag = dec.tag()
+	xwr.Fid = dec.fid()
+	xwr.NewFid = dec.fid()
+	xwr.Name = dec.string()
+	return dec.err
+}
+
+// XattrWalkResponse contains the size of the extended attribute.
+type XattrWalkResponse struct {
+	Tag Tag
+
+	// Size is the size of the extended attribute value.
+	Size uint64
+}
+
+func (xwr *XattrWalkResponse) GetTag() Tag {
+	return xwr.Tag
+}
+
+func (xwr *XattrWalkResponse) SetTag(t Tag) {
+	xwr.Tag = t
+}
+
+func (*XattrWalkResponse) EncodedLength() int {
+	return 2 + 8
+}
+
+func (xwr *XattrWalkResponse) Decode(r io.Reader) error {
+	var err error
+	if xwr.Tag, err = ReadTag(r); err != nil {
+		return err
+	}
+	if xwr.Size, err = ReadUint64(r); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (xwr *XattrWalkResponse) Encode(w io.Writer) error {
+	var err error
+	if err = WriteTag(w, xwr.Tag); err != nil {
+		return err
+	}
+	if err = WriteUint64(w, xwr.Size); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (xwr *XattrWalkResponse) MarshalAppend(b []byte) []byte {
+	b = appendTag(b, xwr.Tag)
+	b = appendUint64(b, xwr.Size)
+	return b
+}
+
+func (xwr *XattrWalkResponse) Unmarshal(b []byte) error {
+	dec := decoder{b: b}
+	xwr.Tag = dec.tag()
+	xwr.Size = dec.uint64()
+	return dec.err
+}
+
+// XattrCreateRequest is used to prepare setting an extended attribute. Fid is
+// changed to represent the attribute, which value is then written to Fid. The
+// attribute is set when Fid is clunked.
+type XattrCreateRequest struct {
+	Tag Tag
+
+	// Fid is the file to set the extended attribute on.
+	Fid Fid
+
+	// Name is the name of the extended attribute.
+	Name string
+
+	// Size is the size of the extended attribute value.
+	Size uint64
+
+	// Flags are the setxattr(2) flags.
+	Flags uint32
+}
+
+func (xcr *XattrCreateRequest) GetTag() Tag {
+	return xcr.Tag
+}
+
+func (xcr *XattrCreateRequest) SetTag(t Tag) {
+	xcr.Tag = t
+}
+
+func (xcr *XattrCreateRequest) EncodedLength() int {
+	return 2 + 4 + 2 + len(xcr.Name) + 8 + 4
+}
+
+func (xcr *XattrCreateRequest) Decode(r io.Reader) error {
+	var err error
+	if xcr.Tag, err = ReadTag(r); err != nil {
+		return err
+	}
+	if xcr.Fid, err = ReadFid(r); err != nil {
+		return err
+	}
+	if xcr.Name, err = ReadString(r); err != nil {
+		return err
+	}
+	if xcr.Size, err = ReadUint64(r); err != nil {
+		return err
+	}
+	if xcr.Flags, err = ReadUint32(r); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (xcr *XattrCreateRequest) Encode(w io.Writer) error {
+	var err error
+	if err = WriteTag(w, xcr.Tag); err != nil {
+		return err
+	}
+	if err = WriteFid(w, xcr.Fid); err != nil {
+		return err
+	}
+	if err = WriteString(w, xcr.Name); err != nil {
+		return err
+	}
+	if err = WriteUint64(w, xcr.Size); err != nil {
+		return err
+	}
+	if err = WriteUint32(w, xcr.Flags); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (xcr *XattrCreateRequest) MarshalAppend(b []byte) []byte {
+	b = appendTag(b, xcr.Tag)
+	b = appendFid(b, xcr.Fid)
+	b = appendString(b, xcr.Name)
+	b = appendUint64(b, xcr.Size)
+	b = appendUint32(b, xcr.Flags)
+	return b
+}
+
+func (xcr *XattrCreateRequest) Unmarshal(b []byte) error {
+	dec := decoder{b: b}
+	xcr.Tag = dec.tag()
+	xcr.Fid = dec.fid()
+	xcr.Name = dec.string()
+	xcr.Size = dec.uint64()
+	xcr.Flags = dec.uint32()
+	return dec.err
+}
+
+// XattrCreateResponse indicates that the extended attribute can be written.
+type XattrCreateResponse struct {
+	Tag Tag
+}
+
+func (xcr *XattrCreateResponse) GetTag() Tag {
+	return xcr.Tag
+}
+
+func (xcr *XattrCreateResponse) SetTag(t Tag) {
+	xcr.Tag = t
+}
+
+func (*XattrCreateResponse) EncodedLength() int {
+	return 2
+}
+
+func (xcr *XattrCreateResponse) Decode(r io.Reader) error {
+	var err error
+	if xcr.Tag, err = ReadTag(r); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (xcr *XattrCreateResponse) Encode(w io.Writer) error {
+	var err error
+	if err = WriteTag(w, xcr.Tag); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (xcr *XattrCreateResponse) MarshalAppend(b []byte) []byte {
+	b = appendTag(b, xcr.Tag)
+	return b
+}
+
+func (xcr *XattrCreateResponse) Unmarshal(b []byte) error {
+	dec := decoder{b: b}
+	xcr.Tag = dec.tag()
+	return dec.err
+}
+
+// ReadDirRequest is used to read directory entries from an open directory.
+// Unlike directory reads in 9P2000, the offset is an opaque value taken from
+// the Offset of a previously returned Dirent, or 0 to start from the
+// beginning.
+type ReadDirRequest struct {
+	Tag Tag
+
+	// Fid is the directory to read.
+	Fid Fid
+
+	// Offset is the offset to continue reading from.
+	Offset uint64
+
+	// Count is the maximum amount of bytes requested.
+	Count uint32
+}
+
+func (rdr *ReadDirRequest) GetTag() Tag {
+	return rdr.Tag
+}
+
+func (rdr *ReadDirRequest) SetTag(t Tag) {
+	rdr.Tag = t
+}
+
+func (*ReadDirRequest) EncodedLength() int {
+	return 2 + 4 + 8 + 4
+}
+
+func (rdr *ReadDirRequest) Decode(r io.Reader) error {
+	var err error
+	if rdr.Tag, err = ReadTag(r); err != nil {
+		return err
+	}
+	if rdr.Fid, err = ReadFid(r); err != nil {
+		return err
+	}
+	if rdr.Offset, err = ReadUint64(r); err != nil {
+		return err
+	}
+	if rdr.Count, err = ReadUint32(r); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (rdr *ReadDirRequest) Encode(w io.Writer) error {
+	var err error
+	if err = WriteTag(w, rdr.Tag); err != nil {
+		return err
+	}
+	if err = WriteFid(w, rdr.Fid); err != nil {
+		return err
+	}
+	if err = WriteUint64(w, rdr.Offset); err != nil {
+		return err
+	}
+	if err = WriteUint32(w, rdr.Count); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (rdr *ReadDirRequest) MarshalAppend(b []byte) []byte {
+	b = appendTag(b, rdr.Tag)
+	b = appendFid(b, rdr.Fid)
+	b = appendUint64(b, rdr.Offset)
+	b = appendUint32(b, rdr.Count)
+	return b
+}
+
+func (rdr *ReadDirRequest) Unmarshal(b []byte) error {
+	dec := decoder{b: b}
+	rdr.Tag = dec.tag()
+	rdr.Fid = dec.fid()
+	rdr.Offset = dec.uint64()
+	rdr.Count = dec.uint32()
+	return dec.err
+}
+
+// ReadDirResponse contains a list of Dirent, encoded end-to-end.
+type ReadDirResponse struct {
+	Tag Tag
+
+	// Data is the encoded directory entries.
+	Data []byte
+}
+
+func (rdr *ReadDirResponse) GetTag() Tag {
+	return rdr.Tag
+}
+
+func (rdr *ReadDirResponse) SetTag(t Tag) {
+	rdr.Tag = t
+}
+
+func (rdr *ReadDirResponse) EncodedLength() int {
+	return 2 + 4 + len(rdr.Data)
+}
+
+func (rdr *ReadDirResponse) Decode(r io.Reader) error {
+	var err error
+	if rdr.Tag, err = ReadTag(r); err != nil {
+		return err
+	}
+	var count uint32
+	if count, err = ReadUint32(r); err != nil {
+		return err
+	}
+	if err = checkRemaining(r, int64(count)); err != nil {
+		return err
+	}
+	rdr.Data = make([]byte, count)
+	if err = read(r, rdr.Data); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (rdr *ReadDirResponse) Encode(w io.Writer) error {
+	var err error
+	if err = WriteTag(w, rdr.Tag); err != nil {
+		return err
+	}
+	if err = WriteUint32(w, uint32(len(rdr.Data))); err != nil {
+		return err
+	}
+	if err = write(w, rdr.Data); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (rdr *ReadDirResponse) MarshalAppend(b []byte) []byte {
+	b = appendTag(b, rdr.Tag)
+	b = appendData(b, rdr.Data)
+	return b
+}
+
+func (rdr *ReadDirResponse) Unmarshal(b []byte) error {
+	dec := decoder{b: b}
+	rdr.Tag = dec.tag()
+	rdr.Data = dec.data()
+	return dec.err
+}
+
+// FsyncRequest is used to commit a file to storage, similar to fsync(2).
+type FsyncRequest struct {
+	Tag Tag
+
+	// Fid is the file to commit.
+	Fid Fid
+
+	// DataSync is non-zero if only the file data needs to be committed, similar
+	// to fdatasync(2).
+	DataSync uint32
+}
+
+func (fr *FsyncRequest) GetTag() Tag {
+	return fr.Tag
+}
+
+func (fr *FsyncRequest) SetTag(t Tag) {
+	fr.Tag = t
+}
+
+func (*FsyncRequest) EncodedLength() int {
+	return 2 + 4 + 4
+}
+
+func (fr *FsyncRequest) Decode(r io.Reader) error {
+	var err error
+	if fr.Tag, err = ReadTag(r); err != nil {
+		return err
+	}
+	if fr.Fid, err = ReadFid(r); err != nil {
+		return err
+	}
+	if fr.DataSync, err = ReadUint32(r); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (fr *FsyncRequest) Encode(w io.Writer) error {
+	var err error
+	if err = WriteTag(w, fr.Tag); err != nil {
+		return err
+	}
+	if err = WriteFid(w, fr.Fid); err != nil {
+		return err
+	}
+	if err = WriteUint32(w, fr.DataSync); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (fr *FsyncRequest) MarshalAppend(b []byte) []byte {
+	b = appendTag(b, fr.Tag)
+	b = appendFid(b, fr.Fid)
+	b = appendUint32(b, fr.DataSync)
+	return b
+}
+
+func (fr *FsyncRequest) Unmarshal(b []byte) error {
+	dec := decoder{b: b}
+	fr.Tag = dec.tag()
+	fr.Fid = dec.fid()
+	fr.DataSync = dec.uint32()
+	return dec.err
+}
+
+// FsyncResponse indicates a successful fsync.
+type FsyncResponse struct {
+	Tag Tag
+}
+
+func (fr *FsyncResponse) GetTag() Tag {
+	return fr.Tag
+}
+
+func (fr *FsyncResponse) SetTag(t Tag) {
+	fr.Tag = t
+}
+
+func (*FsyncResponse) EncodedLength() int {
+	return 2
+}
+
+func (fr *FsyncResponse) Decode(r io.Reader) error {
+	var err error
+	if fr.Tag, err = ReadTag(r); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (fr *FsyncResponse) Encode(w io.Writer) error {
+	var err error
+	if err = WriteTag(w, fr.Tag); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (fr *FsyncResponse) MarshalAppend(b []byte) []byte {
+	b = appendTag(b, fr.Tag)
+	return b
+}
+
+func (fr *FsyncResponse) Unmarshal(b []byte) error {
+	dec := decoder{b: b}
+	fr.Tag = dec.tag()
+	return dec.err
+}
+
+// LockRequest is used to acquire or release a POSIX record lock.
+type LockRequest struct {
+	Tag Tag
+
+	// Fid is the file to lock.
+	Fid Fid
+
+	// Type is the lock type, one of the LOCK_TYPE constants.
+	Type uint8
+
+	// Flags are the LOCK_FLAGS for the request.
+	Flags uint32
+
+	// Start is the starting offset of the lock.
+	Start uint64
+
+	// Length is the length of the lock, or 0 for the rest of the file.
+	Length uint64
+
+	// ProcID is the process id of the lock owner.
+	ProcID uint32
+
+	// ClientID identifies the client of the lock owner.
+	ClientID string
+}
+
+func (lr *LockRequest) GetTag() Tag {
+	return lr.Tag
+}
+
+func (lr *LockRequest) SetTag(t Tag) {
+	lr.Tag = t
+}
+
+func (lr *LockRequest) EncodedLength() int {
+	return 2 + 4 + 1 + 4 + 8 + 8 + 4 + 2 + len(lr.ClientID)
+}
+
+func (lr *LockRequest) Decode(r io.Reader) error {
+	var err error
+	if lr.Tag, err = ReadTag(r); err != nil {
+		return err
+	}
+	if lr.Fid, err = ReadFid(r); err != nil {
+		return err
+	}
+	if lr.Type, err = ReadByte(r); err != nil {
+		return err
+	}
+	if lr.Flags, err = ReadUint32(r); err != nil {
+		return err
+	}
+	if lr.Start, err = ReadUint64(r); err != nil {
+		return err
+	}
+	if lr.Length, err = ReadUint64(r); err != nil {
+		return err
+	}
+	if lr.ProcID, err = ReadUint32(r); err != nil {
+		return err
+	}
+	if lr.ClientID, err = ReadString(r); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (lr *LockRequest) Encode(w io.Writer) error {
+	var err error
+	if err = WriteTag(w, lr.Tag); err != nil {
+		return err
+	}
+	if err = WriteFid(w, lr.Fid); err != nil {
+		return err
+	}
+	if err = WriteByte(w, lr.Type); err != nil {
+		return err
+	}
+	if err = WriteUint32(w, lr.Flags); err != nil {
+		return err
+	}
+	if err = WriteUint64(w, lr.Start); err != nil {
+		return err
+	}
+	if err = WriteUint64(w, lr.Length); err != nil {
+		return err
+	}
+	if err = WriteUint32(w, lr.ProcID); err != nil {
+		return err
+	}
+	if err = WriteString(w, lr.ClientID); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (lr *LockRequest) MarshalAppend(b []byte) []byte {
+	b = appendTag(b, lr.Tag)
+	b = appendFid(b, lr.Fid)
+	b = appendUint8(b, lr.Type)
+	b = appendUint32(b, lr.Flags)
+	b = appendUint64(b, lr.Start)
+	b = appendUint64(b, lr.Length)
+	b = appendUint32(b, lr.ProcID)
+	b = appendString(b, lr.ClientID)
+	return b
+}
+
+func (lr *LockRequest) Unmarshal(b []byte) error {
+	dec := decoder{b: b}
+	lr.Tag = dec.tag()
+	lr.Fid = dec.fid()
+	lr.Type = dec.uint8()
+	lr.Flags = dec.uint32()
+	lr.Start = dec.uint64()
+	lr.Length = dec.uint64()
+	lr.ProcID = dec.uint32()
+	lr.ClientID = dec.string()
+	return dec.err
+}
+
+// LockResponse contains the status of a lock request.
+type LockResponse struct {
+	Tag Tag
+
+	// Status is the lock status, one of the LOCK constants.
+	Status uint8
+}
+
+func (lr *LockResponse) GetTag() Tag {
+	return lr.Tag
+}
+
+func (lr *LockResponse) SetTag(t Tag) {
+	lr.Tag = t
+}
+
+func (*LockResponse) EncodedLength() int {
+	return 2 + 1
+}
+
+func (lr *LockResponse) Decode(r io.Reader) error {
+	var err error
+	if lr.Tag, err = ReadTag(r); err != nil {
+		return err
+	}
+	if lr.Status, err = ReadByte(r); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (lr *LockResponse) Encode(w io.Writer) error {
+	var err error
+	if err = WriteTag(w, lr.Tag); err != nil {
+		return err
+	}
+	if err = WriteByte(w, lr.Status); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (lr *LockResponse) MarshalAppend(b []byte) []byte {
+	b = appendTag(b, lr.Tag)
+	b = appendUint8(b, lr.Status)
+	return b
+}
+
+func (lr *LockResponse) Unmarshal(b []byte) error {
+	dec := decoder{b: b}
+	lr.Tag = dec.tag()
+	lr.Status = dec.uint8()
+	return dec.err
+}
+
+// GetLockRequest is used to test for the existence of a POSIX record lock.
+type GetLockRequest struct {
+	Tag Tag
+
+	// Fid is the file to test.
+	Fid Fid
+
+	// Type is the lock type, one of the LOCK_TYPE constants.
+	Type uint8
+
+	// Start is the starting offset of the lock.
+	Start uint64
+
+	// Length is the length of the lock, or 0 for the rest of the file.
+	Length uint64
+
+	// ProcID is the process id of the lock owner.
+	ProcID uint32
+
+	// ClientID identifies the client of the lock owner.
+	ClientID string
+}
+
+func (glr *GetLockRequest) GetTag() Tag {
+	return glr.Tag
+}
+
+func (glr *GetLockRequest) SetTag(t Tag) {
+	glr.Tag = t
+}
+
+func (glr *GetLockRequest) EncodedLength() int {
+	return 2 + 4 + 1 + 8 + 8 + 4 + 2 + len(glr.ClientID)
+}
+
+func (glr *GetLockRequest) Decode(r io.Reader) error {
+	var err error
+	if glr.Tag, err = ReadTag(r); err != nil {
+		return err
+	}
+	if glr.Fid, err = ReadFid(r); err != nil {
+		return err
+	}
+	if glr.Type, err = ReadByte(r); err != nil {
+		return err
+	}
+	if glr.Start, err = ReadUint64(r); err != nil {
+		return err
+	}
+	if glr.Length, err = ReadUint64(r); err != nil {
+		return err
+	}
+	if glr.ProcID, err = ReadUint32(r); err != nil {
+		return err
+	}
+	if glr.ClientID, err = ReadString(r); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (glr *GetLockRequest) Encode(w io.Writer) error {
+	var err error
+	if err = WriteTag(w, glr.Tag); err != nil {
+		return err
+	}
+	if err = WriteFid(w, glr.Fid); err != nil {
+		return err
+	}
+	if err = WriteByte(w, glr.Type); err != nil {
+		return err
+	}
+	if err = WriteUint64(w, glr.Start); err != nil {
+		return err
+	}
+	if err = WriteUint64(w, glr.Length); err != nil {
+		return err
+	}
+	if err = WriteUint32(w, glr.ProcID); err != nil {
+		return err
+	}
+	if err = WriteString(w, glr.ClientID); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (glr *GetLockRequest) MarshalAppend(b []byte) []byte {
+	b = appendTag(b, glr.Tag)
+	b = appendFid(b, glr.Fid)
+	b = appendUint8(b, glr.Type)
+	b = appendUint64(b, glr.Start)
+	b = appendUint64(b, glr.Length)
+	b = appendUint32(b, glr.ProcID)
+	b = appendString(b, glr.ClientID)
+	return b
+}
+
+func (glr *GetLockRequest) Unmarshal(b []byte) error {
+	dec := decoder{b: b}
+	glr.Tag = dec.tag()
+	glr.Fid = dec.fid()
+	glr.Type = dec.uint8()
+	glr.Start = dec.uint64()
+	glr.Length = dec.uint64()
+	glr.ProcID = dec.uint32()
+	glr.ClientID = dec.string()
+	return dec.err
+}
+
+// GetLockResponse describes a conflicting lock, or has Type set to
+// LOCK_TYPE_UNLCK if the lock could be placed.
+type GetLockResponse struct {
+	Tag Tag
+
+	// Type is the lock type, one of the LOCK_TYPE constants.
+	Type uint8
+
+	// Start is the starting offset of the lock.
+	Start uint64
+
+	// Length is the length of the lock, or 0 for the rest of the file.
+	Length uint64
+
+	// ProcID is the process id of the lock owner.
+	ProcID uint32
+
+	// ClientID identifies the client of the lock owner.
+	ClientID string
+}
+
+func (glr *GetLockResponse) GetTag() Tag {
+	return glr.Tag
+}
+
+func (glr *GetLockResponse) SetTag(t Tag) {
+	glr.Tag = t
+}
+
+func (glr *GetLockResponse) EncodedLength() int {
+	return 2 + 1 + 8 + 8 + 4 + 2 + len(glr.ClientID)
+}
+
+func (glr *GetLockResponse) Decode(r io.Reader) error {
+	var err error
+	if glr.Tag, err = ReadTag(r); err != nil {
+		return err
+	}
+	if glr.Type, err = ReadByte(r); err != nil {
+		return err
+	}
+	if glr.Start, err = ReadUint64(r); err != nil {
+		return err
+	}
+	if glr.Length, err = ReadUint64(r); err != nil {
+		return err
+	}
+	if glr.ProcID, err = ReadUint32(r); err != nil {
+		return err
+	}
+	if glr.ClientID, err = ReadString(r); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (glr *GetLockResponse) Encode(w io.Writer) error {
+	var err error
+	if err = WriteTag(w, glr.Tag); err != nil {
+		return err
+	}
+	if err = WriteByte(w, glr.Type); err != nil {
+		return err
+	}
+	if err = WriteUint64(w, glr.Start); err != nil {
+		return err
+	}
+	if err = WriteUint64(w, glr.Length); err != nil {
+		return err
+	}
+	if err = WriteUint32(w, glr.ProcID); err != nil {
+		return err
+	}
+	if err = WriteString(w, glr.ClientID); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (glr *GetLockResponse) MarshalAppend(b []byte) []byte {
+	b = appendTag(b, glr.Tag)
+	b = appendUint8(b, glr.Type)
+	b = appendUint64(b, glr.Start)
+	b = appendUint64(b, glr.Length)
+	b = appendUint32(b, glr.ProcID)
+	b = appendString(b, glr.ClientID)
+	return b
+}
+
+func (glr *GetLockResponse) Unmarshal(b []byte) error {
+	dec := decoder{b: b}
+	glr.Tag = dec.tag()
+	glr.Type = dec.uint8()
+	glr.Start = dec.uint64()
+	glr.Length = dec.uint64()
+	glr.ProcID = dec.uint32()
+	glr.ClientID = dec.string()
+	return dec.err
+}
+
+// LinkRequest is used to create a hard link to a file in a directory.
+type LinkRequest struct {
+	Tag Tag
+
+	// DirFid is the directory to create the link in.
+	DirFid Fid
+
+	// Fid is the file to link to.
+	Fid Fid
+
+	// Name is the name of the link.
+	Name string
+}
+
+func (lr *LinkRequest) GetTag() Tag {
+	return lr.Tag
+}
+
+func (lr *LinkRequest) SetTag(t Tag) {
+	lr.Tag = t
+}
+
+func (lr *LinkRequest) EncodedLength() int {
+	return 2 + 4 + 4 + 2 + len(lr.Name)
+}
+
+func (lr *LinkRequest) Decode(r io.Reader) error {
+	var err error
+	if lr.Tag, err = ReadTag(r); err != nil {
+		return err
+	}
+	if lr.DirFid, err = ReadFid(r); err != nil {
+		return err
+	}
+	if lr.Fid, err = ReadFid(r); err != nil {
+		return err
+	}
+	if lr.Name, err = ReadString(r); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (lr *LinkRequest) Encode(w io.Writer) error {
+	var err error
+	if err = WriteTag(w, lr.Tag); err != nil {
+		return err
+	}
+	if err = WriteFid(w, lr.DirFid); err != nil {
+		return err
+	}
+	if err = WriteFid(w, lr.Fid); err != nil {
+		return err
+	}
+	if err = WriteString(w, lr.Name); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (lr *LinkRequest) MarshalAppend(b []byte) []byte {
+	b = appendTag(b, lr.Tag)
+	b = appendFid(b, lr.DirFid)
+	b = appendFid(b, lr.Fid)
+	b = appendString(b, lr.Name)
+	return b
+}
+
+func (lr *LinkRequest) Unmarshal(b []byte) error {
+	dec := decoder{b: b}
+	lr.Tag = dec.tag()
+	lr.DirFid = dec.fid()
+	lr.Fid = dec.fid()
+	lr.Name = dec.string()
+	return dec.err
+}
+
+// LinkResponse indicates a successful link.
+type LinkResponse struct {
+	Tag Tag
+}
+
+func (lr *LinkResponse) GetTag() Tag {
+	return lr.Tag
+}
+
+func (lr *LinkResponse) SetTag(t Tag) {
+	lr.Tag = t
+}
+
+func (*LinkResponse) EncodedLength() int {
+	return 2
+}
+
+func (lr *LinkResponse) Decode(r io.Reader) error {
+	var err error
+	if lr.Tag, err = ReadTag(r); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (lr *LinkResponse) Encode(w io.Writer) error {
+	var err error
+	if err = WriteTag(w, lr.Tag); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (lr *LinkResponse) MarshalAppend(b []byte) []byte {
+	b = appendTag(b, lr.Tag)
+	return b
+}
+
+func (lr *LinkResponse) Unmarshal(b []byte) error {
+	dec := decoder{b: b}
+	lr.Tag = dec.tag()
+	return dec.err
+}
+
+// MkdirRequest is used to create a directory.
+type MkdirRequest struct {
+	Tag Tag
+
+	// DirFid is the directory to create the directory in.
+	DirFid Fid
+
+	// Name is the name of the directory.
+	Name string
+
+	// Mode is the Linux permission bits of the directory.
+	Mode uint32
+
+	// GID is the numeric id of the group owning the directory.
+	GID uint32
+}
+
+func (mr *MkdirRequest) GetTag() Tag {
+	return mr.Tag
+}
+
+func (mr *MkdirRequest) SetTag(t Tag) {
+	mr.Tag = t
+}
+
+func (mr *MkdirRequest) EncodedLength() int {
+	return 2 + 4 + 2 + len(mr.Name) + 4 + 4
+}
+
+func (mr *MkdirRequest) Decode(r io.Reader) error {
+	var err error
+	if mr.Tag, err = ReadTag(r); err != nil {
+		return err
+	}
+	if mr.DirFid, err = ReadFid(r); err != nil {
+		return err
+	}
+	if mr.Name, err = ReadString(r); err != nil {
+		return err
+	}
+	if mr.Mode, err = ReadUint32(r); err != nil {
+		return err
+	}
+	if mr.GID, err = ReadUint32(r); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (mr *MkdirRequest) Encode(w io.Writer) error {
+	var err error
+	if err = WriteTag(w, mr.Tag); err != nil {
+		return err
+	}
+	if err = WriteFid(w, mr.DirFid); err != nil {
+		return err
+	}
+	if err = WriteString(w, mr.Name); err != nil {
+		return err
+	}
+	if err = WriteUint32(w, mr.Mode); err != nil {
+		return err
+	}
+	if err = WriteUint32(w, mr.GID); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (mr *MkdirRequest) MarshalAppend(b []byte) []byte {
+	b = appendTag(b, mr.Tag)
+	b = appendFid(b, mr.DirFid)
+	b = appendString(b, mr.Name)
+	b = appendUint32(b, mr.Mode)
+	b = appendUint32(b, mr.GID)
+	return b
+}
+
+func (mr *MkdirRequest) Unmarshal(b []byte) error {
+	dec := decoder{b: b}
+	mr.Tag = dec.tag()
+	mr.DirFid = dec.fid()
+	mr.Name = dec.string()
+	mr.Mode = dec.uint32()
+	mr.GID = dec.uint32()
+	return dec.err
+}
+
+// MkdirResponse returns the qid of the created directory.
+type MkdirResponse struct {
+	Tag Tag
+
+	// Qid is the qid of the directory.
+	Qid Qid
+}
+
+func (mr *MkdirResponse) GetTag() Tag {
+	return mr.Tag
+}
+
+func (mr *MkdirResponse) SetTag(t Tag) {
+	mr.Tag = t
+}
+
+func (*MkdirResponse) EncodedLength() int {
+	return 2 + 13
+}
+
+func (mr *MkdirResponse) Decode(r io.Reader) error {
+	var err error
+	if mr.Tag, err = ReadTag(r); err != nil {
+		return err
+	}
+	if err = mr.Qid.Decode(r); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (mr *MkdirResponse) Encode(w io.Writer) error {
+	var err error
+	if err = WriteTag(w, mr.Tag); err != nil {
+		return err
+	}
+	if err = mr.Qid.Encode(w); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (mr *MkdirResponse) MarshalAppend(b []byte) []byte {
+	b = appendTag(b, mr.Tag)
+	b = mr.Qid.MarshalAppend(b)
+	return b
+}
+
+func (mr *MkdirResponse) Unmarshal(b []byte) error {
+	dec := decoder{b: b}
+	mr.Tag = dec.tag()
+	dec.codec(&mr.Qid, 13)
+	return dec.err
+}
+
+// RenameAtRequest is used to rename a file from one directory to another,
+// similar to renameat(2).
+type RenameAtRequest struct {
+	Tag Tag
+
+	// OldDirFid is the directory containing the file.
+	OldDirFid Fid
+
+	// OldName is the current name of the file.
+	OldName string
+
+	// NewDirFid is the directory to move the file to.
+	NewDirFid Fid
+
+	// NewName is the new name of the file.
+	NewName string
+}
+
+func (rar *RenameAtRequest) GetTag() Tag {
+	return rar.Tag
+}
+
+func (rar *RenameAtRequest) SetTag(t Tag) {
+	rar.Tag = t
+}
+
+func (rar *RenameAtRequest) EncodedLength() int {
+	return 2 + 4 + 2 + len(rar.OldName) + 4 + 2 + len(rar.NewName)
+}
+
+func (rar *RenameAtRequest) Decode(r io.Reader) error {
+	var err error
+	if rar.Tag, err = ReadTag(r); err != nil {
+		return err
+	}
+	if rar.OldDirFid, err = ReadFid(r); err != nil {
+		return err
+	}
+	if rar.OldName, err = ReadString(r); err != nil {
+		return err
+	}
+	if rar.NewDirFid, err = ReadFid(r); err != nil {
+		return err
+	}
+	if rar.NewName, err = ReadString(r); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (rar *RenameAtRequest) Encode(w io.Writer) error {
+	var err error
+	if err = WriteTag(w, rar.Tag); err != nil {
+		return err
+	}
+	if err = WriteFid(w, rar.OldDirFid); err != nil {
+		return err
+	}
+	if err = WriteString(w, rar.OldName); err != nil {
+		return err
+	}
+	if err = WriteFid(w, rar.NewDirFid); err != nil {
+		return err
+	}
+	if err = WriteString(w, rar.NewName); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (rar *RenameAtRequest) MarshalAppend(b []byte) []byte {
+	b = appendTag(b, rar.Tag)
+	b = appendFid(b, rar.OldDirFid)
+	b = appendString(b, rar.OldName)
+	b = appendFid(b, rar.NewDirFid)
+	b = appendString(b, rar.NewName)
+	return b
+}
+
+func (rar *RenameAtRequest) Unmarshal(b []byte) error {
+	dec := decoder{b: b}
+	rar.Tag = dec.tag()
+	rar.OldDirFid = dec.fid()
+	rar.OldName = dec.string()
+	rar.NewDirFid = dec.fid()
+	rar.NewName = dec.string()
+	return dec.err
+}
+
+// RenameAtResponse indicates a successful rename.
+type RenameAtResponse struct {
+	Tag Tag
+}
+
+func (rar *RenameAtResponse) GetTag() Tag {
+	return rar.Tag
+}
+
+func (rar *RenameAtResponse) SetTag(t Tag) {
+	rar.Tag = t
+}
+
+func (*RenameAtResponse) EncodedLength() int {
+	return 2
+}
+
+func (rar *RenameAtResponse) Decode(r io.Reader) error {
+	var err error
+	if rar.Tag, err = ReadTag(r); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (rar *RenameAtResponse) Encode(w io.Writer) error {
+	var err error
+	if err = WriteTag(w, rar.Tag); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (rar *RenameAtResponse) MarshalAppend(b []byte) []byte {
+	b = appendTag(b, rar.Tag)
+	return b
+}
+
+func (rar *RenameAtResponse) Unmarshal(b []byte) error {
+	dec := decoder{b: b}
+	rar.Tag = dec.tag()
+	return dec.err
+}
+
+// UnlinkAtRequest is used to remove a file from a directory, similar to
+// unlinkat(2). Unlike RemoveRequest, no fid is clunked.
+type UnlinkAtRequest struct {
+	Tag Tag
+
+	// DirFid is the directory containing the file.
+	DirFid Fid
+
+	// Name is the name of the file to remove.
+	Name string
+
+	// Flags are the unlinkat(2) flags, such as AT_REMOVEDIR.
+	Flags uint32
+}
+
+func (ur *UnlinkAtRequest) GetTag() Tag {
+	return ur.Tag
+}
+
+func (ur *UnlinkAtRequest) SetTag(t Tag) {
+	ur.Tag = t
+}
+
+func (ur *UnlinkAtRequest) EncodedLength() int {
+	return 2 + 4 + 2 + len(ur.Name) + 4
+}
+
+func (ur *UnlinkAtRequest) Decode(r io.Reader) error {
+	var err error
+	if ur.Tag, err = ReadTag(r); err != nil {
+		return err
+	}
+	if ur.DirFid, err = ReadFid(r); err != nil {
+		return err
+	}
+	if ur.Name, err = ReadString(r); err != nil {
+		return err
+	}
+	if ur.Flags, err = ReadUint32(r); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (ur *UnlinkAtRequest) Encode(w io.Writer) error {
+	var err error
+	if err = WriteTag(w, ur.Tag); err != nil {
+		return err
+	}
+	if err = WriteFid(w, ur.DirFid); err != nil {
+		return err
+	}
+	if err = WriteString(w, ur.Name); err != nil {
+		return err
+	}
+	if err = WriteUint32(w, ur.Flags); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (ur *UnlinkAtRequest) MarshalAppend(b []byte) []byte {
+	b = appendTag(b, ur.Tag)
+	b = appendFid(b, ur.DirFid)
+	b = appendString(b, ur.Name)
+	b = appendUint32(b, ur.Flags)
+	return b
+}
+
+func (ur *UnlinkAtRequest) Unmarshal(b []byte) error {
+	dec := decoder{b: b}
+	ur.Tag = dec.tag()
+	ur.DirFid = dec.fid()
+	ur.Name = dec.string()
+	ur.Flags = dec.uint32()
+	return dec.err
+}
+
+// UnlinkAtResponse indicates a successful unlink.
+type UnlinkAtResponse struct {
+	Tag Tag
+}
+
+func (ur *UnlinkAtResponse) GetTag() Tag {
+	return ur.Tag
+}
+
+func (ur *UnlinkAtResponse) SetTag(t Tag) {
+	ur.Tag = t
+}
+
+func (*UnlinkAtResponse) EncodedLength() int {
+	return 2
+}
+
+func (ur *UnlinkAtResponse) Decode(r io.Reader) error {
+	var err error
+	if ur.Tag, err = ReadTag(r); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (ur *UnlinkAtResponse) Encode(w io.Writer) error {
+	var err error
+	if err = WriteTag(w, ur.Tag); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (ur *UnlinkAtResponse) MarshalAppend(b []byte) []byte {
+	b = appendTag(b, ur.Tag)
+	return b
+}
+
+func (ur *UnlinkAtResponse) Unmarshal(b []byte) error {
+	dec := decoder{b: b}
+	ur.Tag = dec.tag()
+	return dec.err
+}
@@ -2,6 +2,9 @@ package protocol
 
 import (
 	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
 	"reflect"
 	"testing"
 )
@@ -10,6 +13,8 @@ import (
 var (
 	_ Codec   = (*Qid)(nil)
 	_ Codec   = (*Stat)(nil)
+	_ Codec   = (*Attr)(nil)
+	_ Codec   = (*Dirent)(nil)
 	_ Message = (*VersionRequest)(nil)
 	_ Message = (*VersionResponse)(nil)
 	_ Message = (*AuthRequest)(nil)
@@ -37,6 +42,53 @@ var (
 	_ Message = (*StatResponse)(nil)
 	_ Message = (*WriteStatRequest)(nil)
 	_ Message = (*WriteStatResponse)(nil)
+	_ Message = (*LinuxErrorResponse)(nil)
+	_ Message = (*StatFSRequest)(nil)
+	_ Message = (*StatFSResponse)(nil)
+	_ Message = (*LinuxOpenRequest)(nil)
+	_ Message = (*LinuxOpenResponse)(nil)
+	_ Message = (*LinuxCreateRequest)(nil)
+	_ Message = (*LinuxCreateResponse)(nil)
+	_ Message = (*SymlinkRequest)(nil)
+	_ Message = (*SymlinkResponse)(nil)
+	_ Message = (*MknodRequest)(nil)
+	_ Message = (*MknodResponse)(nil)
+	_ Message = (*RenameRequest)(nil)
+	_ Message = (*RenameResponse)(nil)
+	_ Message = (*ReadLinkRequest)(nil)
+	_ Message = (*ReadLinkResponse)(nil)
+	_ Message = (*GetAttrRequest)(nil)
+	_ Message = (*GetAttrResponse)(nil)
+	_ Message = (*SetAttrRequest)(nil)
+	_ Message = (*SetAttrResponse)(nil)
+	_ Message = (*XattrWalkRequest)(nil)
+	_ Message = (*XattrWalkResponse)(nil)
+	_ Message = (*XattrCreateRequest)(nil)
+	_ Message = (*XattrCreateResponse)(nil)
+	_ Message = (*ReadDirRequest)(nil)
+	_ Message = (*ReadDirResponse)(nil)
+	_ Message = (*FsyncRequest)(nil)
+	_ Message = (*FsyncResponse)(nil)
+	_ Message = (*LockRequest)(nil)
+	_ Message = (*LockResponse)(nil)
+	_ Message = (*GetLockRequest)(nil)
+	_ Message = (*GetLockResponse)(nil)
+	_ Message = (*LinkRequest)(nil)
+	_ Message = (*LinkResponse)(nil)
+	_ Message = (*MkdirRequest)(nil)
+	_ Message = (*MkdirResponse)(nil)
+	_ Message = (*RenameAtRequest)(nil)
+	_ Message = (*RenameAtResponse)(nil)
+	_ Message = (*UnlinkAtRequest)(nil)
+	_ Message = (*UnlinkAtResponse)(nil)
+
+	_ DialectCodec = (*Stat)(nil)
+	_ DialectCodec = (*AuthRequest)(nil)
+	_ DialectCodec = (*AttachRequest)(nil)
+	_ DialectCodec = (*ErrorResponse)(nil)
+	_ DialectCodec = (*CreateRequest)(nil)
+	_ DialectCodec = (*StatResponse)(nil)
+	_ DialectCodec = (*WriteStatRequest)(nil)
 )
 
 func reencode(i int, in Codec, t *testing.T) {
@@ -78,6 +130,60 @@ func reencode(i int, in Codec, t *testing.T) {
 	}
 }
 
+// remarshal checks that the buffer based codec produces the same encoding as
+// the io based codec, that it is compatible with itself, and that truncated
+// input is rejected.
+func remarshal(i int, in Codec, t *testing.T) {
+	inputType := reflect.ValueOf(in).Elem().Type()
+	buf := new(bytes.Buffer)
+	var b, body []byte
+	var other Codec
+	if inm, ok := in.(Message); ok {
+		if err := Encode(buf, inm); err != nil {
+			t.Errorf("test %d: encoding failed for %v: %v", i, inputType, err)
+			return
+		}
+		var err error
+		if b, err = AppendMessage(nil, inm, Dialect9P2000); err != nil {
+			t.Errorf("test %d: marshalling failed for %v: %v", i, inputType, err)
+			return
+		}
+		if other, err = UnmarshalMessage(b, Dialect9P2000); err != nil {
+			t.Errorf("test %d: unmarshalling failed for %v: %v", i, inputType, err)
+			return
+		}
+		body = b[HeaderSize:]
+	} else {
+		if err := in.Encode(buf); err != nil {
+			t.Errorf("test %d: encoding failed for %v: %v", i, inputType, err)
+			return
+		}
+		b = in.MarshalAppend(nil)
+		other = reflect.New(inputType).Interface().(Codec)
+		if err := other.Unmarshal(b); err != nil {
+			t.Errorf("test %d: unmarshalling failed for %v: %v", i, inputType, err)
+			return
+		}
+		body = b
+	}
+
+	if !bytes.Equal(buf.Bytes(), b) {
+		t.Errorf("test %d: %v marshalled differently from encode", i, inputType)
+	}
+
+	if !reflect.DeepEqual(reflect.ValueOf(in).Elem().Interface(), reflect.ValueOf(other).Elem().Interface()) {
+		t.Errorf("test %d: %v did not remarshal correctly", i, inputType)
+	}
+
+	for l := range body {
+		other = reflect.New(inputType).Interface().(Codec)
+		if err := other.Unmarshal(body[:l]); err == nil {
+			t.Errorf("test %d: %v unmarshalled from truncated buffer of length %d", i, inputType, l)
+			return
+		}
+	}
+}
+
 // This test does NOT guarantee proper 9P2000 spec coding, but ensures at least
 // that all codecs are compatible with themselves.
 func TestReencode(t *testing.T) {
@@ -264,9 +370,485 @@ func TestReencode(t *testing.T) {
 			&WriteStatResponse{
 				Tag: 45,
 			},
+		}, {
+			&Attr{
+				Valid: GETATTR_ALL,
+				Qid:   Qid{Type: QTDIR, Path: 1234},
+				Mode:  040755,
+				NLink: 2,
+			},
+		}, {
+			&Dirent{
+				Qid:    Qid{},
+				Offset: 1234,
+				Type:   4,
+				Name:   "somedir",
+			},
+		}, {
+			&LinuxErrorResponse{
+				Tag:   45,
+				Ecode: 1037,
+			},
+		}, {
+			&StatFSRequest{
+				Tag: 45,
+				Fid: 1074,
+			},
+		}, {
+			&StatFSResponse{
+				Tag:             45,
+				Type:            1111,
+				BlockSize:       1148,
+				Blocks:          1185,
+				BlocksFree:      1222,
+				BlocksAvailable: 1259,
+				Files:           1296,
+				FilesFree:       1333,
+				FSID:            1370,
+				NameLength:      1407,
+			},
+		}, {
+			&LinuxOpenRequest{
+				Tag:   45,
+				Fid:   1444,
+				Flags: 1481,
+			},
+		}, {
+			&LinuxOpenResponse{
+				Tag:    45,
+				Qid:    Qid{},
+				IOUnit: 1555,
+			},
+		}, {
+			&LinuxCreateRequest{
+				Tag:   45,
+				Fid:   1592,
+				Name:  "somefile",
+				Flags: 1666,
+				Mode:  1703,
+				GID:   1740,
+			},
+		}, {
+			&LinuxCreateResponse{
+				Tag:    45,
+				Qid:    Qid{},
+				IOUnit: 1814,
+			},
+		}, {
+			&SymlinkRequest{
+				Tag:    45,
+				Fid:    1851,
+				Name:   "somefile",
+				Target: "/target",
+				GID:    1962,
+			},
+		}, {
+			&SymlinkResponse{
+				Tag: 45,
+				Qid: Qid{},
+			},
+		}, {
+			&MknodRequest{
+				Tag:    45,
+				DirFid: 2036,
+				Name:   "somefile",
+				Mode:   2110,
+				Major:  2147,
+				Minor:  2184,
+				GID:    2221,
+			},
+		}, {
+			&MknodResponse{
+				Tag: 45,
+				Qid: Qid{},
+			},
+		}, {
+			&RenameRequest{
+				Tag:    45,
+				Fid:    2295,
+				DirFid: 2332,
+				Name:   "somefile",
+			},
+		}, {
+			&RenameResponse{
+				Tag: 45,
+			},
+		}, {
+			&ReadLinkRequest{
+				Tag: 45,
+				Fid: 2406,
+			},
+		}, {
+			&ReadLinkResponse{
+				Tag:    45,
+				Target: "/target",
+			},
+		}, {
+			&GetAttrRequest{
+				Tag:         45,
+				Fid:         2480,
+				RequestMask: 2517,
+			},
+		}, {
+			&GetAttrResponse{
+				Tag: 45,
+				Attr: Attr{
+					Valid: GETATTR_BASIC,
+					Mode:  0100644,
+					UID:   1000,
+					Size:  0x23ABDDF8,
+				},
+			},
+		}, {
+			&SetAttrRequest{
+				Tag:       45,
+				Fid:       2591,
+				Valid:     2628,
+				Mode:      2665,
+				UID:       2702,
+				GID:       2739,
+				Size:      2776,
+				ATimeSec:  2813,
+				ATimeNsec: 2850,
+				MTimeSec:  2887,
+				MTimeNsec: 2924,
+			},
+		}, {
+			&SetAttrResponse{
+				Tag: 45,
+			},
+		}, {
+			&XattrWalkRequest{
+				Tag:    45,
+				Fid:    2961,
+				NewFid: 2998,
+				Name:   "somefile",
+			},
+		}, {
+			&XattrWalkResponse{
+				Tag:  45,
+				Size: 3072,
+			},
+		}, {
+			&XattrCreateRequest{
+				Tag:   45,
+				Fid:   3109,
+				Name:  "somefile",
+				Size:  3183,
+				Flags: 3220,
+			},
+		}, {
+			&XattrCreateResponse{
+				Tag: 45,
+			},
+		}, {
+			&ReadDirRequest{
+				Tag:    45,
+				Fid:    3257,
+				Offset: 3294,
+				Count:  3331,
+			},
+		}, {
+			&ReadDirResponse{
+				Tag:  45,
+				Data: []byte("some directory entries"),
+			},
+		}, {
+			&FsyncRequest{
+				Tag:      45,
+				Fid:      3405,
+				DataSync: 3442,
+			},
+		}, {
+			&FsyncResponse{
+				Tag: 45,
+			},
+		}, {
+			&LockRequest{
+				Tag:      45,
+				Fid:      3479,
+				Type:     1,
+				Flags:    3553,
+				Start:    3590,
+				Length:   3627,
+				ProcID:   3664,
+				ClientID: "client",
+			},
+		}, {
+			&LockResponse{
+				Tag:    45,
+				Status: 1,
+			},
+		}, {
+			&GetLockRequest{
+				Tag:      45,
+				Fid:      3775,
+				Type:     1,
+				Start:    3849,
+				Length:   3886,
+				ProcID:   3923,
+				ClientID: "client",
+			},
+		}, {
+			&GetLockResponse{
+				Tag:      45,
+				Type:     1,
+				Start:    4034,
+				Length:   4071,
+				ProcID:   4108,
+				ClientID: "client",
+			},
+		}, {
+			&LinkRequest{
+				Tag:    45,
+				DirFid: 4182,
+				Fid:    4219,
+				Name:   "somefile",
+			},
+		}, {
+			&LinkResponse{
+				Tag: 45,
+			},
+		}, {
+			&MkdirRequest{
+				Tag:    45,
+				DirFid: 4293,
+				Name:   "somefile",
+				Mode:   4367,
+				GID:    4404,
+			},
+		}, {
+			&MkdirResponse{
+				Tag: 45,
+				Qid: Qid{},
+			},
+		}, {
+			&RenameAtRequest{
+				Tag:       45,
+				OldDirFid: 4478,
+				OldName:   "old",
+				NewDirFid: 4552,
+				NewName:   "new",
+			},
+		}, {
+			&RenameAtResponse{
+				Tag: 45,
+			},
+		}, {
+			&UnlinkAtRequest{
+				Tag:    45,
+				DirFid: 4626,
+				Name:   "somefile",
+				Flags:  4700,
+			},
+		}, {
+			&UnlinkAtResponse{
+				Tag: 45,
+			},
 		},
 	}
 	for i, tt := range tests {
 		reencode(i, tt.in, t)
+		remarshal(i, tt.in, t)
+	}
+}
+
+// TestReencodeDialect ensures that the 9P2000.u extensions survive a
+// reencode, and that the encoded length matches what is written.
+func TestReencodeDialect(t *testing.T) {
+	stat := Stat{
+		Type:      0xDEAD,
+		Dev:       0xABCDEF08,
+		Mode:      DMSYMLINK | 0777,
+		Name:      "link",
+		UID:       "glenda",
+		GID:       "glenda",
+		MUID:      "glenda",
+		Extension: "/target",
+		NUID:      1000,
+		NGID:      100,
+		NMUID:     1000,
+	}
+	tests := []Message{
+		&AuthRequest{
+			Tag:       45,
+			AuthFid:   Fid(1234),
+			Username:  "someone",
+			Service:   "something",
+			NUsername: 1000,
+		},
+		&AttachRequest{
+			Tag:       45,
+			Fid:       35243,
+			AuthFid:   NOFID,
+			Username:  "someone",
+			Service:   "weee",
+			NUsername: NONUNAME,
+		},
+		&ErrorResponse{
+			Tag:   45,
+			Error: "file not found",
+			Errno: 2,
+		},
+		&CreateRequest{
+			Tag:         45,
+			Fid:         12343,
+			Name:        "wakakaaka",
+			Permissions: DMSYMLINK,
+			Mode:        OREAD,
+			Extension:   "/somewhere",
+		},
+		&StatResponse{
+			Tag:  45,
+			Stat: stat,
+		},
+		&WriteStatRequest{
+			Tag:  45,
+			Fid:  12342134,
+			Stat: stat,
+		},
+	}
+	for i, in := range tests {
+		buf := new(bytes.Buffer)
+		if err := EncodeDialect(buf, in, Dialect9P2000u); err != nil {
+			t.Errorf("test %d: encoding failed: %v", i, err)
+			continue
+		}
+		if l := in.(DialectCodec).EncodedLengthDialect(Dialect9P2000u) + HeaderSize; l != buf.Len() {
+			t.Errorf("test %d: encoded length was %d, expected %d", i, buf.Len(), l)
+		}
+		body := new(bytes.Buffer)
+		if err := in.(DialectCodec).EncodeDialect(body, Dialect9P2000u); err != nil {
+			t.Errorf("test %d: encoding failed: %v", i, err)
+			continue
+		}
+		if !bytes.Equal(body.Bytes(), buf.Bytes()[HeaderSize:]) {
+			t.Errorf("test %d: %T marshalled differently from encode", i, in)
+		}
+		out, err := DecodeDialect(buf, Dialect9P2000u)
+		if err != nil {
+			t.Errorf("test %d: decoding failed: %v", i, err)
+			continue
+		}
+		if !reflect.DeepEqual(in, out) {
+			t.Errorf("test %d: %T did not reencode correctly", i, in)
+		}
+	}
+}
+
+func BenchmarkEncodeStat(b *testing.B) {
+	m := &StatResponse{
+		Tag: 45,
+		Stat: Stat{
+			Qid:    Qid{Type: QTFILE, Path: 1234},
+			Mode:   0644,
+			Length: 0x23ABDDF8,
+			Name:   "hello",
+			UID:    "glenda",
+			GID:    "glenda",
+			MUID:   "glenda",
+		},
+	}
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if err := Encode(ioutil.Discard, m); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkDecodeRead(b *testing.B) {
+	buf, _ := AppendMessage(nil, &ReadRequest{Tag: 45, Fid: 5343, Count: 8192}, Dialect9P2000)
+	r := bytes.NewReader(buf)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		r.Reset(buf)
+		if _, err := Decode(r); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// TestReadFrameLimit ensures that oversized frames are rejected before they are
+// read, and that declared sizes and counts are checked against the data
+// actually available.
+func TestReadFrameLimit(t *testing.T) {
+	huge := []byte{0xFF, 0xFF, 0xFF, 0xFF, byte(Rread), 0, 0}
+	if _, err := ReadFrame(bytes.NewReader(huge), 8192); err != ErrMessageTooLarge {
+		t.Errorf("oversized frame: expected %v, got %v", ErrMessageTooLarge, err)
+	}
+	if _, err := ReadFrame(bytes.NewReader(huge), 0); err != io.ErrUnexpectedEOF {
+		t.Errorf("truncated frame: expected %v, got %v", io.ErrUnexpectedEOF, err)
+	}
+
+	// A walk response claiming 0xFFFF qids, but carrying none.
+	walk := []byte{9, 0, 0, 0, byte(Rwalk), 45, 0, 0xFF, 0xFF}
+	if _, err := UnmarshalMessage(walk, Dialect9P2000); err != io.ErrUnexpectedEOF {
+		t.Errorf("walk response: expected %v, got %v", io.ErrUnexpectedEOF, err)
+	}
+	if _, err := Decode(bytes.NewReader(walk)); err != io.ErrUnexpectedEOF {
+		t.Errorf("walk response: expected %v, got %v", io.ErrUnexpectedEOF, err)
+	}
+
+	// A read response claiming 4 GiB of data, but carrying none.
+	read := []byte{11, 0, 0, 0, byte(Rread), 45, 0, 0xFF, 0xFF, 0xFF, 0xFF}
+	r := &ReadResponse{}
+	if err := r.Decode(&io.LimitedReader{R: bytes.NewReader(read[HeaderSize:]), N: 6}); err != io.ErrUnexpectedEOF {
+		t.Errorf("read response: expected %v, got %v", io.ErrUnexpectedEOF, err)
+	}
+}
+
+func TestFrameSplitter(t *testing.T) {
+	var stream []byte
+	for _, m := range []Message{&ClunkRequest{Tag: 1, Fid: 2}, &ReadRequest{Tag: 3, Fid: 4, Count: 5}} {
+		var err error
+		if stream, err = AppendMessage(stream, m, Dialect9P2000); err != nil {
+			t.Fatalf("append failed: %v", err)
+		}
+	}
+
+	// Frames are completed regardless of how the data is chunked.
+	var frames [][]byte
+	var f FrameSplitter
+	for i := range stream {
+		if err := f.Split(stream[i:i+1], func(b []byte) { frames = append(frames, append([]byte(nil), b...)) }); err != nil {
+			t.Fatalf("split failed: %v", err)
+		}
+	}
+	if len(frames) != 2 || !bytes.Equal(bytes.Join(frames, nil), stream) {
+		t.Fatalf("split %d bytes into frames %v", len(stream), frames)
+	}
+
+	if err := f.Split([]byte{1, 0, 0, 0}, func([]byte) {}); err != io.ErrUnexpectedEOF {
+		t.Errorf("bad frame size: expected %v, got %v", io.ErrUnexpectedEOF, err)
+	}
+}
+
+// TestString checks the fcall style rendering of messages.
+func TestString(t *testing.T) {
+	for mt := 0; mt < 256; mt++ {
+		if m, err := MessageTypeToMessage(MessageType(mt)); err == nil {
+			if _, ok := m.(fmt.Stringer); !ok {
+				t.Errorf("%T does not implement fmt.Stringer", m)
+			}
+		}
+	}
+
+	tests := []struct {
+		m    fmt.Stringer
+		want string
+	}{
+		{&WalkRequest{Tag: 3, Fid: 1, NewFid: 2, Names: []string{"usr", "glenda"}}, "Twalk tag 3 fid 1 newfid 2 nwname 2 0:usr 1:glenda"},
+		{&AttachRequest{Tag: 1, Fid: 0, AuthFid: NOFID, Username: "glenda"}, "Tattach tag 1 fid 0 afid -1 uname glenda aname "},
+		{&OpenResponse{Tag: 1, Qid: Qid{Type: QTDIR, Version: 3, Path: 0x2a}}, "Ropen tag 1 qid (000000000000002a 3 d) iounit 0"},
+		{&CreateRequest{Tag: 1, Fid: 2, Name: "log", Permissions: DMAPPEND | DMEXCL | 0640, Mode: OWRITE | OTRUNC}, "Tcreate tag 1 fid 2 name log perm alrw-r----- mode OWRITE|OTRUNC"},
+		{&WriteRequest{Tag: 1, Fid: 2, Data: []byte("hello")}, "Twrite tag 1 fid 2 offset 0 count 5 'hello'"},
+		{&ReadResponse{Tag: 1, Data: []byte{0, 1, 2, 3, 4}}, "Rread tag 1 count 5 '00010203 04'"},
+		{&StatResponse{Tag: 1, Stat: Stat{Name: "lib", UID: "glenda", GID: "sys", Mode: DMDIR | 0775}}, "Rstat tag 1 stat 'lib' 'glenda' 'sys' '' q (0000000000000000 0 ) m 020000000775 at 0 mt 0 l 0 t 0 d 0"},
+	}
+	for _, tt := range tests {
+		if got := tt.m.String(); got != tt.want {
+			t.Errorf("got %q, expected %q", got, tt.want)
+		}
 	}
 }
@@ -0,0 +1,155 @@
+package protocol
+
+import (
+	"encoding/binary"
+	"io"
+)
+
+// decoder reads protocol values from a buffer. The first error encountered is
+// kept in err, after which all reads return zero values. Byte slices returned
+// by the decoder alias the buffer.
+type decoder struct {
+	b   []byte
+	err error
+}
+
+func (d *decoder) next(n int) []byte {
+	if d.err != nil {
+		return nil
+	}
+	if n < 0 || n > len(d.b) {
+		d.err = io.ErrUnexpectedEOF
+		d.b = nil
+		return nil
+	}
+	x := d.b[:n:n]
+	d.b = d.b[n:]
+	return x
+}
+
+func (d *decoder) uint8() uint8 {
+	b := d.next(1)
+	if b == nil {
+		return 0
+	}
+	return b[0]
+}
+
+func (d *decoder) uint16() uint16 {
+	b := d.next(2)
+	if b == nil {
+		return 0
+	}
+	return binary.LittleEndian.Uint16(b)
+}
+
+func (d *decoder) uint32() uint32 {
+	b := d.next(4)
+	if b == nil {
+		return 0
+	}
+	return binary.LittleEndian.Uint32(b)
+}
+
+func (d *decoder) uint64() uint64 {
+	b := d.next(8)
+	if b == nil {
+		return 0
+	}
+	return binary.LittleEndian.Uint64(b)
+}
+
+func (d *decoder) tag() Tag {
+	return Tag(d.uint16())
+}
+
+func (d *decoder) fid() Fid {
+	return Fid(d.uint32())
+}
+
+func (d *decoder) string() string {
+	return string(d.next(int(d.uint16())))
+}
+
+// count reads a 2 byte element count, and verifies that the remaining buffer
+// can hold that many elements of at least size bytes each, so that the count
+// can safely be used to allocate.
+func (d *decoder) count(size int) int {
+	n := int(d.uint16())
+	if d.err == nil && n*size > len(d.b) {
+		d.err = io.ErrUnexpectedEOF
+		d.b = nil
+		return 0
+	}
+	return n
+}
+
+// data reads a byte slice prefixed by a 4 byte count.
+func (d *decoder) data() []byte {
+	return d.next(int(d.uint32()))
+}
+
+// codec unmarshals a fixed size codec, such as a Qid.
+func (d *decoder) codec(c Codec, n int) {
+	b := d.next(n)
+	if b == nil {
+		return
+	}
+	if err := c.Unmarshal(b); err != nil {
+		d.err = err
+	}
+}
+
+// stat unmarshals a Stat, which is prefixed by its own size.
+func (d *decoder) stat(s *Stat, dialect Dialect) {
+	if d.err != nil {
+		return
+	}
+	if len(d.b) < 2 {
+		d.err = io.ErrUnexpectedEOF
+		return
+	}
+	b := d.next(2 + int(binary.LittleEndian.Uint16(d.b)))
+	if b == nil {
+		return
+	}
+	if err := s.UnmarshalDialect(b, dialect); err != nil {
+		d.err = err
+	}
+}
+
+func appendUint8(b []byte, v uint8) []byte {
+	return append(b, v)
+}
+
+func appendUint16(b []byte, v uint16) []byte {
+	return append(b, byte(v), byte(v>>8))
+}
+
+func appendUint32(b []byte, v uint32) []byte {
+	return append(b, byte(v), byte(v>>8), byte(v>>16), byte(v>>24))
+}
+
+func appendUint64(b []byte, v uint64) []byte {
+	return append(b, byte(v), byte(v>>8), byte(v>>16), byte(v>>24),
+		byte(v>>32), byte(v>>40), byte(v>>48), byte(v>>56))
+}
+
+func appendTag(b []byte, t Tag) []byte {
+	return appendUint16(b, uint16(t))
+}
+
+func appendFid(b []byte, f Fid) []byte {
+	return appendUint32(b, uint32(f))
+}
+
+func appendString(b []byte, s string) []byte {
+	b = appendUint16(b, uint16(len(s)))
+	return append(b, s...)
+}
+
+// appendData appends a byte slice prefixed by a 4 byte count.
+func appendData(b []byte, data []byte) []byte {
+	b = appendUint32(b, uint32(len(data)))
+	return append(b, data...)
+}
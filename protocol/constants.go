@@ -4,6 +4,14 @@ const (
 	// HeaderSize is the overhead of the size and type fields of the 9P2000
 	// header.
 	HeaderSize = 4 + 1
+
+	// IOHDRSZ is the overhead of a read or write message, excluding the data.
+	// The largest read or write payload possible on a connection is the
+	// negotiated maximum message size minus IOHDRSZ.
+	IOHDRSZ = 24
+
+	// MAXWELEM is the maximum number of names in a walk.
+	MAXWELEM = 16
 )
 
 // MessageType constants
@@ -39,10 +47,66 @@ const (
 	Tlast
 )
 
+// 9P2000.L MessageType constants
+const (
+	Tlerror MessageType = 6 + iota
+	Rlerror
+	Tstatfs
+	Rstatfs
+)
+
+// 9P2000.L MessageType constants
+const (
+	Tlopen MessageType = 12 + iota
+	Rlopen
+	Tlcreate
+	Rlcreate
+	Tsymlink
+	Rsymlink
+	Tmknod
+	Rmknod
+	Trename
+	Rrename
+	Treadlink
+	Rreadlink
+	Tgetattr
+	Rgetattr
+	Tsetattr
+	Rsetattr
+)
+
+// 9P2000.L MessageType constants
+const (
+	Txattrwalk   MessageType = 30
+	Rxattrwalk   MessageType = 31
+	Txattrcreate MessageType = 32
+	Rxattrcreate MessageType = 33
+	Treaddir     MessageType = 40
+	Rreaddir     MessageType = 41
+	Tfsync       MessageType = 50
+	Rfsync       MessageType = 51
+	Tlock        MessageType = 52
+	Rlock        MessageType = 53
+	Tgetlock     MessageType = 54
+	Rgetlock     MessageType = 55
+	Tlink        MessageType = 70
+	Rlink        MessageType = 71
+	Tmkdir       MessageType = 72
+	Rmkdir       MessageType = 73
+	Trenameat    MessageType = 74
+	Rrenameat    MessageType = 75
+	Tunlinkat    MessageType = 76
+	Runlinkat    MessageType = 77
+)
+
 // Special message values
 const (
 	NOTAG Tag = 0xFFFF
 	NOFID Fid = 0xFFFFFFFF
+
+	// NONUNAME is the numeric username used in 9P2000.u and 9P2000.L when no
+	// numeric id is provided, in which case the string name is authoritative.
+	NONUNAME uint32 = 0xFFFFFFFF
 )
 
 // Opening modes
@@ -89,3 +153,56 @@ const (
 	QTAPPEND  QidType = 0x40
 	QTDIR     QidType = 0x80
 )
+
+// 9P2000.L GetAttrRequest mask and Attr valid bits
+const (
+	GETATTR_MODE         uint64 = 0x00000001
+	GETATTR_NLINK        uint64 = 0x00000002
+	GETATTR_UID          uint64 = 0x00000004
+	GETATTR_GID          uint64 = 0x00000008
+	GETATTR_RDEV         uint64 = 0x00000010
+	GETATTR_ATIME        uint64 = 0x00000020
+	GETATTR_MTIME        uint64 = 0x00000040
+	GETATTR_CTIME        uint64 = 0x00000080
+	GETATTR_INO          uint64 = 0x00000100
+	GETATTR_SIZE         uint64 = 0x00000200
+	GETATTR_BLOCKS       uint64 = 0x00000400
+	GETATTR_BTIME        uint64 = 0x00000800
+	GETATTR_GEN          uint64 = 0x00001000
+	GETATTR_DATA_VERSION uint64 = 0x00002000
+	GETATTR_BASIC        uint64 = 0x000007ff
+	GETATTR_ALL          uint64 = 0x00003fff
+)
+
+// 9P2000.L SetAttrRequest valid bits
+const (
+	SETATTR_MODE      uint32 = 0x00000001
+	SETATTR_UID       uint32 = 0x00000002
+	SETATTR_GID       uint32 = 0x00000004
+	SETATTR_SIZE      uint32 = 0x00000008
+	SETATTR_ATIME     uint32 = 0x00000010
+	SETATTR_MTIME     uint32 = 0x00000020
+	SETATTR_CTIME     uint32 = 0x00000040
+	SETATTR_ATIME_SET uint32 = 0x00000080
+	SETATTR_MTIME_SET uint32 = 0x00000100
+)
+
+// 9P2000.L lock types, flags and status
+const (
+	LOCK_TYPE_RDLCK uint8 = 0
+	LOCK_TYPE_WRLCK uint8 = 1
+	LOCK_TYPE_UNLCK uint8 = 2
+
+	LOCK_FLAGS_BLOCK   uint32 = 1
+	LOCK_FLAGS_RECLAIM uint32 = 2
+
+	LOCK_SUCCESS uint8 = 0
+	LOCK_BLOCKED uint8 = 1
+	LOCK_ERROR   uint8 = 2
+	LOCK_GRACE   uint8 = 3
+)
+
+// 9P2000.L UnlinkAtRequest flags
+const (
+	AT_REMOVEDIR uint32 = 0x200
+)
@@ -0,0 +1,68 @@
+package protocol
+
+import "io"
+
+// Protocol version strings, as used in VersionRequest and VersionResponse.
+const (
+	Version9P2000  = "9P2000"
+	Version9P2000u = "9P2000.u"
+	Version9P2000L = "9P2000.L"
+)
+
+// Dialect is the protocol variant in effect on a connection. It is selected by
+// the version negotiated with Tversion/Rversion, and decides the wire layout of
+// the messages whose encoding differs between the variants.
+type Dialect byte
+
+// Supported dialects
+const (
+	// Dialect9P2000 is the plain 9P2000 protocol.
+	Dialect9P2000 Dialect = iota
+
+	// Dialect9P2000u is the 9P2000.u Unix extension, which adds numeric
+	// user ids, Unix error numbers and special file extensions.
+	Dialect9P2000u
+
+	// Dialect9P2000L is the 9P2000.L Linux extension, which adds numeric
+	// user ids to 9P2000 and a separate set of messages mirroring the Linux
+	// VFS.
+	Dialect9P2000L
+)
+
+// ParseDialect returns the dialect for a negotiated protocol version. If the
+// version is not known, Dialect9P2000 and false is returned.
+func ParseDialect(version string) (Dialect, bool) {
+	switch version {
+	case Version9P2000:
+		return Dialect9P2000, true
+	case Version9P2000u:
+		return Dialect9P2000u, true
+	case Version9P2000L:
+		return Dialect9P2000L, true
+	default:
+		return Dialect9P2000, false
+	}
+}
+
+// String returns the protocol version string of the dialect.
+func (d Dialect) String() string {
+	switch d {
+	case Dialect9P2000u:
+		return Version9P2000u
+	case Dialect9P2000L:
+		return Version9P2000L
+	default:
+		return Version9P2000
+	}
+}
+
+// DialectCodec is a Codec whose wire layout depends on the dialect in use. The
+// plain Codec methods use the Dialect9P2000 layout.
+type DialectCodec interface {
+	Codec
+	EncodedLengthDialect(d Dialect) int
+	EncodeDialect(w io.Writer, d Dialect) error
+	DecodeDialect(r io.Reader, d Dialect) error
+	MarshalAppendDialect(b []byte, d Dialect) []byte
+	UnmarshalDialect(b []byte, d Dialect) error
+}
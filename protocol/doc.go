@@ -1,2 +1,3 @@
-// Package protocol implements the 9P2000 protocol.
+// Package protocol implements the 9P2000 protocol, as well as the 9P2000.u and
+// 9P2000.L extensions.
 package protocol
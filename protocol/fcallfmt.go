@@ -0,0 +1,417 @@
+package protocol
+
+import (
+	"fmt"
+	"strings"
+)
+
+// The String methods below render messages in the format of Plan 9's fcall
+// print verb, as described in http://man.cat-v.org/plan_9/2/fcall. 9P2000.L
+// messages, which Plan 9 does not know, are rendered in the same style.
+
+// String renders the qid as its path in hex, its version and its type, such as
+// "(0000000000000001 3 d)".
+func (q Qid) String() string {
+	var t []byte
+	if q.Type&QTDIR != 0 {
+		t = append(t, 'd')
+	}
+	if q.Type&QTAPPEND != 0 {
+		t = append(t, 'a')
+	}
+	if q.Type&QTEXCL != 0 {
+		t = append(t, 'l')
+	}
+	if q.Type&QTAUTH != 0 {
+		t = append(t, 'A')
+	}
+	if q.Type&QTTMP != 0 {
+		t = append(t, 't')
+	}
+	return fmt.Sprintf("(%016x %d %s)", q.Path, q.Version, t)
+}
+
+// String renders the mode like ls(1), such as "d-rwxr-xr-x". The first
+// character is d for directories, a for append-only files and A for
+// authentication files, and the second is l for exclusive use files.
+func (m FileMode) String() string {
+	b := []byte("-----------")
+	switch {
+	case m&DMDIR != 0:
+		b[0] = 'd'
+	case m&DMAPPEND != 0:
+		b[0] = 'a'
+	case m&DMAUTH != 0:
+		b[0] = 'A'
+	}
+	if m&DMEXCL != 0 {
+		b[1] = 'l'
+	}
+	for i, c := range "rwxrwxrwx" {
+		if m&(1<<(8-i)) != 0 {
+			b[2+i] = byte(c)
+		}
+	}
+	return string(b)
+}
+
+// String renders the mode as the names of its constants, such as
+// "OWRITE|OTRUNC". Unknown bits are rendered in hex.
+func (m OpenMode) String() string {
+	s := [...]string{"OREAD", "OWRITE", "ORDWR", "OEXEC"}[m&3]
+	m &^= 3
+	for _, f := range []struct {
+		mode OpenMode
+		name string
+	}{{ORCLOSE, "ORCLOSE"}, {OCEXEC, "OCEXEC"}, {OTRUNC, "OTRUNC"}} {
+		if m&f.mode == f.mode {
+			s += "|" + f.name
+			m &^= f.mode
+		}
+	}
+	if m != 0 {
+		s += fmt.Sprintf("|%#x", uint8(m))
+	}
+	return s
+}
+
+// String renders the stat as its quoted names followed by the remaining
+// fields, such as "'lib' 'glenda' 'glenda' 'glenda' q (...) m 020000000775 at
+// 0 mt 0 l 0 t 0 d 0".
+func (s Stat) String() string {
+	str := fmt.Sprintf("'%s' '%s' '%s' '%s' q %v m %#o at %d mt %d l %d t %d d %d",
+		s.Name, s.UID, s.GID, s.MUID, s.Qid, uint32(s.Mode), s.Atime, s.Mtime, s.Length, s.Type, s.Dev)
+	if s.Extension != "" {
+		str += fmt.Sprintf(" ext '%s'", s.Extension)
+	}
+	return str
+}
+
+// String renders the attributes in the style of Stat.String.
+func (a Attr) String() string {
+	return fmt.Sprintf("valid %#x qid %v mode %#o uid %d gid %d nlink %d rdev %d size %d blksize %d blocks %d "+
+		"atime %d.%09d mtime %d.%09d ctime %d.%09d btime %d.%09d gen %d data_version %d",
+		a.Valid, a.Qid, a.Mode, a.UID, a.GID, a.NLink, a.RDev, a.Size, a.BlockSize, a.Blocks,
+		a.ATimeSec, a.ATimeNsec, a.MTimeSec, a.MTimeNsec, a.CTimeSec, a.CTimeNsec, a.BTimeSec, a.BTimeNsec,
+		a.Gen, a.DataVersion)
+}
+
+// dumpLength is the number of bytes of data rendered by dumpsome.
+const dumpLength = 64
+
+// dumpsome renders the start of some data, quoted if it is printable, and in
+// hex otherwise.
+func dumpsome(b []byte) string {
+	if b == nil {
+		return "<no data>"
+	}
+	if len(b) > dumpLength {
+		b = b[:dumpLength]
+	}
+
+	printable := true
+	for _, c := range b {
+		if (c < 32 && c != '\n' && c != '\t') || c > 127 {
+			printable = false
+			break
+		}
+	}
+	if printable {
+		return "'" + string(b) + "'"
+	}
+
+	var sb strings.Builder
+	sb.WriteByte('\'')
+	for i, c := range b {
+		if i > 0 && i%4 == 0 {
+			sb.WriteByte(' ')
+		}
+		fmt.Fprintf(&sb, "%02x", c)
+	}
+	sb.WriteByte('\'')
+	return sb.String()
+}
+
+func (vr *VersionRequest) String() string {
+	return fmt.Sprintf("Tversion tag %d msize %d version '%s'", vr.Tag, vr.MaxSize, vr.Version)
+}
+
+func (vr *VersionResponse) String() string {
+	return fmt.Sprintf("Rversion tag %d msize %d version '%s'", vr.Tag, vr.MaxSize, vr.Version)
+}
+
+func (ar *AuthRequest) String() string {
+	return fmt.Sprintf("Tauth tag %d afid %d uname %s aname %s", ar.Tag, int32(ar.AuthFid), ar.Username, ar.Service)
+}
+
+func (ar *AuthResponse) String() string {
+	return fmt.Sprintf("Rauth tag %d qid %v", ar.Tag, ar.AuthQid)
+}
+
+func (ar *AttachRequest) String() string {
+	return fmt.Sprintf("Tattach tag %d fid %d afid %d uname %s aname %s", ar.Tag, ar.Fid, int32(ar.AuthFid), ar.Username, ar.Service)
+}
+
+func (ar *AttachResponse) String() string {
+	return fmt.Sprintf("Rattach tag %d qid %v", ar.Tag, ar.Qid)
+}
+
+func (er *ErrorResponse) String() string {
+	if er.Errno != 0 {
+		return fmt.Sprintf("Rerror tag %d ename %s ecode %d", er.Tag, er.Error, er.Errno)
+	}
+	return fmt.Sprintf("Rerror tag %d ename %s", er.Tag, er.Error)
+}
+
+func (fr *FlushRequest) String() string {
+	return fmt.Sprintf("Tflush tag %d oldtag %d", fr.Tag, fr.OldTag)
+}
+
+func (fr *FlushResponse) String() string {
+	return fmt.Sprintf("Rflush tag %d", fr.Tag)
+}
+
+func (wr *WalkRequest) String() string {
+	s := fmt.Sprintf("Twalk tag %d fid %d newfid %d nwname %d", wr.Tag, wr.Fid, wr.NewFid, len(wr.Names))
+	for i, name := range wr.Names {
+		s += fmt.Sprintf(" %d:%s", i, name)
+	}
+	return s
+}
+
+func (wr *WalkResponse) String() string {
+	s := fmt.Sprintf("Rwalk tag %d nwqid %d", wr.Tag, len(wr.Qids))
+	for i, qid := range wr.Qids {
+		s += fmt.Sprintf(" %d:%v", i, qid)
+	}
+	return s
+}
+
+func (or *OpenRequest) String() string {
+	return fmt.Sprintf("Topen tag %d fid %d mode %v", or.Tag, or.Fid, or.Mode)
+}
+
+func (or *OpenResponse) String() string {
+	return fmt.Sprintf("Ropen tag %d qid %v iounit %d", or.Tag, or.Qid, or.IOUnit)
+}
+
+func (cr *CreateRequest) String() string {
+	s := fmt.Sprintf("Tcreate tag %d fid %d name %s perm %v mode %v", cr.Tag, cr.Fid, cr.Name, cr.Permissions, cr.Mode)
+	if cr.Extension != "" {
+		s += fmt.Sprintf(" ext '%s'", cr.Extension)
+	}
+	return s
+}
+
+func (cr *CreateResponse) String() string {
+	return fmt.Sprintf("Rcreate tag %d qid %v iounit %d", cr.Tag, cr.Qid, cr.IOUnit)
+}
+
+func (rr *ReadRequest) String() string {
+	return fmt.Sprintf("Tread tag %d fid %d offset %d count %d", rr.Tag, rr.Fid, rr.Offset, rr.Count)
+}
+
+func (rr *ReadResponse) String() string {
+	return fmt.Sprintf("Rread tag %d count %d %s", rr.Tag, len(rr.Data), dumpsome(rr.Data))
+}
+
+func (wr *WriteRequest) String() string {
+	return fmt.Sprintf("Twrite tag %d fid %d offset %d count %d %s", wr.Tag, wr.Fid, wr.Offset, len(wr.Data), dumpsome(wr.Data))
+}
+
+func (wr *WriteResponse) String() string {
+	return fmt.Sprintf("Rwrite tag %d count %d", wr.Tag, wr.Count)
+}
+
+func (cr *ClunkRequest) String() string {
+	return fmt.Sprintf("Tclunk tag %d fid %d", cr.Tag, cr.Fid)
+}
+
+func (cr *ClunkResponse) String() string {
+	return fmt.Sprintf("Rclunk tag %d", cr.Tag)
+}
+
+func (rr *RemoveRequest) String() string {
+	return fmt.Sprintf("Tremove tag %d fid %d", rr.Tag, rr.Fid)
+}
+
+func (rr *RemoveResponse) String() string {
+	return fmt.Sprintf("Rremove tag %d", rr.Tag)
+}
+
+func (sr *StatRequest) String() string {
+	return fmt.Sprintf("Tstat tag %d fid %d", sr.Tag, sr.Fid)
+}
+
+func (sr *StatResponse) String() string {
+	return fmt.Sprintf("Rstat tag %d stat %v", sr.Tag, sr.Stat)
+}
+
+func (wsr *WriteStatRequest) String() string {
+	return fmt.Sprintf("Twstat tag %d fid %d stat %v", wsr.Tag, wsr.Fid, wsr.Stat)
+}
+
+func (wsr *WriteStatResponse) String() string {
+	return fmt.Sprintf("Rwstat tag %d", wsr.Tag)
+}
+
+func (ler *LinuxErrorResponse) String() string {
+	return fmt.Sprintf("Rlerror tag %d ecode %d", ler.Tag, ler.Ecode)
+}
+
+func (sfr *StatFSRequest) String() string {
+	return fmt.Sprintf("Tstatfs tag %d fid %d", sfr.Tag, sfr.Fid)
+}
+
+func (sfr *StatFSResponse) String() string {
+	return fmt.Sprintf("Rstatfs tag %d type %d bsize %d blocks %d bfree %d bavail %d files %d ffree %d fsid %d namelen %d",
+		sfr.Tag, sfr.Type, sfr.BlockSize, sfr.Blocks, sfr.BlocksFree, sfr.BlocksAvailable, sfr.Files, sfr.FilesFree, sfr.FSID, sfr.NameLength)
+}
+
+func (lor *LinuxOpenRequest) String() string {
+	return fmt.Sprintf("Tlopen tag %d fid %d flags %#o", lor.Tag, lor.Fid, lor.Flags)
+}
+
+func (lor *LinuxOpenResponse) String() string {
+	return fmt.Sprintf("Rlopen tag %d qid %v iounit %d", lor.Tag, lor.Qid, lor.IOUnit)
+}
+
+func (lcr *LinuxCreateRequest) String() string {
+	return fmt.Sprintf("Tlcreate tag %d fid %d name %s flags %#o mode %#o gid %d", lcr.Tag, lcr.Fid, lcr.Name, lcr.Flags, lcr.Mode, lcr.GID)
+}
+
+func (lcr *LinuxCreateResponse) String() string {
+	return fmt.Sprintf("Rlcreate tag %d qid %v iounit %d", lcr.Tag, lcr.Qid, lcr.IOUnit)
+}
+
+func (sr *SymlinkRequest) String() string {
+	return fmt.Sprintf("Tsymlink tag %d fid %d name %s symtgt %s gid %d", sr.Tag, sr.Fid, sr.Name, sr.Target, sr.GID)
+}
+
+func (sr *SymlinkResponse) String() string {
+	return fmt.Sprintf("Rsymlink tag %d qid %v", sr.Tag, sr.Qid)
+}
+
+func (mr *MknodRequest) String() string {
+	return fmt.Sprintf("Tmknod tag %d dfid %d name %s mode %#o major %d minor %d gid %d", mr.Tag, mr.DirFid, mr.Name, mr.Mode, mr.Major, mr.Minor, mr.GID)
+}
+
+func (mr *MknodResponse) String() string {
+	return fmt.Sprintf("Rmknod tag %d qid %v", mr.Tag, mr.Qid)
+}
+
+func (rr *RenameRequest) String() string {
+	return fmt.Sprintf("Trename tag %d fid %d dfid %d name %s", rr.Tag, rr.Fid, rr.DirFid, rr.Name)
+}
+
+func (rr *RenameResponse) String() string {
+	return fmt.Sprintf("Rrename tag %d", rr.Tag)
+}
+
+func (rlr *ReadLinkRequest) String() string {
+	return fmt.Sprintf("Treadlink tag %d fid %d", rlr.Tag, rlr.Fid)
+}
+
+func (rlr *ReadLinkResponse) String() string {
+	return fmt.Sprintf("Rreadlink tag %d target %s", rlr.Tag, rlr.Target)
+}
+
+func (gar *GetAttrRequest) String() string {
+	return fmt.Sprintf("Tgetattr tag %d fid %d request_mask %#x", gar.Tag, gar.Fid, gar.RequestMask)
+}
+
+func (gar *GetAttrResponse) String() string {
+	return fmt.Sprintf("Rgetattr tag %d %v", gar.Tag, gar.Attr)
+}
+
+func (sar *SetAttrRequest) String() string {
+	return fmt.Sprintf("Tsetattr tag %d fid %d valid %#x mode %#o uid %d gid %d size %d atime %d.%09d mtime %d.%09d",
+		sar.Tag, sar.Fid, sar.Valid, sar.Mode, sar.UID, sar.GID, sar.Size, sar.ATimeSec, sar.ATimeNsec, sar.MTimeSec, sar.MTimeNsec)
+}
+
+func (sar *SetAttrResponse) String() string {
+	return fmt.Sprintf("Rsetattr tag %d", sar.Tag)
+}
+
+func (xwr *XattrWalkRequest) String() string {
+	return fmt.Sprintf("Txattrwalk tag %d fid %d newfid %d name %s", xwr.Tag, xwr.Fid, xwr.NewFid, xwr.Name)
+}
+
+func (xwr *XattrWalkResponse) String() string {
+	return fmt.Sprintf("Rxattrwalk tag %d size %d", xwr.Tag, xwr.Size)
+}
+
+func (xcr *XattrCreateRequest) String() string {
+	return fmt.Sprintf("Txattrcreate tag %d fid %d name %s size %d flags %d", xcr.Tag, xcr.Fid, xcr.Name, xcr.Size, xcr.Flags)
+}
+
+func (xcr *XattrCreateResponse) String() string {
+	return fmt.Sprintf("Rxattrcreate tag %d", xcr.Tag)
+}
+
+func (rdr *ReadDirRequest) String() string {
+	return fmt.Sprintf("Treaddir tag %d fid %d offset %d count %d", rdr.Tag, rdr.Fid, rdr.Offset, rdr.Count)
+}
+
+func (rdr *ReadDirResponse) String() string {
+	return fmt.Sprintf("Rreaddir tag %d count %d", rdr.Tag, len(rdr.Data))
+}
+
+func (fr *FsyncRequest) String() string {
+	return fmt.Sprintf("Tfsync tag %d fid %d datasync %d", fr.Tag, fr.Fid, fr.DataSync)
+}
+
+func (fr *FsyncResponse) String() string {
+	return fmt.Sprintf("Rfsync tag %d", fr.Tag)
+}
+
+func (lr *LockRequest) String() string {
+	return fmt.Sprintf("Tlock tag %d fid %d type %d flags %d start %d length %d proc_id %d client_id %s",
+		lr.Tag, lr.Fid, lr.Type, lr.Flags, lr.Start, lr.Length, lr.ProcID, lr.ClientID)
+}
+
+func (lr *LockResponse) String() string {
+	return fmt.Sprintf("Rlock tag %d status %d", lr.Tag, lr.Status)
+}
+
+func (glr *GetLockRequest) String() string {
+	return fmt.Sprintf("Tgetlock tag %d fid %d type %d start %d length %d proc_id %d client_id %s",
+		glr.Tag, glr.Fid, glr.Type, glr.Start, glr.Length, glr.ProcID, glr.ClientID)
+}
+
+func (glr *GetLockResponse) String() string {
+	return fmt.Sprintf("Rgetlock tag %d type %d start %d length %d proc_id %d client_id %s",
+		glr.Tag, glr.Type, glr.Start, glr.Length, glr.ProcID, glr.ClientID)
+}
+
+func (lr *LinkRequest) String() string {
+	return fmt.Sprintf("Tlink tag %d dfid %d fid %d name %s", lr.Tag, lr.DirFid, lr.Fid, lr.Name)
+}
+
+func (lr *LinkResponse) String() string {
+	return fmt.Sprintf("Rlink tag %d", lr.Tag)
+}
+
+func (mr *MkdirRequest) String() string {
+	return fmt.Sprintf("Tmkdir tag %d dfid %d name %s mode %#o gid %d", mr.Tag, mr.DirFid, mr.Name, mr.Mode, mr.GID)
+}
+
+func (mr *MkdirResponse) String() string {
+	return fmt.Sprintf("Rmkdir tag %d qid %v", mr.Tag, mr.Qid)
+}
+
+func (rar *RenameAtRequest) String() string {
+	return fmt.Sprintf("Trenameat tag %d olddirfid %d oldname %s newdirfid %d newname %s", rar.Tag, rar.OldDirFid, rar.OldName, rar.NewDirFid, rar.NewName)
+}
+
+func (rar *RenameAtResponse) String() string {
+	return fmt.Sprintf("Rrenameat tag %d", rar.Tag)
+}
+
+func (ur *UnlinkAtRequest) String() string {
+	return fmt.Sprintf("Tunlinkat tag %d dirfid %d name %s flags %d", ur.Tag, ur.DirFid, ur.Name, ur.Flags)
+}
+
+func (ur *UnlinkAtResponse) String() string {
+	return fmt.Sprintf("Runlinkat tag %d", ur.Tag)
+}
@@ -63,6 +63,84 @@ func MessageTypeToMessage(mt MessageType) (Message, error) {
 		return &WriteStatResponse{}, nil
 	case Rerror:
 		return &ErrorResponse{}, nil
+	case Rlerror:
+		return &LinuxErrorResponse{}, nil
+	case Tstatfs:
+		return &StatFSRequest{}, nil
+	case Rstatfs:
+		return &StatFSResponse{}, nil
+	case Tlopen:
+		return &LinuxOpenRequest{}, nil
+	case Rlopen:
+		return &LinuxOpenResponse{}, nil
+	case Tlcreate:
+		return &LinuxCreateRequest{}, nil
+	case Rlcreate:
+		return &LinuxCreateResponse{}, nil
+	case Tsymlink:
+		return &SymlinkRequest{}, nil
+	case Rsymlink:
+		return &SymlinkResponse{}, nil
+	case Tmknod:
+		return &MknodRequest{}, nil
+	case Rmknod:
+		return &MknodResponse{}, nil
+	case Trename:
+		return &RenameRequest{}, nil
+	case Rrename:
+		return &RenameResponse{}, nil
+	case Treadlink:
+		return &ReadLinkRequest{}, nil
+	case Rreadlink:
+		return &ReadLinkResponse{}, nil
+	case Tgetattr:
+		return &GetAttrRequest{}, nil
+	case Rgetattr:
+		return &GetAttrResponse{}, nil
+	case Tsetattr:
+		return &SetAttrRequest{}, nil
+	case Rsetattr:
+		return &SetAttrResponse{}, nil
+	case Txattrwalk:
+		return &XattrWalkRequest{}, nil
+	case Rxattrwalk:
+		return &XattrWalkResponse{}, nil
+	case Txattrcreate:
+		return &XattrCreateRequest{}, nil
+	case Rxattrcreate:
+		return &XattrCreateResponse{}, nil
+	case Treaddir:
+		return &ReadDirRequest{}, nil
+	case Rreaddir:
+		return &ReadDirResponse{}, nil
+	case Tfsync:
+		return &FsyncRequest{}, nil
+	case Rfsync:
+		return &FsyncResponse{}, nil
+	case Tlock:
+		return &LockRequest{}, nil
+	case Rlock:
+		return &LockResponse{}, nil
+	case Tgetlock:
+		return &GetLockRequest{}, nil
+	case Rgetlock:
+		return &GetLockResponse{}, nil
+	case Tlink:
+		return &LinkRequest{}, nil
+	case Rlink:
+		return &LinkResponse{}, nil
+	case Tmkdir:
+		return &MkdirRequest{}, nil
+	case Rmkdir:
+		return &MkdirResponse{}, nil
+	case Trenameat:
+		return &RenameAtRequest{}, nil
+	case Rrenameat:
+		return &RenameAtResponse{}, nil
+	case Tunlinkat:
+		return &UnlinkAtRequest{}, nil
+	case Runlinkat:
+		return &UnlinkAtResponse{}, nil
 	default:
 		return nil, ErrUnknownMessageType
 	}
@@ -125,6 +203,84 @@ func MessageToMessageType(d Message) (MessageType, error) {
 		return Twstat, nil
 	case *WriteStatResponse:
 		return Rwstat, nil
+	case *LinuxErrorResponse:
+		return Rlerror, nil
+	case *StatFSRequest:
+		return Tstatfs, nil
+	case *StatFSResponse:
+		return Rstatfs, nil
+	case *LinuxOpenRequest:
+		return Tlopen, nil
+	case *LinuxOpenResponse:
+		return Rlopen, nil
+	case *LinuxCreateRequest:
+		return Tlcreate, nil
+	case *LinuxCreateResponse:
+		return Rlcreate, nil
+	case *SymlinkRequest:
+		return Tsymlink, nil
+	case *SymlinkResponse:
+		return Rsymlink, nil
+	case *MknodRequest:
+		return Tmknod, nil
+	case *MknodResponse:
+		return Rmknod, nil
+	case *RenameRequest:
+		return Trename, nil
+	case *RenameResponse:
+		return Rrename, nil
+	case *ReadLinkRequest:
+		return Treadlink, nil
+	case *ReadLinkResponse:
+		return Rreadlink, nil
+	case *GetAttrRequest:
+		return Tgetattr, nil
+	case *GetAttrResponse:
+		return Rgetattr, nil
+	case *SetAttrRequest:
+		return Tsetattr, nil
+	case *SetAttrResponse:
+		return Rsetattr, nil
+	case *XattrWalkRequest:
+		return Txattrwalk, nil
+	case *XattrWalkResponse:
+		return Rxattrwalk, nil
+	case *XattrCreateRequest:
+		return Txattrcreate, nil
+	case *XattrCreateResponse:
+		return Rxattrcreate, nil
+	case *ReadDirRequest:
+		return Treaddir, nil
+	case *ReadDirResponse:
+		return Rreaddir, nil
+	case *FsyncRequest:
+		return Tfsync, nil
+	case *FsyncResponse:
+		return Rfsync, nil
+	case *LockRequest:
+		return Tlock, nil
+	case *LockResponse:
+		return Rlock, nil
+	case *GetLockRequest:
+		return Tgetlock, nil
+	case *GetLockResponse:
+		return Rgetlock, nil
+	case *LinkRequest:
+		return Tlink, nil
+	case *LinkResponse:
+		return Rlink, nil
+	case *MkdirRequest:
+		return Tmkdir, nil
+	case *MkdirResponse:
+		return Rmkdir, nil
+	case *RenameAtRequest:
+		return Trenameat, nil
+	case *RenameAtResponse:
+		return Rrenameat, nil
+	case *UnlinkAtRequest:
+		return Tunlinkat, nil
+	case *UnlinkAtResponse:
+		return Runlinkat, nil
 	default:
 		return Tlast, ErrUnknownMessageType
 	}
@@ -138,19 +294,29 @@ func read(r io.Reader, b []byte) error {
 func write(w io.Writer, b []byte) error {
 	var (
 		written int
-		err     error
 		l       = len(b)
 	)
 	for written < l {
-		written, err = w.Write(b[written:])
+		n, err := w.Write(b[written:])
 		if err != nil {
 			return err
 		}
+		written += n
 	}
 
 	return nil
 }
 
+// checkRemaining verifies that a reader limited to the current message can
+// provide n more bytes, so that a length read from the message can safely be
+// used to allocate.
+func checkRemaining(r io.Reader, n int64) error {
+	if lr, ok := r.(*io.LimitedReader); ok && n > lr.N {
+		return io.ErrUnexpectedEOF
+	}
+	return nil
+}
+
 func ReadByte(r io.Reader) (byte, error) {
 	b := make([]byte, 1)
 	err := read(r, b)
@@ -237,6 +403,10 @@ func ReadString(r io.Reader) (string, error) {
 		return "", err
 	}
 
+	if err = checkRemaining(r, int64(l)); err != nil {
+		return "", err
+	}
+
 	b := make([]byte, int(l))
 	err = read(r, b)
 	if err != nil {
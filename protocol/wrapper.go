@@ -1,22 +1,32 @@
 package protocol
 
 import (
+	"bytes"
+	"encoding/binary"
 	"fmt"
 	"io"
+	"sync"
 )
 
 // Errors
 var (
 	ErrUnknownMessageType = fmt.Errorf("unknown message type")
+	ErrMessageTooLarge    = fmt.Errorf("message too large")
 )
 
 // Codec is an interface describing an item that can encode itself to a writer,
 // decode itself from a reader, and inform how large the encoded form would be
-// at the current time.
+// at the current time. MarshalAppend and Unmarshal are the buffer based
+// equivalents of Encode and Decode. MarshalAppend appends the encoded form to
+// the provided slice and returns the extended slice, while Unmarshal decodes
+// from the provided slice. Byte slices in the decoded item, such as the Data of
+// a ReadResponse, alias the buffer passed to Unmarshal.
 type Codec interface {
 	EncodedLength() int
 	Encode(w io.Writer) error
 	Decode(r io.Reader) error
+	MarshalAppend(b []byte) []byte
+	Unmarshal(b []byte) error
 }
 
 // Message is an interface like Codec, but also capable of getting/setting the
@@ -53,23 +63,115 @@ func DecodeHdr(r io.Reader) (uint32, MessageType, error) {
 // tries to consume more data than the size of the header indicated, making the
 // message invalid.
 func Decode(r io.Reader) (Message, error) {
-	var (
-		size uint32
-		mt   MessageType
-		err  error
-	)
-	if size, mt, err = DecodeHdr(r); err != nil {
+	return DecodeDialect(r, Dialect9P2000)
+}
+
+// DecodeDialect is like Decode, but decodes the message according to the wire
+// layout of the provided dialect. The message is read into a single buffer
+// before it is decoded.
+func DecodeDialect(r io.Reader, dialect Dialect) (Message, error) {
+	b, err := ReadFrame(r, 0)
+	if err != nil {
+		return nil, err
+	}
+	return UnmarshalMessage(b, dialect)
+}
+
+// frameChunkSize is the largest frame ReadFrame allocates a buffer for up
+// front. Larger frames are read into a buffer that grows as data arrives, so
+// that a peer cannot cause large allocations by merely declaring a large size.
+const frameChunkSize = 64 * 1024
+
+// ReadFrame reads an entire message, including header, into a buffer. If
+// maxSize is not 0, ErrMessageTooLarge is returned without reading the rest of
+// the message if the message is larger than maxSize.
+func ReadFrame(r io.Reader, maxSize uint32) ([]byte, error) {
+	var hdr [4]byte
+	if err := read(r, hdr[:]); err != nil {
+		return nil, err
+	}
+
+	size := binary.LittleEndian.Uint32(hdr[:])
+	if size < HeaderSize {
+		return nil, io.ErrUnexpectedEOF
+	}
+	if maxSize != 0 && size > maxSize {
+		return nil, ErrMessageTooLarge
+	}
+
+	if size <= frameChunkSize {
+		b := make([]byte, size)
+		copy(b, hdr[:])
+		if err := read(r, b[4:]); err != nil {
+			return nil, err
+		}
+		return b, nil
+	}
+
+	buf := bytes.NewBuffer(make([]byte, 0, frameChunkSize))
+	buf.Write(hdr[:])
+	n, err := io.CopyN(buf, r, int64(size)-4)
+	if err != nil {
+		if err == io.EOF && n > 0 {
+			err = io.ErrUnexpectedEOF
+		}
 		return nil, err
 	}
+	return buf.Bytes(), nil
+}
+
+// FrameSplitter splits a stream of data, such as the data read from or written
+// to a connection, into frames. The zero value is ready for use. A
+// FrameSplitter is not safe for concurrent use.
+type FrameSplitter struct {
+	buf []byte
+}
 
-	// This LimitedReader is not a necessity, but used as an error checker.
-	limiter := &io.LimitedReader{R: r, N: int64(size) - HeaderSize}
+// Split appends data to the partial frame held by the FrameSplitter, and calls
+// fn with every frame completed by it, including its header. fn must not
+// retain the frame. If a frame has a size smaller than the header,
+// io.ErrUnexpectedEOF is returned, and the buffered data is discarded.
+func (f *FrameSplitter) Split(data []byte, fn func(frame []byte)) error {
+	buf := append(f.buf, data...)
+	for len(buf) >= 4 {
+		size := binary.LittleEndian.Uint32(buf)
+		if size < HeaderSize {
+			f.buf = nil
+			return io.ErrUnexpectedEOF
+		}
+		if uint32(len(buf)) < size {
+			break
+		}
+		fn(buf[:size])
+		buf = buf[size:]
+	}
 
-	m, err := MessageTypeToMessage(mt)
+	// Keep the buffer from aliasing data, and from growing without bound.
+	f.buf = append([]byte(nil), buf...)
+	return nil
+}
+
+// UnmarshalMessage decodes an entire message, including header, from the
+// provided buffer according to the wire layout of the provided dialect. Byte
+// slices in the message alias the buffer.
+func UnmarshalMessage(b []byte, dialect Dialect) (Message, error) {
+	if len(b) < HeaderSize {
+		return nil, io.ErrUnexpectedEOF
+	}
+	if size := binary.LittleEndian.Uint32(b); size != uint32(len(b)) {
+		return nil, io.ErrUnexpectedEOF
+	}
+
+	m, err := MessageTypeToMessage(MessageType(b[4]))
 	if err != nil {
 		return nil, err
 	}
-	if err = m.Decode(limiter); err != nil {
+	if dc, ok := m.(DialectCodec); ok {
+		err = dc.UnmarshalDialect(b[HeaderSize:], dialect)
+	} else {
+		err = m.Unmarshal(b[HeaderSize:])
+	}
+	if err != nil {
 		return nil, err
 	}
 	return m, nil
@@ -78,23 +180,61 @@ func Decode(r io.Reader) (Message, error) {
 // Encode write a header and message to the provided writer. It returns an
 // error if writing failed.
 func Encode(w io.Writer, d Message) error {
-	var err error
-	var mt MessageType
-	if mt, err = MessageToMessageType(d); err != nil {
-		return err
+	return EncodeDialect(w, d, Dialect9P2000)
+}
+
+// encodeBuffers holds buffers for EncodeDialect, allowing messages to be
+// encoded without allocating.
+var encodeBuffers = sync.Pool{
+	New: func() interface{} {
+		return new([]byte)
+	},
+}
+
+// maxPooledBuffer is the largest buffer that is returned to encodeBuffers.
+const maxPooledBuffer = 64 * 1024
+
+// EncodeDialect is like Encode, but encodes the message according to the wire
+// layout of the provided dialect. The message is written with a single call
+// to Write.
+func EncodeDialect(w io.Writer, d Message, dialect Dialect) error {
+	bp := encodeBuffers.Get().(*[]byte)
+	b, err := AppendMessage((*bp)[:0], d, dialect)
+	if err == nil {
+		err = write(w, b)
 	}
+	if cap(b) <= maxPooledBuffer {
+		*bp = b
+		encodeBuffers.Put(bp)
+	}
+	return err
+}
 
-	size := uint32(d.EncodedLength() + HeaderSize)
-	if err = WriteUint32(w, size); err != nil {
-		return err
+// AppendMessage appends an entire message, including header, encoded
+// according to the wire layout of the provided dialect, to the provided
+// buffer. It returns the extended buffer, or an error if the message type is
+// unknown.
+func AppendMessage(b []byte, d Message, dialect Dialect) ([]byte, error) {
+	mt, err := MessageToMessageType(d)
+	if err != nil {
+		return b, err
 	}
 
-	if err = WriteMessageType(w, mt); err != nil {
-		return err
+	b = appendUint32(b, uint32(MessageSize(d, dialect)))
+	b = appendUint8(b, uint8(mt))
+	if dc, ok := d.(DialectCodec); ok {
+		b = dc.MarshalAppendDialect(b, dialect)
+	} else {
+		b = d.MarshalAppend(b)
 	}
+	return b, nil
+}
 
-	if err = d.Encode(w); err != nil {
-		return err
+// MessageSize returns the size of an entire message, including header, when
+// encoded according to the wire layout of the provided dialect.
+func MessageSize(d Message, dialect Dialect) int {
+	if dc, ok := d.(DialectCodec); ok {
+		return dc.EncodedLengthDialect(dialect) + HeaderSize
 	}
-	return nil
+	return d.EncodedLength() + HeaderSize
 }
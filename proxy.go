@@ -0,0 +1,300 @@
+package g9p
+
+import (
+	"context"
+	"strings"
+	"sync"
+
+	"github.com/kennylevinsen/g9p/protocol"
+)
+
+// Proxy serves any number of downstream connections from a single upstream
+// Client. The tags and fids of every downstream connection are remapped onto
+// tags and fids of the upstream connection, so that downstream connections
+// cannot collide with each other. Flushed downstream requests are flushed
+// upstream, and the upstream fids of a downstream connection are clunked when
+// it is closed.
+//
+// The Client must have negotiated 9P2000 with Version before it is used by the
+// Proxy. Downstream connections negotiate their own version and maximum message
+// size with the Proxy, which is limited to that of the Client.
+type Proxy struct {
+	client *Client
+
+	fidLock sync.Mutex
+	nextFid protocol.Fid
+	fids    map[protocol.Fid]struct{}
+}
+
+// NewProxy returns a Proxy forwarding requests to c.
+func NewProxy(c *Client) *Proxy {
+	return &Proxy{
+		client: c,
+		fids:   make(map[protocol.Fid]struct{}),
+	}
+}
+
+// Handler returns a new handler for a downstream connection. A handler must
+// only serve a single connection.
+func (p *Proxy) Handler() ContextHandler {
+	return &proxyConn{
+		proxy: p,
+		fids:  make(map[protocol.Fid]protocol.Fid),
+	}
+}
+
+// alloc allocates an upstream fid.
+func (p *Proxy) alloc() protocol.Fid {
+	p.fidLock.Lock()
+	defer p.fidLock.Unlock()
+	for {
+		f := p.nextFid
+		p.nextFid++
+		if _, used := p.fids[f]; !used && f != protocol.NOFID {
+			p.fids[f] = struct{}{}
+			return f
+		}
+	}
+}
+
+// free frees an upstream fid allocated by alloc.
+func (p *Proxy) free(f protocol.Fid) {
+	p.fidLock.Lock()
+	defer p.fidLock.Unlock()
+	delete(p.fids, f)
+}
+
+// proxyConn is the handler of a downstream connection. fids maps downstream
+// fids to upstream fids.
+type proxyConn struct {
+	proxy *Proxy
+
+	fidLock sync.Mutex
+	fids    map[protocol.Fid]protocol.Fid
+}
+
+// lookup returns the upstream fid of a downstream fid.
+func (pc *proxyConn) lookup(num protocol.Fid) (protocol.Fid, error) {
+	pc.fidLock.Lock()
+	defer pc.fidLock.Unlock()
+	f, exists := pc.fids[num]
+	if !exists {
+		return 0, ErrUnknownFid
+	}
+	return f, nil
+}
+
+// add allocates an upstream fid for a new downstream fid. The fid is
+// registered right away, so that the number cannot be taken by a concurrent
+// request, and must be forgotten if the upstream request fails.
+func (pc *proxyConn) add(num protocol.Fid) (protocol.Fid, error) {
+	pc.fidLock.Lock()
+	defer pc.fidLock.Unlock()
+	if _, exists := pc.fids[num]; exists || num == protocol.NOFID {
+		return 0, ErrFidInUse
+	}
+	f := pc.proxy.alloc()
+	pc.fids[num] = f
+	return f, nil
+}
+
+// forget unregisters a downstream fid, and frees its upstream fid, which must
+// no longer be known upstream.
+func (pc *proxyConn) forget(num, f protocol.Fid) {
+	pc.fidLock.Lock()
+	if pc.fids[num] == f {
+		delete(pc.fids, num)
+	}
+	pc.fidLock.Unlock()
+	pc.proxy.free(f)
+}
+
+// reset clunks the upstream fids of all downstream fids.
+func (pc *proxyConn) reset() {
+	pc.fidLock.Lock()
+	fids := pc.fids
+	pc.fids = make(map[protocol.Fid]protocol.Fid)
+	pc.fidLock.Unlock()
+
+	for _, f := range fids {
+		pc.proxy.client.Clunk(&protocol.ClunkRequest{Fid: f})
+		pc.proxy.free(f)
+	}
+}
+
+// Close clunks all upstream fids of the connection. It is called by Server
+// when the connection is closed.
+func (pc *proxyConn) Close() error {
+	pc.reset()
+	return nil
+}
+
+// Version negotiates the downstream connection, releasing all its fids.
+func (pc *proxyConn) Version(_ context.Context, r *protocol.VersionRequest) (*protocol.VersionResponse, error) {
+	pc.reset()
+
+	msize := r.MaxSize
+	if max := pc.proxy.client.maxSize(); max < msize {
+		msize = max
+	}
+
+	version := "unknown"
+	if strings.HasPrefix(r.Version, protocol.Version9P2000) {
+		version = protocol.Version9P2000
+	}
+	return &protocol.VersionResponse{MaxSize: msize, Version: version}, nil
+}
+
+func (pc *proxyConn) Auth(ctx context.Context, r *protocol.AuthRequest) (*protocol.AuthResponse, error) {
+	afid, err := pc.add(r.AuthFid)
+	if err != nil {
+		return nil, err
+	}
+
+	up := *r
+	up.Tag, up.AuthFid = 0, afid
+	res, err := pc.proxy.client.AuthContext(ctx, &up)
+	if err != nil {
+		pc.forget(r.AuthFid, afid)
+		return nil, err
+	}
+	return res, nil
+}
+
+func (pc *proxyConn) Attach(ctx context.Context, r *protocol.AttachRequest) (*protocol.AttachResponse, error) {
+	afid := protocol.NOFID
+	if r.AuthFid != protocol.NOFID {
+		var err error
+		if afid, err = pc.lookup(r.AuthFid); err != nil {
+			return nil, err
+		}
+	}
+	fid, err := pc.add(r.Fid)
+	if err != nil {
+		return nil, err
+	}
+
+	up := *r
+	up.Tag, up.Fid, up.AuthFid = 0, fid, afid
+	res, err := pc.proxy.client.AttachContext(ctx, &up)
+	if err != nil {
+		pc.forget(r.Fid, fid)
+		return nil, err
+	}
+	return res, nil
+}
+
+// Walk walks upstream. If the walk is to a new fid, an upstream fid is
+// allocated for it, and forgotten again unless all names were walked.
+func (pc *proxyConn) Walk(ctx context.Context, r *protocol.WalkRequest) (*protocol.WalkResponse, error) {
+	fid, err := pc.lookup(r.Fid)
+	if err != nil {
+		return nil, err
+	}
+	newfid := fid
+	if r.NewFid != r.Fid {
+		if newfid, err = pc.add(r.NewFid); err != nil {
+			return nil, err
+		}
+	}
+
+	up := *r
+	up.Tag, up.Fid, up.NewFid = 0, fid, newfid
+	res, err := pc.proxy.client.WalkContext(ctx, &up)
+	if r.NewFid != r.Fid && (err != nil || len(res.Qids) != len(r.Names)) {
+		pc.forget(r.NewFid, newfid)
+	}
+	return res, err
+}
+
+func (pc *proxyConn) Open(ctx context.Context, r *protocol.OpenRequest) (*protocol.OpenResponse, error) {
+	fid, err := pc.lookup(r.Fid)
+	if err != nil {
+		return nil, err
+	}
+	up := *r
+	up.Tag, up.Fid = 0, fid
+	return pc.proxy.client.OpenContext(ctx, &up)
+}
+
+func (pc *proxyConn) Create(ctx context.Context, r *protocol.CreateRequest) (*protocol.CreateResponse, error) {
+	fid, err := pc.lookup(r.Fid)
+	if err != nil {
+		return nil, err
+	}
+	up := *r
+	up.Tag, up.Fid = 0, fid
+	return pc.proxy.client.CreateContext(ctx, &up)
+}
+
+func (pc *proxyConn) Read(ctx context.Context, r *protocol.ReadRequest) (*protocol.ReadResponse, error) {
+	fid, err := pc.lookup(r.Fid)
+	if err != nil {
+		return nil, err
+	}
+	up := *r
+	up.Tag, up.Fid = 0, fid
+	return pc.proxy.client.ReadContext(ctx, &up)
+}
+
+func (pc *proxyConn) Write(ctx context.Context, r *protocol.WriteRequest) (*protocol.WriteResponse, error) {
+	fid, err := pc.lookup(r.Fid)
+	if err != nil {
+		return nil, err
+	}
+	up := *r
+	up.Tag, up.Fid = 0, fid
+	return pc.proxy.client.WriteContext(ctx, &up)
+}
+
+// Clunk clunks the fid upstream. Unless the request is flushed, the fid is
+// clunked upstream even if an error is returned, so it is forgotten.
+func (pc *proxyConn) Clunk(ctx context.Context, r *protocol.ClunkRequest) (*protocol.ClunkResponse, error) {
+	fid, err := pc.lookup(r.Fid)
+	if err != nil {
+		return nil, err
+	}
+	up := *r
+	up.Tag, up.Fid = 0, fid
+	res, err := pc.proxy.client.ClunkContext(ctx, &up)
+	if err == nil || ctx.Err() == nil {
+		pc.forget(r.Fid, fid)
+	}
+	return res, err
+}
+
+// Remove removes the file upstream. Like Clunk, the fid is forgotten unless
+// the request is flushed.
+func (pc *proxyConn) Remove(ctx context.Context, r *protocol.RemoveRequest) (*protocol.RemoveResponse, error) {
+	fid, err := pc.lookup(r.Fid)
+	if err != nil {
+		return nil, err
+	}
+	up := *r
+	up.Tag, up.Fid = 0, fid
+	res, err := pc.proxy.client.RemoveContext(ctx, &up)
+	if err == nil || ctx.Err() == nil {
+		pc.forget(r.Fid, fid)
+	}
+	return res, err
+}
+
+func (pc *proxyConn) Stat(ctx context.Context, r *protocol.StatRequest) (*protocol.StatResponse, error) {
+	fid, err := pc.lookup(r.Fid)
+	if err != nil {
+		return nil, err
+	}
+	up := *r
+	up.Tag, up.Fid = 0, fid
+	return pc.proxy.client.StatContext(ctx, &up)
+}
+
+func (pc *proxyConn) WriteStat(ctx context.Context, r *protocol.WriteStatRequest) (*protocol.WriteStatResponse, error) {
+	fid, err := pc.lookup(r.Fid)
+	if err != nil {
+		return nil, err
+	}
+	up := *r
+	up.Tag, up.Fid = 0, fid
+	return pc.proxy.client.WriteStatContext(ctx, &up)
+}
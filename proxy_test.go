@@ -0,0 +1,112 @@
+package g9p
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/kennylevinsen/g9p/protocol"
+)
+
+// blockingHandler is a countingHandler whose reads block until flushed.
+type blockingHandler struct {
+	countingHandler
+	started chan struct{}
+}
+
+func (h *blockingHandler) Read(ctx context.Context, _ *Fid[int], _ *protocol.ReadRequest) (*protocol.ReadResponse, error) {
+	h.started <- struct{}{}
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+func (*blockingHandler) Clunk(*Fid[int]) {}
+
+// fidCount returns the number of fids registered with a FidServer.
+func fidCount[T any](fs *FidServer[T]) int {
+	fs.fidLock.Lock()
+	defer fs.fidLock.Unlock()
+	return len(fs.fids)
+}
+
+func TestProxy(t *testing.T) {
+	h := &blockingHandler{started: make(chan struct{})}
+	upstream := NewFidServer[int](h)
+	a, b := net.Pipe()
+	go ServeContext(a, upstream)
+	c := NewClient(b)
+	go c.Start()
+	defer c.Stop()
+	if _, err := c.Version(&protocol.VersionRequest{Tag: protocol.NOTAG, MaxSize: 8192, Version: protocol.Version9P2000}); err != nil {
+		t.Fatalf("version failed: %v", err)
+	}
+
+	p := NewProxy(c)
+	var clients []*Client
+	for i := 0; i < 2; i++ {
+		a, b := net.Pipe()
+		go ServeContext(a, p.Handler())
+		d := NewClient(b)
+		go d.Start()
+		defer d.Stop()
+		clients = append(clients, d)
+
+		vr, err := d.Version(&protocol.VersionRequest{Tag: protocol.NOTAG, MaxSize: 65536, Version: protocol.Version9P2000})
+		if err != nil {
+			t.Fatalf("version failed: %v", err)
+		}
+		if vr.MaxSize != 8192 {
+			t.Fatalf("negotiated msize %d, expected upstream msize", vr.MaxSize)
+		}
+	}
+
+	// Downstream connections may use the same fids and tags.
+	for _, d := range clients {
+		if _, err := d.Attach(&protocol.AttachRequest{Tag: 1, Fid: 1, AuthFid: protocol.NOFID}); err != nil {
+			t.Fatalf("attach failed: %v", err)
+		}
+		if _, err := d.Walk(&protocol.WalkRequest{Tag: 1, Fid: 1, NewFid: 2}); err != nil {
+			t.Fatalf("walk failed: %v", err)
+		}
+		if _, err := d.Open(&protocol.OpenRequest{Tag: 1, Fid: 2, Mode: protocol.OREAD}); err != nil {
+			t.Fatalf("open failed: %v", err)
+		}
+	}
+	if n := fidCount(upstream); n != 4 {
+		t.Fatalf("%d upstream fids, expected 4", n)
+	}
+	if _, err := clients[0].Walk(&protocol.WalkRequest{Tag: 1, Fid: 1, NewFid: 2}); err != ErrFidInUse {
+		t.Fatalf("walk to used fid returned %v, expected %v", err, ErrFidInUse)
+	}
+
+	// Flushes are forwarded upstream.
+	ctx, cancel := context.WithCancel(context.Background())
+	errc := make(chan error, 1)
+	go func() {
+		_, err := clients[0].ReadContext(ctx, &protocol.ReadRequest{Fid: 2, Count: 10})
+		errc <- err
+	}()
+	<-h.started
+	cancel()
+	select {
+	case err := <-errc:
+		if err != context.Canceled {
+			t.Fatalf("flushed read returned %v, expected %v", err, context.Canceled)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("read not flushed upstream")
+	}
+
+	// The upstream fids of a downstream connection are clunked when it closes.
+	clients[0].Stop()
+	for i := 0; fidCount(upstream) != 2; i++ {
+		if i == 100 {
+			t.Fatalf("%d upstream fids after disconnect, expected 2", fidCount(upstream))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if _, err := clients[1].Stat(&protocol.StatRequest{Tag: 1, Fid: 2}); err != nil {
+		t.Fatalf("stat on remaining connection failed: %v", err)
+	}
+}
@@ -0,0 +1,546 @@
+// Package ramfs implements an in-memory file system served over 9P, in the
+// style of Plan 9's ramfs. It supports creating, writing, removing and
+// changing files, with permissions checked against the user given to Attach,
+// and its full state can be snapshotted and restored.
+//
+// Group membership is simplified: a user is a member of a group only if the
+// group has the same name as the user, as is the default on Plan 9.
+package ramfs
+
+import (
+	"context"
+	"encoding/binary"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/kennylevinsen/g9p"
+	"github.com/kennylevinsen/g9p/p9err"
+	"github.com/kennylevinsen/g9p/protocol"
+)
+
+// Errors returned by the file system.
+var (
+	ErrNoAuth     = p9err.ErrNoAuth
+	ErrNotExist   = p9err.ErrNotExist
+	ErrExist      = p9err.ErrExist
+	ErrPermission = p9err.ErrPermission
+	ErrNotDir     = p9err.ErrNotDir
+	ErrIsDir      = p9err.ErrIsDir
+	ErrNotEmpty   = p9err.ErrNotEmpty
+	ErrBadOffset  = p9err.ErrBadOffset
+	ErrBadName    = &g9p.Error{Err: "bad file name", Errno: 22}
+	ErrShortRead  = &g9p.Error{Err: "read count too small for directory entry", Errno: 22}
+	ErrBadStat    = &g9p.Error{Err: "wstat cannot change this field", Errno: 1}
+	ErrExclusive  = &g9p.Error{Err: "exclusive use file already open", Errno: 16}
+	ErrTooLarge   = &g9p.Error{Err: "file too large", Errno: 27}
+)
+
+// MaxFileSize is the largest size a file may grow to, by writes or wstat.
+const MaxFileSize = 1 << 30
+
+// Permission bits checked by hasPerm.
+const (
+	permRead  = 4
+	permWrite = 2
+	permExec  = 1
+)
+
+// FS is an in-memory file system. It may be served by any number of
+// connections at once.
+type FS struct {
+	// mu protects all nodes and the qid path counter.
+	mu       sync.Mutex
+	root     *node
+	nextPath uint64
+}
+
+// node is a file or directory.
+type node struct {
+	stat     protocol.Stat
+	parent   *node
+	children map[string]*node
+	data     []byte
+
+	// opens counts the fids that have the node open, for DMEXCL.
+	opens int
+
+	// removed is set once the node is no longer part of the file system.
+	removed bool
+}
+
+func (n *node) isDir() bool {
+	return n.stat.Mode&protocol.DMDIR != 0
+}
+
+// hasPerm reports whether user has the requested permission bits on the node.
+func (n *node) hasPerm(user string, perm protocol.FileMode) bool {
+	m := n.stat.Mode & 7
+	if user == n.stat.UID {
+		m |= n.stat.Mode >> 6 & 7
+	}
+	if user == n.stat.GID {
+		m |= n.stat.Mode >> 3 & 7
+	}
+	return m&perm == perm
+}
+
+// file is the per-fid state of a file.
+type file struct {
+	node *node
+
+	// dirLock protects the directory read state.
+	dirLock sync.Mutex
+
+	// dir holds the packed stats of an opened directory, as read from offset
+	// 0. dirOffset is the offset the next directory read must start at.
+	dir       []byte
+	dirOffset uint64
+}
+
+// New returns an empty file system, with a root directory owned by owner that
+// anyone may create files in.
+func New(owner string) *FS {
+	fsys := &FS{}
+	now := uint32(time.Now().Unix())
+	fsys.root = &node{
+		stat: protocol.Stat{
+			Qid:   protocol.Qid{Type: protocol.QTDIR, Path: fsys.newPath()},
+			Mode:  protocol.DMDIR | 0777,
+			Atime: now,
+			Mtime: now,
+			Name:  "/",
+			UID:   owner,
+			GID:   owner,
+			MUID:  owner,
+		},
+		children: make(map[string]*node),
+	}
+	return fsys
+}
+
+// Handler returns a new handler serving the file system. A handler must only
+// serve a single connection.
+func (fsys *FS) Handler() g9p.ContextHandler {
+	return g9p.NewFidServer[*file](fsys)
+}
+
+// newPath returns a new qid path. The mutex must be held, unless the file
+// system is not yet shared.
+func (fsys *FS) newPath() uint64 {
+	p := fsys.nextPath
+	fsys.nextPath++
+	return p
+}
+
+// validName reports whether name is a valid name of a directory entry.
+func validName(name string) bool {
+	return name != "" && name != "." && name != ".." && !strings.Contains(name, "/")
+}
+
+// openPerm returns the permission bits required to open a file with the
+// given mode.
+func openPerm(mode protocol.OpenMode) protocol.FileMode {
+	var perm protocol.FileMode
+	switch mode & 3 {
+	case protocol.OREAD:
+		perm = permRead
+	case protocol.OWRITE:
+		perm = permWrite
+	case protocol.ORDWR:
+		perm = permRead | permWrite
+	case protocol.OEXEC:
+		perm = permExec
+	}
+	if mode&protocol.OTRUNC != 0 {
+		perm |= permWrite
+	}
+	return perm
+}
+
+// writes reports whether an open mode permits writing or truncates.
+func writes(mode protocol.OpenMode) bool {
+	m := mode & 3
+	return m == protocol.OWRITE || m == protocol.ORDWR || mode&protocol.OTRUNC != 0
+}
+
+func (fsys *FS) Auth(context.Context, *g9p.Fid[*file], *protocol.AuthRequest) (*protocol.AuthResponse, error) {
+	return nil, ErrNoAuth
+}
+
+func (fsys *FS) Attach(_ context.Context, fid, _ *g9p.Fid[*file], r *protocol.AttachRequest) (*protocol.AttachResponse, error) {
+	fsys.mu.Lock()
+	defer fsys.mu.Unlock()
+
+	fid.Value = &file{node: fsys.root}
+	return &protocol.AttachResponse{Qid: fsys.root.stat.Qid}, nil
+}
+
+func (fsys *FS) Walk(_ context.Context, fid, newfid *g9p.Fid[*file], r *protocol.WalkRequest) (*protocol.WalkResponse, error) {
+	fsys.mu.Lock()
+	defer fsys.mu.Unlock()
+
+	n := fid.Value.node
+	qids := make([]protocol.Qid, 0, len(r.Names))
+	for i, name := range r.Names {
+		var err error
+		switch {
+		case !n.isDir():
+			err = ErrNotDir
+		case n.removed:
+			err = ErrNotExist
+		case !n.hasPerm(fid.User, permExec):
+			err = ErrPermission
+		}
+
+		next := n
+		if err == nil {
+			if name == ".." {
+				if n.parent != nil {
+					next = n.parent
+				}
+			} else if next = n.children[name]; next == nil {
+				err = ErrNotExist
+			}
+		}
+
+		if err != nil {
+			if i == 0 {
+				return nil, err
+			}
+			break
+		}
+		n = next
+		qids = append(qids, n.stat.Qid)
+	}
+
+	newfid.Value = &file{node: n}
+	return &protocol.WalkResponse{Qids: qids}, nil
+}
+
+// open opens a node for a user. The mutex must be held.
+func (fsys *FS) open(n *node, user string, mode protocol.OpenMode) error {
+	if n.removed {
+		return ErrNotExist
+	}
+	if n.isDir() && writes(mode) {
+		return ErrIsDir
+	}
+	if !n.hasPerm(user, openPerm(mode)) {
+		return ErrPermission
+	}
+	if mode&protocol.ORCLOSE != 0 && (n.parent == nil || !n.parent.hasPerm(user, permWrite)) {
+		return ErrPermission
+	}
+	if n.stat.Mode&protocol.DMEXCL != 0 && n.opens > 0 {
+		return ErrExclusive
+	}
+
+	if mode&protocol.OTRUNC != 0 && n.stat.Mode&protocol.DMAPPEND == 0 {
+		fsys.modify(n, user)
+		n.data = nil
+	}
+	n.opens++
+	return nil
+}
+
+// modify records a modification of a node by user. The mutex must be held.
+func (fsys *FS) modify(n *node, user string) {
+	n.stat.Qid.Version++
+	n.stat.Mtime = uint32(time.Now().Unix())
+	n.stat.MUID = user
+}
+
+func (fsys *FS) Open(_ context.Context, fid *g9p.Fid[*file], r *protocol.OpenRequest) (*protocol.OpenResponse, error) {
+	fsys.mu.Lock()
+	defer fsys.mu.Unlock()
+
+	n := fid.Value.node
+	if err := fsys.open(n, fid.User, r.Mode); err != nil {
+		return nil, err
+	}
+	return &protocol.OpenResponse{Qid: n.stat.Qid}, nil
+}
+
+func (fsys *FS) Create(_ context.Context, fid *g9p.Fid[*file], r *protocol.CreateRequest) (*protocol.CreateResponse, error) {
+	fsys.mu.Lock()
+	defer fsys.mu.Unlock()
+
+	dir := fid.Value.node
+	switch {
+	case !dir.isDir():
+		return nil, ErrNotDir
+	case dir.removed:
+		return nil, ErrNotExist
+	case !validName(r.Name):
+		return nil, ErrBadName
+	case !dir.hasPerm(fid.User, permWrite):
+		return nil, ErrPermission
+	case dir.children[r.Name] != nil:
+		return nil, ErrExist
+	}
+
+	// The permissions of the new file are limited by those of the directory,
+	// as described in http://man.cat-v.org/plan_9/5/open.
+	perm := r.Permissions & (^protocol.FileMode(0666) | dir.stat.Mode&0666)
+	if r.Permissions&protocol.DMDIR != 0 {
+		if writes(r.Mode) {
+			return nil, ErrIsDir
+		}
+		perm = r.Permissions & (^protocol.FileMode(0777) | dir.stat.Mode&0777)
+	}
+
+	now := uint32(time.Now().Unix())
+	n := &node{
+		stat: protocol.Stat{
+			Qid:   protocol.Qid{Type: protocol.QidType(perm >> 24), Path: fsys.newPath()},
+			Mode:  perm,
+			Atime: now,
+			Mtime: now,
+			Name:  r.Name,
+			UID:   fid.User,
+			GID:   dir.stat.GID,
+			MUID:  fid.User,
+		},
+		parent: dir,
+	}
+	if n.isDir() {
+		n.children = make(map[string]*node)
+	}
+
+	// The new file is opened without checking its permissions, which need
+	// not permit the requested mode.
+	n.opens++
+
+	dir.children[r.Name] = n
+	fsys.modify(dir, fid.User)
+
+	fid.Value = &file{node: n}
+	return &protocol.CreateResponse{Qid: n.stat.Qid}, nil
+}
+
+func (fsys *FS) Read(ctx context.Context, fid *g9p.Fid[*file], r *protocol.ReadRequest) (*protocol.ReadResponse, error) {
+	if fid.Qid.Type&protocol.QTDIR != 0 {
+		return fsys.readDir(ctx, fid.Value, r)
+	}
+
+	fsys.mu.Lock()
+	defer fsys.mu.Unlock()
+
+	n := fid.Value.node
+	n.stat.Atime = uint32(time.Now().Unix())
+	if r.Offset >= uint64(len(n.data)) {
+		return &protocol.ReadResponse{}, nil
+	}
+	rest := n.data[r.Offset:]
+	if uint64(len(rest)) > uint64(r.Count) {
+		rest = rest[:r.Count]
+	}
+	return &protocol.ReadResponse{Data: append([]byte(nil), rest...)}, nil
+}
+
+// readDir reads packed stats from a directory. Only whole stats are returned,
+// and reads must either start at offset 0, or where the previous read ended.
+func (fsys *FS) readDir(ctx context.Context, f *file, r *protocol.ReadRequest) (*protocol.ReadResponse, error) {
+	f.dirLock.Lock()
+	defer f.dirLock.Unlock()
+
+	if r.Offset == 0 {
+		fsys.mu.Lock()
+		names := make([]string, 0, len(f.node.children))
+		for name := range f.node.children {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		f.dir = nil
+		for _, name := range names {
+			f.dir = f.node.children[name].stat.MarshalAppendDialect(f.dir, g9p.Dialect(ctx))
+		}
+		f.node.stat.Atime = uint32(time.Now().Unix())
+		fsys.mu.Unlock()
+		f.dirOffset = 0
+	} else if r.Offset != f.dirOffset {
+		return nil, ErrBadOffset
+	}
+
+	rest := f.dir[f.dirOffset:]
+	var n uint32
+	for int(n)+2 <= len(rest) {
+		size := 2 + uint32(binary.LittleEndian.Uint16(rest[n:]))
+		if n+size > r.Count {
+			break
+		}
+		n += size
+	}
+	if n == 0 && len(rest) > 0 {
+		return nil, ErrShortRead
+	}
+
+	f.dirOffset += uint64(n)
+	return &protocol.ReadResponse{Data: rest[:n:n]}, nil
+}
+
+// Write writes to a file. Writes to append-only files are made at the end of
+// the file, regardless of the offset.
+func (fsys *FS) Write(_ context.Context, fid *g9p.Fid[*file], r *protocol.WriteRequest) (*protocol.WriteResponse, error) {
+	fsys.mu.Lock()
+	defer fsys.mu.Unlock()
+
+	n := fid.Value.node
+	offset := r.Offset
+	if n.stat.Mode&protocol.DMAPPEND != 0 {
+		offset = uint64(len(n.data))
+	}
+
+	// The end is checked before it is computed, as it may otherwise wrap.
+	if offset > MaxFileSize || uint64(len(r.Data)) > MaxFileSize-offset {
+		return nil, ErrTooLarge
+	}
+	end := offset + uint64(len(r.Data))
+	if end > uint64(len(n.data)) {
+		n.data = append(n.data, make([]byte, end-uint64(len(n.data)))...)
+	}
+	copy(n.data[offset:], r.Data)
+	fsys.modify(n, fid.User)
+	return &protocol.WriteResponse{Count: uint32(len(r.Data))}, nil
+}
+
+// remove removes a node on behalf of user. The mutex must be held.
+func (fsys *FS) remove(n *node, user string) error {
+	switch {
+	case n.parent == nil:
+		return ErrPermission
+	case n.removed:
+		return ErrNotExist
+	case !n.parent.hasPerm(user, permWrite):
+		return ErrPermission
+	case len(n.children) > 0:
+		return ErrNotEmpty
+	}
+
+	delete(n.parent.children, n.stat.Name)
+	fsys.modify(n.parent, user)
+	n.removed = true
+	return nil
+}
+
+func (fsys *FS) Remove(_ context.Context, fid *g9p.Fid[*file], r *protocol.RemoveRequest) error {
+	fsys.mu.Lock()
+	defer fsys.mu.Unlock()
+	return fsys.remove(fid.Value.node, fid.User)
+}
+
+func (fsys *FS) Stat(_ context.Context, fid *g9p.Fid[*file], r *protocol.StatRequest) (*protocol.StatResponse, error) {
+	fsys.mu.Lock()
+	defer fsys.mu.Unlock()
+
+	n := fid.Value.node
+	s := n.stat
+	s.Length = uint64(len(n.data))
+	return &protocol.StatResponse{Stat: s}, nil
+}
+
+// WriteStat applies the changes of a stat, as described in
+// http://man.cat-v.org/plan_9/5/stat. All changes are validated before any is
+// applied, so that either all or none of the changes take effect. The name
+// may be changed by users with write permission in the parent directory, the
+// length by users with write permission on the file, and the mode, mtime and
+// group only by the owner.
+func (fsys *FS) WriteStat(_ context.Context, fid *g9p.Fid[*file], r *protocol.WriteStatRequest) (*protocol.WriteStatResponse, error) {
+	fsys.mu.Lock()
+	defer fsys.mu.Unlock()
+
+	n := fid.Value.node
+	old := n.stat
+	s := r.Stat
+	owner := fid.User == old.UID
+
+	// Validate.
+	if n.removed {
+		return nil, ErrNotExist
+	}
+	if s.Type != ^uint16(0) || s.Dev != ^uint32(0) ||
+		s.Qid.Type != ^protocol.QidType(0) || s.Qid.Version != ^uint32(0) || s.Qid.Path != ^uint64(0) ||
+		s.Atime != ^uint32(0) || (s.UID != "" && s.UID != old.UID) || s.MUID != "" {
+		return nil, ErrBadStat
+	}
+
+	changeMode := s.Mode != ^protocol.FileMode(0) && s.Mode != old.Mode
+	if changeMode && s.Mode&protocol.DMDIR != old.Mode&protocol.DMDIR {
+		return nil, ErrBadStat
+	}
+	changeMtime := s.Mtime != ^uint32(0) && s.Mtime != old.Mtime
+	changeGID := s.GID != "" && s.GID != old.GID
+	if (changeMode || changeMtime || changeGID) && !owner {
+		return nil, ErrPermission
+	}
+
+	changeLength := s.Length != ^uint64(0) && s.Length != uint64(len(n.data))
+	if changeLength {
+		if n.isDir() {
+			return nil, ErrIsDir
+		}
+		if !n.hasPerm(fid.User, permWrite) {
+			return nil, ErrPermission
+		}
+		if s.Length > MaxFileSize {
+			return nil, ErrTooLarge
+		}
+	}
+
+	changeName := s.Name != "" && s.Name != old.Name
+	if changeName {
+		switch {
+		case n.parent == nil || !validName(s.Name):
+			return nil, ErrBadName
+		case !n.parent.hasPerm(fid.User, permWrite):
+			return nil, ErrPermission
+		case n.parent.children[s.Name] != nil:
+			return nil, ErrExist
+		}
+	}
+
+	// Apply.
+	if changeMode {
+		n.stat.Mode = s.Mode
+		n.stat.Qid.Type = protocol.QidType(s.Mode >> 24)
+	}
+	if changeMtime {
+		n.stat.Mtime = s.Mtime
+	}
+	if changeGID {
+		n.stat.GID = s.GID
+	}
+	if changeLength {
+		if s.Length < uint64(len(n.data)) {
+			n.data = n.data[:s.Length:s.Length]
+		} else {
+			n.data = append(n.data, make([]byte, s.Length-uint64(len(n.data)))...)
+		}
+		n.stat.Qid.Version++
+	}
+	if changeName {
+		delete(n.parent.children, old.Name)
+		n.parent.children[s.Name] = n
+		n.stat.Name = s.Name
+	}
+
+	return &protocol.WriteStatResponse{}, nil
+}
+
+func (fsys *FS) Clunk(fid *g9p.Fid[*file]) {
+	if fid.Value == nil || !fid.Opened {
+		return
+	}
+
+	fsys.mu.Lock()
+	defer fsys.mu.Unlock()
+
+	n := fid.Value.node
+	n.opens--
+	if fid.Mode&protocol.ORCLOSE != 0 {
+		fsys.remove(n, fid.User)
+	}
+}
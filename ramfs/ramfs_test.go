@@ -0,0 +1,243 @@
+package ramfs
+
+import (
+	"errors"
+	"net"
+	"testing"
+
+	"github.com/kennylevinsen/g9p"
+	"github.com/kennylevinsen/g9p/protocol"
+)
+
+// connect serves the file system over a pipe, and attaches fid 1 as "glenda"
+// and fid 2 as "other".
+func connect(t *testing.T, fsys *FS) *g9p.Client {
+	a, b := net.Pipe()
+	go g9p.ServeContext(a, fsys.Handler())
+	c := g9p.NewClient(b)
+	go c.Start()
+	t.Cleanup(func() { b.Close() })
+
+	if _, err := c.Version(&protocol.VersionRequest{Tag: protocol.NOTAG, MaxSize: 8192, Version: protocol.Version9P2000}); err != nil {
+		t.Fatalf("version failed: %v", err)
+	}
+	if _, err := c.Attach(&protocol.AttachRequest{Tag: 1, Fid: 1, AuthFid: protocol.NOFID, Username: "glenda"}); err != nil {
+		t.Fatalf("attach failed: %v", err)
+	}
+	if _, err := c.Attach(&protocol.AttachRequest{Tag: 1, Fid: 2, AuthFid: protocol.NOFID, Username: "other"}); err != nil {
+		t.Fatalf("attach failed: %v", err)
+	}
+	return c
+}
+
+func TestRamFS(t *testing.T) {
+	c := connect(t, New("glenda"))
+
+	// Create and write a file, which changes its version.
+	if _, err := c.Walk(&protocol.WalkRequest{Tag: 1, Fid: 1, NewFid: 3}); err != nil {
+		t.Fatalf("walk failed: %v", err)
+	}
+	cr, err := c.Create(&protocol.CreateRequest{Tag: 1, Fid: 3, Name: "file", Permissions: 0644, Mode: protocol.ORDWR})
+	if err != nil {
+		t.Fatalf("create failed: %v", err)
+	}
+	if _, err := c.Write(&protocol.WriteRequest{Tag: 1, Fid: 3, Offset: 2, Data: []byte("hello")}); err != nil {
+		t.Fatalf("write failed: %v", err)
+	}
+	sr, err := c.Stat(&protocol.StatRequest{Tag: 1, Fid: 3})
+	if err != nil {
+		t.Fatalf("stat failed: %v", err)
+	}
+	if sr.Stat.Length != 7 || sr.Stat.UID != "glenda" || sr.Stat.Qid.Version == cr.Qid.Version {
+		t.Fatalf("unexpected stat after write: %+v", sr.Stat)
+	}
+	rr, err := c.Read(&protocol.ReadRequest{Tag: 1, Fid: 3, Count: 100})
+	if err != nil {
+		t.Fatalf("read failed: %v", err)
+	}
+	if string(rr.Data) != "\x00\x00hello" {
+		t.Fatalf("read %q", rr.Data)
+	}
+
+	// Files cannot grow beyond MaxFileSize, even if the end of a write
+	// wraps around.
+	if _, err := c.Write(&protocol.WriteRequest{Tag: 1, Fid: 3, Offset: ^uint64(0) - 2, Data: []byte("hello")}); !errors.Is(err, ErrTooLarge) {
+		t.Fatalf("write at wrapping offset returned %v, expected %v", err, ErrTooLarge)
+	}
+	s := protocol.DontTouch()
+	s.Length = MaxFileSize + 1
+	if _, err := c.WriteStat(&protocol.WriteStatRequest{Tag: 1, Fid: 3, Stat: s}); !errors.Is(err, ErrTooLarge) {
+		t.Fatalf("wstat beyond MaxFileSize returned %v, expected %v", err, ErrTooLarge)
+	}
+	if sr, err = c.Stat(&protocol.StatRequest{Tag: 1, Fid: 3}); err != nil || sr.Stat.Length != 7 {
+		t.Fatalf("unexpected stat after failed writes: %+v, %v", sr, err)
+	}
+
+	// Other users may read, but not write the file, nor remove it.
+	if _, err := c.Walk(&protocol.WalkRequest{Tag: 1, Fid: 2, NewFid: 4, Names: []string{"file"}}); err != nil {
+		t.Fatalf("walk failed: %v", err)
+	}
+	if _, err := c.Open(&protocol.OpenRequest{Tag: 1, Fid: 4, Mode: protocol.OWRITE}); err != ErrPermission {
+		t.Fatalf("open for writing by other user returned %v, expected %v", err, ErrPermission)
+	}
+	s = protocol.DontTouch()
+	s.Mode = 0666
+	if _, err := c.WriteStat(&protocol.WriteStatRequest{Tag: 1, Fid: 4, Stat: s}); err != ErrPermission {
+		t.Fatalf("chmod by other user returned %v, expected %v", err, ErrPermission)
+	}
+	if _, err := c.Open(&protocol.OpenRequest{Tag: 1, Fid: 4, Mode: protocol.OREAD}); err != nil {
+		t.Fatalf("open for reading by other user failed: %v", err)
+	}
+
+	// Truncate and rename it.
+	s = protocol.DontTouch()
+	s.Name = "renamed"
+	s.Length = 3
+	if _, err := c.WriteStat(&protocol.WriteStatRequest{Tag: 1, Fid: 3, Stat: s}); err != nil {
+		t.Fatalf("wstat failed: %v", err)
+	}
+	if _, err := c.Walk(&protocol.WalkRequest{Tag: 1, Fid: 1, NewFid: 5, Names: []string{"renamed"}}); err != nil {
+		t.Fatalf("walk to renamed file failed: %v", err)
+	}
+	if sr, err = c.Stat(&protocol.StatRequest{Tag: 1, Fid: 5}); err != nil || sr.Stat.Length != 3 {
+		t.Fatalf("unexpected stat after truncate: %+v, %v", sr, err)
+	}
+
+	// Appends ignore the offset, and exclusive files are only opened once.
+	if _, err := c.Walk(&protocol.WalkRequest{Tag: 1, Fid: 1, NewFid: 6}); err != nil {
+		t.Fatalf("walk failed: %v", err)
+	}
+	if _, err := c.Create(&protocol.CreateRequest{Tag: 1, Fid: 6, Name: "log", Permissions: protocol.DMAPPEND | protocol.DMEXCL | 0600, Mode: protocol.OWRITE}); err != nil {
+		t.Fatalf("create failed: %v", err)
+	}
+	for _, p := range []string{"a", "b"} {
+		if _, err := c.Write(&protocol.WriteRequest{Tag: 1, Fid: 6, Data: []byte(p)}); err != nil {
+			t.Fatalf("write failed: %v", err)
+		}
+	}
+	if _, err := c.Walk(&protocol.WalkRequest{Tag: 1, Fid: 1, NewFid: 7, Names: []string{"log"}}); err != nil {
+		t.Fatalf("walk failed: %v", err)
+	}
+	if _, err := c.Open(&protocol.OpenRequest{Tag: 1, Fid: 7, Mode: protocol.OREAD}); !errors.Is(err, ErrExclusive) {
+		t.Fatalf("second open of exclusive file returned %v, expected %v", err, ErrExclusive)
+	}
+	if _, err := c.Clunk(&protocol.ClunkRequest{Tag: 1, Fid: 6}); err != nil {
+		t.Fatalf("clunk failed: %v", err)
+	}
+	if _, err := c.Open(&protocol.OpenRequest{Tag: 1, Fid: 7, Mode: protocol.OREAD}); err != nil {
+		t.Fatalf("open after clunk failed: %v", err)
+	}
+	if rr, err = c.Read(&protocol.ReadRequest{Tag: 1, Fid: 7, Count: 100}); err != nil || string(rr.Data) != "ab" {
+		t.Fatalf("read %+v, %v", rr, err)
+	}
+
+	// Files opened with ORCLOSE are removed when clunked.
+	if _, err := c.Walk(&protocol.WalkRequest{Tag: 1, Fid: 1, NewFid: 8}); err != nil {
+		t.Fatalf("walk failed: %v", err)
+	}
+	if _, err := c.Create(&protocol.CreateRequest{Tag: 1, Fid: 8, Name: "tmp", Permissions: 0600, Mode: protocol.OWRITE | protocol.ORCLOSE}); err != nil {
+		t.Fatalf("create failed: %v", err)
+	}
+	if _, err := c.Clunk(&protocol.ClunkRequest{Tag: 1, Fid: 8}); err != nil {
+		t.Fatalf("clunk failed: %v", err)
+	}
+	if _, err := c.Walk(&protocol.WalkRequest{Tag: 1, Fid: 1, NewFid: 8, Names: []string{"tmp"}}); err != ErrNotExist {
+		t.Fatalf("walk to ORCLOSE file returned %v, expected %v", err, ErrNotExist)
+	}
+}
+
+func TestSnapshot(t *testing.T) {
+	fsys := New("glenda")
+	c := connect(t, fsys)
+
+	if _, err := c.Walk(&protocol.WalkRequest{Tag: 1, Fid: 1, NewFid: 3}); err != nil {
+		t.Fatalf("walk failed: %v", err)
+	}
+	if _, err := c.Create(&protocol.CreateRequest{Tag: 1, Fid: 3, Name: "dir", Permissions: protocol.DMDIR | 0755, Mode: protocol.OREAD}); err != nil {
+		t.Fatalf("create failed: %v", err)
+	}
+	if _, err := c.Walk(&protocol.WalkRequest{Tag: 1, Fid: 1, NewFid: 4, Names: []string{"dir"}}); err != nil {
+		t.Fatalf("walk failed: %v", err)
+	}
+	if _, err := c.Create(&protocol.CreateRequest{Tag: 1, Fid: 4, Name: "file", Permissions: 0644, Mode: protocol.OWRITE}); err != nil {
+		t.Fatalf("create failed: %v", err)
+	}
+	if _, err := c.Write(&protocol.WriteRequest{Tag: 1, Fid: 4, Data: []byte("before")}); err != nil {
+		t.Fatalf("write failed: %v", err)
+	}
+
+	b, err := fsys.Snapshot().MarshalBinary()
+	if err != nil {
+		t.Fatalf("marshal failed: %v", err)
+	}
+	var snap Snapshot
+	if err := snap.UnmarshalBinary(b); err != nil {
+		t.Fatalf("unmarshal failed: %v", err)
+	}
+	if err := new(Snapshot).UnmarshalBinary(b[:len(b)-1]); err != ErrBadSnapshot {
+		t.Fatalf("unmarshal of truncated snapshot returned %v, expected %v", err, ErrBadSnapshot)
+	}
+
+	if _, err := c.Write(&protocol.WriteRequest{Tag: 1, Fid: 4, Data: []byte("after!")}); err != nil {
+		t.Fatalf("write failed: %v", err)
+	}
+	fsys.Restore(&snap)
+
+	// Fids of the replaced state no longer work.
+	if _, err := c.Walk(&protocol.WalkRequest{Tag: 1, Fid: 1, NewFid: 5, Names: []string{"dir"}}); err != ErrNotExist {
+		t.Fatalf("walk from replaced root returned %v, expected %v", err, ErrNotExist)
+	}
+
+	// The restored state is that of the snapshot.
+	if _, err := c.Attach(&protocol.AttachRequest{Tag: 1, Fid: 5, AuthFid: protocol.NOFID, Username: "glenda"}); err != nil {
+		t.Fatalf("attach failed: %v", err)
+	}
+	if _, err := c.Walk(&protocol.WalkRequest{Tag: 1, Fid: 5, NewFid: 6, Names: []string{"dir", "file"}}); err != nil {
+		t.Fatalf("walk failed: %v", err)
+	}
+	if _, err := c.Open(&protocol.OpenRequest{Tag: 1, Fid: 6, Mode: protocol.OREAD}); err != nil {
+		t.Fatalf("open failed: %v", err)
+	}
+	rr, err := c.Read(&protocol.ReadRequest{Tag: 1, Fid: 6, Count: 100})
+	if err != nil || string(rr.Data) != "before" {
+		t.Fatalf("read %+v, %v", rr, err)
+	}
+}
+
+func TestDirReadUnix(t *testing.T) {
+	a, b := net.Pipe()
+	go g9p.ServeContext(a, New("glenda").Handler())
+	c := g9p.NewClient(b)
+	go c.Start()
+	defer b.Close()
+
+	vr, err := c.Version(&protocol.VersionRequest{Tag: protocol.NOTAG, MaxSize: 8192, Version: protocol.Version9P2000u})
+	if err != nil || vr.Version != protocol.Version9P2000u {
+		t.Fatalf("version returned %+v, %v, expected %s", vr, err, protocol.Version9P2000u)
+	}
+	if _, err := c.Attach(&protocol.AttachRequest{Tag: 1, Fid: 1, AuthFid: protocol.NOFID, Username: "glenda"}); err != nil {
+		t.Fatalf("attach failed: %v", err)
+	}
+	if _, err := c.Walk(&protocol.WalkRequest{Tag: 1, Fid: 1, NewFid: 2}); err != nil {
+		t.Fatalf("walk failed: %v", err)
+	}
+	if _, err := c.Create(&protocol.CreateRequest{Tag: 1, Fid: 2, Name: "file", Permissions: 0644, Mode: protocol.OREAD}); err != nil {
+		t.Fatalf("create failed: %v", err)
+	}
+
+	// Directory reads carry stats in the 9P2000.u layout.
+	if _, err := c.Open(&protocol.OpenRequest{Tag: 1, Fid: 1, Mode: protocol.OREAD}); err != nil {
+		t.Fatalf("open failed: %v", err)
+	}
+	rr, err := c.Read(&protocol.ReadRequest{Tag: 1, Fid: 1, Count: 1000})
+	if err != nil {
+		t.Fatalf("read failed: %v", err)
+	}
+	var s protocol.Stat
+	if err := s.UnmarshalDialect(rr.Data, protocol.Dialect9P2000u); err != nil || s.Name != "file" {
+		t.Fatalf("unexpected directory entry %+v, %v", s, err)
+	}
+	if l := s.EncodedLengthDialect(protocol.Dialect9P2000u); l != len(rr.Data) {
+		t.Fatalf("directory entry is %d bytes, expected %d", len(rr.Data), l)
+	}
+}
@@ -0,0 +1,144 @@
+package ramfs
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+
+	"github.com/kennylevinsen/g9p/protocol"
+)
+
+// ErrBadSnapshot is returned when unmarshalling a malformed snapshot.
+var ErrBadSnapshot = errors.New("ramfs: malformed snapshot")
+
+// Snapshot is a copy of the full state of a file system. The zero Snapshot is
+// not valid, and a Snapshot is only obtained from Snapshot or UnmarshalBinary.
+type Snapshot struct {
+	root     *node
+	nextPath uint64
+}
+
+// Snapshot returns a copy of the current state of the file system. Open files
+// are not part of the snapshot.
+func (fsys *FS) Snapshot() *Snapshot {
+	fsys.mu.Lock()
+	defer fsys.mu.Unlock()
+	return &Snapshot{root: copyNode(fsys.root, nil), nextPath: fsys.nextPath}
+}
+
+// Restore replaces the state of the file system with that of a snapshot,
+// which may be restored again later. Fids referring to files of the replaced
+// state behave as if the files were removed.
+func (fsys *FS) Restore(s *Snapshot) {
+	root := copyNode(s.root, nil)
+
+	fsys.mu.Lock()
+	defer fsys.mu.Unlock()
+	markRemoved(fsys.root)
+	fsys.root = root
+	fsys.nextPath = s.nextPath
+}
+
+// copyNode returns a deep copy of a node, without its open state.
+func copyNode(n, parent *node) *node {
+	c := &node{
+		stat:   n.stat,
+		parent: parent,
+		data:   append([]byte(nil), n.data...),
+	}
+	if n.children != nil {
+		c.children = make(map[string]*node, len(n.children))
+		for name, child := range n.children {
+			c.children[name] = copyNode(child, c)
+		}
+	}
+	return c
+}
+
+// markRemoved marks a node and all nodes below it as removed.
+func markRemoved(n *node) {
+	n.removed = true
+	for _, child := range n.children {
+		markRemoved(child)
+	}
+}
+
+// MarshalBinary encodes the snapshot. Every file is encoded as its stat,
+// followed by the length and content of its data, the number of entries if it
+// is a directory, and the entries in turn. The file system is preceded by the
+// next qid path.
+func (s *Snapshot) MarshalBinary() ([]byte, error) {
+	b := binary.LittleEndian.AppendUint64(nil, s.nextPath)
+	return appendNode(b, s.root), nil
+}
+
+func appendNode(b []byte, n *node) []byte {
+	b = n.stat.MarshalAppend(b)
+	b = binary.LittleEndian.AppendUint64(b, uint64(len(n.data)))
+	b = append(b, n.data...)
+	if n.isDir() {
+		b = binary.LittleEndian.AppendUint32(b, uint32(len(n.children)))
+		for _, child := range n.children {
+			b = appendNode(b, child)
+		}
+	}
+	return b
+}
+
+// UnmarshalBinary decodes a snapshot encoded by MarshalBinary.
+func (s *Snapshot) UnmarshalBinary(b []byte) error {
+	r := bytes.NewReader(b)
+	var nextPath uint64
+	if err := binary.Read(r, binary.LittleEndian, &nextPath); err != nil {
+		return ErrBadSnapshot
+	}
+	root, err := readNode(r, nil)
+	if err != nil {
+		return err
+	}
+	if r.Len() != 0 || !root.isDir() {
+		return ErrBadSnapshot
+	}
+
+	s.root, s.nextPath = root, nextPath
+	return nil
+}
+
+func readNode(r *bytes.Reader, parent *node) (*node, error) {
+	n := &node{parent: parent}
+	if err := n.stat.Decode(r); err != nil {
+		return nil, ErrBadSnapshot
+	}
+	n.stat.Length = 0
+
+	var size uint64
+	if err := binary.Read(r, binary.LittleEndian, &size); err != nil || size > uint64(r.Len()) {
+		return nil, ErrBadSnapshot
+	}
+	n.data = make([]byte, size)
+	if _, err := io.ReadFull(r, n.data); err != nil {
+		return nil, ErrBadSnapshot
+	}
+
+	if n.stat.Mode&protocol.DMDIR == 0 {
+		return n, nil
+	}
+
+	var count uint32
+	if err := binary.Read(r, binary.LittleEndian, &count); err != nil {
+		return nil, ErrBadSnapshot
+	}
+	n.children = make(map[string]*node)
+	for i := uint32(0); i < count; i++ {
+		child, err := readNode(r, n)
+		if err != nil {
+			return nil, err
+		}
+		if !validName(child.stat.Name) || n.children[child.stat.Name] != nil {
+			return nil, ErrBadSnapshot
+		}
+		n.children[child.stat.Name] = child
+	}
+	return n, nil
+}
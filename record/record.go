@@ -0,0 +1,207 @@
+// Package record records 9P conversations to a file, and replays them against
+// a server or to a client.
+//
+// A recording is made by wrapping either end of a connection in a Recorder,
+// which writes every frame passing through it, in both directions, to a
+// recording. The recording starts with the 8 byte magic "g9prec1\n",
+// followed by a record for every frame:
+//
+//	dir[1] time[8] frame[size]
+//
+// dir is 'r' for frames read by the Recorder, and 'w' for frames written by
+// it. time is the time the frame was completed, as nanoseconds since the Unix
+// epoch. frame is the complete 9P message, starting with its size[4] header.
+// All integers are little endian, like those of 9P itself.
+package record
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/kennylevinsen/g9p/protocol"
+)
+
+// Magic is the magic that starts every recording.
+const Magic = "g9prec1\n"
+
+// Errors
+var (
+	ErrBadMagic  = errors.New("record: not a recording")
+	ErrBadRecord = errors.New("record: malformed record")
+)
+
+// Direction is the direction of a recorded frame, relative to the Recorder.
+type Direction byte
+
+// Directions
+const (
+	Read    Direction = 'r'
+	Written Direction = 'w'
+)
+
+// Frame is a recorded frame.
+type Frame struct {
+	Dir  Direction
+	Time time.Time
+
+	// Data is the complete 9P message, including its header.
+	Data []byte
+}
+
+// Recorder is an io.ReadWriter recording the frames read from and written to
+// an underlying ReadWriter, such as a network connection.
+type Recorder struct {
+	rw io.ReadWriter
+
+	// read and written split the data read and written into frames. They
+	// are protected by readLock and writeLock, respectively.
+	readLock  sync.Mutex
+	read      protocol.FrameSplitter
+	writeLock sync.Mutex
+	written   protocol.FrameSplitter
+
+	// mu protects the recording and its first error.
+	mu  sync.Mutex
+	w   io.Writer
+	err error
+}
+
+// NewRecorder returns a Recorder recording the frames passing through rw to
+// w. The magic is written right away.
+func NewRecorder(rw io.ReadWriter, w io.Writer) *Recorder {
+	r := &Recorder{rw: rw, w: w}
+	_, r.err = io.WriteString(w, Magic)
+	return r
+}
+
+func (r *Recorder) Read(p []byte) (int, error) {
+	n, err := r.rw.Read(p)
+	if n > 0 {
+		r.readLock.Lock()
+		r.record(&r.read, p[:n], Read)
+		r.readLock.Unlock()
+	}
+	return n, err
+}
+
+// Write records the frames completed by p before writing p, so that a request
+// is always recorded ahead of its response.
+func (r *Recorder) Write(p []byte) (int, error) {
+	r.writeLock.Lock()
+	r.record(&r.written, p, Written)
+	r.writeLock.Unlock()
+	return r.rw.Write(p)
+}
+
+// Close closes the underlying ReadWriter if it implements io.Closer.
+func (r *Recorder) Close() error {
+	if c, ok := r.rw.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
+
+// Err returns the first error writing the recording, after which nothing more
+// is recorded.
+func (r *Recorder) Err() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.err
+}
+
+// record records the frames completed by data.
+func (r *Recorder) record(s *protocol.FrameSplitter, data []byte, dir Direction) {
+	err := s.Split(data, func(b []byte) {
+		r.write(Frame{Dir: dir, Time: time.Now(), Data: b})
+	})
+	if err != nil {
+		r.fail(ErrBadRecord)
+	}
+}
+
+func (r *Recorder) fail(err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.err == nil {
+		r.err = err
+	}
+}
+
+// write writes a record.
+func (r *Recorder) write(f Frame) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.err != nil {
+		return
+	}
+
+	b := make([]byte, 0, 9+len(f.Data))
+	b = append(b, byte(f.Dir))
+	b = binary.LittleEndian.AppendUint64(b, uint64(f.Time.UnixNano()))
+	b = append(b, f.Data...)
+	_, r.err = r.w.Write(b)
+}
+
+// Reader reads the frames of a recording.
+type Reader struct {
+	r *bufio.Reader
+}
+
+// NewReader returns a Reader reading a recording from r, after checking its
+// magic.
+func NewReader(r io.Reader) (*Reader, error) {
+	br := bufio.NewReader(r)
+	magic := make([]byte, len(Magic))
+	if _, err := io.ReadFull(br, magic); err != nil || !bytes.Equal(magic, []byte(Magic)) {
+		return nil, ErrBadMagic
+	}
+	return &Reader{r: br}, nil
+}
+
+// Next returns the next frame of the recording, or io.EOF at the end of the
+// recording.
+func (r *Reader) Next() (Frame, error) {
+	var hdr [9]byte
+	if _, err := io.ReadFull(r.r, hdr[:]); err != nil {
+		if err == io.EOF {
+			return Frame{}, io.EOF
+		}
+		return Frame{}, ErrBadRecord
+	}
+
+	dir := Direction(hdr[0])
+	if dir != Read && dir != Written {
+		return Frame{}, ErrBadRecord
+	}
+	data, err := protocol.ReadFrame(r.r, 0)
+	if err != nil {
+		return Frame{}, ErrBadRecord
+	}
+	t := time.Unix(0, int64(binary.LittleEndian.Uint64(hdr[1:])))
+	return Frame{Dir: dir, Time: t, Data: data}, nil
+}
+
+// ReadAll reads all frames of a recording.
+func ReadAll(r io.Reader) ([]Frame, error) {
+	rr, err := NewReader(r)
+	if err != nil {
+		return nil, err
+	}
+
+	var frames []Frame
+	for {
+		f, err := rr.Next()
+		if err == io.EOF {
+			return frames, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		frames = append(frames, f)
+	}
+}
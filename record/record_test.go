@@ -0,0 +1,101 @@
+package record
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/kennylevinsen/g9p"
+	"github.com/kennylevinsen/g9p/protocol"
+	"github.com/kennylevinsen/g9p/ramfs"
+)
+
+// session creates and writes a file through c, using tags starting at tag.
+func session(t *testing.T, c *g9p.Client, tag protocol.Tag) {
+	if _, err := c.Version(&protocol.VersionRequest{Tag: protocol.NOTAG, MaxSize: 8192, Version: protocol.Version9P2000}); err != nil {
+		t.Fatalf("version failed: %v", err)
+	}
+	if _, err := c.Attach(&protocol.AttachRequest{Tag: tag, Fid: 1, AuthFid: protocol.NOFID, Username: "glenda"}); err != nil {
+		t.Fatalf("attach failed: %v", err)
+	}
+	if _, err := c.Walk(&protocol.WalkRequest{Tag: tag + 1, Fid: 1, NewFid: 2}); err != nil {
+		t.Fatalf("walk failed: %v", err)
+	}
+	if _, err := c.Create(&protocol.CreateRequest{Tag: tag + 2, Fid: 2, Name: "file", Permissions: 0644, Mode: protocol.OWRITE}); err != nil {
+		t.Fatalf("create failed: %v", err)
+	}
+	wr, err := c.Write(&protocol.WriteRequest{Tag: tag + 3, Fid: 2, Data: []byte("hello")})
+	if err != nil {
+		t.Fatalf("write failed: %v", err)
+	}
+	if wr.Count != 5 {
+		t.Fatalf("wrote %d bytes, expected 5", wr.Count)
+	}
+}
+
+func TestRecordReplay(t *testing.T) {
+	var rec bytes.Buffer
+	a, b := net.Pipe()
+	go g9p.ServeContext(a, ramfs.New("glenda").Handler())
+	r := NewRecorder(b, &rec)
+	c := g9p.NewClient(r)
+	go c.Start()
+	session(t, c, 1)
+	c.Stop()
+	if err := r.Err(); err != nil {
+		t.Fatalf("recording failed: %v", err)
+	}
+
+	frames, err := ReadAll(bytes.NewReader(rec.Bytes()))
+	if err != nil {
+		t.Fatalf("could not read recording: %v", err)
+	}
+	if len(frames) != 10 {
+		t.Fatalf("recorded %d frames, expected 10", len(frames))
+	}
+	if frames[0].Dir != Written || frames[1].Dir != Read || frames[1].Time.Before(frames[0].Time) {
+		t.Fatalf("unexpected frames: %+v, %+v", frames[0], frames[1])
+	}
+	if _, err := ReadAll(bytes.NewReader(rec.Bytes()[:rec.Len()-1])); err != ErrBadRecord {
+		t.Fatalf("reading truncated recording returned %v, expected %v", err, ErrBadRecord)
+	}
+
+	// Replaying against a fresh file system gives the same responses, but
+	// not against one where the file already exists.
+	rp := &Replayer{Frames: frames, Timeout: time.Second}
+	if err := rp.DriveHandler(ramfs.New("glenda").Handler()); err != nil {
+		t.Fatalf("replay failed: %v", err)
+	}
+	fsys := ramfs.New("glenda")
+	if err := rp.DriveHandler(fsys.Handler()); err != nil {
+		t.Fatalf("replay failed: %v", err)
+	}
+	var mismatch *MismatchError
+	if err := rp.DriveHandler(fsys.Handler()); !errors.As(err, &mismatch) {
+		t.Fatalf("replay against changed file system returned %v, expected mismatches", err)
+	}
+	found := false
+	for _, m := range mismatch.Mismatches {
+		if _, ok := m.Got.(*protocol.ErrorResponse); ok && m.Index == 7 {
+			found = true
+		}
+	}
+	if !found {
+		t.Fatalf("failed create not reported: %+v", mismatch.Mismatches)
+	}
+
+	// The recording can also act as the server, even if the client uses
+	// other tags.
+	a, b = net.Pipe()
+	errc := make(chan error, 1)
+	go func() { errc <- rp.ServeClient(a) }()
+	c = g9p.NewClient(b)
+	go c.Start()
+	defer c.Stop()
+	session(t, c, 100)
+	if err := <-errc; err != nil {
+		t.Fatalf("replay failed: %v", err)
+	}
+}
@@ -0,0 +1,258 @@
+package record
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"time"
+
+	"github.com/kennylevinsen/g9p"
+	"github.com/kennylevinsen/g9p/protocol"
+)
+
+// ErrTimeout is returned when a replay times out waiting for a message.
+var ErrTimeout = errors.New("record: timed out waiting for message")
+
+// Replayer replays a recording, either to drive a server with the recorded
+// requests, or to act as a scripted server for a client. Either way, the
+// messages received are compared against those recorded, and mismatches are
+// reported by returning a *MismatchError once the replay is complete.
+type Replayer struct {
+	Frames []Frame
+
+	// Compare reports whether a received message matches the recorded one.
+	// If nil, the messages must be encoded identically. Compare is useful to
+	// ignore fields that are expected to change, such as times.
+	Compare func(want, got protocol.Message) bool
+
+	// Timeout limits the time to wait for each message. Zero means no limit.
+	Timeout time.Duration
+}
+
+// Mismatch is a received message that did not match the recording.
+type Mismatch struct {
+	// Index is the index of the recorded frame.
+	Index int
+
+	// Want is the recorded message, and Got the received message. Either is
+	// nil if it could not be decoded.
+	Want, Got protocol.Message
+}
+
+// MismatchError reports the mismatches of a replay.
+type MismatchError struct {
+	Mismatches []Mismatch
+}
+
+func (e *MismatchError) Error() string {
+	m := e.Mismatches[0]
+	return fmt.Sprintf("record: %d mismatches, the first at frame %d: expected %v, got %v",
+		len(e.Mismatches), m.Index, m.Want, m.Got)
+}
+
+// DriveHandler replays the recorded requests against a handler, served by a
+// Server over a pipe, and compares its responses to those recorded.
+func (rp *Replayer) DriveHandler(h g9p.ContextHandler) error {
+	a, b := net.Pipe()
+	go g9p.ServeContext(a, h)
+	defer b.Close()
+	return rp.DriveServer(b)
+}
+
+// DriveServer replays the recorded requests to a server, in the recorded
+// order, and compares its responses to those recorded. Responses are matched
+// to requests by their tag, so they may arrive in any order.
+func (rp *Replayer) DriveServer(rw io.ReadWriter) error {
+	p := newPeer(rw)
+	defer close(p.done)
+
+	var (
+		mismatches []Mismatch
+		dialect    protocol.Dialect
+		stash      = make(map[protocol.Tag][][]byte)
+	)
+	for i, f := range rp.Frames {
+		if isRequest(f.Data) {
+			if _, err := rw.Write(f.Data); err != nil {
+				return err
+			}
+			continue
+		}
+
+		tag := tagOf(f.Data)
+		for len(stash[tag]) == 0 {
+			got, err := p.receive(rp.Timeout)
+			if err != nil {
+				return err
+			}
+			stash[tagOf(got)] = append(stash[tagOf(got)], got)
+		}
+		got := stash[tag][0]
+		stash[tag] = stash[tag][1:]
+
+		if m, ok := rp.match(i, f.Data, got, dialect); !ok {
+			mismatches = append(mismatches, m)
+		}
+		dialect = negotiated(f.Data, dialect)
+	}
+	return mismatchError(mismatches)
+}
+
+// ServeClient acts as the server of a client, expecting the recorded requests
+// in the recorded order, and responding with the recorded responses. The
+// client may use other tags than those recorded, which are mapped to those
+// of the client.
+func (rp *Replayer) ServeClient(rw io.ReadWriter) error {
+	p := newPeer(rw)
+	defer close(p.done)
+
+	var (
+		mismatches []Mismatch
+		dialect    protocol.Dialect
+		tags       = make(map[protocol.Tag]protocol.Tag)
+	)
+	mapTag := func(t protocol.Tag) protocol.Tag {
+		if mapped, ok := tags[t]; ok {
+			return mapped
+		}
+		return t
+	}
+
+	for i, f := range rp.Frames {
+		want := withTag(f.Data, mapTag(tagOf(f.Data)))
+		if !isRequest(f.Data) {
+			if _, err := rw.Write(want); err != nil {
+				return err
+			}
+			dialect = negotiated(f.Data, dialect)
+			continue
+		}
+
+		got, err := p.receive(rp.Timeout)
+		if err != nil {
+			return err
+		}
+		tags[tagOf(f.Data)] = tagOf(got)
+
+		// The tag of a flush refers to a request of the client.
+		want = withTag(f.Data, tagOf(got))
+		if protocol.MessageType(want[4]) == protocol.Tflush && len(want) >= protocol.HeaderSize+4 {
+			old := binary.LittleEndian.Uint16(want[protocol.HeaderSize+2:])
+			binary.LittleEndian.PutUint16(want[protocol.HeaderSize+2:], uint16(mapTag(protocol.Tag(old))))
+		}
+
+		if m, ok := rp.match(i, want, got, dialect); !ok {
+			mismatches = append(mismatches, m)
+		}
+	}
+	return mismatchError(mismatches)
+}
+
+// match compares a received frame to the recorded one.
+func (rp *Replayer) match(i int, want, got []byte, dialect protocol.Dialect) (Mismatch, bool) {
+	wm, werr := protocol.UnmarshalMessage(want, dialect)
+	gm, gerr := protocol.UnmarshalMessage(got, dialect)
+
+	ok := bytes.Equal(want, got)
+	if rp.Compare != nil && werr == nil && gerr == nil {
+		ok = rp.Compare(wm, gm)
+	}
+	return Mismatch{Index: i, Want: wm, Got: gm}, ok
+}
+
+func mismatchError(mismatches []Mismatch) error {
+	if len(mismatches) == 0 {
+		return nil
+	}
+	return &MismatchError{Mismatches: mismatches}
+}
+
+// peer reads the frames sent by the other end of a replay.
+type peer struct {
+	frames chan []byte
+	done   chan struct{}
+
+	// err is the error that ended reading, which is set before frames is
+	// closed.
+	err error
+}
+
+func newPeer(r io.Reader) *peer {
+	p := &peer{
+		frames: make(chan []byte),
+		done:   make(chan struct{}),
+	}
+	go func() {
+		defer close(p.frames)
+		for {
+			b, err := protocol.ReadFrame(r, 0)
+			if err != nil {
+				p.err = err
+				return
+			}
+			select {
+			case p.frames <- b:
+			case <-p.done:
+				return
+			}
+		}
+	}()
+	return p
+}
+
+// receive returns the next frame, waiting at most timeout if not zero.
+func (p *peer) receive(timeout time.Duration) ([]byte, error) {
+	var expired <-chan time.Time
+	if timeout > 0 {
+		t := time.NewTimer(timeout)
+		defer t.Stop()
+		expired = t.C
+	}
+
+	select {
+	case b, ok := <-p.frames:
+		if !ok {
+			return nil, p.err
+		}
+		return b, nil
+	case <-expired:
+		return nil, ErrTimeout
+	}
+}
+
+// isRequest returns whether a frame is a request.
+func isRequest(b []byte) bool {
+	return len(b) > 4 && protocol.MessageType(b[4]).IsRequest()
+}
+
+// tagOf returns the tag of a frame.
+func tagOf(b []byte) protocol.Tag {
+	if len(b) < protocol.HeaderSize+2 {
+		return protocol.NOTAG
+	}
+	return protocol.Tag(binary.LittleEndian.Uint16(b[protocol.HeaderSize:]))
+}
+
+// withTag returns a copy of a frame with its tag replaced.
+func withTag(b []byte, t protocol.Tag) []byte {
+	b = append([]byte(nil), b...)
+	if len(b) >= protocol.HeaderSize+2 {
+		binary.LittleEndian.PutUint16(b[protocol.HeaderSize:], uint16(t))
+	}
+	return b
+}
+
+// negotiated returns the dialect in use after a frame.
+func negotiated(b []byte, dialect protocol.Dialect) protocol.Dialect {
+	m, err := protocol.UnmarshalMessage(b, dialect)
+	if err != nil {
+		return dialect
+	}
+	if vr, ok := m.(*protocol.VersionResponse); ok {
+		dialect, _ = protocol.ParseDialect(vr.Version)
+	}
+	return dialect
+}
@@ -1,230 +1,700 @@
 package g9p
 
 import (
+	"context"
 	"io"
+	"log"
 	"net"
 	"sync"
+	"sync/atomic"
 
+	"github.com/kennylevinsen/g9p/p9err"
 	"github.com/kennylevinsen/g9p/protocol"
 )
 
-// Server serves a ReadWriter with a given handler.
+// Server serves a ReadWriter with a given handler. Either Handler or
+// ContextHandler must be set. If ContextHandler is set, Handler is ignored.
 type Server struct {
-	Handler   Handler
-	RW        io.ReadWriter
+	Handler        Handler
+	ContextHandler ContextHandler
+	RW             io.ReadWriter
+
+	// MaxRequests limits the number of requests handled at once on the
+	// connection. Zero means no limit. Once the limit is reached, the server
+	// stops reading requests until one finishes, except for flushes.
+	MaxRequests int
+
+	// Limiter, if set, limits the number of requests handled at once across
+	// all servers sharing it.
+	Limiter *Limiter
+
+	// Sequential makes the server handle one request at a time, in the order
+	// they are received, for handlers that are not safe for concurrent use.
+	// A request that blocks indefinitely can then only be flushed by
+	// closing the connection.
+	Sequential bool
+
+	// ErrorLog is used to log panics in the handler, which are recovered
+	// from, failing the request. If nil, the log package's standard logger
+	// is used.
+	ErrorLog *log.Logger
+
 	writeLock sync.Mutex
+	dialect   protocol.Dialect
+
+	// msize is the negotiated maximum message size. It is accessed
+	// atomically.
+	msize uint32
+
+	// pending holds the requests currently being handled, by tag.
+	pendingLock sync.Mutex
+	pending     map[protocol.Tag]*request
+
+	// active counts the requests that have been read but not yet finished,
+	// and closing is set once the connection has been closed, at which
+	// point quit is closed. All are protected by pendingLock.
+	active  int
+	closing bool
+	quit    chan struct{}
+
+	// sem limits the number of requests handled at once if MaxRequests is
+	// set.
+	sem chan struct{}
+
+	// reading delivers the frame being read ahead by acquire, and held is a
+	// frame read ahead that is not yet served. Both are only used by the
+	// goroutine running Start.
+	reading chan frame
+	held    []byte
+}
+
+// frame is the result of reading a frame from the connection.
+type frame struct {
+	b   []byte
+	err error
+}
+
+// dialectKey carries the negotiated dialect in the context of requests.
+type dialectKey struct{}
+
+// Dialect returns the dialect negotiated on the connection that a request was
+// received on, given the context passed to the handler by Server. Handlers
+// encoding stats into directory reads must use it, as the stat layout differs
+// between dialects.
+func Dialect(ctx context.Context) protocol.Dialect {
+	d, _ := ctx.Value(dialectKey{}).(protocol.Dialect)
+	return d
+}
+
+// Limiter limits the number of requests handled at once. A Limiter may be
+// shared by any number of servers.
+type Limiter struct {
+	sem chan struct{}
+}
+
+// NewLimiter returns a Limiter allowing n requests to be handled at once.
+func NewLimiter(n int) *Limiter {
+	return &Limiter{sem: make(chan struct{}, n)}
+}
+
+// request is a request currently being handled by the server.
+type request struct {
+	tag    protocol.Tag
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	// done is closed once the request has been responded to.
+	done chan struct{}
+
+	// flush is set if the request is a FlushRequest. Flushes do not wait
+	// for other flushes, as two flushes flushing each other would
+	// otherwise never complete.
+	flush bool
+}
+
+// defaultMaxSize is the maximum message size used on a connection until a
+// size has been negotiated by Version.
+const defaultMaxSize = 8192
+
+// errnoEIO is the Linux error number of internal server errors.
+const errnoEIO = 5
+
+var errNotSupported = p9err.ErrNotSupported
+
+// handler returns the ContextHandler to dispatch requests to.
+func (s *Server) handler() ContextHandler {
+	if s.ContextHandler != nil {
+		return s.ContextHandler
+	}
+	return contextAdapter{s.Handler}
+}
+
+// linuxHandler returns the handler to dispatch 9P2000.L requests to, if the
+// handler implements LinuxContextHandler or LinuxHandler.
+func (s *Server) linuxHandler() (LinuxContextHandler, bool) {
+	var h interface{} = s.Handler
+	if s.ContextHandler != nil {
+		h = s.ContextHandler
+	}
+	switch lh := h.(type) {
+	case LinuxContextHandler:
+		return lh, true
+	case LinuxHandler:
+		return linuxAdapter{lh}, true
+	}
+	return nil, false
+}
+
+func (s *Server) maxSize() uint32 {
+	if msize := atomic.LoadUint32(&s.msize); msize != 0 {
+		return msize
+	}
+	return defaultMaxSize
+}
+
+// errorResponse returns the error response for the current dialect. The
+// writeLock must be held.
+func (s *Server) errorResponse(tag protocol.Tag, e error) protocol.Message {
+	if s.dialect == protocol.Dialect9P2000L {
+		ecode := errno(e)
+		if ecode == 0 {
+			ecode = errnoEIO
+		}
+		return &protocol.LinuxErrorResponse{Tag: tag, Ecode: ecode}
+	}
+	return &protocol.ErrorResponse{Tag: tag, Error: e.Error(), Errno: errno(e)}
 }
 
 func (s *Server) handleResponse(tag protocol.Tag, d protocol.Message, e error) {
+	s.writeLock.Lock()
+	defer s.writeLock.Unlock()
+	s.writeResponse(tag, d, e)
+}
+
+// respond sends the response to a pending request. The request is removed
+// from the tag table while holding the writeLock, so that the tag is free for
+// reuse by the time the client receives the response, while a flush that no
+// longer finds the request still cannot respond before it.
+func (s *Server) respond(req *request, d protocol.Message, e error) {
+	s.writeLock.Lock()
+	defer s.writeLock.Unlock()
+	s.unregister(req)
+	s.writeResponse(req.tag, d, e)
+}
+
+// writeResponse writes a response, or an error response if e is not nil. The
+// writeLock must be held.
+func (s *Server) writeResponse(tag protocol.Tag, d protocol.Message, e error) {
 	if e == ErrFlushed {
 		return
 	}
 
 	if e != nil {
-		d = &protocol.ErrorResponse{Tag: tag, Error: e.Error()}
+		d = s.errorResponse(tag, e)
 	}
 
-	s.writeLock.Lock()
-	defer s.writeLock.Unlock()
+	if vr, ok := d.(*protocol.VersionResponse); ok {
+		s.dialect, _ = protocol.ParseDialect(vr.Version)
+		atomic.StoreUint32(&s.msize, vr.MaxSize)
+	}
 
-	protocol.Encode(s.RW, d)
+	if uint32(protocol.MessageSize(d, s.dialect)) > s.maxSize() {
+		d = s.errorResponse(tag, protocol.ErrMessageTooLarge)
+	}
+
+	protocol.EncodeDialect(s.RW, d, s.dialect)
 }
 
-// Start starts the server loop
-func (s *Server) Start() error {
-	for {
-		var (
-			size uint32
-			mt   protocol.MessageType
-			err  error
-		)
+// clamp limits the count of reads to what fits in a response within the
+// negotiated maximum message size.
+func (s *Server) clamp(m protocol.Message) {
+	var max uint32
+	if msize := s.maxSize(); msize > protocol.IOHDRSZ {
+		max = msize - protocol.IOHDRSZ
+	}
 
-		if size, mt, err = protocol.DecodeHdr(s.RW); err != nil {
-			return err
+	switch r := m.(type) {
+	case *protocol.ReadRequest:
+		if r.Count > max {
+			r.Count = max
+		}
+	case *protocol.ReadDirRequest:
+		if r.Count > max {
+			r.Count = max
 		}
+	}
+}
 
-		// This LimitedReader is not a necessity, but simply a sanity check.
-		limiter := &io.LimitedReader{R: s.RW, N: int64(size) - protocol.HeaderSize}
+// enter marks a request as active, returning false if the connection is
+// closing.
+func (s *Server) enter() bool {
+	s.pendingLock.Lock()
+	defer s.pendingLock.Unlock()
+	if s.closing {
+		return false
+	}
+	s.active++
+	return true
+}
 
-		switch mt {
-		case protocol.Tversion:
-			r := &protocol.VersionRequest{}
-			if err = r.Decode(limiter); err != nil {
-				return err
-			}
+// leave marks a request as no longer active.
+func (s *Server) leave() {
+	s.pendingLock.Lock()
+	defer s.pendingLock.Unlock()
+	s.active--
+}
 
-			go func(r *protocol.VersionRequest) {
-				tag := r.Tag
-				res, err := s.Handler.Version(r)
-				if res != nil {
-					res.Tag = tag
-				}
-				s.handleResponse(tag, res, err)
-			}(r)
-		case protocol.Tauth:
-			r := &protocol.AuthRequest{}
-			if err = r.Decode(limiter); err != nil {
-				return err
-			}
+// stopped returns a channel that is closed once the connection is closed.
+func (s *Server) stopped() chan struct{} {
+	s.pendingLock.Lock()
+	defer s.pendingLock.Unlock()
+	if s.quit == nil {
+		s.quit = make(chan struct{})
+	}
+	return s.quit
+}
 
-			go func(r *protocol.AuthRequest) {
-				tag := r.Tag
-				res, err := s.Handler.Auth(r)
-				if res != nil {
-					res.Tag = tag
-				}
-				s.handleResponse(tag, res, err)
-			}(r)
-		case protocol.Tattach:
-			r := &protocol.AttachRequest{}
-			if err = r.Decode(limiter); err != nil {
-				return err
-			}
-			go func(r *protocol.AttachRequest) {
-				tag := r.Tag
-				res, err := s.Handler.Attach(r)
-				if res != nil {
-					res.Tag = tag
-				}
-				s.handleResponse(tag, res, err)
-			}(r)
-		case protocol.Tflush:
-			r := &protocol.FlushRequest{}
-			if err = r.Decode(limiter); err != nil {
-				return err
-			}
+// closeLocked closes the connection. The pendingLock must be held.
+func (s *Server) closeLocked() {
+	if s.closing {
+		return
+	}
+	s.closing = true
+	if s.quit == nil {
+		s.quit = make(chan struct{})
+	}
+	close(s.quit)
+	if c, ok := s.RW.(io.Closer); ok {
+		c.Close()
+	}
+}
 
-			// FlushRequest is not handled concurrently to ensure the sequential
-			// behaviour the spec demands
-			//go func(r *protocol.FlushRequest) {
-			tag := r.Tag
-			res, err := s.Handler.Flush(r)
-			if res != nil {
-				res.Tag = tag
-			}
-			s.handleResponse(tag, res, err)
-			//}(r)
-		case protocol.Twalk:
-			r := &protocol.WalkRequest{}
-			if err = r.Decode(limiter); err != nil {
-				return err
-			}
-			go func(r *protocol.WalkRequest) {
-				tag := r.Tag
-				res, err := s.Handler.Walk(r)
-				if res != nil {
-					res.Tag = tag
-				}
-				s.handleResponse(tag, res, err)
-			}(r)
-		case protocol.Topen:
-			r := &protocol.OpenRequest{}
-			if err = r.Decode(limiter); err != nil {
-				return err
-			}
-			go func(r *protocol.OpenRequest) {
-				tag := r.Tag
-				res, err := s.Handler.Open(r)
-				if res != nil {
-					res.Tag = tag
-				}
-				s.handleResponse(tag, res, err)
-			}(r)
-		case protocol.Tcreate:
-			r := &protocol.CreateRequest{}
-			if err = r.Decode(limiter); err != nil {
-				return err
-			}
-			go func(r *protocol.CreateRequest) {
-				tag := r.Tag
-				res, err := s.Handler.Create(r)
-				if res != nil {
-					res.Tag = tag
-				}
-				s.handleResponse(tag, res, err)
-			}(r)
-		case protocol.Tread:
-			r := &protocol.ReadRequest{}
-			if err = r.Decode(limiter); err != nil {
-				return err
+// close closes the connection, regardless of requests being handled.
+func (s *Server) close() {
+	s.pendingLock.Lock()
+	defer s.pendingLock.Unlock()
+	s.closeLocked()
+}
+
+// closeIfIdle closes the connection if no requests are active, and returns
+// whether the connection is closed. The writeLock is held while checking, so
+// that the connection is never closed in the middle of a response.
+func (s *Server) closeIfIdle() bool {
+	s.writeLock.Lock()
+	defer s.writeLock.Unlock()
+	s.pendingLock.Lock()
+	defer s.pendingLock.Unlock()
+
+	if !s.closing && s.active != 0 {
+		return false
+	}
+	s.closeLocked()
+	return true
+}
+
+// acquire waits until req may be handled, as limited by MaxRequests and
+// Limiter. While waiting, flushes are read ahead and served, so that req and
+// the requests holding it up can be flushed, but reading stops at the first
+// frame that is not a flush. The error is that of the context of req if it is
+// flushed, ErrServerClosed if the connection is closed, or that of reading
+// from the connection.
+func (s *Server) acquire(ctx context.Context, req *request) error {
+	if s.sem != nil {
+		if err := s.wait(ctx, req, s.sem); err != nil {
+			return err
+		}
+	}
+	if s.Limiter != nil {
+		if err := s.wait(ctx, req, s.Limiter.sem); err != nil {
+			if s.sem != nil {
+				<-s.sem
 			}
-			go func(r *protocol.ReadRequest) {
-				tag := r.Tag
-				res, err := s.Handler.Read(r)
-				if res != nil {
-					res.Tag = tag
-				}
-				s.handleResponse(tag, res, err)
-			}(r)
-		case protocol.Twrite:
-			r := &protocol.WriteRequest{}
-			if err = r.Decode(limiter); err != nil {
-				return err
+			return err
+		}
+	}
+	return nil
+}
+
+// wait waits for a slot in sem for acquire.
+func (s *Server) wait(ctx context.Context, req *request, sem chan struct{}) error {
+	select {
+	case sem <- struct{}{}:
+		return nil
+	default:
+	}
+
+	quit := s.stopped()
+	for {
+		var next chan frame
+		if s.held == nil {
+			if s.reading == nil {
+				s.reading = make(chan frame, 1)
+				go func(c chan frame, maxSize uint32) {
+					b, err := protocol.ReadFrame(s.RW, maxSize)
+					c <- frame{b: b, err: err}
+				}(s.reading, s.maxSize())
 			}
-			go func(r *protocol.WriteRequest) {
-				tag := r.Tag
-				res, err := s.Handler.Write(r)
-				if res != nil {
-					res.Tag = tag
-				}
-				s.handleResponse(tag, res, err)
-			}(r)
-		case protocol.Tclunk:
-			r := &protocol.ClunkRequest{}
-			if err = r.Decode(limiter); err != nil {
-				return err
+			next = s.reading
+		}
+
+		select {
+		case sem <- struct{}{}:
+			return nil
+		case f := <-next:
+			s.reading = nil
+			if f.err != nil {
+				return f.err
 			}
-			go func(r *protocol.ClunkRequest) {
-				tag := r.Tag
-				res, err := s.Handler.Clunk(r)
-				if res != nil {
-					res.Tag = tag
-				}
-				s.handleResponse(tag, res, err)
-			}(r)
-		case protocol.Tremove:
-			r := &protocol.RemoveRequest{}
-			if err = r.Decode(limiter); err != nil {
-				return err
+			if protocol.MessageType(f.b[4]) != protocol.Tflush {
+				s.held = f.b
+				continue
 			}
-			go func(r *protocol.RemoveRequest) {
-				tag := r.Tag
-				res, err := s.Handler.Remove(r)
-				if res != nil {
-					res.Tag = tag
-				}
-				s.handleResponse(tag, res, err)
-			}(r)
-		case protocol.Tstat:
-			r := &protocol.StatRequest{}
-			if err = r.Decode(limiter); err != nil {
+			if err := s.serveFrame(ctx, f.b); err != nil {
 				return err
 			}
-			go func(r *protocol.StatRequest) {
-				tag := r.Tag
-				res, err := s.Handler.Stat(r)
-				if res != nil {
-					res.Tag = tag
-				}
-				s.handleResponse(tag, res, err)
-			}(r)
-		case protocol.Twstat:
-			r := &protocol.WriteStatRequest{}
-			if err = r.Decode(limiter); err != nil {
-				return err
+		case <-req.ctx.Done():
+			return req.ctx.Err()
+		case <-quit:
+			return ErrServerClosed
+		}
+	}
+}
+
+// readFrame returns the next frame from the connection, which may already
+// have been read ahead by acquire.
+func (s *Server) readFrame() ([]byte, error) {
+	if b := s.held; b != nil {
+		s.held = nil
+		return b, nil
+	}
+	if s.reading != nil {
+		f := <-s.reading
+		s.reading = nil
+		return f.b, f.err
+	}
+	return protocol.ReadFrame(s.RW, s.maxSize())
+}
+
+// release releases what was acquired by acquire.
+func (s *Server) release() {
+	if s.Limiter != nil {
+		<-s.Limiter.sem
+	}
+	if s.sem != nil {
+		<-s.sem
+	}
+}
+
+// begin registers a request in the tag table. ErrTagInUse is returned if a
+// request with the same tag is already being handled.
+func (s *Server) begin(ctx context.Context, m protocol.Message) (*request, error) {
+	s.pendingLock.Lock()
+	defer s.pendingLock.Unlock()
+
+	tag := m.GetTag()
+	if _, exists := s.pending[tag]; exists {
+		return nil, ErrTagInUse
+	}
+
+	_, flush := m.(*protocol.FlushRequest)
+	req := &request{tag: tag, done: make(chan struct{}), flush: flush}
+	req.ctx, req.cancel = context.WithCancel(context.WithValue(ctx, dialectKey{}, s.dialect))
+	s.pending[tag] = req
+	return req, nil
+}
+
+// unregister removes a request from the tag table.
+func (s *Server) unregister(req *request) {
+	s.pendingLock.Lock()
+	defer s.pendingLock.Unlock()
+	if s.pending[req.tag] == req {
+		delete(s.pending, req.tag)
+	}
+}
+
+// finish removes a request from the tag table if it has not been responded
+// to, releases any flushes waiting for it, and marks it as no longer active.
+func (s *Server) finish(req *request) {
+	s.unregister(req)
+	req.cancel()
+	close(req.done)
+	s.leave()
+}
+
+// abort cancels all pending requests, and waits for them to finish.
+func (s *Server) abort() {
+	s.pendingLock.Lock()
+	reqs := make([]*request, 0, len(s.pending))
+	for _, req := range s.pending {
+		req.cancel()
+		reqs = append(reqs, req)
+	}
+	s.pendingLock.Unlock()
+
+	for _, req := range reqs {
+		<-req.done
+	}
+}
+
+// closeHandler closes the handler if it implements io.Closer. The handler is
+// closed in the background once all pending requests have finished.
+func (s *Server) closeHandler() {
+	var h interface{} = s.Handler
+	if s.ContextHandler != nil {
+		h = s.ContextHandler
+	}
+	c, ok := h.(io.Closer)
+	if !ok {
+		return
+	}
+
+	go func() {
+		s.abort()
+		c.Close()
+	}()
+}
+
+// run handles a request that has been registered by begin.
+func (s *Server) run(req *request, m protocol.Message) {
+	defer s.finish(req)
+	if r, ok := m.(*protocol.FlushRequest); ok {
+		s.flush(req, r)
+		return
+	}
+	defer s.release()
+	s.handle(req, m)
+}
+
+// handle dispatches a request to the handler and sends the response. If the
+// request fails after its context has been cancelled, it is considered flushed,
+// and no response is sent.
+func (s *Server) handle(req *request, r protocol.Message) {
+	res, err := s.dispatch(req.ctx, r)
+	if err == nil {
+		res.SetTag(req.tag)
+	} else if req.ctx.Err() != nil {
+		err = ErrFlushed
+	}
+	s.respond(req, res, err)
+}
+
+// flush handles a FlushRequest. The request being flushed has its context
+// cancelled, and the response is not sent until that request has finished,
+// which ensures that any response to it is sent before the response to the
+// flush.
+func (s *Server) flush(req *request, r *protocol.FlushRequest) {
+	if s.ContextHandler == nil {
+		// Handlers without contexts are still notified of the flush, so that
+		// they may abort the request themselves.
+		if _, err := s.Handler.Flush(r); err != nil {
+			s.respond(req, nil, err)
+			return
+		}
+	}
+
+	s.pendingLock.Lock()
+	old, exists := s.pending[r.OldTag]
+	s.pendingLock.Unlock()
+
+	if exists && !old.flush {
+		old.cancel()
+		select {
+		case <-old.done:
+		case <-req.ctx.Done():
+			return
+		}
+	}
+
+	s.respond(req, &protocol.FlushResponse{Tag: r.Tag}, nil)
+}
+
+// dispatch calls the handler method matching the request. A panic in the
+// handler is logged, and fails the request, as done by Recovery.
+func (s *Server) dispatch(ctx context.Context, m protocol.Message) (protocol.Message, error) {
+	return Recovery(s.ErrorLog)(ctx, m, s.call)
+}
+
+// call calls the handler method matching the request.
+func (s *Server) call(ctx context.Context, m protocol.Message) (protocol.Message, error) {
+	// The message types of 9P2000.L precede those of 9P2000.
+	if mt, _ := protocol.MessageToMessageType(m); mt >= protocol.Tversion {
+		res, err := call(ctx, s.handler(), m)
+		if r, ok := m.(*protocol.VersionRequest); ok && err == nil {
+			if vr := res.(*protocol.VersionResponse); vr.MaxSize > r.MaxSize {
+				vr.MaxSize = r.MaxSize
 			}
-			go func(r *protocol.WriteStatRequest) {
-				tag := r.Tag
-				res, err := s.Handler.WriteStat(r)
-				if res != nil {
-					res.Tag = tag
-				}
-				s.handleResponse(tag, res, err)
-			}(r)
-		default:
-			return protocol.ErrUnknownMessageType
+		}
+		return res, err
+	}
+
+	lh, ok := s.linuxHandler()
+	if !ok {
+		return nil, errNotSupported
+	}
+
+	switch r := m.(type) {
+	case *protocol.StatFSRequest:
+		res, err := lh.StatFS(ctx, r)
+		return res, err
+	case *protocol.LinuxOpenRequest:
+		res, err := lh.LinuxOpen(ctx, r)
+		return res, err
+	case *protocol.LinuxCreateRequest:
+		res, err := lh.LinuxCreate(ctx, r)
+		return res, err
+	case *protocol.SymlinkRequest:
+		res, err := lh.Symlink(ctx, r)
+		return res, err
+	case *protocol.MknodRequest:
+		res, err := lh.Mknod(ctx, r)
+		return res, err
+	case *protocol.RenameRequest:
+		res, err := lh.Rename(ctx, r)
+		return res, err
+	case *protocol.ReadLinkRequest:
+		res, err := lh.ReadLink(ctx, r)
+		return res, err
+	case *protocol.GetAttrRequest:
+		res, err := lh.GetAttr(ctx, r)
+		return res, err
+	case *protocol.SetAttrRequest:
+		res, err := lh.SetAttr(ctx, r)
+		return res, err
+	case *protocol.XattrWalkRequest:
+		res, err := lh.XattrWalk(ctx, r)
+		return res, err
+	case *protocol.XattrCreateRequest:
+		res, err := lh.XattrCreate(ctx, r)
+		return res, err
+	case *protocol.ReadDirRequest:
+		res, err := lh.ReadDir(ctx, r)
+		return res, err
+	case *protocol.FsyncRequest:
+		res, err := lh.Fsync(ctx, r)
+		return res, err
+	case *protocol.LockRequest:
+		res, err := lh.Lock(ctx, r)
+		return res, err
+	case *protocol.GetLockRequest:
+		res, err := lh.GetLock(ctx, r)
+		return res, err
+	case *protocol.LinkRequest:
+		res, err := lh.Link(ctx, r)
+		return res, err
+	case *protocol.MkdirRequest:
+		res, err := lh.Mkdir(ctx, r)
+		return res, err
+	case *protocol.RenameAtRequest:
+		res, err := lh.RenameAt(ctx, r)
+		return res, err
+	case *protocol.UnlinkAtRequest:
+		res, err := lh.UnlinkAt(ctx, r)
+		return res, err
+	default:
+		return nil, protocol.ErrUnknownMessageType
+	}
+}
+
+// Start starts the server loop. Messages larger than the negotiated maximum
+// message size are rejected by returning protocol.ErrMessageTooLarge, and
+// reads are clamped to fit within it. All pending requests have their contexts
+// cancelled when Start returns. If the handler implements io.Closer, it is
+// closed once the pending requests have finished.
+//
+// When MaxRequests or the Limiter is exhausted, Start stops reading from the
+// connection until a request finishes. Flushes are exempt from the limits, and
+// are still read while Start is waiting, up to the first request that is not
+// a flush.
+func (s *Server) Start() error {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	defer s.closeHandler()
+
+	s.pendingLock.Lock()
+	s.pending = make(map[protocol.Tag]*request)
+	s.pendingLock.Unlock()
+
+	if s.MaxRequests > 0 {
+		s.sem = make(chan struct{}, s.MaxRequests)
+	}
+
+	for {
+		b, err := s.readFrame()
+		if err != nil {
+			return err
+		}
+		if err := s.serveFrame(ctx, b); err != nil {
+			return err
+		}
+	}
+}
+
+// serveFrame decodes a request and starts handling it, waiting for MaxRequests
+// and the Limiter first unless it is a flush.
+func (s *Server) serveFrame(ctx context.Context, b []byte) error {
+	// The dialect is only changed by this goroutine, so it is safe to read
+	// without holding the writeLock.
+	m, err := protocol.UnmarshalMessage(b, s.dialect)
+	if err != nil {
+		return err
+	}
+
+	if mt, _ := protocol.MessageToMessageType(m); !mt.IsRequest() {
+		return protocol.ErrUnknownMessageType
+	}
+
+	s.clamp(m)
+
+	if !s.enter() {
+		return ErrServerClosed
+	}
+
+	if _, ok := m.(*protocol.VersionRequest); ok {
+		// VersionRequest is not handled concurrently, as the negotiated
+		// dialect must be in effect before the next message is decoded.
+		// A version request also aborts all outstanding requests.
+		s.abort()
+		res, err := s.dispatch(ctx, m)
+		if err == nil {
+			res.SetTag(m.GetTag())
+		}
+		s.handleResponse(m.GetTag(), res, err)
+		s.leave()
+		return nil
+	}
+
+	req, err := s.begin(ctx, m)
+	if err != nil {
+		s.handleResponse(m.GetTag(), nil, err)
+		s.leave()
+		return nil
+	}
+
+	// The request is registered before waiting, so that a flush read in
+	// the meantime finds it.
+	if !req.flush {
+		err := s.acquire(ctx, req)
+		if err != nil && req.ctx.Err() != nil {
+			// The request was flushed while waiting.
+			s.respond(req, nil, ErrFlushed)
+			s.finish(req)
+			return nil
+		}
+		if err != nil {
+			s.finish(req)
+			return err
 		}
 	}
+
+	// Flushes are handled concurrently even for sequential servers, as a
+	// flush read ahead by acquire waits for the request acquire is waiting
+	// for.
+	if s.Sequential && !req.flush {
+		s.run(req, m)
+	} else {
+		go s.run(req, m)
+	}
+	return nil
 }
 
 // Serve serves a ReadWriter with the given handler. Serve does not return
@@ -234,7 +704,19 @@ func Serve(rw io.ReadWriter, handler Handler) error {
 		Handler: handler,
 		RW:      rw,
 	}
+	return s.serve()
+}
 
+// ServeContext is like Serve, but for a ContextHandler.
+func ServeContext(rw io.ReadWriter, handler ContextHandler) error {
+	s := Server{
+		ContextHandler: handler,
+		RW:             rw,
+	}
+	return s.serve()
+}
+
+func (s *Server) serve() error {
 	err := s.Start()
 	if c, ok := s.RW.(io.Closer); ok {
 		c.Close()
@@ -243,13 +725,15 @@ func Serve(rw io.ReadWriter, handler Handler) error {
 }
 
 // ServeListener accepts connections, calls the provided function to retrieve a
-// new handler, calling Serve with the connection and handler.
+// new handler, calling Serve with the connection and handler. Errors ending a
+// connection are logged. Use ListenServer for control over shutdown.
 func ServeListener(l net.Listener, handler func() Handler) error {
-	for {
-		conn, err := l.Accept()
-		if err != nil {
-			return err
-		}
-		go Serve(conn, handler())
-	}
+	ls := ListenServer{Handler: handler}
+	return ls.Serve(l)
+}
+
+// ServeListenerContext is like ServeListener, but for ContextHandlers.
+func ServeListenerContext(l net.Listener, handler func() ContextHandler) error {
+	ls := ListenServer{ContextHandler: handler}
+	return ls.Serve(l)
 }
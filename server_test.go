@@ -0,0 +1,225 @@
+package g9p
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/fs"
+	"log"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/kennylevinsen/g9p/p9err"
+	"github.com/kennylevinsen/g9p/protocol"
+)
+
+// flushHandler is a handler whose reads block until flushed. Reads at offset
+// 0 then fail, while reads at other offsets succeed anyway.
+type flushHandler struct {
+	ContextHandler
+}
+
+func (flushHandler) Version(_ context.Context, r *protocol.VersionRequest) (*protocol.VersionResponse, error) {
+	return &protocol.VersionResponse{MaxSize: r.MaxSize, Version: r.Version}, nil
+}
+
+func (flushHandler) Stat(context.Context, *protocol.StatRequest) (*protocol.StatResponse, error) {
+	return &protocol.StatResponse{Stat: protocol.Stat{Name: "file"}}, nil
+}
+
+func (flushHandler) Read(ctx context.Context, r *protocol.ReadRequest) (*protocol.ReadResponse, error) {
+	<-ctx.Done()
+	if r.Offset == 0 {
+		return nil, ctx.Err()
+	}
+	return &protocol.ReadResponse{Data: []byte("late")}, nil
+}
+
+// serverConn is the client end of a connection to a Server, speaking raw
+// messages.
+type serverConn struct {
+	t    *testing.T
+	conn net.Conn
+}
+
+// newServerConn serves a connection with s, and negotiates the version.
+func newServerConn(t *testing.T, s *Server) *serverConn {
+	a, b := net.Pipe()
+	s.RW = a
+	go s.serve()
+	t.Cleanup(func() { b.Close() })
+
+	sc := &serverConn{t: t, conn: b}
+	sc.send(&protocol.VersionRequest{Tag: protocol.NOTAG, MaxSize: 8192, Version: protocol.Version9P2000})
+	sc.receive()
+	return sc
+}
+
+func (sc *serverConn) send(m protocol.Message) {
+	if err := protocol.Encode(sc.conn, m); err != nil {
+		sc.t.Fatalf("send failed: %v", err)
+	}
+}
+
+func (sc *serverConn) receive() protocol.Message {
+	sc.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	m, err := protocol.Decode(sc.conn)
+	if err != nil {
+		sc.t.Fatalf("receive failed: %v", err)
+	}
+	return m
+}
+
+func TestServerFlush(t *testing.T) {
+	sc := newServerConn(t, &Server{ContextHandler: flushHandler{}})
+
+	// A flushed request that fails gets no response.
+	sc.send(&protocol.ReadRequest{Tag: 1})
+	sc.send(&protocol.FlushRequest{Tag: 2, OldTag: 1})
+	if m, ok := sc.receive().(*protocol.FlushResponse); !ok || m.Tag != 2 {
+		t.Fatalf("expected flush response with tag 2, got %v", m)
+	}
+
+	// A flushed request that succeeds anyway is responded to before the
+	// flush.
+	sc.send(&protocol.ReadRequest{Tag: 1, Offset: 1})
+	sc.send(&protocol.FlushRequest{Tag: 2, OldTag: 1})
+	if m, ok := sc.receive().(*protocol.ReadResponse); !ok || m.Tag != 1 {
+		t.Fatalf("expected read response with tag 1, got %v", m)
+	}
+	if m, ok := sc.receive().(*protocol.FlushResponse); !ok || m.Tag != 2 {
+		t.Fatalf("expected flush response with tag 2, got %v", m)
+	}
+
+	// Flushing an unknown tag responds right away.
+	sc.send(&protocol.FlushRequest{Tag: 2, OldTag: 1})
+	if m, ok := sc.receive().(*protocol.FlushResponse); !ok || m.Tag != 2 {
+		t.Fatalf("expected flush response with tag 2, got %v", m)
+	}
+}
+
+func TestServerTags(t *testing.T) {
+	sc := newServerConn(t, &Server{ContextHandler: flushHandler{}})
+
+	// Tags of pending requests cannot be reused.
+	sc.send(&protocol.ReadRequest{Tag: 1})
+	sc.send(&protocol.StatRequest{Tag: 1})
+	if m, ok := sc.receive().(*protocol.ErrorResponse); !ok || m.Tag != 1 || m.Error != ErrTagInUse.Error() {
+		t.Fatalf("expected tag in use error, got %v", m)
+	}
+	sc.send(&protocol.FlushRequest{Tag: 2, OldTag: 1})
+	sc.receive()
+
+	// Tags can be reused as soon as their response is received.
+	for i := 0; i < 100; i++ {
+		sc.send(&protocol.StatRequest{Tag: 1})
+		if m, ok := sc.receive().(*protocol.StatResponse); !ok || m.Tag != 1 {
+			t.Fatalf("request %d: expected stat response with tag 1, got %v", i, m)
+		}
+	}
+}
+
+func TestServerLimitFlush(t *testing.T) {
+	sc := newServerConn(t, &Server{ContextHandler: flushHandler{}, MaxRequests: 1})
+
+	// Requests waiting for their turn can be flushed, as can the request
+	// holding them up.
+	sc.send(&protocol.ReadRequest{Tag: 1})
+	sc.send(&protocol.ReadRequest{Tag: 2})
+	sc.send(&protocol.FlushRequest{Tag: 3, OldTag: 2})
+	if m, ok := sc.receive().(*protocol.FlushResponse); !ok || m.Tag != 3 {
+		t.Fatalf("expected flush response with tag 3, got %v", m)
+	}
+	sc.send(&protocol.FlushRequest{Tag: 3, OldTag: 1})
+	if m, ok := sc.receive().(*protocol.FlushResponse); !ok || m.Tag != 3 {
+		t.Fatalf("expected flush response with tag 3, got %v", m)
+	}
+
+	// The slot is free again once the request holding it is flushed.
+	sc.send(&protocol.StatRequest{Tag: 1})
+	if m, ok := sc.receive().(*protocol.StatResponse); !ok || m.Tag != 1 {
+		t.Fatalf("expected stat response with tag 1, got %v", m)
+	}
+}
+
+func TestServerLimit(t *testing.T) {
+	sc := newServerConn(t, &Server{ContextHandler: flushHandler{}, MaxRequests: 1})
+
+	// Once a request is waiting for its turn, and the request after it has
+	// been read ahead, no more requests are read.
+	sc.send(&protocol.ReadRequest{Tag: 1})
+	sc.send(&protocol.ReadRequest{Tag: 2})
+	sc.send(&protocol.StatRequest{Tag: 3})
+	sc.conn.SetWriteDeadline(time.Now().Add(50 * time.Millisecond))
+	err := protocol.Encode(sc.conn, &protocol.StatRequest{Tag: 4})
+	if ne, ok := err.(net.Error); !ok || !ne.Timeout() {
+		t.Fatalf("send beyond the limit returned %v, expected a timeout", err)
+	}
+}
+
+// linuxFlushHandler is a flushHandler that also serves 9P2000.L, with StatFS
+// blocking until flushed. Other 9P2000.L requests are not supported.
+type linuxFlushHandler struct {
+	flushHandler
+	LinuxContextHandler
+}
+
+func (linuxFlushHandler) StatFS(ctx context.Context, _ *protocol.StatFSRequest) (*protocol.StatFSResponse, error) {
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+func TestServerLinuxFlush(t *testing.T) {
+	sc := newServerConn(t, &Server{ContextHandler: linuxFlushHandler{}})
+	sc.send(&protocol.VersionRequest{Tag: protocol.NOTAG, MaxSize: 8192, Version: protocol.Version9P2000L})
+	if m, ok := sc.receive().(*protocol.VersionResponse); !ok || m.Version != protocol.Version9P2000L {
+		t.Fatalf("expected version response for %s, got %v", protocol.Version9P2000L, m)
+	}
+
+	// 9P2000.L requests receive the context of the request, and can be
+	// flushed.
+	sc.send(&protocol.StatFSRequest{Tag: 1})
+	sc.send(&protocol.FlushRequest{Tag: 2, OldTag: 1})
+	if m, ok := sc.receive().(*protocol.FlushResponse); !ok || m.Tag != 2 {
+		t.Fatalf("expected flush response with tag 2, got %v", m)
+	}
+}
+
+// walkHandler is a panicHandler whose walks fail with the given error.
+type walkHandler struct {
+	panicHandler
+	err error
+}
+
+func (h walkHandler) Walk(context.Context, *protocol.WalkRequest) (*protocol.WalkResponse, error) {
+	return nil, h.err
+}
+
+func TestServerErrors(t *testing.T) {
+	a, b := net.Pipe()
+	s := &Server{
+		ContextHandler: walkHandler{err: &Error{Err: "file does not exist"}},
+		RW:             a,
+		ErrorLog:       log.New(io.Discard, "", 0),
+	}
+	go s.serve()
+	c := NewClient(b)
+	go c.Start()
+	defer c.Stop()
+
+	if _, err := c.Version(&protocol.VersionRequest{Tag: protocol.NOTAG, MaxSize: 8192, Version: protocol.Version9P2000}); err != nil {
+		t.Fatalf("version failed: %v", err)
+	}
+
+	// Error strings are mapped to canonical errors.
+	_, err := c.Walk(&protocol.WalkRequest{})
+	if err != p9err.ErrNotExist || !errors.Is(err, fs.ErrNotExist) {
+		t.Fatalf("walk returned %v, expected %v", err, p9err.ErrNotExist)
+	}
+
+	// Panics fail the request without taking down the server.
+	if _, err := c.Read(&protocol.ReadRequest{}); err == nil || err.Error() != errInternal.Err {
+		t.Fatalf("read returned %v, expected %v", err, errInternal)
+	}
+}
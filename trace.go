@@ -0,0 +1,114 @@
+package g9p
+
+import (
+	"io"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/kennylevinsen/g9p/protocol"
+)
+
+// Tracer is an io.ReadWriter logging the 9P messages read from and written to
+// an underlying ReadWriter, such as a network connection, in the format of
+// their String methods. Responses are logged along with the time since their
+// request, so a Tracer may be used on either side of a connection:
+//
+//	c := g9p.NewClient(g9p.NewTracer(conn, nil))
+//
+// The dialect used to decode messages follows the version negotiated on the
+// connection. Traffic that cannot be decoded is logged as such, but is passed
+// on unchanged.
+type Tracer struct {
+	rw  io.ReadWriter
+	log *log.Logger
+
+	// read and written split the data read and written into messages. They
+	// are protected by readLock and writeLock, respectively.
+	readLock  sync.Mutex
+	read      protocol.FrameSplitter
+	writeLock sync.Mutex
+	written   protocol.FrameSplitter
+
+	// mu protects the dialect and the start times of requests in flight.
+	mu      sync.Mutex
+	dialect protocol.Dialect
+	started map[protocol.Tag]time.Time
+}
+
+// NewTracer returns a Tracer logging the messages passing through rw to l. If
+// l is nil, the log package's standard logger is used, which timestamps every
+// message.
+func NewTracer(rw io.ReadWriter, l *log.Logger) *Tracer {
+	return &Tracer{
+		rw:      rw,
+		log:     l,
+		started: make(map[protocol.Tag]time.Time),
+	}
+}
+
+func (t *Tracer) Read(p []byte) (int, error) {
+	n, err := t.rw.Read(p)
+	if n > 0 {
+		t.readLock.Lock()
+		t.trace(&t.read, p[:n], "<-")
+		t.readLock.Unlock()
+	}
+	return n, err
+}
+
+// Write writes to the underlying ReadWriter. Messages are logged before they
+// are written, as the response may otherwise be read before the request has
+// been logged.
+func (t *Tracer) Write(p []byte) (int, error) {
+	t.writeLock.Lock()
+	t.trace(&t.written, p, "->")
+	t.writeLock.Unlock()
+	return t.rw.Write(p)
+}
+
+// Close closes the underlying ReadWriter if it implements io.Closer.
+func (t *Tracer) Close() error {
+	if c, ok := t.rw.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
+
+// trace logs the messages completed by data.
+func (t *Tracer) trace(s *protocol.FrameSplitter, data []byte, dir string) {
+	if err := s.Split(data, func(b []byte) { t.message(b, dir) }); err != nil {
+		logf(t.log, "g9p: %s bad frame size", dir)
+	}
+}
+
+// message logs a single frame.
+func (t *Tracer) message(b []byte, dir string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	m, err := protocol.UnmarshalMessage(b, t.dialect)
+	if err != nil {
+		logf(t.log, "g9p: %s undecodable message type %d: %v", dir, b[4], err)
+		return
+	}
+
+	now := time.Now()
+	tag := m.GetTag()
+	mt, _ := protocol.MessageToMessageType(m)
+	if mt.IsRequest() {
+		t.started[tag] = now
+		logf(t.log, "g9p: %s %v", dir, m)
+		return
+	}
+
+	if vr, ok := m.(*protocol.VersionResponse); ok {
+		t.dialect, _ = protocol.ParseDialect(vr.Version)
+	}
+	if start, ok := t.started[tag]; ok {
+		delete(t.started, tag)
+		logf(t.log, "g9p: %s %v (%v)", dir, m, now.Sub(start))
+		return
+	}
+	logf(t.log, "g9p: %s %v", dir, m)
+}
@@ -0,0 +1,40 @@
+package g9p
+
+import (
+	"bytes"
+	"log"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/kennylevinsen/g9p/protocol"
+)
+
+func TestTracer(t *testing.T) {
+	var buf bytes.Buffer
+	a, b := net.Pipe()
+	go ServeContext(a, statHandler{})
+	c := NewClient(NewTracer(b, log.New(&buf, "", 0)))
+	go c.Start()
+
+	if _, err := c.Version(&protocol.VersionRequest{Tag: protocol.NOTAG, MaxSize: 8192, Version: protocol.Version9P2000}); err != nil {
+		t.Fatalf("version failed: %v", err)
+	}
+	if _, err := c.Stat(&protocol.StatRequest{Tag: 1, Fid: 2}); err != nil {
+		t.Fatalf("stat failed: %v", err)
+	}
+
+	// Stopping the client closes the connection through the Tracer.
+	c.Stop()
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 4 {
+		t.Fatalf("expected 4 lines, got %q", lines)
+	}
+	if lines[2] != "g9p: -> Tstat tag 1 fid 2" {
+		t.Errorf("unexpected request line %q", lines[2])
+	}
+	if !strings.HasPrefix(lines[3], "g9p: <- Rstat tag 1 stat 'file' ") || !strings.HasSuffix(lines[3], "s)") {
+		t.Errorf("unexpected response line %q", lines[3])
+	}
+}
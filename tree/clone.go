@@ -0,0 +1,245 @@
+package tree
+
+import (
+	"context"
+	"sort"
+	"strconv"
+	"sync"
+
+	"github.com/kennylevinsen/g9p/protocol"
+)
+
+// CloneDir is a directory of numbered connection directories in the style of
+// /net/tcp. Opening its clone file allocates a new directory, numbered with
+// the lowest free number, whose files are created by New. The open clone
+// file then acts as the ctl file of the new directory: reading it returns
+// the number of the directory, and writes are passed on to the ctl file of
+// the directory, if it has one.
+//
+// A directory lives for as long as it is referenced by the open clone file,
+// or by fids referring to the directory or the files within it. Once the last
+// reference is gone, Release is called and the directory disappears.
+type CloneDir struct {
+	Name string
+
+	// Perm is the permissions of the directory and the numbered
+	// directories. If zero, 0555 is used. The clone file may be read and
+	// written by those who may read the directory.
+	Perm protocol.FileMode
+
+	// New creates the files of a new directory.
+	New func(ctx context.Context, n int) ([]Node, error)
+
+	// Release, if set, is called once a directory is no longer in use.
+	Release func(n int)
+
+	mu    sync.Mutex
+	clone *cloneFile
+	convs map[int]*conv
+}
+
+func (d *CloneDir) perm() protocol.FileMode {
+	if d.Perm == 0 {
+		return 0555
+	}
+	return d.Perm
+}
+
+func (d *CloneDir) Stat(context.Context) (protocol.Stat, error) {
+	return protocol.Stat{Name: d.Name, Mode: d.perm()}, nil
+}
+
+// cloneFile returns the clone file. The same node is always returned, as
+// nodes are identified by their value.
+func (d *CloneDir) cloneFile() *cloneFile {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.clone == nil {
+		d.clone = &cloneFile{dir: d}
+	}
+	return d.clone
+}
+
+func (d *CloneDir) Walk(_ context.Context, name string) (Node, error) {
+	if name == "clone" {
+		return d.cloneFile(), nil
+	}
+
+	n, err := strconv.Atoi(name)
+	if err != nil || strconv.Itoa(n) != name {
+		return nil, ErrNotExist
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	c, exists := d.convs[n]
+	if !exists || !c.ready {
+		return nil, ErrNotExist
+	}
+	return c, nil
+}
+
+// Children lists the clone file followed by the directories in order.
+func (d *CloneDir) Children(context.Context) ([]Node, error) {
+	clone := d.cloneFile()
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	convs := make([]*conv, 0, len(d.convs))
+	for _, c := range d.convs {
+		if c.ready {
+			convs = append(convs, c)
+		}
+	}
+	sort.Slice(convs, func(i, j int) bool { return convs[i].n < convs[j].n })
+
+	children := []Node{clone}
+	for _, c := range convs {
+		children = append(children, c)
+	}
+	return children, nil
+}
+
+// alloc allocates a new directory, holding a single reference.
+func (d *CloneDir) alloc(ctx context.Context) (*conv, error) {
+	d.mu.Lock()
+	if d.convs == nil {
+		d.convs = make(map[int]*conv)
+	}
+	n := 0
+	for d.convs[n] != nil {
+		n++
+	}
+	c := &conv{dir: d, n: n, refs: 1}
+	d.convs[n] = c
+	d.mu.Unlock()
+
+	// The number is reserved while New runs, but the directory cannot be
+	// walked to until it is ready.
+	children, err := d.New(ctx, n)
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if err != nil {
+		delete(d.convs, n)
+		return nil, err
+	}
+	c.children = children
+	c.ready = true
+	return c, nil
+}
+
+// conv is a numbered directory of a CloneDir.
+type conv struct {
+	dir      *CloneDir
+	n        int
+	children []Node
+
+	// ready, refs and released are protected by the mutex of the CloneDir.
+	ready    bool
+	refs     int
+	released bool
+}
+
+func (c *conv) Stat(context.Context) (protocol.Stat, error) {
+	return protocol.Stat{Name: strconv.Itoa(c.n), Mode: c.dir.perm()}, nil
+}
+
+func (c *conv) Walk(ctx context.Context, name string) (Node, error) {
+	for _, n := range c.children {
+		if s, err := n.Stat(ctx); err == nil && s.Name == name {
+			return n, nil
+		}
+	}
+	return nil, ErrNotExist
+}
+
+func (c *conv) Children(context.Context) ([]Node, error) {
+	return c.children, nil
+}
+
+func (c *conv) Ref() {
+	c.dir.mu.Lock()
+	defer c.dir.mu.Unlock()
+	if !c.released {
+		c.refs++
+	}
+}
+
+func (c *conv) Unref() {
+	c.dir.mu.Lock()
+	if c.released {
+		c.dir.mu.Unlock()
+		return
+	}
+	c.refs--
+	if c.refs > 0 {
+		c.dir.mu.Unlock()
+		return
+	}
+	c.released = true
+	delete(c.dir.convs, c.n)
+	c.dir.mu.Unlock()
+
+	if c.dir.Release != nil {
+		c.dir.Release(c.n)
+	}
+}
+
+// cloneFile is the clone file of a CloneDir.
+type cloneFile struct {
+	dir *CloneDir
+}
+
+func (f *cloneFile) Stat(context.Context) (protocol.Stat, error) {
+	read := f.dir.perm() & 0444
+	return protocol.Stat{Name: "clone", Mode: read | read>>1}, nil
+}
+
+func (f *cloneFile) Open(ctx context.Context, mode protocol.OpenMode) (Handle, error) {
+	c, err := f.dir.alloc(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	h := &cloneHandle{
+		snapshot: snapshot(strconv.Itoa(c.n)),
+		conv:     c,
+	}
+	if writes(mode) {
+		if ctl, err := c.Walk(ctx, "ctl"); err == nil {
+			if file, ok := ctl.(File); ok {
+				if h.ctl, err = file.Open(ctx, protocol.OWRITE); err != nil {
+					c.Unref()
+					return nil, err
+				}
+			}
+		}
+	}
+	return h, nil
+}
+
+// cloneHandle is an open clone file, holding a reference to its directory.
+type cloneHandle struct {
+	snapshot
+	conv *conv
+
+	// ctl is the open ctl file of the directory, if any.
+	ctl Handle
+}
+
+func (h *cloneHandle) Write(ctx context.Context, p []byte, offset int64) (int, error) {
+	if h.ctl == nil {
+		return 0, ErrPermission
+	}
+	return h.ctl.Write(ctx, p, offset)
+}
+
+func (h *cloneHandle) Close() error {
+	var err error
+	if h.ctl != nil {
+		err = h.ctl.Close()
+	}
+	h.conv.Unref()
+	return err
+}
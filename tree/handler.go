@@ -0,0 +1,377 @@
+package tree
+
+import (
+	"context"
+	"encoding/binary"
+	"sync"
+	"sync/atomic"
+
+	"github.com/kennylevinsen/g9p"
+	"github.com/kennylevinsen/g9p/protocol"
+)
+
+// state is the per-fid state of a tree connection.
+type state struct {
+	// path holds the nodes from the root to the current node.
+	path []Node
+
+	// handle is the handle of an opened file.
+	handle Handle
+
+	// dirLock protects the directory read state.
+	dirLock sync.Mutex
+
+	// dir holds the packed stats of an opened directory, as read from offset
+	// 0, and listed the nodes they describe, which are held by the tree.
+	// dirOffset is the offset the next directory read must start at.
+	dir       []byte
+	listed    []Node
+	dirOffset uint64
+}
+
+func (s *state) node() Node {
+	return s.path[len(s.path)-1]
+}
+
+// ref marks the nodes of a path as in use by a fid, holding them in the tree
+// and referencing those that implement Referenced.
+func (c *conn) ref(path []Node) {
+	for _, n := range path {
+		c.tree.hold(n)
+		if r, ok := n.(Referenced); ok {
+			r.Ref()
+		}
+	}
+}
+
+// release releases nodes held in the tree.
+func (c *conn) release(nodes []Node) {
+	for _, n := range nodes {
+		c.tree.release(n)
+	}
+}
+
+// unref releases the references taken by ref.
+func (c *conn) unref(path []Node) {
+	for _, n := range path {
+		if r, ok := n.(Referenced); ok {
+			r.Unref()
+		}
+		c.tree.release(n)
+	}
+}
+
+// server is the ContextHandler serving a single connection.
+type server struct {
+	*g9p.FidServer[*state]
+	conn *conn
+}
+
+func (s *server) Version(ctx context.Context, r *protocol.VersionRequest) (*protocol.VersionResponse, error) {
+	res, err := s.FidServer.Version(ctx, r)
+	if err == nil {
+		atomic.StoreUint32(&s.conn.msize, res.MaxSize)
+	}
+	return res, err
+}
+
+// conn is the FidHandler of a single connection.
+type conn struct {
+	tree *Tree
+
+	// msize is the negotiated maximum message size. It is accessed
+	// atomically.
+	msize uint32
+}
+
+// iounit returns the I/O unit for the connection.
+func (c *conn) iounit() uint32 {
+	if msize := atomic.LoadUint32(&c.msize); msize > protocol.IOHDRSZ {
+		return msize - protocol.IOHDRSZ
+	}
+	return 0
+}
+
+func withUser(ctx context.Context, fid *g9p.Fid[*state]) context.Context {
+	return context.WithValue(ctx, userKey{}, fid.User)
+}
+
+func (c *conn) Auth(context.Context, *g9p.Fid[*state], *protocol.AuthRequest) (*protocol.AuthResponse, error) {
+	return nil, ErrNoAuth
+}
+
+func (c *conn) Attach(ctx context.Context, fid, _ *g9p.Fid[*state], r *protocol.AttachRequest) (*protocol.AttachResponse, error) {
+	// The root is held while its qid is taken, so that it keeps the qid
+	// path once referenced by the fid.
+	c.tree.hold(c.tree.root)
+	defer c.tree.release(c.tree.root)
+
+	qid, err := c.tree.qid(withUser(ctx, fid), c.tree.root)
+	if err != nil {
+		return nil, err
+	}
+
+	fid.Value = &state{path: []Node{c.tree.root}}
+	c.ref(fid.Value.path)
+	return &protocol.AttachResponse{Qid: qid}, nil
+}
+
+func (c *conn) Walk(ctx context.Context, fid, newfid *g9p.Fid[*state], r *protocol.WalkRequest) (*protocol.WalkResponse, error) {
+	ctx = withUser(ctx, fid)
+
+	// The walked nodes are held while walking, so that the qids returned
+	// match those of the nodes once referenced by newfid.
+	var held []Node
+	defer func() { c.release(held) }()
+
+	path := append([]Node(nil), fid.Value.path...)
+	qids := make([]protocol.Qid, 0, len(r.Names))
+	for i, name := range r.Names {
+		d, ok := path[len(path)-1].(Dir)
+		if !ok {
+			if i == 0 {
+				return nil, ErrNotDir
+			}
+			break
+		}
+
+		var n Node
+		if name == ".." {
+			if len(path) > 1 {
+				path = path[:len(path)-1]
+			}
+			n = path[len(path)-1]
+		} else {
+			var err error
+			if n, err = d.Walk(ctx, name); err != nil {
+				if i == 0 {
+					return nil, err
+				}
+				break
+			}
+			path = append(path, n)
+		}
+
+		c.tree.hold(n)
+		held = append(held, n)
+		qid, err := c.tree.qid(ctx, n)
+		if err != nil {
+			if i == 0 {
+				return nil, err
+			}
+			break
+		}
+		qids = append(qids, qid)
+	}
+
+	newfid.Value = &state{path: path}
+	if len(qids) == len(r.Names) {
+		// newfid is only registered, and eventually clunked, if the walk
+		// is complete.
+		c.ref(path)
+	}
+	return &protocol.WalkResponse{Qids: qids}, nil
+}
+
+// open opens a node, storing the handle in the state.
+func (c *conn) open(ctx context.Context, s *state, mode protocol.OpenMode) error {
+	switch n := s.node().(type) {
+	case File:
+		h, err := n.Open(ctx, mode)
+		if err != nil {
+			return err
+		}
+		s.handle = h
+	case Dir:
+		if writes(mode) {
+			return ErrIsDir
+		}
+	default:
+		return ErrPermission
+	}
+	return nil
+}
+
+func (c *conn) Open(ctx context.Context, fid *g9p.Fid[*state], r *protocol.OpenRequest) (*protocol.OpenResponse, error) {
+	ctx = withUser(ctx, fid)
+
+	qid, err := c.tree.qid(ctx, fid.Value.node())
+	if err != nil {
+		return nil, err
+	}
+	if err := c.open(ctx, fid.Value, r.Mode); err != nil {
+		return nil, err
+	}
+	return &protocol.OpenResponse{Qid: qid, IOUnit: c.iounit()}, nil
+}
+
+func (c *conn) Create(ctx context.Context, fid *g9p.Fid[*state], r *protocol.CreateRequest) (*protocol.CreateResponse, error) {
+	ctx = withUser(ctx, fid)
+
+	if _, ok := fid.Value.node().(Dir); !ok {
+		return nil, ErrNotDir
+	}
+	cr, ok := fid.Value.node().(Creator)
+	if !ok {
+		return nil, ErrPermission
+	}
+	if r.Name == "." || r.Name == ".." {
+		return nil, ErrPermission
+	}
+
+	n, err := cr.Create(ctx, r.Name, r.Permissions, r.Mode)
+	if err != nil {
+		return nil, err
+	}
+
+	c.tree.hold(n)
+	defer c.tree.release(n)
+
+	s := &state{path: append(fid.Value.path[:len(fid.Value.path):len(fid.Value.path)], n)}
+	qid, err := c.tree.qid(ctx, n)
+	if err != nil {
+		return nil, err
+	}
+	if err := c.open(ctx, s, r.Mode); err != nil {
+		return nil, err
+	}
+
+	c.ref(s.path)
+	c.unref(fid.Value.path)
+	fid.Value = s
+	return &protocol.CreateResponse{Qid: qid, IOUnit: c.iounit()}, nil
+}
+
+func (c *conn) Read(ctx context.Context, fid *g9p.Fid[*state], r *protocol.ReadRequest) (*protocol.ReadResponse, error) {
+	ctx = withUser(ctx, fid)
+	s := fid.Value
+
+	if s.handle != nil {
+		b := make([]byte, r.Count)
+		n, err := s.handle.Read(ctx, b, int64(r.Offset))
+		if err != nil {
+			return nil, err
+		}
+		return &protocol.ReadResponse{Data: b[:n]}, nil
+	}
+
+	d, ok := s.node().(Dir)
+	if !ok {
+		return nil, ErrPermission
+	}
+
+	s.dirLock.Lock()
+	defer s.dirLock.Unlock()
+
+	if r.Offset == 0 {
+		children, err := d.Children(ctx)
+		if err != nil {
+			return nil, err
+		}
+
+		c.release(s.listed)
+		s.dir, s.listed = nil, nil
+		for _, child := range children {
+			c.tree.hold(child)
+			s.listed = append(s.listed, child)
+			st, err := c.tree.stat(ctx, child)
+			if err != nil {
+				return nil, err
+			}
+			s.dir = st.MarshalAppendDialect(s.dir, g9p.Dialect(ctx))
+		}
+		s.dirOffset = 0
+	} else if r.Offset != s.dirOffset {
+		return nil, ErrBadOffset
+	}
+
+	// Only whole stats are returned.
+	rest := s.dir[s.dirOffset:]
+	var n uint32
+	for int(n)+2 <= len(rest) {
+		size := 2 + uint32(binary.LittleEndian.Uint16(rest[n:]))
+		if n+size > r.Count {
+			break
+		}
+		n += size
+	}
+	if n == 0 && len(rest) > 0 {
+		return nil, ErrShortRead
+	}
+
+	s.dirOffset += uint64(n)
+	return &protocol.ReadResponse{Data: rest[:n:n]}, nil
+}
+
+func (c *conn) Write(ctx context.Context, fid *g9p.Fid[*state], r *protocol.WriteRequest) (*protocol.WriteResponse, error) {
+	ctx = withUser(ctx, fid)
+	s := fid.Value
+
+	if s.handle == nil {
+		return nil, ErrIsDir
+	}
+
+	n, err := s.handle.Write(ctx, r.Data, int64(r.Offset))
+	if err != nil {
+		return nil, err
+	}
+	return &protocol.WriteResponse{Count: uint32(n)}, nil
+}
+
+// remove removes the current node of a state from its parent directory.
+func (c *conn) remove(ctx context.Context, s *state) error {
+	if len(s.path) < 2 {
+		return ErrPermission
+	}
+
+	n := s.node()
+	rm, ok := s.path[len(s.path)-2].(Remover)
+	if !ok {
+		return ErrPermission
+	}
+
+	st, err := n.Stat(ctx)
+	if err != nil {
+		return err
+	}
+	return rm.Remove(ctx, st.Name)
+}
+
+func (c *conn) Remove(ctx context.Context, fid *g9p.Fid[*state], r *protocol.RemoveRequest) error {
+	return c.remove(withUser(ctx, fid), fid.Value)
+}
+
+func (c *conn) Stat(ctx context.Context, fid *g9p.Fid[*state], r *protocol.StatRequest) (*protocol.StatResponse, error) {
+	st, err := c.tree.stat(withUser(ctx, fid), fid.Value.node())
+	if err != nil {
+		return nil, err
+	}
+	return &protocol.StatResponse{Stat: st}, nil
+}
+
+func (c *conn) WriteStat(ctx context.Context, fid *g9p.Fid[*state], r *protocol.WriteStatRequest) (*protocol.WriteStatResponse, error) {
+	sw, ok := fid.Value.node().(StatWriter)
+	if !ok {
+		return nil, ErrPermission
+	}
+	if err := sw.WriteStat(withUser(ctx, fid), r.Stat); err != nil {
+		return nil, err
+	}
+	return &protocol.WriteStatResponse{}, nil
+}
+
+func (c *conn) Clunk(fid *g9p.Fid[*state]) {
+	s := fid.Value
+	if s == nil {
+		return
+	}
+
+	if s.handle != nil {
+		s.handle.Close()
+	}
+	if fid.Opened && fid.Mode&protocol.ORCLOSE != 0 {
+		c.remove(withUser(context.Background(), fid), s)
+	}
+	c.release(s.listed)
+	c.unref(s.path)
+}
@@ -0,0 +1,254 @@
+package tree
+
+import (
+	"context"
+	"strings"
+	"sync"
+
+	"github.com/kennylevinsen/g9p/protocol"
+)
+
+// Ctl is a control file in the style of Plan 9 devices, accepting text
+// commands. Every non-empty line written to the file is passed to Command.
+// Offsets are ignored, and a write fails with the error of the first failing
+// command, after the commands preceding it have been executed.
+//
+// If Status is set, the file may also be read, returning the content rendered
+// by Status when the file was opened.
+type Ctl struct {
+	Name string
+
+	// Perm is the permissions of the file. If zero, 0220 is used, or 0660
+	// if Status is set.
+	Perm protocol.FileMode
+
+	// Command executes a command.
+	Command func(ctx context.Context, cmd string) error
+
+	// Status renders the content of the file.
+	Status func(ctx context.Context) ([]byte, error)
+}
+
+func (c *Ctl) Stat(context.Context) (protocol.Stat, error) {
+	perm := c.Perm
+	if perm == 0 {
+		perm = 0220
+		if c.Status != nil {
+			perm = 0660
+		}
+	}
+	return protocol.Stat{Name: c.Name, Mode: perm}, nil
+}
+
+func (c *Ctl) Open(ctx context.Context, mode protocol.OpenMode) (Handle, error) {
+	if reads(mode) && c.Status == nil {
+		return nil, ErrPermission
+	}
+
+	h := &ctlHandle{ctl: c}
+	if reads(mode) {
+		b, err := c.Status(ctx)
+		if err != nil {
+			return nil, err
+		}
+		h.snapshot = snapshot(b)
+	}
+	return h, nil
+}
+
+type ctlHandle struct {
+	snapshot
+	ctl *Ctl
+}
+
+func (h *ctlHandle) Write(ctx context.Context, p []byte, _ int64) (int, error) {
+	for _, line := range strings.Split(string(p), "\n") {
+		if line == "" {
+			continue
+		}
+		if err := h.ctl.Command(ctx, line); err != nil {
+			return 0, err
+		}
+	}
+	return len(p), nil
+}
+
+// Status is a read-only file whose content is rendered each time the file is
+// opened, such that all reads through an open see the same content.
+type Status struct {
+	Name string
+
+	// Perm is the permissions of the file. If zero, 0444 is used.
+	Perm protocol.FileMode
+
+	// Render renders the content of the file.
+	Render func(ctx context.Context) ([]byte, error)
+}
+
+func (s *Status) Stat(context.Context) (protocol.Stat, error) {
+	perm := s.Perm
+	if perm == 0 {
+		perm = 0444
+	}
+	return protocol.Stat{Name: s.Name, Mode: perm}, nil
+}
+
+func (s *Status) Open(ctx context.Context, mode protocol.OpenMode) (Handle, error) {
+	if writes(mode) {
+		return nil, ErrPermission
+	}
+	b, err := s.Render(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return snapshot(b), nil
+}
+
+// snapshot is a read-only handle on fixed content.
+type snapshot []byte
+
+func (s snapshot) Read(_ context.Context, p []byte, offset int64) (int, error) {
+	if offset >= int64(len(s)) {
+		return 0, nil
+	}
+	return copy(p, s[offset:]), nil
+}
+
+func (s snapshot) Write(context.Context, []byte, int64) (int, error) {
+	return 0, ErrPermission
+}
+
+func (s snapshot) Close() error {
+	return nil
+}
+
+// Events is a read-only file whose reads block until an event is published.
+// Every open of the file receives the events published after it was opened,
+// in order. Offsets are ignored. A read returns the rest of a single event,
+// or as much of it as fits.
+//
+// A blocked read returns when its request is flushed, or when the connection
+// is closed.
+type Events struct {
+	Name string
+
+	// Perm is the permissions of the file. If zero, 0444 is used.
+	Perm protocol.FileMode
+
+	// Backlog limits the number of events queued for a reader that is not
+	// keeping up, beyond which the oldest events are dropped. Zero means no
+	// limit.
+	Backlog int
+
+	mu      sync.Mutex
+	readers map[*eventReader]struct{}
+}
+
+// eventReader is an open events file. The queue is protected by the mutex of
+// the Events.
+type eventReader struct {
+	events *Events
+	queue  [][]byte
+	wake   chan struct{}
+}
+
+func (e *Events) Stat(context.Context) (protocol.Stat, error) {
+	perm := e.Perm
+	if perm == 0 {
+		perm = 0444
+	}
+	return protocol.Stat{Name: e.Name, Mode: perm}, nil
+}
+
+func (e *Events) Open(_ context.Context, mode protocol.OpenMode) (Handle, error) {
+	if writes(mode) {
+		return nil, ErrPermission
+	}
+
+	r := &eventReader{events: e, wake: make(chan struct{}, 1)}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.readers == nil {
+		e.readers = make(map[*eventReader]struct{})
+	}
+	e.readers[r] = struct{}{}
+	return r, nil
+}
+
+// Publish queues an event for all open readers. Empty events are ignored.
+func (e *Events) Publish(event []byte) {
+	if len(event) == 0 {
+		return
+	}
+	event = append([]byte(nil), event...)
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	for r := range e.readers {
+		r.queue = append(r.queue, event)
+		if e.Backlog > 0 && len(r.queue) > e.Backlog {
+			r.queue = r.queue[len(r.queue)-e.Backlog:]
+		}
+		select {
+		case r.wake <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// next returns the next part of an event that fits in p, or 0 if no events
+// are queued.
+func (r *eventReader) next(p []byte) int {
+	r.events.mu.Lock()
+	defer r.events.mu.Unlock()
+	if len(r.queue) == 0 {
+		return 0
+	}
+
+	n := copy(p, r.queue[0])
+	if n < len(r.queue[0]) {
+		r.queue[0] = r.queue[0][n:]
+	} else {
+		r.queue = r.queue[1:]
+	}
+	return n
+}
+
+func (r *eventReader) Read(ctx context.Context, p []byte, _ int64) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	for {
+		if n := r.next(p); n > 0 {
+			return n, nil
+		}
+		select {
+		case <-r.wake:
+		case <-ctx.Done():
+			return 0, ctx.Err()
+		}
+	}
+}
+
+func (r *eventReader) Write(context.Context, []byte, int64) (int, error) {
+	return 0, ErrPermission
+}
+
+func (r *eventReader) Close() error {
+	r.events.mu.Lock()
+	defer r.events.mu.Unlock()
+	delete(r.events.readers, r)
+	return nil
+}
+
+// reads returns whether an open mode permits reading.
+func reads(mode protocol.OpenMode) bool {
+	m := mode & 3
+	return m == protocol.OREAD || m == protocol.ORDWR || m == protocol.OEXEC
+}
+
+// writes returns whether an open mode permits writing.
+func writes(mode protocol.OpenMode) bool {
+	m := mode & 3
+	return m == protocol.OWRITE || m == protocol.ORDWR || mode&protocol.OTRUNC != 0
+}
@@ -0,0 +1,214 @@
+// Package tree implements a 9P file server for trees of File and Dir nodes,
+// taking care of the protocol details such as fids, qids, directory reads and
+// the I/O unit.
+package tree
+
+import (
+	"context"
+	"sync"
+
+	"github.com/kennylevinsen/g9p"
+	"github.com/kennylevinsen/g9p/p9err"
+	"github.com/kennylevinsen/g9p/protocol"
+)
+
+// Errors returned by the tree.
+var (
+	ErrNotExist   = p9err.ErrNotExist
+	ErrPermission = p9err.ErrPermission
+	ErrNotDir     = p9err.ErrNotDir
+	ErrIsDir      = p9err.ErrIsDir
+	ErrBadOffset  = p9err.ErrBadOffset
+	ErrShortRead  = &g9p.Error{Err: "read count too small for directory entry", Errno: 22}
+	ErrNoAuth     = p9err.ErrNoAuth
+)
+
+// Node is a file or directory in a tree. Nodes are identified by their
+// value, which must therefore be comparable, and should usually be a pointer.
+//
+// The contexts passed to node methods are cancelled if the request is flushed,
+// and carry the user of the fid, available through User.
+type Node interface {
+	// Stat returns the stat of the node. The Qid is managed by the tree, and
+	// only the Qid.Version is used. The DMDIR bit of Mode is set by the tree
+	// for directories.
+	Stat(ctx context.Context) (protocol.Stat, error)
+}
+
+// File is a regular file.
+type File interface {
+	Node
+
+	// Open opens the file with the given mode. Truncation with OTRUNC is the
+	// responsibility of the file.
+	Open(ctx context.Context, mode protocol.OpenMode) (Handle, error)
+}
+
+// Handle is an open file.
+type Handle interface {
+	// Read reads into p from the given offset, returning the amount of bytes
+	// read. Reaching the end of the file is not an error.
+	Read(ctx context.Context, p []byte, offset int64) (int, error)
+
+	// Write writes p at the given offset, returning the amount of bytes
+	// written.
+	Write(ctx context.Context, p []byte, offset int64) (int, error)
+
+	// Close releases the handle.
+	Close() error
+}
+
+// Dir is a directory.
+type Dir interface {
+	Node
+
+	// Walk returns the child with the given name. It is never called with
+	// "..", which is handled by the tree. ErrNotExist should be returned if
+	// the child does not exist.
+	Walk(ctx context.Context, name string) (Node, error)
+
+	// Children returns the children of the directory, in the order they
+	// should be listed. It is called when a directory read starts from offset
+	// 0.
+	Children(ctx context.Context) ([]Node, error)
+}
+
+// Creator is implemented by directories that support creating files.
+type Creator interface {
+	// Create creates a child with the given name and permissions. The node
+	// must be a Dir if perm has DMDIR set. The new node is then opened with
+	// mode by the tree.
+	Create(ctx context.Context, name string, perm protocol.FileMode, mode protocol.OpenMode) (Node, error)
+}
+
+// Remover is implemented by directories that support removing files.
+type Remover interface {
+	// Remove removes the child with the given name.
+	Remove(ctx context.Context, name string) error
+}
+
+// StatWriter is implemented by nodes that support WriteStat.
+type StatWriter interface {
+	// WriteStat changes the stat of the node, following the rules of
+	// http://man.cat-v.org/plan_9/5/stat.
+	WriteStat(ctx context.Context, s protocol.Stat) error
+}
+
+// Referenced is implemented by nodes that need to know whether they are in
+// use, such as the directories of a CloneDir.
+type Referenced interface {
+	// Ref is called whenever a fid starts referring to the node or a node
+	// below it.
+	Ref()
+
+	// Unref is called when such a fid is clunked or moved elsewhere by
+	// Create.
+	Unref()
+}
+
+type userKey struct{}
+
+// User returns the user that a request is performed as, as given to Attach.
+func User(ctx context.Context) string {
+	user, _ := ctx.Value(userKey{}).(string)
+	return user
+}
+
+// Tree is a file tree to be served.
+//
+// Qid paths are assigned to nodes for as long as they are in use, that is,
+// while fids refer to them or to nodes below them, or while they are listed
+// by a directory read of an open fid. A node that is no longer in use may be
+// given a different qid path when it is next used.
+type Tree struct {
+	root Dir
+
+	pathLock sync.Mutex
+	paths    map[Node]*qidPath
+	nextPath uint64
+}
+
+// qidPath is the qid path of a node in use, and the number of uses.
+type qidPath struct {
+	path uint64
+	refs int
+}
+
+// New returns a Tree with the given root directory.
+func New(root Dir) *Tree {
+	return &Tree{
+		root:  root,
+		paths: make(map[Node]*qidPath),
+	}
+}
+
+// Handler returns a new handler serving the tree. A handler must only serve a
+// single connection, but the tree may be served by any number of handlers.
+func (t *Tree) Handler() g9p.ContextHandler {
+	c := &conn{tree: t}
+	return &server{
+		FidServer: g9p.NewFidServer[*state](c),
+		conn:      c,
+	}
+}
+
+// path returns the qid path of a node. A node that is not in use is given a
+// new path every time.
+func (t *Tree) path(n Node) uint64 {
+	t.pathLock.Lock()
+	defer t.pathLock.Unlock()
+
+	if p, exists := t.paths[n]; exists {
+		return p.path
+	}
+	t.nextPath++
+	return t.nextPath
+}
+
+// hold marks a node as in use, keeping its qid path until release is called.
+func (t *Tree) hold(n Node) {
+	t.pathLock.Lock()
+	defer t.pathLock.Unlock()
+
+	p, exists := t.paths[n]
+	if !exists {
+		t.nextPath++
+		p = &qidPath{path: t.nextPath}
+		t.paths[n] = p
+	}
+	p.refs++
+}
+
+// release releases a use of a node, forgetting its qid path with the last.
+func (t *Tree) release(n Node) {
+	t.pathLock.Lock()
+	defer t.pathLock.Unlock()
+
+	if p, exists := t.paths[n]; exists {
+		p.refs--
+		if p.refs == 0 {
+			delete(t.paths, n)
+		}
+	}
+}
+
+// stat returns the stat of a node with the qid and directory bit filled in.
+func (t *Tree) stat(ctx context.Context, n Node) (protocol.Stat, error) {
+	s, err := n.Stat(ctx)
+	if err != nil {
+		return s, err
+	}
+
+	if _, ok := n.(Dir); ok {
+		s.Mode |= protocol.DMDIR
+	}
+	s.Qid.Type = protocol.QidType(s.Mode >> 24)
+	s.Qid.Path = t.path(n)
+	return s, nil
+}
+
+// qid returns the qid of a node.
+func (t *Tree) qid(ctx context.Context, n Node) (protocol.Qid, error) {
+	s, err := t.stat(ctx, n)
+	return s.Qid, err
+}
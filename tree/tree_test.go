@@ -0,0 +1,336 @@
+package tree
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/kennylevinsen/g9p"
+	"github.com/kennylevinsen/g9p/protocol"
+)
+
+type testFile struct {
+	name    string
+	content string
+}
+
+func (f *testFile) Stat(context.Context) (protocol.Stat, error) {
+	return protocol.Stat{Name: f.name, Mode: 0444, Length: uint64(len(f.content))}, nil
+}
+
+func (f *testFile) Open(context.Context, protocol.OpenMode) (Handle, error) {
+	return f, nil
+}
+
+func (f *testFile) Read(_ context.Context, p []byte, offset int64) (int, error) {
+	if offset >= int64(len(f.content)) {
+		return 0, nil
+	}
+	return copy(p, f.content[offset:]), nil
+}
+
+func (f *testFile) Write(context.Context, []byte, int64) (int, error) {
+	return 0, ErrPermission
+}
+
+func (f *testFile) Close() error {
+	return nil
+}
+
+type testDir struct {
+	name     string
+	children []Node
+}
+
+func (d *testDir) Stat(context.Context) (protocol.Stat, error) {
+	return protocol.Stat{Name: d.name, Mode: 0555}, nil
+}
+
+func (d *testDir) Walk(ctx context.Context, name string) (Node, error) {
+	for _, n := range d.children {
+		if s, _ := n.Stat(ctx); s.Name == name {
+			return n, nil
+		}
+	}
+	return nil, ErrNotExist
+}
+
+func (d *testDir) Children(context.Context) ([]Node, error) {
+	return d.children, nil
+}
+
+func TestTree(t *testing.T) {
+	root := &testDir{name: "/", children: []Node{
+		&testFile{name: "hello", content: "hello, world"},
+		&testDir{name: "sub"},
+		&testFile{name: "empty"},
+	}}
+
+	tree := New(root)
+	a, b := net.Pipe()
+	go g9p.ServeContext(a, tree.Handler())
+	c := g9p.NewClient(b)
+	go c.Start()
+	defer b.Close()
+
+	if _, err := c.Version(&protocol.VersionRequest{Tag: protocol.NOTAG, MaxSize: 8192, Version: protocol.Version9P2000}); err != nil {
+		t.Fatalf("version failed: %v", err)
+	}
+	if _, err := c.Attach(&protocol.AttachRequest{Tag: 1, Fid: 1, AuthFid: protocol.NOFID, Username: "glenda"}); err != nil {
+		t.Fatalf("attach failed: %v", err)
+	}
+
+	// Read the root directory with a count that only fits a single entry.
+	if _, err := c.Walk(&protocol.WalkRequest{Tag: 1, Fid: 1, NewFid: 2}); err != nil {
+		t.Fatalf("walk failed: %v", err)
+	}
+	if _, err := c.Open(&protocol.OpenRequest{Tag: 1, Fid: 2, Mode: protocol.OREAD}); err != nil {
+		t.Fatalf("open failed: %v", err)
+	}
+	var names []string
+	var offset uint64
+	for {
+		res, err := c.Read(&protocol.ReadRequest{Tag: 1, Fid: 2, Offset: offset, Count: 60})
+		if err != nil {
+			t.Fatalf("directory read failed: %v", err)
+		}
+		if len(res.Data) == 0 {
+			break
+		}
+		offset += uint64(len(res.Data))
+
+		var s protocol.Stat
+		if err := s.Unmarshal(res.Data); err != nil {
+			t.Fatalf("could not unmarshal directory entry: %v", err)
+		}
+		names = append(names, s.Name)
+	}
+	if len(names) != 3 || names[0] != "hello" || names[1] != "sub" || names[2] != "empty" {
+		t.Fatalf("unexpected directory entries: %v", names)
+	}
+	if _, err := c.Read(&protocol.ReadRequest{Tag: 1, Fid: 2, Offset: 1, Count: 60}); err == nil {
+		t.Fatalf("directory read at bad offset succeeded")
+	}
+
+	// Read a file.
+	wr, err := c.Walk(&protocol.WalkRequest{Tag: 1, Fid: 1, NewFid: 3, Names: []string{"sub", "..", "hello"}})
+	if err != nil {
+		t.Fatalf("walk failed: %v", err)
+	}
+	if len(wr.Qids) != 3 || wr.Qids[0].Type != protocol.QTDIR || wr.Qids[2].Type != protocol.QTFILE {
+		t.Fatalf("unexpected walk qids: %v", wr.Qids)
+	}
+	or, err := c.Open(&protocol.OpenRequest{Tag: 1, Fid: 3, Mode: protocol.OREAD})
+	if err != nil {
+		t.Fatalf("open failed: %v", err)
+	}
+	if or.IOUnit != 8192-protocol.IOHDRSZ {
+		t.Fatalf("unexpected iounit: %d", or.IOUnit)
+	}
+	res, err := c.Read(&protocol.ReadRequest{Tag: 1, Fid: 3, Count: 5})
+	if err != nil {
+		t.Fatalf("read failed: %v", err)
+	}
+	if string(res.Data) != "hello" {
+		t.Fatalf("unexpected read: %q", res.Data)
+	}
+	if or.Qid != wr.Qids[2] {
+		t.Fatalf("open returned qid %v, walk returned %v", or.Qid, wr.Qids[2])
+	}
+
+	// Qid paths are only kept for nodes in use, here the root of fid 1.
+	for _, fid := range []protocol.Fid{2, 3} {
+		if _, err := c.Clunk(&protocol.ClunkRequest{Tag: 1, Fid: fid}); err != nil {
+			t.Fatalf("clunk failed: %v", err)
+		}
+	}
+	tree.pathLock.Lock()
+	n := len(tree.paths)
+	tree.pathLock.Unlock()
+	if n != 1 {
+		t.Fatalf("tree holds %d qid paths, expected 1", n)
+	}
+}
+
+func TestSynthetic(t *testing.T) {
+	var commands []string
+	ctl := &Ctl{
+		Name: "ctl",
+		Command: func(_ context.Context, cmd string) error {
+			if cmd == "fail" {
+				return ErrPermission
+			}
+			commands = append(commands, cmd)
+			return nil
+		},
+	}
+	opens := 0
+	status := &Status{Name: "status", Render: func(context.Context) ([]byte, error) {
+		opens++
+		return []byte(fmt.Sprintf("open %d", opens)), nil
+	}}
+	events := &Events{Name: "events"}
+	root := &testDir{name: "/", children: []Node{ctl, status, events}}
+
+	a, b := net.Pipe()
+	go g9p.ServeContext(a, New(root).Handler())
+	c := g9p.NewClient(b)
+	go c.Start()
+	defer b.Close()
+
+	if _, err := c.Version(&protocol.VersionRequest{Tag: protocol.NOTAG, MaxSize: 8192, Version: protocol.Version9P2000}); err != nil {
+		t.Fatalf("version failed: %v", err)
+	}
+	if _, err := c.Attach(&protocol.AttachRequest{Fid: 1, AuthFid: protocol.NOFID}); err != nil {
+		t.Fatalf("attach failed: %v", err)
+	}
+	open := func(fid protocol.Fid, name string, mode protocol.OpenMode) {
+		if _, err := c.Walk(&protocol.WalkRequest{Fid: 1, NewFid: fid, Names: []string{name}}); err != nil {
+			t.Fatalf("walk to %s failed: %v", name, err)
+		}
+		if _, err := c.Open(&protocol.OpenRequest{Fid: fid, Mode: mode}); err != nil {
+			t.Fatalf("open of %s failed: %v", name, err)
+		}
+	}
+
+	// Every line written to the ctl file is a command.
+	open(2, "ctl", protocol.OWRITE)
+	if _, err := c.Write(&protocol.WriteRequest{Fid: 2, Data: []byte("a\nb\n")}); err != nil {
+		t.Fatalf("write failed: %v", err)
+	}
+	if _, err := c.Write(&protocol.WriteRequest{Fid: 2, Data: []byte("fail")}); err == nil {
+		t.Fatalf("failing command succeeded")
+	}
+	if len(commands) != 2 || commands[0] != "a" || commands[1] != "b" {
+		t.Fatalf("unexpected commands: %q", commands)
+	}
+
+	// The status file is rendered on every open.
+	for i := 1; i <= 2; i++ {
+		open(3, "status", protocol.OREAD)
+		res, err := c.Read(&protocol.ReadRequest{Fid: 3, Count: 100})
+		if err != nil {
+			t.Fatalf("read failed: %v", err)
+		}
+		if expected := fmt.Sprintf("open %d", i); string(res.Data) != expected {
+			t.Fatalf("read %q, expected %q", res.Data, expected)
+		}
+		c.Clunk(&protocol.ClunkRequest{Fid: 3})
+	}
+
+	// A read of the events file blocks until an event is published, and can
+	// be flushed.
+	open(4, "events", protocol.OREAD)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err := c.ReadContext(ctx, &protocol.ReadRequest{Fid: 4, Count: 100}); err != context.DeadlineExceeded {
+		t.Fatalf("read returned %v, expected %v", err, context.DeadlineExceeded)
+	}
+	events.Publish([]byte("hello"))
+	events.Publish([]byte("world"))
+	for _, expected := range []string{"hel", "lo", "world"} {
+		count := uint32(100)
+		if expected == "hel" {
+			count = 3
+		}
+		res, err := c.Read(&protocol.ReadRequest{Fid: 4, Count: count})
+		if err != nil {
+			t.Fatalf("read failed: %v", err)
+		}
+		if string(res.Data) != expected {
+			t.Fatalf("read %q, expected %q", res.Data, expected)
+		}
+	}
+}
+
+func TestCloneDir(t *testing.T) {
+	var commands []string
+	released := make(chan int, 2)
+	tcp := &CloneDir{
+		Name: "tcp",
+		Perm: 0550,
+		New: func(_ context.Context, n int) ([]Node, error) {
+			ctl := &Ctl{Name: "ctl", Command: func(_ context.Context, cmd string) error {
+				commands = append(commands, fmt.Sprintf("%d %s", n, cmd))
+				return nil
+			}}
+			status := &Status{Name: "status", Render: func(context.Context) ([]byte, error) {
+				return []byte(fmt.Sprintf("conv %d", n)), nil
+			}}
+			return []Node{ctl, status}, nil
+		},
+		Release: func(n int) { released <- n },
+	}
+	root := &testDir{name: "/", children: []Node{tcp}}
+
+	a, b := net.Pipe()
+	go g9p.ServeContext(a, New(root).Handler())
+	c := g9p.NewClient(b)
+	go c.Start()
+	defer b.Close()
+
+	if _, err := c.Version(&protocol.VersionRequest{Tag: protocol.NOTAG, MaxSize: 8192, Version: protocol.Version9P2000}); err != nil {
+		t.Fatalf("version failed: %v", err)
+	}
+	if _, err := c.Attach(&protocol.AttachRequest{Fid: 1, AuthFid: protocol.NOFID}); err != nil {
+		t.Fatalf("attach failed: %v", err)
+	}
+	walk := func(fid protocol.Fid, names ...string) error {
+		_, err := c.Walk(&protocol.WalkRequest{Fid: 1, NewFid: fid, Names: names})
+		return err
+	}
+	read := func(fid protocol.Fid) string {
+		res, err := c.Read(&protocol.ReadRequest{Fid: fid, Count: 100})
+		if err != nil {
+			t.Fatalf("read failed: %v", err)
+		}
+		return string(res.Data)
+	}
+
+	// Opening clone allocates a directory, and acts as its ctl file.
+	if err := walk(2, "tcp", "clone"); err != nil {
+		t.Fatalf("walk failed: %v", err)
+	}
+	if _, err := c.Open(&protocol.OpenRequest{Fid: 2, Mode: protocol.ORDWR}); err != nil {
+		t.Fatalf("open failed: %v", err)
+	}
+	if n := read(2); n != "0" {
+		t.Fatalf("clone returned %q, expected 0", n)
+	}
+	if sr, err := c.Stat(&protocol.StatRequest{Fid: 2}); err != nil || sr.Stat.Mode != 0660 {
+		t.Fatalf("unexpected stat of clone: %+v, %v", sr, err)
+	}
+	if _, err := c.Write(&protocol.WriteRequest{Fid: 2, Data: []byte("connect 1.2.3.4!564")}); err != nil {
+		t.Fatalf("write failed: %v", err)
+	}
+	if len(commands) != 1 || commands[0] != "0 connect 1.2.3.4!564" {
+		t.Fatalf("unexpected commands: %q", commands)
+	}
+
+	// The directory is kept alive by fids within it after clone is clunked.
+	if err := walk(3, "tcp", "0", "status"); err != nil {
+		t.Fatalf("walk failed: %v", err)
+	}
+	c.Clunk(&protocol.ClunkRequest{Fid: 2})
+	if _, err := c.Open(&protocol.OpenRequest{Fid: 3, Mode: protocol.OREAD}); err != nil {
+		t.Fatalf("open failed: %v", err)
+	}
+	if s := read(3); s != "conv 0" {
+		t.Fatalf("status returned %q", s)
+	}
+	select {
+	case n := <-released:
+		t.Fatalf("directory %d released while in use", n)
+	default:
+	}
+
+	c.Clunk(&protocol.ClunkRequest{Fid: 3})
+	if n := <-released; n != 0 {
+		t.Fatalf("directory %d released, expected 0", n)
+	}
+	if wr, err := c.Walk(&protocol.WalkRequest{Fid: 1, NewFid: 4, Names: []string{"tcp", "0"}}); err != nil || len(wr.Qids) != 1 {
+		t.Fatalf("walk to released directory returned %v, %v", wr, err)
+	}
+}